@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
+	"strings"
 	"time"
 	"tritontube/internal/proto"
 
@@ -12,13 +15,26 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 )
 
+var (
+	timeout = flag.Duration("timeout", 0, "Deadline for add/remove/drain/undrain including the migration (0 waits until it finishes)")
+	dryRun  = flag.Bool("dry-run", false, "For add/remove/drain/undrain, only list the files that would move; for gc, only list the orphans")
+	weight  = flag.Int("weight", 1, "For add, the node's relative share of files under weighted placements")
+	zone    = flag.String("zone", "", "For add, the node's zone")
+	rack    = flag.String("rack", "", "For add, the node's rack")
+	host    = flag.String("host", "", "For add, the node's host")
+	grace   = flag.Duration("grace", 0, "For gc, keep files younger than this (0 uses the web server's -orphan-grace)")
+)
+
 func main() {
-	if len(os.Args) < 3 { // Minimum 3 args: program, command, server_address
+	flag.Usage = printUsageAndExit
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 2 { // Minimum 2 args: command, server_address
 		printUsageAndExit()
 	}
 
-	cmd := os.Args[1]
-	serverAddr := os.Args[2]
+	cmd := args[0]
+	serverAddr := args[1]
 
 	conn, err := grpc.NewClient(serverAddr, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -30,23 +46,67 @@ func main() {
 
 	switch cmd {
 	case "add":
-		if len(os.Args) != 4 {
+		if len(args) != 3 {
 			fmt.Println("Usage: add <server_address> <node_address>")
 			os.Exit(1)
 		}
-		addNode(client, os.Args[3])
+		addNode(client, args[2])
 	case "remove":
-		if len(os.Args) != 4 {
+		if len(args) != 3 {
 			fmt.Println("Usage: remove <server_address> <node_address>")
 			os.Exit(1)
 		}
-		removeNode(client, os.Args[3])
+		removeNode(client, args[2])
+	case "drain":
+		if len(args) != 3 {
+			fmt.Println("Usage: drain <server_address> <node_address>")
+			os.Exit(1)
+		}
+		drainNode(client, args[2])
+	case "undrain":
+		if len(args) != 3 {
+			fmt.Println("Usage: undrain <server_address> <node_address>")
+			os.Exit(1)
+		}
+		undrainNode(client, args[2])
+	case "status":
+		if len(args) != 2 {
+			fmt.Println("Usage: status <server_address>")
+			os.Exit(1)
+		}
+		showStatus(client)
+	case "migration":
+		if len(args) != 3 {
+			fmt.Println("Usage: migration <server_address> <migration_id>")
+			os.Exit(1)
+		}
+		printMigration(getMigration(client, args[2]))
+	case "watch":
+		if len(args) != 3 {
+			fmt.Println("Usage: watch <server_address> <migration_id>")
+			os.Exit(1)
+		}
+		ctx, cancel := commandContext()
+		defer cancel()
+		watchMigration(ctx, client, args[2])
 	case "list":
-		if len(os.Args) != 3 {
+		if len(args) != 2 {
 			fmt.Println("Usage: list <server_address>")
 			os.Exit(1)
 		}
 		listNodes(client)
+	case "gc":
+		if len(args) != 2 {
+			fmt.Println("Usage: gc <server_address>")
+			os.Exit(1)
+		}
+		collectOrphans(proto.NewOrphanAdminServiceClient(conn))
+	case "dedup":
+		if len(args) != 2 {
+			fmt.Println("Usage: dedup <server_address>")
+			os.Exit(1)
+		}
+		showDedupStats(proto.NewDedupAdminServiceClient(conn))
 	default:
 		fmt.Printf("Unknown command: %s\n", cmd)
 		printUsageAndExit()
@@ -54,58 +114,326 @@ func main() {
 }
 
 func printUsageAndExit() {
-	fmt.Println("Usage:")
+	fmt.Println("Usage: admin [OPTIONS] <command> ...")
+	fmt.Println()
+	fmt.Println("Commands:")
 	fmt.Println("  add <server_address> <node_address>     - Add a node to the cluster")
-	fmt.Println("  remove <server_address> <node_address>  - Remove a node from the cluster")
+	fmt.Println("  remove <server_address> <node_address>  - Drain a node, then remove it from the cluster")
+	fmt.Println("  drain <server_address> <node_address>   - Stop writes to a node and move its files away")
+	fmt.Println("  undrain <server_address> <node_address> - Make a draining or drained node active again")
 	fmt.Println("  list <server_address>                   - List all nodes in the cluster")
+	fmt.Println("  status <server_address>                 - Show node states and the running migration")
+	fmt.Println("  migration <server_address> <id>         - Show the state of a migration")
+	fmt.Println("  watch <server_address> <id>             - Follow a migration until it finishes")
+	fmt.Println("  dedup <server_address>                  - Show how much segment deduplication saves")
+	fmt.Println("  gc <server_address>                     - Delete content of videos with no metadata (see -dry-run, -grace)")
+	fmt.Println()
+	fmt.Println("Options:")
+	flag.PrintDefaults()
 	os.Exit(1)
 }
 
+// commandContext bounds add/remove by -timeout, or not at all when it is 0.
+func commandContext() (context.Context, context.CancelFunc) {
+	if *timeout > 0 {
+		return context.WithTimeout(context.Background(), *timeout)
+	}
+	return context.WithCancel(context.Background())
+}
+
 func addNode(client proto.VideoContentAdminServiceClient, nodeAddr string) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := commandContext()
 	defer cancel()
 
 	response, err := client.AddNode(ctx, &proto.AddNodeRequest{
 		NodeAddress: nodeAddr,
+		DryRun:      *dryRun,
+		Weight:      int32(*weight),
+		Zone:        *zone,
+		Rack:        *rack,
+		Host:        *host,
 	})
 	if err != nil {
 		log.Fatalf("AddNode RPC failed: %v", err)
 	}
 
+	if *dryRun {
+		fmt.Printf("Dry run: adding %s would move %d files\n", nodeAddr, response.MigratedFileCount)
+		printPlannedMoves(response.PlannedMoves)
+		return
+	}
 	fmt.Printf("Successfully added node: %s\n", nodeAddr)
-	fmt.Printf("Number of files migrated: %d\n", response.MigratedFileCount)
+	watchMigration(ctx, client, response.MigrationId)
 }
 
 func removeNode(client proto.VideoContentAdminServiceClient, nodeAddr string) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	ctx, cancel := commandContext()
 	defer cancel()
 
 	response, err := client.RemoveNode(ctx, &proto.RemoveNodeRequest{
 		NodeAddress: nodeAddr,
+		DryRun:      *dryRun,
 	})
 	if err != nil {
 		log.Fatalf("RemoveNode RPC failed: %v", err)
 	}
 
+	if *dryRun {
+		fmt.Printf("Dry run: removing %s would move %d files\n", nodeAddr, response.MigratedFileCount)
+		printPlannedMoves(response.PlannedMoves)
+		return
+	}
 	fmt.Printf("Successfully removed node: %s\n", nodeAddr)
-	fmt.Printf("Number of files migrated: %d\n", response.MigratedFileCount)
+	watchMigration(ctx, client, response.MigrationId)
 }
 
-func listNodes(client proto.VideoContentAdminServiceClient) {
+func drainNode(client proto.VideoContentAdminServiceClient, nodeAddr string) {
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	response, err := client.DrainNode(ctx, &proto.DrainNodeRequest{
+		NodeAddress: nodeAddr,
+		DryRun:      *dryRun,
+	})
+	if err != nil {
+		log.Fatalf("DrainNode RPC failed: %v", err)
+	}
+
+	if *dryRun {
+		fmt.Printf("Dry run: draining %s would move %d files\n", nodeAddr, response.MigratedFileCount)
+		printPlannedMoves(response.PlannedMoves)
+		return
+	}
+	fmt.Printf("Draining node: %s\n", nodeAddr)
+	watchMigration(ctx, client, response.MigrationId)
+}
+
+func undrainNode(client proto.VideoContentAdminServiceClient, nodeAddr string) {
+	ctx, cancel := commandContext()
+	defer cancel()
+
+	response, err := client.UndrainNode(ctx, &proto.UndrainNodeRequest{
+		NodeAddress: nodeAddr,
+		DryRun:      *dryRun,
+	})
+	if err != nil {
+		log.Fatalf("UndrainNode RPC failed: %v", err)
+	}
+
+	if *dryRun {
+		fmt.Printf("Dry run: undraining %s would move %d files\n", nodeAddr, response.MigratedFileCount)
+		printPlannedMoves(response.PlannedMoves)
+		return
+	}
+	fmt.Printf("Undrained node: %s\n", nodeAddr)
+	watchMigration(ctx, client, response.MigrationId)
+}
+
+func printPlannedMoves(moves []*proto.PlannedMove) {
+	var total int64
+	for _, mv := range moves {
+		fmt.Printf("  %s/%s  %s -> %s  (%s)\n", mv.VideoId, mv.Filename, mv.Source, mv.Destination, formatBytes(mv.Size))
+		total += mv.Size
+	}
+	fmt.Printf("Total: %s\n", formatBytes(total))
+}
+
+func getMigration(client proto.VideoContentAdminServiceClient, id string) *proto.GetMigrationResponse {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
+	response, err := client.GetMigration(ctx, &proto.GetMigrationRequest{MigrationId: id})
+	if err != nil {
+		log.Fatalf("GetMigration RPC failed: %v", err)
+	}
+	return response
+}
+
+// watchMigration renders a progress bar until the migration finishes.
+func watchMigration(ctx context.Context, client proto.VideoContentAdminServiceClient, id string) {
+	fmt.Printf("Migration id: %s\n", id)
+	stream, err := client.WatchMigration(ctx, &proto.GetMigrationRequest{MigrationId: id})
+	if err != nil {
+		log.Fatalf("WatchMigration RPC failed: %v", err)
+	}
+	var last *proto.GetMigrationResponse
+	for {
+		m, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Println()
+			log.Fatalf("WatchMigration failed: %v (the migration keeps running; check it with: migration <server_address> %s)", err, id)
+		}
+		last = m
+		fmt.Printf("\r%s", progressLine(m))
+	}
+	fmt.Println()
+	if last == nil {
+		return
+	}
+	fmt.Printf("Number of files migrated: %d\n", last.MigratedFileCount)
+	if last.FailedFileCount > 0 {
+		fmt.Printf("Number of files that failed to migrate: %d (left on their source node)\n", last.FailedFileCount)
+	}
+	if last.State != "done" {
+		fmt.Printf("Migration %s\n", last.State)
+		os.Exit(1)
+	}
+}
+
+func progressLine(m *proto.GetMigrationResponse) string {
+	const width = 30
+	done := m.MigratedFileCount + m.FailedFileCount
+	filled := width
+	if m.PlannedFileCount > 0 {
+		filled = int(done) * width / int(m.PlannedFileCount)
+	}
+	bar := strings.Repeat("#", filled) + strings.Repeat(".", width-filled)
+	eta := "--"
+	if m.EtaSeconds >= 0 {
+		eta = (time.Duration(m.EtaSeconds) * time.Second).String()
+	}
+	line := fmt.Sprintf("[%s] %d/%d files  %s/%s  ETA %s",
+		bar, m.MigratedFileCount, m.PlannedFileCount,
+		formatBytes(m.MigratedBytes), formatBytes(m.PlannedBytes), eta)
+	if m.FailedFileCount > 0 {
+		line += fmt.Sprintf("  %d failed", m.FailedFileCount)
+	}
+	return line + "   "
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func printMigration(m *proto.GetMigrationResponse) {
+	fmt.Printf("Migration %s (%s %s): %s\n", m.MigrationId, m.Kind, m.NodeAddress, m.State)
+	fmt.Printf("  planned:  %d (%s)\n", m.PlannedFileCount, formatBytes(m.PlannedBytes))
+	fmt.Printf("  migrated: %d (%s)\n", m.MigratedFileCount, formatBytes(m.MigratedBytes))
+	fmt.Printf("  failed:   %d\n", m.FailedFileCount)
+}
+
+// listTimeout bounds ListNodes. The server waits up to half a second for
+// the usage of every storage node, and a follower first forwards the call
+// to the leader, so one second left almost nothing for the network.
+const listTimeout = 5 * time.Second
+
+func listNodes(client proto.VideoContentAdminServiceClient) *proto.ListNodesResponse {
+	ctx, cancel := context.WithTimeout(context.Background(), listTimeout)
+	defer cancel()
+
 	response, err := client.ListNodes(ctx, &proto.ListNodesRequest{})
 	if err != nil {
 		log.Fatalf("ListNodes RPC failed: %v", err)
 	}
 
 	fmt.Println("Storage cluster nodes:")
-	if len(response.Nodes) == 0 {
+	if len(response.NodeInfo) == 0 {
 		fmt.Println("  No nodes in cluster")
 	} else {
-		for _, node := range response.Nodes {
-			fmt.Printf("  - %s\n", node)
+		for _, node := range response.NodeInfo {
+			fmt.Printf("  - %-24s %-9s weight %d", node.Address, node.State, node.Weight)
+			if node.CapacityPercent != 0 && node.CapacityPercent != 100 {
+				fmt.Printf(" (at %d%%)", node.CapacityPercent)
+			}
+			if labels := nodeLabels(node); labels != "" {
+				fmt.Printf("  %s", labels)
+			}
+			fmt.Println()
+			fmt.Printf("    %s\n", nodeUsage(node))
 		}
 	}
+	return response
+}
+
+func collectOrphans(client proto.OrphanAdminServiceClient) {
+	ctx, cancel := commandContext()
+	defer cancel()
+	resp, err := client.CollectOrphans(ctx, &proto.CollectOrphansRequest{
+		DryRun:       *dryRun,
+		GraceSeconds: int64(grace.Seconds()),
+	})
+	if err != nil {
+		log.Fatalf("CollectOrphans RPC failed: %v", err)
+	}
+	var total int64
+	for _, f := range resp.Orphans {
+		where := ""
+		if f.Node != "" {
+			where = "  on " + f.Node
+		}
+		fmt.Printf("  %s/%s  (%s)%s\n", f.VideoId, f.Filename, formatBytes(f.Size), where)
+		total += f.Size
+	}
+	if *dryRun {
+		fmt.Printf("Dry run: %d orphaned files, %s would be deleted\n", len(resp.Orphans), formatBytes(total))
+		return
+	}
+	fmt.Printf("Deleted %d orphaned files (%s)", resp.DeletedCount, formatBytes(resp.DeletedBytes))
+	if resp.FailedCount > 0 {
+		fmt.Printf(", %d failed", resp.FailedCount)
+	}
+	fmt.Println()
+}
+
+func showDedupStats(client proto.DedupAdminServiceClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	st, err := client.GetDedupStats(ctx, &proto.GetDedupStatsRequest{})
+	if err != nil {
+		log.Fatalf("GetDedupStats RPC failed: %v", err)
+	}
+	fmt.Printf("Deduplicated segments: %d names, %d blobs\n", st.FileCount, st.BlobCount)
+	fmt.Printf("  logical: %s\n", formatBytes(st.LogicalBytes))
+	fmt.Printf("  stored:  %s\n", formatBytes(st.StoredBytes))
+	saved := 0.0
+	if st.LogicalBytes > 0 {
+		saved = 100 * float64(st.SavedBytes) / float64(st.LogicalBytes)
+	}
+	fmt.Printf("  saved:   %s (%.1f%%)\n", formatBytes(st.SavedBytes), saved)
+}
+
+// nodeUsage formats what a node reported about its usage.
+func nodeUsage(node *proto.NodeInfo) string {
+	if node.UsedBytes < 0 {
+		return "usage unknown"
+	}
+	line := fmt.Sprintf("used %s in %d files", formatBytes(node.UsedBytes), node.FileCount)
+	if node.QuotaBytes > 0 {
+		line += fmt.Sprintf(" of %s quota", formatBytes(node.QuotaBytes))
+	}
+	if node.FreeBytes >= 0 {
+		line += fmt.Sprintf(", %s free on disk", formatBytes(node.FreeBytes))
+	}
+	return line
+}
+
+// nodeLabels formats the failure domains of a node as zone/rack/host.
+func nodeLabels(node *proto.NodeInfo) string {
+	if node.Zone == "" && node.Rack == "" && node.Host == "" {
+		return ""
+	}
+	return fmt.Sprintf("zone=%s rack=%s host=%s", node.Zone, node.Rack, node.Host)
+}
+
+func showStatus(client proto.VideoContentAdminServiceClient) {
+	response := listNodes(client)
+	if response.MigrationId == "" {
+		fmt.Println("No migration running")
+		return
+	}
+	m := getMigration(client, response.MigrationId)
+	fmt.Printf("Migration %s (%s %s):\n", m.MigrationId, m.Kind, m.NodeAddress)
+	fmt.Println(progressLine(m))
 }
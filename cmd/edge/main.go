@@ -0,0 +1,68 @@
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"tritontube/internal/logging"
+	"tritontube/internal/web"
+)
+
+func main() {
+	host := flag.String("host", "localhost", "Host address for the edge server")
+	port := flag.Int("port", 8180, "Port number for the edge server")
+	maxBytes := flag.Int64("cache-size", 10<<30, "Bytes of content to cache on disk")
+	ttl := flag.Duration("ttl", 5*time.Minute, "How long to serve a file without asking the origin when it sends no max-age")
+	maxTTL := flag.Duration("max-ttl", 0, "Cap on the origin's max-age (0 means no cap)")
+	prefetch := flag.Int("prefetch", 3, "Segments to fetch ahead after each requested segment (0 disables)")
+	prefetchWorkers := flag.Int("prefetch-workers", 4, "Prefetch requests to the origin at a time")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
+	logLevel := flag.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
+	timeout := flag.Duration("origin-timeout", 30*time.Second, "Timeout of each request to the origin")
+	flag.Parse()
+
+	if err := logging.Setup(os.Stderr, *logFormat, *logLevel); err != nil {
+		log.Fatalf("Logging: %v", err)
+	}
+
+	if *port <= 0 {
+		panic("Error: Port number must be positive")
+	}
+	if flag.NArg() < 2 {
+		fmt.Println("Usage: edge [OPTIONS] <originURL> <cacheDir>")
+		fmt.Println("Error: Origin URL and cache directory arguments are required")
+		return
+	}
+	origin := flag.Arg(0)
+	cacheDir := flag.Arg(1)
+
+	edge, err := web.NewEdgeServer(origin, web.EdgeConfig{
+		Dir:             cacheDir,
+		MaxBytes:        *maxBytes,
+		TTL:             *ttl,
+		MaxTTL:          *maxTTL,
+		Prefetch:        *prefetch,
+		PrefetchWorkers: *prefetchWorkers,
+		Timeout:         *timeout,
+	})
+	if err != nil {
+		log.Fatalf("Edge server: %v", err)
+	}
+	expvar.Publish("edge_cache", expvar.Func(func() any { return edge.Stats() }))
+
+	addr := fmt.Sprintf("%s:%d", *host, *port)
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		log.Fatalf("Failed listen %s, %v", addr, err)
+	}
+	slog.Info("edge server running", "addr", addr, "origin", origin, "cache", cacheDir)
+	if err := edge.Start(lis); err != nil {
+		log.Fatalf("Failed to serve: %v", err)
+	}
+}
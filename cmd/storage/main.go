@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"os"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
 
+	"tritontube/internal/logging"
+	"tritontube/internal/metrics"
 	pb "tritontube/internal/proto"
+	"tritontube/internal/tracing"
 	"tritontube/internal/storage"  
 )
 
@@ -17,8 +25,20 @@ import (
 func main() {
 	host := flag.String("host", "localhost", "Host address for the server")
 	port := flag.Int("port", 8090, "Port number for the server")
+	quota := flag.Int64("quota", 0, "Maximum bytes to store; writes beyond it fail with ResourceExhausted (0 means no limit)")
+	scrubInterval := flag.Duration("scrub-interval", 24*time.Hour, "How often to re-hash stored files against their checksums (0 disables)")
+	metricsAddr := flag.String("metrics", "", "Address to serve Prometheus metrics at /metrics on, like localhost:9090 (empty disables)")
+	traceExporter := flag.String("trace", "", "Where to export traces: stdout, or otlp for the collector at -trace-endpoint (empty disables tracing)")
+	traceEndpoint := flag.String("trace-endpoint", "localhost:4317", "OTLP gRPC endpoint of the trace collector with -trace otlp")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
+	logLevel := flag.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
+	quarantine := flag.Bool("quarantine", false, "Move files that fail the scrub into <baseDir>/.quarantine instead of only reporting them")
 	flag.Parse()
 
+	if err := logging.Setup(os.Stderr, *logFormat, *logLevel); err != nil {
+		log.Fatalf("Logging: %v", err)
+	}
+
 	// Validate arguments
 	if *port <= 0 {
 		panic("Error: Port number must be positive")
@@ -36,7 +56,13 @@ func main() {
 	fmt.Printf("Port: %d\n", *port)
 	fmt.Printf("Base Directory: %s\n", baseDir)
 
-	err := os.MkdirAll(baseDir, os.ModePerm)
+	shutdownTracing, err := tracing.Setup(context.Background(), "tritontube-storage", *traceExporter, *traceEndpoint)
+	if err != nil {
+		log.Fatalf("Tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	err = os.MkdirAll(baseDir, os.ModePerm)
 	if err != nil {
 		log.Fatalf("Directory Make Fail %v", err)
 	}
@@ -45,9 +71,35 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed listen %s, %v", addr, err)
 	}
-	grpcServer := grpc.NewServer()
-	pb.RegisterStorageServiceServer(grpcServer, storage.NewStorageService(baseDir))
-	log.Printf("Storage server running at %s (dir: %s)", addr, baseDir)
+	// Web servers ping idle connections every 30s (web.StorageKeepalive);
+	// allow that rather than closing them for pinging too often.
+	grpcServer := grpc.NewServer(
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             10 * time.Second,
+			PermitWithoutStream: true,
+		}),
+		grpc.ChainUnaryInterceptor(metrics.UnaryServerInterceptor, logging.UnaryServerInterceptor),
+		// Continues the trace of the web server request that made the call.
+		tracing.ServerOption(),
+	)
+	storageService := storage.NewStorageService(baseDir)
+	storageService.Quota = *quota
+	pb.RegisterStorageServiceServer(grpcServer, storageService)
+	if *metricsAddr != "" {
+		if err := storageService.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+			log.Fatalf("Register metrics: %v", err)
+		}
+		go func() {
+			slog.Info("serving metrics", "addr", *metricsAddr)
+			if err := metrics.ListenAndServe(*metricsAddr); err != nil {
+				log.Fatalf("Metrics server: %v", err)
+			}
+		}()
+	}
+	if *scrubInterval > 0 {
+		go storageService.RunScrubber(context.Background(), *scrubInterval, *quarantine)
+	}
+	slog.Info("storage server running", "addr", addr, "dir", baseDir)
 	if err := grpcServer.Serve(lis); err != nil {
 		log.Fatalf("Failed to serve: %v", err)
 	}
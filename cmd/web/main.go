@@ -1,35 +1,28 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net"
 	"database/sql"
+	"expvar"
 	"log"
-	"sort"
-	
-	"crypto/sha256"
-	"encoding/binary"
-	
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"log/slog"
 
+	"google.golang.org/grpc"
 
 	"os"
 	"tritontube/internal/web"
+	"tritontube/internal/logging"
+	"tritontube/internal/metrics"
 	pb "tritontube/internal/proto"
+	"tritontube/internal/tracing"
 	"strings"
-)
-
-func hashStringToUint64(s string) uint64 {
-	sum := sha256.Sum256([]byte(s))
-	return binary.BigEndian.Uint64(sum[:8])
-}
+	"time"
 
-type StorageNode struct {
-	Address string
-	Hash    uint64
-}
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
 
 // printUsage prints the usage information for the application
 func printUsage() {
@@ -37,9 +30,15 @@ func printUsage() {
 	fmt.Println()
 	fmt.Println("Arguments:")
 	fmt.Println("  METADATA_TYPE         Metadata service type (sqlite, etcd)")
-	fmt.Println("  METADATA_OPTIONS      Options for metadata service (e.g., db path)")
+	fmt.Println("  METADATA_OPTIONS      Options for metadata service (db path for sqlite,")
+	fmt.Println("                        comma-separated endpoints for etcd)")
 	fmt.Println("  CONTENT_TYPE          Content service type (fs, nw)")
 	fmt.Println("  CONTENT_OPTIONS       Options for content service (e.g., base dir, network addresses)")
+	fmt.Println("                        For nw: ADMIN_ADDR,NODE1,NODE2,... where a node is")
+	fmt.Println("                        ADDR[@ZONE[/RACK[/HOST]]]. The node list only seeds a")
+	fmt.Println("                        new cluster; later the ring saved in the metadata DB is used.")
+	fmt.Println("                        With -etcd the ring is kept in etcd and shared with every web")
+	fmt.Println("                        server using the same endpoints.")
 	fmt.Println()
 	fmt.Println("Options:")
 	flag.PrintDefaults()
@@ -47,11 +46,49 @@ func printUsage() {
 	fmt.Println("Example: ./program sqlite db.db fs /path/to/videos")
 }
 
+// flagSet reports whether the named flag was given on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
 
 func main() {
 	// Define flags
 	port := flag.Int("port", 8080, "Port number for the web server")
 	host := flag.String("host", "localhost", "Host address for the web server")
+	etcdEndpoints := flag.String("etcd", "", "Comma-separated etcd endpoints; share the nw ring with other web servers")
+	placement := flag.String("placement", web.PlacementRing, "How nw maps files to nodes: ring, vnode (weighted) or rendezvous (weighted, lookups O(nodes)); fixed once the cluster is created")
+	spread := flag.Bool("spread", false, "Spread the shards of each nw file across zones, racks and hosts; changing it on an existing cluster migrates the shards that move")
+	ecData := flag.Int("ec-data", 0, "Data shards per erasure-coded nw file (0 stores every file whole)")
+	ecParity := flag.Int("ec-parity", 2, "Parity shards per erasure-coded nw file; that many nodes may be lost")
+	ecMinSize := flag.Int("ec-min-size", 1<<20, "Erasure-code nw files of at least this many bytes (0 codes only -ec-videos)")
+	ecVideos := flag.String("ec-videos", "", "Comma-separated video ids whose files are always erasure coded")
+	dedup := flag.Bool("dedup", false, "Store each distinct .m4s segment once, by digest, and index segment names in the metadata database")
+	dedupGCInterval := flag.Duration("dedup-gc-interval", time.Hour, "How often to delete segments no video refers to any more (0 disables)")
+	adminFlag := flag.String("admin", "", "Address for the admin gRPC API with fs content (nw serves it on ADMIN_ADDR)")
+	orphanGrace := flag.Duration("orphan-grace", time.Hour, "Content younger than this is never collected as an orphan, since its upload may still be running")
+	orphanGCInterval := flag.Duration("orphan-gc-interval", 0, "How often to delete content whose video has no metadata (0 disables; cmd/admin gc runs it on demand)")
+	prefetch := flag.Int("prefetch", 3, "Segments nw reads ahead after each requested segment (0 disables; segments renamed by -dedup are not recognized)")
+	prefetchWorkers := flag.Int("prefetch-workers", 8, "Segments nw reads ahead at a time")
+	prefetchCacheSize := flag.Int64("prefetch-cache-size", 64<<20, "Bytes of segments read ahead that nw keeps until they are requested")
+	rpcTimeout := flag.Duration("rpc-timeout", web.DefaultRPCTimeout, "Timeout of each nw storage RPC")
+	uploadWorkers := flag.Int("upload-workers", web.DefaultUploadConfig.Workers, "Files of an upload written at a time")
+	uploadNodeWorkers := flag.Int("upload-node-workers", web.DefaultUploadConfig.NodeWorkers, "Files of an upload written to any one nw node at a time")
+	uploadAttempts := flag.Int("upload-attempts", web.DefaultUploadConfig.Attempts, "Tries of an upload write that fails with a transient error")
+	cacheSize := flag.Int64("cache-size", 0, "Bytes of video files to cache in memory in front of the content service (0 disables the cache)")
+	cacheDir := flag.String("cache-dir", "", "Directory for files evicted from the memory cache; emptied at startup")
+	cacheDiskSize := flag.Int64("cache-disk-size", 1<<30, "Bytes of video files to cache in -cache-dir")
+	traceExporter := flag.String("trace", "", "Where to export traces: stdout, or otlp for the collector at -trace-endpoint (empty disables tracing)")
+	traceEndpoint := flag.String("trace-endpoint", "localhost:4317", "OTLP gRPC endpoint of the trace collector with -trace otlp")
+	readyTimeout := flag.Duration("ready-timeout", web.DefaultReadyTimeout, "Timeout of each check /readyz runs")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
+	logLevel := flag.String("log-level", "info", "Lowest level logged: debug, info, warn or error")
+	capacityInterval := flag.Duration("capacity-interval", time.Minute, "How often nw checks node usage and down-weights nearly full nodes (0 disables; needs a weighted -placement)")
 
 	// Set custom usage message
 	flag.Usage = printUsage
@@ -59,6 +96,10 @@ func main() {
 	// Parse flags
 	flag.Parse()
 
+	if err := logging.Setup(os.Stderr, *logFormat, *logLevel); err != nil {
+		log.Fatalf("Logging: %v", err)
+	}
+
 	// Check if the correct number of positional arguments is provided
 	if len(flag.Args()) != 4 {
 		fmt.Println("Error: Incorrect number of arguments")
@@ -79,24 +120,48 @@ func main() {
 		return
 	}
 
+	shutdownTracing, err := tracing.Setup(context.Background(), "tritontube-web", *traceExporter, *traceEndpoint)
+	if err != nil {
+		log.Fatalf("Tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	// Construct metadata service
 	var metadataService web.VideoMetadataService
 	fmt.Println("Creating metadata service of type", metadataServiceType, "with options", metadataServiceOptions)
 	// TODO: Implement metadata service creation logic
 	// metadataService = &web.SQLiteVideoMetadataService{}
-	db, err := sql.Open("sqlite3", metadataServiceOptions)
-	if err != nil {
-		log.Fatalf("Failed db: %v", err)
-	}
-	_, err = db.Exec(` CREATE TABLE IF NOT EXISTS videos (videoId TEXT PRIMARY KEY, uploadedTime TIMESTAMP);`)
-	if err != nil {
-		log.Fatalf("Err: %v", err)
-		return
+	// db also holds the ring and migrations without -etcd, and the dedup
+	// index; it is nil when the metadata is kept in etcd.
+	var db *sql.DB
+	if metadataServiceType == "etcd" {
+		metadataClient, err := clientv3.New(clientv3.Config{
+			Endpoints:   strings.Split(metadataServiceOptions, ","),
+			DialTimeout: 5 * time.Second,
+		})
+		if err != nil {
+			log.Fatalf("Failed to connect to etcd: %v", err)
+		}
+		defer metadataClient.Close()
+		metadataService = web.NewEtcdVideoMetadataService(metadataClient)
+	} else {
+		db, err = sql.Open("sqlite3", metadataServiceOptions)
+		if err != nil {
+			log.Fatalf("Failed db: %v", err)
+		}
+		_, err = db.Exec(` CREATE TABLE IF NOT EXISTS videos (videoId TEXT PRIMARY KEY, uploadedTime TIMESTAMP);`)
+		if err != nil {
+			log.Fatalf("Err: %v", err)
+			return
+		}
+		metadataService = &web.SQLiteVideoMetadataService{DB: db}
 	}
-	metadataService = &web.SQLiteVideoMetadataService{DB: db}
 
 	// Construct content service
 	var contentService web.VideoContentService
+	// The admin API is served for nw only.
+	var adminServer *grpc.Server
+	var adminListenAddr string
 	if contentServiceType == "fs"{
 		fmt.Println("Creating content service of type", contentServiceType, "with options", contentServiceOptions)
 		// TODO: Implement content service creation logic
@@ -104,32 +169,167 @@ func main() {
 		if err != nil {
 			log.Fatalf("Directory Fail %v", err)
 		}
-		contentService = &web.FSVideoContentService{StorageDirectory: contentServiceOptions}
+		contentService = web.NewFSVideoContentService(contentServiceOptions)
 	} else {
 		serverNames := strings.Split(contentServiceOptions, ",")
 		adminAddr := serverNames[0]
-		storageAddrs := serverNames[1:]
-		var nodes []web.StorageNode
-		clients := make(map[string]pb.StorageServiceClient)
-		for _, addr := range storageAddrs {
-			h := hashStringToUint64(addr)
-			nodes = append(nodes, web.StorageNode{Address: addr, Hash: h})
-			conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		var storageNodes []web.StorageNode
+		for _, spec := range serverNames[1:] {
+			n, err := web.ParseStorageNode(spec)
+			if err != nil {
+				log.Fatalf("Storage node: %v", err)
+			}
+			storageNodes = append(storageNodes, n)
+		}
+		var membershipStore web.MembershipStore
+		var migrationStore web.MigrationStore
+		var etcdClient *clientv3.Client
+		if *etcdEndpoints != "" {
+			etcdClient, err = clientv3.New(clientv3.Config{
+				Endpoints:   strings.Split(*etcdEndpoints, ","),
+				DialTimeout: 5 * time.Second,
+			})
+			if err != nil {
+				log.Fatalf("Failed to connect to etcd: %v", err)
+			}
+			defer etcdClient.Close()
+			membershipStore = web.NewEtcdMembershipStore(etcdClient)
+			migrationStore = web.NewEtcdMigrationStore(etcdClient)
+		} else {
+			if db == nil {
+				log.Fatalf("nw without -etcd keeps its ring in the sqlite metadata database")
+			}
+			membershipStore, err = web.NewSQLiteMembershipStore(db)
+			if err != nil {
+				log.Fatalf("Membership store: %v", err)
+			}
+			migrationStore, err = web.NewSQLiteMigrationStore(db)
 			if err != nil {
-				panic(fmt.Sprintf("Failed to connect to %s: %v", addr, err))
+				log.Fatalf("Migration store: %v", err)
 			}
-			clients[addr] = pb.NewStorageServiceClient(conn)
 		}
-		sort.Slice(nodes, func(i, j int) bool { return nodes[i].Hash < nodes[j].Hash })
-		contentService = &web.NetworkVideoContentService{Nodes: nodes, Clients: clients,}
+		// The node list only seeds a fresh cluster; after that the saved
+		// ring is used.
+		config := web.NetworkConfig{Placement: *placement, Spread: *spread}
+		if *ecData > 0 {
+			config.Erasure = web.ErasureConfig{
+				DataShards:   *ecData,
+				ParityShards: *ecParity,
+				MinSize:      *ecMinSize,
+			}
+			if *ecVideos != "" {
+				config.Erasure.Videos = strings.Split(*ecVideos, ",")
+			}
+		}
+		config.RPCTimeout = *rpcTimeout
+		config.Prefetch = web.PrefetchConfig{
+			Segments:   *prefetch,
+			Workers:    *prefetchWorkers,
+			CacheBytes: *prefetchCacheSize,
+		}
+		nw, err := web.NewNetworkVideoContentService(membershipStore, migrationStore, storageNodes, config)
+		if err != nil {
+			log.Fatalf("Content service: %v", err)
+		}
+		if etcdClient != nil {
+			// Migrations are resumed by whichever web server is elected leader.
+			if err := nw.JoinCluster(context.Background(), etcdClient, adminAddr); err != nil {
+				log.Fatalf("Join cluster: %v", err)
+			}
+		} else if err := nw.ResumeMigrations(); err != nil {
+			log.Fatalf("Resume migrations: %v", err)
+		}
+		// The single-point ring cannot give a node less than its arc, so
+		// nearly full nodes are only down-weighted with a weighted placement.
+		// Asking for it with the ring is an error; the default only warns.
+		if *capacityInterval > 0 && nw.WeightedPlacement() {
+			go nw.MonitorCapacity(context.Background(), *capacityInterval)
+		} else if *capacityInterval > 0 && flagSet("capacity-interval") {
+			log.Fatalf("-capacity-interval needs -placement vnode or rendezvous; the ring placement ignores node weights")
+		} else if *capacityInterval > 0 {
+			slog.Warn("nearly full storage nodes will not be down-weighted: the ring placement ignores node weights; use -placement vnode or rendezvous for a new cluster")
+		}
+		// Prefetch hit rates are served at /debug/vars and /metrics.
+		expvar.Publish("nw_prefetch", expvar.Func(func() any { return nw.PrefetchStats() }))
+		if err := web.RegisterPrefetchMetrics(nw); err != nil {
+			log.Fatalf("Prefetch metrics: %v", err)
+		}
+		defer nw.Close()
+		contentService = nw
+		adminServer = grpc.NewServer(grpc.ChainUnaryInterceptor(metrics.UnaryServerInterceptor, logging.UnaryServerInterceptor), tracing.ServerOption())
+		pb.RegisterVideoContentAdminServiceServer(adminServer, nw)
+		adminListenAddr = adminAddr
+	}
+
+	if *dedup {
+		if *etcdEndpoints != "" {
+			// Every web server would keep its own index of segment names.
+			log.Fatalf("-dedup cannot be used with -etcd")
+		}
+		if db == nil {
+			log.Fatalf("-dedup keeps its index in the sqlite metadata database")
+		}
+		index, err := web.NewSQLiteDedupIndex(db)
+		if err != nil {
+			log.Fatalf("Dedup index: %v", err)
+		}
+		dedupService := web.NewDedupVideoContentService(contentService, index)
+		if *dedupGCInterval > 0 {
+			go dedupService.RunGarbageCollector(context.Background(), *dedupGCInterval)
+		}
+		if adminServer != nil {
+			pb.RegisterDedupAdminServiceServer(adminServer, dedupService)
+		}
+		contentService = dedupService
+	}
+
+	if *cacheSize > 0 {
+		cache, err := web.NewCachedVideoContentService(contentService, web.CacheConfig{
+			MaxBytes:     *cacheSize,
+			Dir:          *cacheDir,
+			DiskMaxBytes: *cacheDiskSize,
+		})
+		if err != nil {
+			log.Fatalf("Content cache: %v", err)
+		}
+		// Hit and miss counts are served at /debug/vars and /metrics.
+		expvar.Publish("content_cache", expvar.Func(func() any { return cache.Stats() }))
+		if err := web.RegisterCacheMetrics(cache); err != nil {
+			log.Fatalf("Cache metrics: %v", err)
+		}
+		contentService = cache
+	}
+
+	if adminServer == nil && *adminFlag != "" {
+		adminServer = grpc.NewServer(grpc.ChainUnaryInterceptor(metrics.UnaryServerInterceptor, logging.UnaryServerInterceptor), tracing.ServerOption())
+		adminListenAddr = *adminFlag
+	}
+	// Web servers that share a ring through -etcd but keep their metadata
+	// in their own SQLite database would each see the others' videos as
+	// orphans. With etcd metadata every server sees every video.
+	privateMetadata := *etcdEndpoints != "" && metadataServiceType != "etcd"
+	if !privateMetadata {
+		collector, err := web.NewOrphanCollector(metadataService, contentService, *orphanGrace)
+		if err != nil {
+			log.Fatalf("Orphan collector: %v", err)
+		}
+		if adminServer != nil {
+			pb.RegisterOrphanAdminServiceServer(adminServer, collector)
+		}
+		if *orphanGCInterval > 0 {
+			go collector.Run(context.Background(), *orphanGCInterval)
+		}
+	} else if *orphanGCInterval > 0 {
+		log.Fatalf("-orphan-gc-interval cannot be used with -etcd unless the metadata is kept in etcd too")
+	}
+
+	if adminServer != nil {
 		go func() {
-			adminLis, err := net.Listen("tcp", adminAddr)
+			adminLis, err := net.Listen("tcp", adminListenAddr)
 			if err != nil {
-				log.Fatalf("Failed to listen for admin gRPC on %s: %v", adminAddr, err)
+				log.Fatalf("Failed to listen for admin gRPC on %s: %v", adminListenAddr, err)
 			}
-			adminServer := grpc.NewServer()
-			pb.RegisterVideoContentAdminServiceServer(adminServer, contentService.(*web.NetworkVideoContentService))
-			log.Printf("Admin gRPC server running at %s", adminAddr)
+			slog.Info("admin gRPC server running", "addr", adminListenAddr)
 			if err := adminServer.Serve(adminLis); err != nil {
 				log.Fatalf("Admin gRPC server error: %v", err)
 			}
@@ -139,6 +339,10 @@ func main() {
 
 	// Start the server
 	server := web.NewServer(metadataService, contentService)
+	server.Upload.Workers = *uploadWorkers
+	server.Upload.NodeWorkers = *uploadNodeWorkers
+	server.Upload.Attempts = *uploadAttempts
+	server.ReadyTimeout = *readyTimeout
 	listenAddr := fmt.Sprintf("%s:%d", *host, *port)
 	lis, err := net.Listen("tcp", listenAddr)
 	if err != nil {
@@ -0,0 +1,123 @@
+// Package atomicfile replaces files so that readers and crashes only ever
+// see the old contents or the new ones, never a partial write.
+package atomicfile
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// tempPrefix starts the name of every temporary file, so they are easy to
+// skip when listing and to sweep after a crash.
+const tempPrefix = ".tmp-"
+
+// IsTemp reports whether name is the name of a temporary file left by
+// WriteFile.
+func IsTemp(name string) bool {
+	return strings.HasPrefix(name, tempPrefix)
+}
+
+// WriteFile writes data to a temporary file next to path, syncs it to disk
+// and renames it over path. The directory is synced too, so once WriteFile
+// returns the new contents survive a crash.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	t, err := Prepare(path, data, perm)
+	if err != nil {
+		return err
+	}
+	return t.Commit()
+}
+
+// Temp is new contents for a file, synced to disk but not yet in place.
+type Temp struct {
+	path string
+	tmp  string
+}
+
+// Prepare writes data to a temporary file next to path and syncs it, but
+// leaves path alone until Commit. This lets a caller get a file ready before
+// it changes anything else, and back out with Discard.
+func Prepare(path string, data []byte, perm os.FileMode) (*Temp, error) {
+	dir, name := filepath.Split(path)
+	f, err := os.CreateTemp(dir, tempPrefix+name+".*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %v", err)
+	}
+	if err := write(f, data, perm); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return &Temp{path: path, tmp: f.Name()}, nil
+}
+
+// Commit renames the prepared contents over the file and syncs the
+// directory.
+func (t *Temp) Commit() error {
+	if err := os.Rename(t.tmp, t.path); err != nil {
+		os.Remove(t.tmp)
+		return fmt.Errorf("rename temp file: %v", err)
+	}
+	syncDir(filepath.Dir(t.path))
+	return nil
+}
+
+// Discard removes the prepared contents without touching the file.
+func (t *Temp) Discard() {
+	os.Remove(t.tmp)
+}
+
+func write(f *os.File, data []byte, perm os.FileMode) error {
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return fmt.Errorf("write temp file: %v", err)
+	}
+	if err := f.Chmod(perm); err != nil {
+		return fmt.Errorf("chmod temp file: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("sync temp file: %v", err)
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename in dir durable. Not every platform can sync a
+// directory, so failures are ignored.
+func syncDir(dir string) {
+	if dir == "" {
+		dir = "."
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// Sweep removes the temporary files that writes interrupted by a crash left
+// anywhere under root and returns how many it removed. It must run before
+// anything writes under root.
+func Sweep(root string) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !IsTemp(d.Name()) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("sweep temp files: %v", err)
+	}
+	return removed, nil
+}
@@ -0,0 +1,63 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"tritontube/internal/writetest"
+)
+
+func TestWriter(t *testing.T) {
+	path := writetest.ChildArg()
+	if path == "" {
+		t.Skip("only runs as the child of TestKillDuringWriteFile")
+	}
+	v := writetest.Versions()
+	for i := 0; ; i++ {
+		if err := WriteFile(path, v[i%2], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestKillDuringWriteFile kills a child in the middle of WriteFile and
+// checks that the file holds one of the two versions and that Sweep
+// removes the temporary files the child left.
+func TestKillDuringWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "video.mp4")
+	if err := WriteFile(path, writetest.Versions()[0], 0644); err != nil {
+		t.Fatal(err)
+	}
+	writetest.KillLoop(t, "TestWriter", path, func(round int) {
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("round %d: %v", round, err)
+		}
+		writetest.Check(t, "after kill", got)
+		if _, err := Sweep(dir); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if IsTemp(e.Name()) {
+				t.Fatalf("round %d: sweep left %s", round, e.Name())
+			}
+		}
+	})
+}
+
+// TestReadDuringWriteFile reads a file while WriteFile keeps replacing it.
+func TestReadDuringWriteFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "video.mp4")
+	if err := WriteFile(path, writetest.Versions()[0], 0644); err != nil {
+		t.Fatal(err)
+	}
+	writetest.ReadWhileWriting(t,
+		func(content []byte) error { return WriteFile(path, content, 0644) },
+		func() ([]byte, error) { return os.ReadFile(path) })
+}
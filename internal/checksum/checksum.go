@@ -0,0 +1,115 @@
+// Package checksum computes the SHA-256 digests that protect stored video
+// files and reads and writes the sidecar files that keep them on disk.
+package checksum
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"tritontube/internal/atomicfile"
+)
+
+// SidecarSuffix is appended to a file's name to get its sidecar. A sidecar
+// holds one line in the format of sha256sum, so `sha256sum -c` can check a
+// video directory by hand.
+const SidecarSuffix = ".sha256"
+
+// ErrMismatch is returned, wrapped, for data that does not match its digest.
+var ErrMismatch = errors.New("checksum mismatch")
+
+// Sum returns the SHA-256 digest of data.
+func Sum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// Verify fails if data does not have digest want. An empty want is not
+// checked.
+func Verify(data, want []byte) error {
+	if len(want) == 0 {
+		return nil
+	}
+	if got := Sum(data); !bytes.Equal(got, want) {
+		return fmt.Errorf("%w: got sha256 %x, want %x", ErrMismatch, got, want)
+	}
+	return nil
+}
+
+// IsSidecar reports whether name is the name of a sidecar file.
+func IsSidecar(name string) bool {
+	return strings.HasSuffix(name, SidecarSuffix)
+}
+
+// SidecarPath is the path of the sidecar of the file at path.
+func SidecarPath(path string) string {
+	return path + SidecarSuffix
+}
+
+// WriteSidecar records sum as the digest of the file at path.
+func WriteSidecar(path string, sum []byte) error {
+	t, err := PrepareSidecar(path, sum)
+	if err != nil {
+		return err
+	}
+	if err := t.Commit(); err != nil {
+		return fmt.Errorf("write checksum: %v", err)
+	}
+	return nil
+}
+
+// PrepareSidecar gets the sidecar recording sum ready on disk without
+// putting it in place, so a write can fail before it touches the old file.
+func PrepareSidecar(path string, sum []byte) (*atomicfile.Temp, error) {
+	line := fmt.Sprintf("%x  %s\n", sum, filepath.Base(path))
+	t, err := atomicfile.Prepare(SidecarPath(path), []byte(line), 0644)
+	if err != nil {
+		return nil, fmt.Errorf("write checksum: %v", err)
+	}
+	return t, nil
+}
+
+// ReadSidecar returns the digest recorded for the file at path. The error
+// satisfies os.IsNotExist if the file has no sidecar.
+func ReadSidecar(path string) ([]byte, error) {
+	b, err := os.ReadFile(SidecarPath(path))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("empty checksum file %s", SidecarPath(path))
+	}
+	sum, err := hex.DecodeString(fields[0])
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("malformed checksum file %s", SidecarPath(path))
+	}
+	return sum, nil
+}
+
+// ReadFile reads the file at path and checks it against its sidecar. It
+// returns the file and its digest; a file without a sidecar is returned
+// unchecked with the digest of what was read. A corrupted file fails with an
+// error wrapping ErrMismatch.
+func ReadFile(path string) ([]byte, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	want, err := ReadSidecar(path)
+	if os.IsNotExist(err) {
+		return data, Sum(data), nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := Verify(data, want); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return data, want, nil
+}
@@ -0,0 +1,63 @@
+// Package keylock hands out a read-write lock per key, so operations on one
+// file can be serialized without holding up operations on the others.
+package keylock
+
+import "sync"
+
+// Map holds the locks of the keys that are currently locked. The zero value
+// is ready to use.
+type Map struct {
+	mu    sync.Mutex
+	locks map[string]*entry
+}
+
+type entry struct {
+	sync.RWMutex
+	// refs counts the holders and waiters, so the entry is dropped once
+	// nobody needs it.
+	refs int
+}
+
+// Lock locks key for writing and returns the function that unlocks it.
+func (m *Map) Lock(key string) func() {
+	e := m.acquire(key)
+	e.Lock()
+	return func() {
+		e.Unlock()
+		m.release(key, e)
+	}
+}
+
+// RLock locks key for reading and returns the function that unlocks it.
+func (m *Map) RLock(key string) func() {
+	e := m.acquire(key)
+	e.RLock()
+	return func() {
+		e.RUnlock()
+		m.release(key, e)
+	}
+}
+
+func (m *Map) acquire(key string) *entry {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.locks == nil {
+		m.locks = make(map[string]*entry)
+	}
+	e := m.locks[key]
+	if e == nil {
+		e = &entry{}
+		m.locks[key] = e
+	}
+	e.refs++
+	return e
+}
+
+func (m *Map) release(key string, e *entry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e.refs--
+	if e.refs == 0 {
+		delete(m.locks, key)
+	}
+}
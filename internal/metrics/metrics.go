@@ -0,0 +1,92 @@
+// Prometheus metrics shared by the web and storage servers
+
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "tritontube_http_requests_total",
+		Help: "HTTP requests by route and status code.",
+	}, []string{"route", "code"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tritontube_http_request_duration_seconds",
+		Help:    "Time to serve HTTP requests by route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route"})
+	rpcServerDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tritontube_grpc_server_handling_seconds",
+		Help:    "Time to handle gRPC calls by method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+	rpcClientDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tritontube_grpc_client_duration_seconds",
+		Help:    "Time of gRPC calls to other servers by target, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"target", "method", "code"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequests, httpDuration, rpcServerDuration, rpcClientDuration)
+}
+
+// Handler serves every registered metric in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ListenAndServe serves Handler at /metrics on addr.
+func ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+// statusRecorder remembers the status code a handler wrote.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// InstrumentHandler counts and times the requests h serves under route.
+func InstrumentHandler(route string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(rec, r)
+		httpDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		httpRequests.WithLabelValues(route, strconv.Itoa(rec.code)).Inc()
+	}
+}
+
+// UnaryServerInterceptor times the gRPC calls a server handles.
+func UnaryServerInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	rpcServerDuration.WithLabelValues(info.FullMethod, status.Code(err).String()).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// UnaryClientInterceptor times the gRPC calls a client makes, by the
+// server they go to.
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	rpcClientDuration.WithLabelValues(cc.Target(), method, status.Code(err).String()).Observe(time.Since(start).Seconds())
+	return err
+}
@@ -22,8 +22,17 @@ const (
 )
 
 type AddNodeRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	NodeAddress   string                 `protobuf:"bytes,1,opt,name=node_address,json=nodeAddress,proto3" json:"node_address,omitempty"`
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	NodeAddress string                 `protobuf:"bytes,1,opt,name=node_address,json=nodeAddress,proto3" json:"node_address,omitempty"`
+	// Only plan the migration and return the moves; the ring is not changed.
+	DryRun bool `protobuf:"varint,2,opt,name=dry_run,json=dryRun,proto3" json:"dry_run,omitempty"`
+	// Relative share of keys under weighted placements; 0 means 1.
+	Weight int32 `protobuf:"varint,3,opt,name=weight,proto3" json:"weight,omitempty"`
+	// Failure domains of the node. The shards of a file are spread over
+	// as many distinct zones, then racks, then hosts as possible.
+	Zone          string `protobuf:"bytes,4,opt,name=zone,proto3" json:"zone,omitempty"`
+	Rack          string `protobuf:"bytes,5,opt,name=rack,proto3" json:"rack,omitempty"`
+	Host          string `protobuf:"bytes,6,opt,name=host,proto3" json:"host,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -65,11 +74,51 @@ func (x *AddNodeRequest) GetNodeAddress() string {
 	return ""
 }
 
+func (x *AddNodeRequest) GetDryRun() bool {
+	if x != nil {
+		return x.DryRun
+	}
+	return false
+}
+
+func (x *AddNodeRequest) GetWeight() int32 {
+	if x != nil {
+		return x.Weight
+	}
+	return 0
+}
+
+func (x *AddNodeRequest) GetZone() string {
+	if x != nil {
+		return x.Zone
+	}
+	return ""
+}
+
+func (x *AddNodeRequest) GetRack() string {
+	if x != nil {
+		return x.Rack
+	}
+	return ""
+}
+
+func (x *AddNodeRequest) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
 type AddNodeResponse struct {
-	state             protoimpl.MessageState `protogen:"open.v1"`
-	MigratedFileCount int32                  `protobuf:"varint,1,opt,name=migrated_file_count,json=migratedFileCount,proto3" json:"migrated_file_count,omitempty"`
-	unknownFields     protoimpl.UnknownFields
-	sizeCache         protoimpl.SizeCache
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Number of files scheduled to move. The migration itself runs in the
+	// background; poll GetMigration with migration_id for its outcome.
+	MigratedFileCount int32  `protobuf:"varint,1,opt,name=migrated_file_count,json=migratedFileCount,proto3" json:"migrated_file_count,omitempty"`
+	MigrationId       string `protobuf:"bytes,2,opt,name=migration_id,json=migrationId,proto3" json:"migration_id,omitempty"`
+	// Set for dry runs only.
+	PlannedMoves  []*PlannedMove `protobuf:"bytes,3,rep,name=planned_moves,json=plannedMoves,proto3" json:"planned_moves,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *AddNodeResponse) Reset() {
@@ -109,9 +158,25 @@ func (x *AddNodeResponse) GetMigratedFileCount() int32 {
 	return 0
 }
 
+func (x *AddNodeResponse) GetMigrationId() string {
+	if x != nil {
+		return x.MigrationId
+	}
+	return ""
+}
+
+func (x *AddNodeResponse) GetPlannedMoves() []*PlannedMove {
+	if x != nil {
+		return x.PlannedMoves
+	}
+	return nil
+}
+
 type RemoveNodeRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	NodeAddress   string                 `protobuf:"bytes,1,opt,name=node_address,json=nodeAddress,proto3" json:"node_address,omitempty"`
+	state       protoimpl.MessageState `protogen:"open.v1"`
+	NodeAddress string                 `protobuf:"bytes,1,opt,name=node_address,json=nodeAddress,proto3" json:"node_address,omitempty"`
+	// Only plan the migration and return the moves; the ring is not changed.
+	DryRun        bool `protobuf:"varint,2,opt,name=dry_run,json=dryRun,proto3" json:"dry_run,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -153,11 +218,23 @@ func (x *RemoveNodeRequest) GetNodeAddress() string {
 	return ""
 }
 
+func (x *RemoveNodeRequest) GetDryRun() bool {
+	if x != nil {
+		return x.DryRun
+	}
+	return false
+}
+
 type RemoveNodeResponse struct {
-	state             protoimpl.MessageState `protogen:"open.v1"`
-	MigratedFileCount int32                  `protobuf:"varint,1,opt,name=migrated_file_count,json=migratedFileCount,proto3" json:"migrated_file_count,omitempty"`
-	unknownFields     protoimpl.UnknownFields
-	sizeCache         protoimpl.SizeCache
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Number of files scheduled to move. The migration itself runs in the
+	// background; poll GetMigration with migration_id for its outcome.
+	MigratedFileCount int32  `protobuf:"varint,1,opt,name=migrated_file_count,json=migratedFileCount,proto3" json:"migrated_file_count,omitempty"`
+	MigrationId       string `protobuf:"bytes,2,opt,name=migration_id,json=migrationId,proto3" json:"migration_id,omitempty"`
+	// Set for dry runs only.
+	PlannedMoves  []*PlannedMove `protobuf:"bytes,3,rep,name=planned_moves,json=plannedMoves,proto3" json:"planned_moves,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
 }
 
 func (x *RemoveNodeResponse) Reset() {
@@ -197,26 +274,45 @@ func (x *RemoveNodeResponse) GetMigratedFileCount() int32 {
 	return 0
 }
 
-type ListNodesRequest struct {
+func (x *RemoveNodeResponse) GetMigrationId() string {
+	if x != nil {
+		return x.MigrationId
+	}
+	return ""
+}
+
+func (x *RemoveNodeResponse) GetPlannedMoves() []*PlannedMove {
+	if x != nil {
+		return x.PlannedMoves
+	}
+	return nil
+}
+
+type PlannedMove struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
+	VideoId       string                 `protobuf:"bytes,1,opt,name=video_id,json=videoId,proto3" json:"video_id,omitempty"`
+	Filename      string                 `protobuf:"bytes,2,opt,name=filename,proto3" json:"filename,omitempty"`
+	Source        string                 `protobuf:"bytes,3,opt,name=source,proto3" json:"source,omitempty"`
+	Destination   string                 `protobuf:"bytes,4,opt,name=destination,proto3" json:"destination,omitempty"`
+	Size          int64                  `protobuf:"varint,5,opt,name=size,proto3" json:"size,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *ListNodesRequest) Reset() {
-	*x = ListNodesRequest{}
+func (x *PlannedMove) Reset() {
+	*x = PlannedMove{}
 	mi := &file_proto_admin_proto_msgTypes[4]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *ListNodesRequest) String() string {
+func (x *PlannedMove) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*ListNodesRequest) ProtoMessage() {}
+func (*PlannedMove) ProtoMessage() {}
 
-func (x *ListNodesRequest) ProtoReflect() protoreflect.Message {
+func (x *PlannedMove) ProtoReflect() protoreflect.Message {
 	mi := &file_proto_admin_proto_msgTypes[4]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -228,32 +324,68 @@ func (x *ListNodesRequest) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use ListNodesRequest.ProtoReflect.Descriptor instead.
-func (*ListNodesRequest) Descriptor() ([]byte, []int) {
+// Deprecated: Use PlannedMove.ProtoReflect.Descriptor instead.
+func (*PlannedMove) Descriptor() ([]byte, []int) {
 	return file_proto_admin_proto_rawDescGZIP(), []int{4}
 }
 
-type ListNodesResponse struct {
+func (x *PlannedMove) GetVideoId() string {
+	if x != nil {
+		return x.VideoId
+	}
+	return ""
+}
+
+func (x *PlannedMove) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *PlannedMove) GetSource() string {
+	if x != nil {
+		return x.Source
+	}
+	return ""
+}
+
+func (x *PlannedMove) GetDestination() string {
+	if x != nil {
+		return x.Destination
+	}
+	return ""
+}
+
+func (x *PlannedMove) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+type DrainNodeRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
-	Nodes         []string               `protobuf:"bytes,1,rep,name=nodes,proto3" json:"nodes,omitempty"`
+	NodeAddress   string                 `protobuf:"bytes,1,opt,name=node_address,json=nodeAddress,proto3" json:"node_address,omitempty"`
+	DryRun        bool                   `protobuf:"varint,2,opt,name=dry_run,json=dryRun,proto3" json:"dry_run,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
 
-func (x *ListNodesResponse) Reset() {
-	*x = ListNodesResponse{}
+func (x *DrainNodeRequest) Reset() {
+	*x = DrainNodeRequest{}
 	mi := &file_proto_admin_proto_msgTypes[5]
 	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 	ms.StoreMessageInfo(mi)
 }
 
-func (x *ListNodesResponse) String() string {
+func (x *DrainNodeRequest) String() string {
 	return protoimpl.X.MessageStringOf(x)
 }
 
-func (*ListNodesResponse) ProtoMessage() {}
+func (*DrainNodeRequest) ProtoMessage() {}
 
-func (x *ListNodesResponse) ProtoReflect() protoreflect.Message {
+func (x *DrainNodeRequest) ProtoReflect() protoreflect.Message {
 	mi := &file_proto_admin_proto_msgTypes[5]
 	if x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
@@ -265,40 +397,1009 @@ func (x *ListNodesResponse) ProtoReflect() protoreflect.Message {
 	return mi.MessageOf(x)
 }
 
-// Deprecated: Use ListNodesResponse.ProtoReflect.Descriptor instead.
-func (*ListNodesResponse) Descriptor() ([]byte, []int) {
+// Deprecated: Use DrainNodeRequest.ProtoReflect.Descriptor instead.
+func (*DrainNodeRequest) Descriptor() ([]byte, []int) {
 	return file_proto_admin_proto_rawDescGZIP(), []int{5}
 }
 
-func (x *ListNodesResponse) GetNodes() []string {
+func (x *DrainNodeRequest) GetNodeAddress() string {
 	if x != nil {
-		return x.Nodes
+		return x.NodeAddress
+	}
+	return ""
+}
+
+func (x *DrainNodeRequest) GetDryRun() bool {
+	if x != nil {
+		return x.DryRun
+	}
+	return false
+}
+
+type DrainNodeResponse struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	MigratedFileCount int32                  `protobuf:"varint,1,opt,name=migrated_file_count,json=migratedFileCount,proto3" json:"migrated_file_count,omitempty"`
+	MigrationId       string                 `protobuf:"bytes,2,opt,name=migration_id,json=migrationId,proto3" json:"migration_id,omitempty"`
+	PlannedMoves      []*PlannedMove         `protobuf:"bytes,3,rep,name=planned_moves,json=plannedMoves,proto3" json:"planned_moves,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *DrainNodeResponse) Reset() {
+	*x = DrainNodeResponse{}
+	mi := &file_proto_admin_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DrainNodeResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DrainNodeResponse) ProtoMessage() {}
+
+func (x *DrainNodeResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_admin_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DrainNodeResponse.ProtoReflect.Descriptor instead.
+func (*DrainNodeResponse) Descriptor() ([]byte, []int) {
+	return file_proto_admin_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *DrainNodeResponse) GetMigratedFileCount() int32 {
+	if x != nil {
+		return x.MigratedFileCount
+	}
+	return 0
+}
+
+func (x *DrainNodeResponse) GetMigrationId() string {
+	if x != nil {
+		return x.MigrationId
+	}
+	return ""
+}
+
+func (x *DrainNodeResponse) GetPlannedMoves() []*PlannedMove {
+	if x != nil {
+		return x.PlannedMoves
 	}
 	return nil
 }
 
-var File_proto_admin_proto protoreflect.FileDescriptor
+type UndrainNodeRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	NodeAddress   string                 `protobuf:"bytes,1,opt,name=node_address,json=nodeAddress,proto3" json:"node_address,omitempty"`
+	DryRun        bool                   `protobuf:"varint,2,opt,name=dry_run,json=dryRun,proto3" json:"dry_run,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
 
-const file_proto_admin_proto_rawDesc = "" +
-	"\n" +
-	"\x11proto/admin.proto\x12\n" +
-	"tritontube\"3\n" +
-	"\x0eAddNodeRequest\x12!\n" +
-	"\fnode_address\x18\x01 \x01(\tR\vnodeAddress\"A\n" +
-	"\x0fAddNodeResponse\x12.\n" +
-	"\x13migrated_file_count\x18\x01 \x01(\x05R\x11migratedFileCount\"6\n" +
-	"\x11RemoveNodeRequest\x12!\n" +
-	"\fnode_address\x18\x01 \x01(\tR\vnodeAddress\"D\n" +
-	"\x12RemoveNodeResponse\x12.\n" +
-	"\x13migrated_file_count\x18\x01 \x01(\x05R\x11migratedFileCount\"\x12\n" +
-	"\x10ListNodesRequest\")\n" +
-	"\x11ListNodesResponse\x12\x14\n" +
-	"\x05nodes\x18\x01 \x03(\tR\x05nodes2\xf5\x01\n" +
+func (x *UndrainNodeRequest) Reset() {
+	*x = UndrainNodeRequest{}
+	mi := &file_proto_admin_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UndrainNodeRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UndrainNodeRequest) ProtoMessage() {}
+
+func (x *UndrainNodeRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_admin_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UndrainNodeRequest.ProtoReflect.Descriptor instead.
+func (*UndrainNodeRequest) Descriptor() ([]byte, []int) {
+	return file_proto_admin_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *UndrainNodeRequest) GetNodeAddress() string {
+	if x != nil {
+		return x.NodeAddress
+	}
+	return ""
+}
+
+func (x *UndrainNodeRequest) GetDryRun() bool {
+	if x != nil {
+		return x.DryRun
+	}
+	return false
+}
+
+type UndrainNodeResponse struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	MigratedFileCount int32                  `protobuf:"varint,1,opt,name=migrated_file_count,json=migratedFileCount,proto3" json:"migrated_file_count,omitempty"`
+	MigrationId       string                 `protobuf:"bytes,2,opt,name=migration_id,json=migrationId,proto3" json:"migration_id,omitempty"`
+	PlannedMoves      []*PlannedMove         `protobuf:"bytes,3,rep,name=planned_moves,json=plannedMoves,proto3" json:"planned_moves,omitempty"`
+	unknownFields     protoimpl.UnknownFields
+	sizeCache         protoimpl.SizeCache
+}
+
+func (x *UndrainNodeResponse) Reset() {
+	*x = UndrainNodeResponse{}
+	mi := &file_proto_admin_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UndrainNodeResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UndrainNodeResponse) ProtoMessage() {}
+
+func (x *UndrainNodeResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_admin_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UndrainNodeResponse.ProtoReflect.Descriptor instead.
+func (*UndrainNodeResponse) Descriptor() ([]byte, []int) {
+	return file_proto_admin_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *UndrainNodeResponse) GetMigratedFileCount() int32 {
+	if x != nil {
+		return x.MigratedFileCount
+	}
+	return 0
+}
+
+func (x *UndrainNodeResponse) GetMigrationId() string {
+	if x != nil {
+		return x.MigrationId
+	}
+	return ""
+}
+
+func (x *UndrainNodeResponse) GetPlannedMoves() []*PlannedMove {
+	if x != nil {
+		return x.PlannedMoves
+	}
+	return nil
+}
+
+type ListNodesRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListNodesRequest) Reset() {
+	*x = ListNodesRequest{}
+	mi := &file_proto_admin_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListNodesRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListNodesRequest) ProtoMessage() {}
+
+func (x *ListNodesRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_admin_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListNodesRequest.ProtoReflect.Descriptor instead.
+func (*ListNodesRequest) Descriptor() ([]byte, []int) {
+	return file_proto_admin_proto_rawDescGZIP(), []int{9}
+}
+
+type NodeInfo struct {
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Address string                 `protobuf:"bytes,1,opt,name=address,proto3" json:"address,omitempty"`
+	// One of "active", "draining" or "drained".
+	State  string `protobuf:"bytes,2,opt,name=state,proto3" json:"state,omitempty"`
+	Weight int32  `protobuf:"varint,3,opt,name=weight,proto3" json:"weight,omitempty"`
+	Zone   string `protobuf:"bytes,4,opt,name=zone,proto3" json:"zone,omitempty"`
+	Rack   string `protobuf:"bytes,5,opt,name=rack,proto3" json:"rack,omitempty"`
+	Host   string `protobuf:"bytes,6,opt,name=host,proto3" json:"host,omitempty"`
+	// Usage as reported by the node; the byte counts are -1 when the node
+	// could not be asked or does not know.
+	UsedBytes int64 `protobuf:"varint,7,opt,name=used_bytes,json=usedBytes,proto3" json:"used_bytes,omitempty"`
+	FileCount int64 `protobuf:"varint,8,opt,name=file_count,json=fileCount,proto3" json:"file_count,omitempty"`
+	FreeBytes int64 `protobuf:"varint,9,opt,name=free_bytes,json=freeBytes,proto3" json:"free_bytes,omitempty"`
+	// 0 means the node has no quota.
+	QuotaBytes int64 `protobuf:"varint,10,opt,name=quota_bytes,json=quotaBytes,proto3" json:"quota_bytes,omitempty"`
+	// Percentage of its weight that placement gives the node.
+	CapacityPercent int32 `protobuf:"varint,11,opt,name=capacity_percent,json=capacityPercent,proto3" json:"capacity_percent,omitempty"`
+	unknownFields   protoimpl.UnknownFields
+	sizeCache       protoimpl.SizeCache
+}
+
+func (x *NodeInfo) Reset() {
+	*x = NodeInfo{}
+	mi := &file_proto_admin_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *NodeInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*NodeInfo) ProtoMessage() {}
+
+func (x *NodeInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_admin_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use NodeInfo.ProtoReflect.Descriptor instead.
+func (*NodeInfo) Descriptor() ([]byte, []int) {
+	return file_proto_admin_proto_rawDescGZIP(), []int{10}
+}
+
+func (x *NodeInfo) GetAddress() string {
+	if x != nil {
+		return x.Address
+	}
+	return ""
+}
+
+func (x *NodeInfo) GetState() string {
+	if x != nil {
+		return x.State
+	}
+	return ""
+}
+
+func (x *NodeInfo) GetWeight() int32 {
+	if x != nil {
+		return x.Weight
+	}
+	return 0
+}
+
+func (x *NodeInfo) GetZone() string {
+	if x != nil {
+		return x.Zone
+	}
+	return ""
+}
+
+func (x *NodeInfo) GetRack() string {
+	if x != nil {
+		return x.Rack
+	}
+	return ""
+}
+
+func (x *NodeInfo) GetHost() string {
+	if x != nil {
+		return x.Host
+	}
+	return ""
+}
+
+func (x *NodeInfo) GetUsedBytes() int64 {
+	if x != nil {
+		return x.UsedBytes
+	}
+	return 0
+}
+
+func (x *NodeInfo) GetFileCount() int64 {
+	if x != nil {
+		return x.FileCount
+	}
+	return 0
+}
+
+func (x *NodeInfo) GetFreeBytes() int64 {
+	if x != nil {
+		return x.FreeBytes
+	}
+	return 0
+}
+
+func (x *NodeInfo) GetQuotaBytes() int64 {
+	if x != nil {
+		return x.QuotaBytes
+	}
+	return 0
+}
+
+func (x *NodeInfo) GetCapacityPercent() int32 {
+	if x != nil {
+		return x.CapacityPercent
+	}
+	return 0
+}
+
+type ListNodesResponse struct {
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	Nodes    []string               `protobuf:"bytes,1,rep,name=nodes,proto3" json:"nodes,omitempty"`
+	NodeInfo []*NodeInfo            `protobuf:"bytes,2,rep,name=node_info,json=nodeInfo,proto3" json:"node_info,omitempty"`
+	// The migration currently running, if any.
+	MigrationId   string `protobuf:"bytes,3,opt,name=migration_id,json=migrationId,proto3" json:"migration_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListNodesResponse) Reset() {
+	*x = ListNodesResponse{}
+	mi := &file_proto_admin_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListNodesResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListNodesResponse) ProtoMessage() {}
+
+func (x *ListNodesResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_admin_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListNodesResponse.ProtoReflect.Descriptor instead.
+func (*ListNodesResponse) Descriptor() ([]byte, []int) {
+	return file_proto_admin_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *ListNodesResponse) GetNodes() []string {
+	if x != nil {
+		return x.Nodes
+	}
+	return nil
+}
+
+func (x *ListNodesResponse) GetNodeInfo() []*NodeInfo {
+	if x != nil {
+		return x.NodeInfo
+	}
+	return nil
+}
+
+func (x *ListNodesResponse) GetMigrationId() string {
+	if x != nil {
+		return x.MigrationId
+	}
+	return ""
+}
+
+type GetMigrationRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	MigrationId   string                 `protobuf:"bytes,1,opt,name=migration_id,json=migrationId,proto3" json:"migration_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetMigrationRequest) Reset() {
+	*x = GetMigrationRequest{}
+	mi := &file_proto_admin_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetMigrationRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetMigrationRequest) ProtoMessage() {}
+
+func (x *GetMigrationRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_admin_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetMigrationRequest.ProtoReflect.Descriptor instead.
+func (*GetMigrationRequest) Descriptor() ([]byte, []int) {
+	return file_proto_admin_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *GetMigrationRequest) GetMigrationId() string {
+	if x != nil {
+		return x.MigrationId
+	}
+	return ""
+}
+
+type GetMigrationResponse struct {
+	state             protoimpl.MessageState `protogen:"open.v1"`
+	MigrationId       string                 `protobuf:"bytes,1,opt,name=migration_id,json=migrationId,proto3" json:"migration_id,omitempty"`
+	Kind              string                 `protobuf:"bytes,2,opt,name=kind,proto3" json:"kind,omitempty"`
+	NodeAddress       string                 `protobuf:"bytes,3,opt,name=node_address,json=nodeAddress,proto3" json:"node_address,omitempty"`
+	State             string                 `protobuf:"bytes,4,opt,name=state,proto3" json:"state,omitempty"`
+	PlannedFileCount  int32                  `protobuf:"varint,5,opt,name=planned_file_count,json=plannedFileCount,proto3" json:"planned_file_count,omitempty"`
+	MigratedFileCount int32                  `protobuf:"varint,6,opt,name=migrated_file_count,json=migratedFileCount,proto3" json:"migrated_file_count,omitempty"`
+	FailedFileCount   int32                  `protobuf:"varint,7,opt,name=failed_file_count,json=failedFileCount,proto3" json:"failed_file_count,omitempty"`
+	PlannedBytes      int64                  `protobuf:"varint,8,opt,name=planned_bytes,json=plannedBytes,proto3" json:"planned_bytes,omitempty"`
+	MigratedBytes     int64                  `protobuf:"varint,9,opt,name=migrated_bytes,json=migratedBytes,proto3" json:"migrated_bytes,omitempty"`
+	// Estimated seconds left, or -1 when there is no estimate yet.
+	EtaSeconds    int64 `protobuf:"varint,10,opt,name=eta_seconds,json=etaSeconds,proto3" json:"eta_seconds,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetMigrationResponse) Reset() {
+	*x = GetMigrationResponse{}
+	mi := &file_proto_admin_proto_msgTypes[13]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetMigrationResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetMigrationResponse) ProtoMessage() {}
+
+func (x *GetMigrationResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_admin_proto_msgTypes[13]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetMigrationResponse.ProtoReflect.Descriptor instead.
+func (*GetMigrationResponse) Descriptor() ([]byte, []int) {
+	return file_proto_admin_proto_rawDescGZIP(), []int{13}
+}
+
+func (x *GetMigrationResponse) GetMigrationId() string {
+	if x != nil {
+		return x.MigrationId
+	}
+	return ""
+}
+
+func (x *GetMigrationResponse) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+func (x *GetMigrationResponse) GetNodeAddress() string {
+	if x != nil {
+		return x.NodeAddress
+	}
+	return ""
+}
+
+func (x *GetMigrationResponse) GetState() string {
+	if x != nil {
+		return x.State
+	}
+	return ""
+}
+
+func (x *GetMigrationResponse) GetPlannedFileCount() int32 {
+	if x != nil {
+		return x.PlannedFileCount
+	}
+	return 0
+}
+
+func (x *GetMigrationResponse) GetMigratedFileCount() int32 {
+	if x != nil {
+		return x.MigratedFileCount
+	}
+	return 0
+}
+
+func (x *GetMigrationResponse) GetFailedFileCount() int32 {
+	if x != nil {
+		return x.FailedFileCount
+	}
+	return 0
+}
+
+func (x *GetMigrationResponse) GetPlannedBytes() int64 {
+	if x != nil {
+		return x.PlannedBytes
+	}
+	return 0
+}
+
+func (x *GetMigrationResponse) GetMigratedBytes() int64 {
+	if x != nil {
+		return x.MigratedBytes
+	}
+	return 0
+}
+
+func (x *GetMigrationResponse) GetEtaSeconds() int64 {
+	if x != nil {
+		return x.EtaSeconds
+	}
+	return 0
+}
+
+type GetDedupStatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetDedupStatsRequest) Reset() {
+	*x = GetDedupStatsRequest{}
+	mi := &file_proto_admin_proto_msgTypes[14]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetDedupStatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetDedupStatsRequest) ProtoMessage() {}
+
+func (x *GetDedupStatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_admin_proto_msgTypes[14]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetDedupStatsRequest.ProtoReflect.Descriptor instead.
+func (*GetDedupStatsRequest) Descriptor() ([]byte, []int) {
+	return file_proto_admin_proto_rawDescGZIP(), []int{14}
+}
+
+type GetDedupStatsResponse struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Names that point at a blob, and the blobs stored for them.
+	FileCount int64 `protobuf:"varint,1,opt,name=file_count,json=fileCount,proto3" json:"file_count,omitempty"`
+	BlobCount int64 `protobuf:"varint,2,opt,name=blob_count,json=blobCount,proto3" json:"blob_count,omitempty"`
+	// Bytes the files would take stored one by one, and the bytes their
+	// blobs take; saved_bytes is the difference.
+	LogicalBytes  int64 `protobuf:"varint,3,opt,name=logical_bytes,json=logicalBytes,proto3" json:"logical_bytes,omitempty"`
+	StoredBytes   int64 `protobuf:"varint,4,opt,name=stored_bytes,json=storedBytes,proto3" json:"stored_bytes,omitempty"`
+	SavedBytes    int64 `protobuf:"varint,5,opt,name=saved_bytes,json=savedBytes,proto3" json:"saved_bytes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *GetDedupStatsResponse) Reset() {
+	*x = GetDedupStatsResponse{}
+	mi := &file_proto_admin_proto_msgTypes[15]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *GetDedupStatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*GetDedupStatsResponse) ProtoMessage() {}
+
+func (x *GetDedupStatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_admin_proto_msgTypes[15]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use GetDedupStatsResponse.ProtoReflect.Descriptor instead.
+func (*GetDedupStatsResponse) Descriptor() ([]byte, []int) {
+	return file_proto_admin_proto_rawDescGZIP(), []int{15}
+}
+
+func (x *GetDedupStatsResponse) GetFileCount() int64 {
+	if x != nil {
+		return x.FileCount
+	}
+	return 0
+}
+
+func (x *GetDedupStatsResponse) GetBlobCount() int64 {
+	if x != nil {
+		return x.BlobCount
+	}
+	return 0
+}
+
+func (x *GetDedupStatsResponse) GetLogicalBytes() int64 {
+	if x != nil {
+		return x.LogicalBytes
+	}
+	return 0
+}
+
+func (x *GetDedupStatsResponse) GetStoredBytes() int64 {
+	if x != nil {
+		return x.StoredBytes
+	}
+	return 0
+}
+
+func (x *GetDedupStatsResponse) GetSavedBytes() int64 {
+	if x != nil {
+		return x.SavedBytes
+	}
+	return 0
+}
+
+type CollectOrphansRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Only list the orphans; delete nothing.
+	DryRun bool `protobuf:"varint,1,opt,name=dry_run,json=dryRun,proto3" json:"dry_run,omitempty"`
+	// Files modified more recently than this are left alone, since their
+	// upload may still be running. 0 uses the server's grace period.
+	GraceSeconds  int64 `protobuf:"varint,2,opt,name=grace_seconds,json=graceSeconds,proto3" json:"grace_seconds,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CollectOrphansRequest) Reset() {
+	*x = CollectOrphansRequest{}
+	mi := &file_proto_admin_proto_msgTypes[16]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CollectOrphansRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CollectOrphansRequest) ProtoMessage() {}
+
+func (x *CollectOrphansRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_admin_proto_msgTypes[16]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CollectOrphansRequest.ProtoReflect.Descriptor instead.
+func (*CollectOrphansRequest) Descriptor() ([]byte, []int) {
+	return file_proto_admin_proto_rawDescGZIP(), []int{16}
+}
+
+func (x *CollectOrphansRequest) GetDryRun() bool {
+	if x != nil {
+		return x.DryRun
+	}
+	return false
+}
+
+func (x *CollectOrphansRequest) GetGraceSeconds() int64 {
+	if x != nil {
+		return x.GraceSeconds
+	}
+	return 0
+}
+
+type OrphanFile struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Storage node holding the file; empty for the local filesystem.
+	Node          string `protobuf:"bytes,1,opt,name=node,proto3" json:"node,omitempty"`
+	VideoId       string `protobuf:"bytes,2,opt,name=video_id,json=videoId,proto3" json:"video_id,omitempty"`
+	Filename      string `protobuf:"bytes,3,opt,name=filename,proto3" json:"filename,omitempty"`
+	Size          int64  `protobuf:"varint,4,opt,name=size,proto3" json:"size,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *OrphanFile) Reset() {
+	*x = OrphanFile{}
+	mi := &file_proto_admin_proto_msgTypes[17]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *OrphanFile) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*OrphanFile) ProtoMessage() {}
+
+func (x *OrphanFile) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_admin_proto_msgTypes[17]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use OrphanFile.ProtoReflect.Descriptor instead.
+func (*OrphanFile) Descriptor() ([]byte, []int) {
+	return file_proto_admin_proto_rawDescGZIP(), []int{17}
+}
+
+func (x *OrphanFile) GetNode() string {
+	if x != nil {
+		return x.Node
+	}
+	return ""
+}
+
+func (x *OrphanFile) GetVideoId() string {
+	if x != nil {
+		return x.VideoId
+	}
+	return ""
+}
+
+func (x *OrphanFile) GetFilename() string {
+	if x != nil {
+		return x.Filename
+	}
+	return ""
+}
+
+func (x *OrphanFile) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+type CollectOrphansResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Orphans       []*OrphanFile          `protobuf:"bytes,1,rep,name=orphans,proto3" json:"orphans,omitempty"`
+	DeletedCount  int32                  `protobuf:"varint,2,opt,name=deleted_count,json=deletedCount,proto3" json:"deleted_count,omitempty"`
+	DeletedBytes  int64                  `protobuf:"varint,3,opt,name=deleted_bytes,json=deletedBytes,proto3" json:"deleted_bytes,omitempty"`
+	FailedCount   int32                  `protobuf:"varint,4,opt,name=failed_count,json=failedCount,proto3" json:"failed_count,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *CollectOrphansResponse) Reset() {
+	*x = CollectOrphansResponse{}
+	mi := &file_proto_admin_proto_msgTypes[18]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *CollectOrphansResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CollectOrphansResponse) ProtoMessage() {}
+
+func (x *CollectOrphansResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_admin_proto_msgTypes[18]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CollectOrphansResponse.ProtoReflect.Descriptor instead.
+func (*CollectOrphansResponse) Descriptor() ([]byte, []int) {
+	return file_proto_admin_proto_rawDescGZIP(), []int{18}
+}
+
+func (x *CollectOrphansResponse) GetOrphans() []*OrphanFile {
+	if x != nil {
+		return x.Orphans
+	}
+	return nil
+}
+
+func (x *CollectOrphansResponse) GetDeletedCount() int32 {
+	if x != nil {
+		return x.DeletedCount
+	}
+	return 0
+}
+
+func (x *CollectOrphansResponse) GetDeletedBytes() int64 {
+	if x != nil {
+		return x.DeletedBytes
+	}
+	return 0
+}
+
+func (x *CollectOrphansResponse) GetFailedCount() int32 {
+	if x != nil {
+		return x.FailedCount
+	}
+	return 0
+}
+
+var File_proto_admin_proto protoreflect.FileDescriptor
+
+const file_proto_admin_proto_rawDesc = "" +
+	"\n" +
+	"\x11proto/admin.proto\x12\n" +
+	"tritontube\"\xa0\x01\n" +
+	"\x0eAddNodeRequest\x12!\n" +
+	"\fnode_address\x18\x01 \x01(\tR\vnodeAddress\x12\x17\n" +
+	"\adry_run\x18\x02 \x01(\bR\x06dryRun\x12\x16\n" +
+	"\x06weight\x18\x03 \x01(\x05R\x06weight\x12\x12\n" +
+	"\x04zone\x18\x04 \x01(\tR\x04zone\x12\x12\n" +
+	"\x04rack\x18\x05 \x01(\tR\x04rack\x12\x12\n" +
+	"\x04host\x18\x06 \x01(\tR\x04host\"\xa2\x01\n" +
+	"\x0fAddNodeResponse\x12.\n" +
+	"\x13migrated_file_count\x18\x01 \x01(\x05R\x11migratedFileCount\x12!\n" +
+	"\fmigration_id\x18\x02 \x01(\tR\vmigrationId\x12<\n" +
+	"\rplanned_moves\x18\x03 \x03(\v2\x17.tritontube.PlannedMoveR\fplannedMoves\"O\n" +
+	"\x11RemoveNodeRequest\x12!\n" +
+	"\fnode_address\x18\x01 \x01(\tR\vnodeAddress\x12\x17\n" +
+	"\adry_run\x18\x02 \x01(\bR\x06dryRun\"\xa5\x01\n" +
+	"\x12RemoveNodeResponse\x12.\n" +
+	"\x13migrated_file_count\x18\x01 \x01(\x05R\x11migratedFileCount\x12!\n" +
+	"\fmigration_id\x18\x02 \x01(\tR\vmigrationId\x12<\n" +
+	"\rplanned_moves\x18\x03 \x03(\v2\x17.tritontube.PlannedMoveR\fplannedMoves\"\x92\x01\n" +
+	"\vPlannedMove\x12\x19\n" +
+	"\bvideo_id\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
+	"\bfilename\x18\x02 \x01(\tR\bfilename\x12\x16\n" +
+	"\x06source\x18\x03 \x01(\tR\x06source\x12 \n" +
+	"\vdestination\x18\x04 \x01(\tR\vdestination\x12\x12\n" +
+	"\x04size\x18\x05 \x01(\x03R\x04size\"N\n" +
+	"\x10DrainNodeRequest\x12!\n" +
+	"\fnode_address\x18\x01 \x01(\tR\vnodeAddress\x12\x17\n" +
+	"\adry_run\x18\x02 \x01(\bR\x06dryRun\"\xa4\x01\n" +
+	"\x11DrainNodeResponse\x12.\n" +
+	"\x13migrated_file_count\x18\x01 \x01(\x05R\x11migratedFileCount\x12!\n" +
+	"\fmigration_id\x18\x02 \x01(\tR\vmigrationId\x12<\n" +
+	"\rplanned_moves\x18\x03 \x03(\v2\x17.tritontube.PlannedMoveR\fplannedMoves\"P\n" +
+	"\x12UndrainNodeRequest\x12!\n" +
+	"\fnode_address\x18\x01 \x01(\tR\vnodeAddress\x12\x17\n" +
+	"\adry_run\x18\x02 \x01(\bR\x06dryRun\"\xa6\x01\n" +
+	"\x13UndrainNodeResponse\x12.\n" +
+	"\x13migrated_file_count\x18\x01 \x01(\x05R\x11migratedFileCount\x12!\n" +
+	"\fmigration_id\x18\x02 \x01(\tR\vmigrationId\x12<\n" +
+	"\rplanned_moves\x18\x03 \x03(\v2\x17.tritontube.PlannedMoveR\fplannedMoves\"\x12\n" +
+	"\x10ListNodesRequest\"\xb7\x02\n" +
+	"\bNodeInfo\x12\x18\n" +
+	"\aaddress\x18\x01 \x01(\tR\aaddress\x12\x14\n" +
+	"\x05state\x18\x02 \x01(\tR\x05state\x12\x16\n" +
+	"\x06weight\x18\x03 \x01(\x05R\x06weight\x12\x12\n" +
+	"\x04zone\x18\x04 \x01(\tR\x04zone\x12\x12\n" +
+	"\x04rack\x18\x05 \x01(\tR\x04rack\x12\x12\n" +
+	"\x04host\x18\x06 \x01(\tR\x04host\x12\x1d\n" +
+	"\n" +
+	"used_bytes\x18\a \x01(\x03R\tusedBytes\x12\x1d\n" +
+	"\n" +
+	"file_count\x18\b \x01(\x03R\tfileCount\x12\x1d\n" +
+	"\n" +
+	"free_bytes\x18\t \x01(\x03R\tfreeBytes\x12\x1f\n" +
+	"\vquota_bytes\x18\n" +
+	" \x01(\x03R\n" +
+	"quotaBytes\x12)\n" +
+	"\x10capacity_percent\x18\v \x01(\x05R\x0fcapacityPercent\"\x7f\n" +
+	"\x11ListNodesResponse\x12\x14\n" +
+	"\x05nodes\x18\x01 \x03(\tR\x05nodes\x121\n" +
+	"\tnode_info\x18\x02 \x03(\v2\x14.tritontube.NodeInfoR\bnodeInfo\x12!\n" +
+	"\fmigration_id\x18\x03 \x01(\tR\vmigrationId\"8\n" +
+	"\x13GetMigrationRequest\x12!\n" +
+	"\fmigration_id\x18\x01 \x01(\tR\vmigrationId\"\xfd\x02\n" +
+	"\x14GetMigrationResponse\x12!\n" +
+	"\fmigration_id\x18\x01 \x01(\tR\vmigrationId\x12\x12\n" +
+	"\x04kind\x18\x02 \x01(\tR\x04kind\x12!\n" +
+	"\fnode_address\x18\x03 \x01(\tR\vnodeAddress\x12\x14\n" +
+	"\x05state\x18\x04 \x01(\tR\x05state\x12,\n" +
+	"\x12planned_file_count\x18\x05 \x01(\x05R\x10plannedFileCount\x12.\n" +
+	"\x13migrated_file_count\x18\x06 \x01(\x05R\x11migratedFileCount\x12*\n" +
+	"\x11failed_file_count\x18\a \x01(\x05R\x0ffailedFileCount\x12#\n" +
+	"\rplanned_bytes\x18\b \x01(\x03R\fplannedBytes\x12%\n" +
+	"\x0emigrated_bytes\x18\t \x01(\x03R\rmigratedBytes\x12\x1f\n" +
+	"\veta_seconds\x18\n" +
+	" \x01(\x03R\n" +
+	"etaSeconds\"\x16\n" +
+	"\x14GetDedupStatsRequest\"\xbe\x01\n" +
+	"\x15GetDedupStatsResponse\x12\x1d\n" +
+	"\n" +
+	"file_count\x18\x01 \x01(\x03R\tfileCount\x12\x1d\n" +
+	"\n" +
+	"blob_count\x18\x02 \x01(\x03R\tblobCount\x12#\n" +
+	"\rlogical_bytes\x18\x03 \x01(\x03R\flogicalBytes\x12!\n" +
+	"\fstored_bytes\x18\x04 \x01(\x03R\vstoredBytes\x12\x1f\n" +
+	"\vsaved_bytes\x18\x05 \x01(\x03R\n" +
+	"savedBytes\"U\n" +
+	"\x15CollectOrphansRequest\x12\x17\n" +
+	"\adry_run\x18\x01 \x01(\bR\x06dryRun\x12#\n" +
+	"\rgrace_seconds\x18\x02 \x01(\x03R\fgraceSeconds\"k\n" +
+	"\n" +
+	"OrphanFile\x12\x12\n" +
+	"\x04node\x18\x01 \x01(\tR\x04node\x12\x19\n" +
+	"\bvideo_id\x18\x02 \x01(\tR\avideoId\x12\x1a\n" +
+	"\bfilename\x18\x03 \x01(\tR\bfilename\x12\x12\n" +
+	"\x04size\x18\x04 \x01(\x03R\x04size\"\xb7\x01\n" +
+	"\x16CollectOrphansResponse\x120\n" +
+	"\aorphans\x18\x01 \x03(\v2\x16.tritontube.OrphanFileR\aorphans\x12#\n" +
+	"\rdeleted_count\x18\x02 \x01(\x05R\fdeletedCount\x12#\n" +
+	"\rdeleted_bytes\x18\x03 \x01(\x03R\fdeletedBytes\x12!\n" +
+	"\ffailed_count\x18\x04 \x01(\x05R\vfailedCount2\xb9\x04\n" +
 	"\x18VideoContentAdminService\x12B\n" +
 	"\aAddNode\x12\x1a.tritontube.AddNodeRequest\x1a\x1b.tritontube.AddNodeResponse\x12K\n" +
 	"\n" +
 	"RemoveNode\x12\x1d.tritontube.RemoveNodeRequest\x1a\x1e.tritontube.RemoveNodeResponse\x12H\n" +
-	"\tListNodes\x12\x1c.tritontube.ListNodesRequest\x1a\x1d.tritontube.ListNodesResponseB\x16Z\x14internal/proto;protob\x06proto3"
+	"\tListNodes\x12\x1c.tritontube.ListNodesRequest\x1a\x1d.tritontube.ListNodesResponse\x12H\n" +
+	"\tDrainNode\x12\x1c.tritontube.DrainNodeRequest\x1a\x1d.tritontube.DrainNodeResponse\x12N\n" +
+	"\vUndrainNode\x12\x1e.tritontube.UndrainNodeRequest\x1a\x1f.tritontube.UndrainNodeResponse\x12Q\n" +
+	"\fGetMigration\x12\x1f.tritontube.GetMigrationRequest\x1a .tritontube.GetMigrationResponse\x12U\n" +
+	"\x0eWatchMigration\x12\x1f.tritontube.GetMigrationRequest\x1a .tritontube.GetMigrationResponse0\x012i\n" +
+	"\x11DedupAdminService\x12T\n" +
+	"\rGetDedupStats\x12 .tritontube.GetDedupStatsRequest\x1a!.tritontube.GetDedupStatsResponse2m\n" +
+	"\x12OrphanAdminService\x12W\n" +
+	"\x0eCollectOrphans\x12!.tritontube.CollectOrphansRequest\x1a\".tritontube.CollectOrphansResponseB\x16Z\x14internal/proto;protob\x06proto3"
 
 var (
 	file_proto_admin_proto_rawDescOnce sync.Once
@@ -312,27 +1413,58 @@ func file_proto_admin_proto_rawDescGZIP() []byte {
 	return file_proto_admin_proto_rawDescData
 }
 
-var file_proto_admin_proto_msgTypes = make([]protoimpl.MessageInfo, 6)
+var file_proto_admin_proto_msgTypes = make([]protoimpl.MessageInfo, 19)
 var file_proto_admin_proto_goTypes = []any{
-	(*AddNodeRequest)(nil),     // 0: tritontube.AddNodeRequest
-	(*AddNodeResponse)(nil),    // 1: tritontube.AddNodeResponse
-	(*RemoveNodeRequest)(nil),  // 2: tritontube.RemoveNodeRequest
-	(*RemoveNodeResponse)(nil), // 3: tritontube.RemoveNodeResponse
-	(*ListNodesRequest)(nil),   // 4: tritontube.ListNodesRequest
-	(*ListNodesResponse)(nil),  // 5: tritontube.ListNodesResponse
+	(*AddNodeRequest)(nil),         // 0: tritontube.AddNodeRequest
+	(*AddNodeResponse)(nil),        // 1: tritontube.AddNodeResponse
+	(*RemoveNodeRequest)(nil),      // 2: tritontube.RemoveNodeRequest
+	(*RemoveNodeResponse)(nil),     // 3: tritontube.RemoveNodeResponse
+	(*PlannedMove)(nil),            // 4: tritontube.PlannedMove
+	(*DrainNodeRequest)(nil),       // 5: tritontube.DrainNodeRequest
+	(*DrainNodeResponse)(nil),      // 6: tritontube.DrainNodeResponse
+	(*UndrainNodeRequest)(nil),     // 7: tritontube.UndrainNodeRequest
+	(*UndrainNodeResponse)(nil),    // 8: tritontube.UndrainNodeResponse
+	(*ListNodesRequest)(nil),       // 9: tritontube.ListNodesRequest
+	(*NodeInfo)(nil),               // 10: tritontube.NodeInfo
+	(*ListNodesResponse)(nil),      // 11: tritontube.ListNodesResponse
+	(*GetMigrationRequest)(nil),    // 12: tritontube.GetMigrationRequest
+	(*GetMigrationResponse)(nil),   // 13: tritontube.GetMigrationResponse
+	(*GetDedupStatsRequest)(nil),   // 14: tritontube.GetDedupStatsRequest
+	(*GetDedupStatsResponse)(nil),  // 15: tritontube.GetDedupStatsResponse
+	(*CollectOrphansRequest)(nil),  // 16: tritontube.CollectOrphansRequest
+	(*OrphanFile)(nil),             // 17: tritontube.OrphanFile
+	(*CollectOrphansResponse)(nil), // 18: tritontube.CollectOrphansResponse
 }
 var file_proto_admin_proto_depIdxs = []int32{
-	0, // 0: tritontube.VideoContentAdminService.AddNode:input_type -> tritontube.AddNodeRequest
-	2, // 1: tritontube.VideoContentAdminService.RemoveNode:input_type -> tritontube.RemoveNodeRequest
-	4, // 2: tritontube.VideoContentAdminService.ListNodes:input_type -> tritontube.ListNodesRequest
-	1, // 3: tritontube.VideoContentAdminService.AddNode:output_type -> tritontube.AddNodeResponse
-	3, // 4: tritontube.VideoContentAdminService.RemoveNode:output_type -> tritontube.RemoveNodeResponse
-	5, // 5: tritontube.VideoContentAdminService.ListNodes:output_type -> tritontube.ListNodesResponse
-	3, // [3:6] is the sub-list for method output_type
-	0, // [0:3] is the sub-list for method input_type
-	0, // [0:0] is the sub-list for extension type_name
-	0, // [0:0] is the sub-list for extension extendee
-	0, // [0:0] is the sub-list for field type_name
+	4,  // 0: tritontube.AddNodeResponse.planned_moves:type_name -> tritontube.PlannedMove
+	4,  // 1: tritontube.RemoveNodeResponse.planned_moves:type_name -> tritontube.PlannedMove
+	4,  // 2: tritontube.DrainNodeResponse.planned_moves:type_name -> tritontube.PlannedMove
+	4,  // 3: tritontube.UndrainNodeResponse.planned_moves:type_name -> tritontube.PlannedMove
+	10, // 4: tritontube.ListNodesResponse.node_info:type_name -> tritontube.NodeInfo
+	17, // 5: tritontube.CollectOrphansResponse.orphans:type_name -> tritontube.OrphanFile
+	0,  // 6: tritontube.VideoContentAdminService.AddNode:input_type -> tritontube.AddNodeRequest
+	2,  // 7: tritontube.VideoContentAdminService.RemoveNode:input_type -> tritontube.RemoveNodeRequest
+	9,  // 8: tritontube.VideoContentAdminService.ListNodes:input_type -> tritontube.ListNodesRequest
+	5,  // 9: tritontube.VideoContentAdminService.DrainNode:input_type -> tritontube.DrainNodeRequest
+	7,  // 10: tritontube.VideoContentAdminService.UndrainNode:input_type -> tritontube.UndrainNodeRequest
+	12, // 11: tritontube.VideoContentAdminService.GetMigration:input_type -> tritontube.GetMigrationRequest
+	12, // 12: tritontube.VideoContentAdminService.WatchMigration:input_type -> tritontube.GetMigrationRequest
+	14, // 13: tritontube.DedupAdminService.GetDedupStats:input_type -> tritontube.GetDedupStatsRequest
+	16, // 14: tritontube.OrphanAdminService.CollectOrphans:input_type -> tritontube.CollectOrphansRequest
+	1,  // 15: tritontube.VideoContentAdminService.AddNode:output_type -> tritontube.AddNodeResponse
+	3,  // 16: tritontube.VideoContentAdminService.RemoveNode:output_type -> tritontube.RemoveNodeResponse
+	11, // 17: tritontube.VideoContentAdminService.ListNodes:output_type -> tritontube.ListNodesResponse
+	6,  // 18: tritontube.VideoContentAdminService.DrainNode:output_type -> tritontube.DrainNodeResponse
+	8,  // 19: tritontube.VideoContentAdminService.UndrainNode:output_type -> tritontube.UndrainNodeResponse
+	13, // 20: tritontube.VideoContentAdminService.GetMigration:output_type -> tritontube.GetMigrationResponse
+	13, // 21: tritontube.VideoContentAdminService.WatchMigration:output_type -> tritontube.GetMigrationResponse
+	15, // 22: tritontube.DedupAdminService.GetDedupStats:output_type -> tritontube.GetDedupStatsResponse
+	18, // 23: tritontube.OrphanAdminService.CollectOrphans:output_type -> tritontube.CollectOrphansResponse
+	15, // [15:24] is the sub-list for method output_type
+	6,  // [6:15] is the sub-list for method input_type
+	6,  // [6:6] is the sub-list for extension type_name
+	6,  // [6:6] is the sub-list for extension extendee
+	0,  // [0:6] is the sub-list for field type_name
 }
 
 func init() { file_proto_admin_proto_init() }
@@ -346,9 +1478,9 @@ func file_proto_admin_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_admin_proto_rawDesc), len(file_proto_admin_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   6,
+			NumMessages:   19,
 			NumExtensions: 0,
-			NumServices:   1,
+			NumServices:   3,
 		},
 		GoTypes:           file_proto_admin_proto_goTypes,
 		DependencyIndexes: file_proto_admin_proto_depIdxs,
@@ -19,9 +19,13 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	VideoContentAdminService_AddNode_FullMethodName    = "/tritontube.VideoContentAdminService/AddNode"
-	VideoContentAdminService_RemoveNode_FullMethodName = "/tritontube.VideoContentAdminService/RemoveNode"
-	VideoContentAdminService_ListNodes_FullMethodName  = "/tritontube.VideoContentAdminService/ListNodes"
+	VideoContentAdminService_AddNode_FullMethodName        = "/tritontube.VideoContentAdminService/AddNode"
+	VideoContentAdminService_RemoveNode_FullMethodName     = "/tritontube.VideoContentAdminService/RemoveNode"
+	VideoContentAdminService_ListNodes_FullMethodName      = "/tritontube.VideoContentAdminService/ListNodes"
+	VideoContentAdminService_DrainNode_FullMethodName      = "/tritontube.VideoContentAdminService/DrainNode"
+	VideoContentAdminService_UndrainNode_FullMethodName    = "/tritontube.VideoContentAdminService/UndrainNode"
+	VideoContentAdminService_GetMigration_FullMethodName   = "/tritontube.VideoContentAdminService/GetMigration"
+	VideoContentAdminService_WatchMigration_FullMethodName = "/tritontube.VideoContentAdminService/WatchMigration"
 )
 
 // VideoContentAdminServiceClient is the client API for VideoContentAdminService service.
@@ -31,6 +35,14 @@ type VideoContentAdminServiceClient interface {
 	AddNode(ctx context.Context, in *AddNodeRequest, opts ...grpc.CallOption) (*AddNodeResponse, error)
 	RemoveNode(ctx context.Context, in *RemoveNodeRequest, opts ...grpc.CallOption) (*RemoveNodeResponse, error)
 	ListNodes(ctx context.Context, in *ListNodesRequest, opts ...grpc.CallOption) (*ListNodesResponse, error)
+	// DrainNode stops writes to a node and copies its files away. The node
+	// keeps serving reads until every file is verified on its new owner.
+	DrainNode(ctx context.Context, in *DrainNodeRequest, opts ...grpc.CallOption) (*DrainNodeResponse, error)
+	// UndrainNode makes a draining or drained node active again.
+	UndrainNode(ctx context.Context, in *UndrainNodeRequest, opts ...grpc.CallOption) (*UndrainNodeResponse, error)
+	GetMigration(ctx context.Context, in *GetMigrationRequest, opts ...grpc.CallOption) (*GetMigrationResponse, error)
+	// WatchMigration streams the migration's progress until it finishes.
+	WatchMigration(ctx context.Context, in *GetMigrationRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GetMigrationResponse], error)
 }
 
 type videoContentAdminServiceClient struct {
@@ -71,6 +83,55 @@ func (c *videoContentAdminServiceClient) ListNodes(ctx context.Context, in *List
 	return out, nil
 }
 
+func (c *videoContentAdminServiceClient) DrainNode(ctx context.Context, in *DrainNodeRequest, opts ...grpc.CallOption) (*DrainNodeResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(DrainNodeResponse)
+	err := c.cc.Invoke(ctx, VideoContentAdminService_DrainNode_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *videoContentAdminServiceClient) UndrainNode(ctx context.Context, in *UndrainNodeRequest, opts ...grpc.CallOption) (*UndrainNodeResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UndrainNodeResponse)
+	err := c.cc.Invoke(ctx, VideoContentAdminService_UndrainNode_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *videoContentAdminServiceClient) GetMigration(ctx context.Context, in *GetMigrationRequest, opts ...grpc.CallOption) (*GetMigrationResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetMigrationResponse)
+	err := c.cc.Invoke(ctx, VideoContentAdminService_GetMigration_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *videoContentAdminServiceClient) WatchMigration(ctx context.Context, in *GetMigrationRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[GetMigrationResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &VideoContentAdminService_ServiceDesc.Streams[0], VideoContentAdminService_WatchMigration_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[GetMigrationRequest, GetMigrationResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type VideoContentAdminService_WatchMigrationClient = grpc.ServerStreamingClient[GetMigrationResponse]
+
 // VideoContentAdminServiceServer is the server API for VideoContentAdminService service.
 // All implementations must embed UnimplementedVideoContentAdminServiceServer
 // for forward compatibility.
@@ -78,6 +139,14 @@ type VideoContentAdminServiceServer interface {
 	AddNode(context.Context, *AddNodeRequest) (*AddNodeResponse, error)
 	RemoveNode(context.Context, *RemoveNodeRequest) (*RemoveNodeResponse, error)
 	ListNodes(context.Context, *ListNodesRequest) (*ListNodesResponse, error)
+	// DrainNode stops writes to a node and copies its files away. The node
+	// keeps serving reads until every file is verified on its new owner.
+	DrainNode(context.Context, *DrainNodeRequest) (*DrainNodeResponse, error)
+	// UndrainNode makes a draining or drained node active again.
+	UndrainNode(context.Context, *UndrainNodeRequest) (*UndrainNodeResponse, error)
+	GetMigration(context.Context, *GetMigrationRequest) (*GetMigrationResponse, error)
+	// WatchMigration streams the migration's progress until it finishes.
+	WatchMigration(*GetMigrationRequest, grpc.ServerStreamingServer[GetMigrationResponse]) error
 	mustEmbedUnimplementedVideoContentAdminServiceServer()
 }
 
@@ -97,6 +166,18 @@ func (UnimplementedVideoContentAdminServiceServer) RemoveNode(context.Context, *
 func (UnimplementedVideoContentAdminServiceServer) ListNodes(context.Context, *ListNodesRequest) (*ListNodesResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ListNodes not implemented")
 }
+func (UnimplementedVideoContentAdminServiceServer) DrainNode(context.Context, *DrainNodeRequest) (*DrainNodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DrainNode not implemented")
+}
+func (UnimplementedVideoContentAdminServiceServer) UndrainNode(context.Context, *UndrainNodeRequest) (*UndrainNodeResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UndrainNode not implemented")
+}
+func (UnimplementedVideoContentAdminServiceServer) GetMigration(context.Context, *GetMigrationRequest) (*GetMigrationResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetMigration not implemented")
+}
+func (UnimplementedVideoContentAdminServiceServer) WatchMigration(*GetMigrationRequest, grpc.ServerStreamingServer[GetMigrationResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method WatchMigration not implemented")
+}
 func (UnimplementedVideoContentAdminServiceServer) mustEmbedUnimplementedVideoContentAdminServiceServer() {
 }
 func (UnimplementedVideoContentAdminServiceServer) testEmbeddedByValue() {}
@@ -173,6 +254,71 @@ func _VideoContentAdminService_ListNodes_Handler(srv interface{}, ctx context.Co
 	return interceptor(ctx, in, info, handler)
 }
 
+func _VideoContentAdminService_DrainNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DrainNodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideoContentAdminServiceServer).DrainNode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VideoContentAdminService_DrainNode_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideoContentAdminServiceServer).DrainNode(ctx, req.(*DrainNodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VideoContentAdminService_UndrainNode_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UndrainNodeRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideoContentAdminServiceServer).UndrainNode(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VideoContentAdminService_UndrainNode_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideoContentAdminServiceServer).UndrainNode(ctx, req.(*UndrainNodeRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VideoContentAdminService_GetMigration_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetMigrationRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(VideoContentAdminServiceServer).GetMigration(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: VideoContentAdminService_GetMigration_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(VideoContentAdminServiceServer).GetMigration(ctx, req.(*GetMigrationRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _VideoContentAdminService_WatchMigration_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(GetMigrationRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(VideoContentAdminServiceServer).WatchMigration(m, &grpc.GenericServerStream[GetMigrationRequest, GetMigrationResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type VideoContentAdminService_WatchMigrationServer = grpc.ServerStreamingServer[GetMigrationResponse]
+
 // VideoContentAdminService_ServiceDesc is the grpc.ServiceDesc for VideoContentAdminService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -192,6 +338,238 @@ var VideoContentAdminService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ListNodes",
 			Handler:    _VideoContentAdminService_ListNodes_Handler,
 		},
+		{
+			MethodName: "DrainNode",
+			Handler:    _VideoContentAdminService_DrainNode_Handler,
+		},
+		{
+			MethodName: "UndrainNode",
+			Handler:    _VideoContentAdminService_UndrainNode_Handler,
+		},
+		{
+			MethodName: "GetMigration",
+			Handler:    _VideoContentAdminService_GetMigration_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchMigration",
+			Handler:       _VideoContentAdminService_WatchMigration_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "proto/admin.proto",
+}
+
+const (
+	DedupAdminService_GetDedupStats_FullMethodName = "/tritontube.DedupAdminService/GetDedupStats"
+)
+
+// DedupAdminServiceClient is the client API for DedupAdminService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// DedupAdminService reports on a web server's deduplicated segment store.
+type DedupAdminServiceClient interface {
+	GetDedupStats(ctx context.Context, in *GetDedupStatsRequest, opts ...grpc.CallOption) (*GetDedupStatsResponse, error)
+}
+
+type dedupAdminServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDedupAdminServiceClient(cc grpc.ClientConnInterface) DedupAdminServiceClient {
+	return &dedupAdminServiceClient{cc}
+}
+
+func (c *dedupAdminServiceClient) GetDedupStats(ctx context.Context, in *GetDedupStatsRequest, opts ...grpc.CallOption) (*GetDedupStatsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(GetDedupStatsResponse)
+	err := c.cc.Invoke(ctx, DedupAdminService_GetDedupStats_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DedupAdminServiceServer is the server API for DedupAdminService service.
+// All implementations must embed UnimplementedDedupAdminServiceServer
+// for forward compatibility.
+//
+// DedupAdminService reports on a web server's deduplicated segment store.
+type DedupAdminServiceServer interface {
+	GetDedupStats(context.Context, *GetDedupStatsRequest) (*GetDedupStatsResponse, error)
+	mustEmbedUnimplementedDedupAdminServiceServer()
+}
+
+// UnimplementedDedupAdminServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedDedupAdminServiceServer struct{}
+
+func (UnimplementedDedupAdminServiceServer) GetDedupStats(context.Context, *GetDedupStatsRequest) (*GetDedupStatsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDedupStats not implemented")
+}
+func (UnimplementedDedupAdminServiceServer) mustEmbedUnimplementedDedupAdminServiceServer() {}
+func (UnimplementedDedupAdminServiceServer) testEmbeddedByValue()                           {}
+
+// UnsafeDedupAdminServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DedupAdminServiceServer will
+// result in compilation errors.
+type UnsafeDedupAdminServiceServer interface {
+	mustEmbedUnimplementedDedupAdminServiceServer()
+}
+
+func RegisterDedupAdminServiceServer(s grpc.ServiceRegistrar, srv DedupAdminServiceServer) {
+	// If the following call pancis, it indicates UnimplementedDedupAdminServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&DedupAdminService_ServiceDesc, srv)
+}
+
+func _DedupAdminService_GetDedupStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetDedupStatsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DedupAdminServiceServer).GetDedupStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DedupAdminService_GetDedupStats_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DedupAdminServiceServer).GetDedupStats(ctx, req.(*GetDedupStatsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// DedupAdminService_ServiceDesc is the grpc.ServiceDesc for DedupAdminService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var DedupAdminService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tritontube.DedupAdminService",
+	HandlerType: (*DedupAdminServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetDedupStats",
+			Handler:    _DedupAdminService_GetDedupStats_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/admin.proto",
+}
+
+const (
+	OrphanAdminService_CollectOrphans_FullMethodName = "/tritontube.OrphanAdminService/CollectOrphans"
+)
+
+// OrphanAdminServiceClient is the client API for OrphanAdminService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// OrphanAdminService cleans up content that no video's metadata refers to,
+// such as the segments of an upload that failed halfway.
+type OrphanAdminServiceClient interface {
+	CollectOrphans(ctx context.Context, in *CollectOrphansRequest, opts ...grpc.CallOption) (*CollectOrphansResponse, error)
+}
+
+type orphanAdminServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewOrphanAdminServiceClient(cc grpc.ClientConnInterface) OrphanAdminServiceClient {
+	return &orphanAdminServiceClient{cc}
+}
+
+func (c *orphanAdminServiceClient) CollectOrphans(ctx context.Context, in *CollectOrphansRequest, opts ...grpc.CallOption) (*CollectOrphansResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(CollectOrphansResponse)
+	err := c.cc.Invoke(ctx, OrphanAdminService_CollectOrphans_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// OrphanAdminServiceServer is the server API for OrphanAdminService service.
+// All implementations must embed UnimplementedOrphanAdminServiceServer
+// for forward compatibility.
+//
+// OrphanAdminService cleans up content that no video's metadata refers to,
+// such as the segments of an upload that failed halfway.
+type OrphanAdminServiceServer interface {
+	CollectOrphans(context.Context, *CollectOrphansRequest) (*CollectOrphansResponse, error)
+	mustEmbedUnimplementedOrphanAdminServiceServer()
+}
+
+// UnimplementedOrphanAdminServiceServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedOrphanAdminServiceServer struct{}
+
+func (UnimplementedOrphanAdminServiceServer) CollectOrphans(context.Context, *CollectOrphansRequest) (*CollectOrphansResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CollectOrphans not implemented")
+}
+func (UnimplementedOrphanAdminServiceServer) mustEmbedUnimplementedOrphanAdminServiceServer() {}
+func (UnimplementedOrphanAdminServiceServer) testEmbeddedByValue()                            {}
+
+// UnsafeOrphanAdminServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to OrphanAdminServiceServer will
+// result in compilation errors.
+type UnsafeOrphanAdminServiceServer interface {
+	mustEmbedUnimplementedOrphanAdminServiceServer()
+}
+
+func RegisterOrphanAdminServiceServer(s grpc.ServiceRegistrar, srv OrphanAdminServiceServer) {
+	// If the following call pancis, it indicates UnimplementedOrphanAdminServiceServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&OrphanAdminService_ServiceDesc, srv)
+}
+
+func _OrphanAdminService_CollectOrphans_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CollectOrphansRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(OrphanAdminServiceServer).CollectOrphans(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: OrphanAdminService_CollectOrphans_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(OrphanAdminServiceServer).CollectOrphans(ctx, req.(*CollectOrphansRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// OrphanAdminService_ServiceDesc is the grpc.ServiceDesc for OrphanAdminService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var OrphanAdminService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "tritontube.OrphanAdminService",
+	HandlerType: (*OrphanAdminServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "CollectOrphans",
+			Handler:    _OrphanAdminService_CollectOrphans_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/admin.proto",
@@ -22,10 +22,13 @@ const (
 )
 
 type WriteRequest struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	VideoId       string                 `protobuf:"bytes,1,opt,name=videoId,proto3" json:"videoId,omitempty"`
-	Filename      string                 `protobuf:"bytes,2,opt,name=filename,proto3" json:"filename,omitempty"`
-	Content       []byte                 `protobuf:"bytes,3,opt,name=content,proto3" json:"content,omitempty"`
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	VideoId  string                 `protobuf:"bytes,1,opt,name=videoId,proto3" json:"videoId,omitempty"`
+	Filename string                 `protobuf:"bytes,2,opt,name=filename,proto3" json:"filename,omitempty"`
+	Content  []byte                 `protobuf:"bytes,3,opt,name=content,proto3" json:"content,omitempty"`
+	// SHA-256 of content as the sender computed it. The node refuses the
+	// write if the bytes it received do not match; empty skips the check.
+	Sha256        []byte `protobuf:"bytes,4,opt,name=sha256,proto3" json:"sha256,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -81,6 +84,13 @@ func (x *WriteRequest) GetContent() []byte {
 	return nil
 }
 
+func (x *WriteRequest) GetSha256() []byte {
+	if x != nil {
+		return x.Sha256
+	}
+	return nil
+}
+
 type ReadRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	VideoId       string                 `protobuf:"bytes,1,opt,name=videoId,proto3" json:"videoId,omitempty"`
@@ -178,9 +188,11 @@ func (x *WriteResponse) GetStatus() string {
 }
 
 type ReadResponse struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	Status        string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
-	Content       []byte                 `protobuf:"bytes,2,opt,name=content,proto3" json:"content,omitempty"`
+	state   protoimpl.MessageState `protogen:"open.v1"`
+	Status  string                 `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	Content []byte                 `protobuf:"bytes,2,opt,name=content,proto3" json:"content,omitempty"`
+	// SHA-256 of content, recorded when the file was written.
+	Sha256        []byte `protobuf:"bytes,3,opt,name=sha256,proto3" json:"sha256,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -229,6 +241,13 @@ func (x *ReadResponse) GetContent() []byte {
 	return nil
 }
 
+func (x *ReadResponse) GetSha256() []byte {
+	if x != nil {
+		return x.Sha256
+	}
+	return nil
+}
+
 type ListRequest struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	unknownFields protoimpl.UnknownFields
@@ -266,9 +285,12 @@ func (*ListRequest) Descriptor() ([]byte, []int) {
 }
 
 type File struct {
-	state         protoimpl.MessageState `protogen:"open.v1"`
-	VideoId       string                 `protobuf:"bytes,1,opt,name=videoId,proto3" json:"videoId,omitempty"`
-	Filename      string                 `protobuf:"bytes,2,opt,name=filename,proto3" json:"filename,omitempty"`
+	state    protoimpl.MessageState `protogen:"open.v1"`
+	VideoId  string                 `protobuf:"bytes,1,opt,name=videoId,proto3" json:"videoId,omitempty"`
+	Filename string                 `protobuf:"bytes,2,opt,name=filename,proto3" json:"filename,omitempty"`
+	Size     int64                  `protobuf:"varint,3,opt,name=size,proto3" json:"size,omitempty"`
+	// Last modification, in Unix seconds.
+	ModifiedUnix  int64 `protobuf:"varint,4,opt,name=modifiedUnix,proto3" json:"modifiedUnix,omitempty"`
 	unknownFields protoimpl.UnknownFields
 	sizeCache     protoimpl.SizeCache
 }
@@ -317,6 +339,20 @@ func (x *File) GetFilename() string {
 	return ""
 }
 
+func (x *File) GetSize() int64 {
+	if x != nil {
+		return x.Size
+	}
+	return 0
+}
+
+func (x *File) GetModifiedUnix() int64 {
+	if x != nil {
+		return x.ModifiedUnix
+	}
+	return 0
+}
+
 type ListResponse struct {
 	state         protoimpl.MessageState `protogen:"open.v1"`
 	FilesList     []*File                `protobuf:"bytes,1,rep,name=filesList,proto3" json:"filesList,omitempty"`
@@ -537,27 +573,147 @@ func (x *DeleteResponse) GetStatus() string {
 	return ""
 }
 
+type StatRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatRequest) Reset() {
+	*x = StatRequest{}
+	mi := &file_proto_storage_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatRequest) ProtoMessage() {}
+
+func (x *StatRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_storage_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatRequest.ProtoReflect.Descriptor instead.
+func (*StatRequest) Descriptor() ([]byte, []int) {
+	return file_proto_storage_proto_rawDescGZIP(), []int{11}
+}
+
+// StatResponse reports the node's usage. Byte counts are -1 when unknown.
+type StatResponse struct {
+	state     protoimpl.MessageState `protogen:"open.v1"`
+	UsedBytes int64                  `protobuf:"varint,1,opt,name=usedBytes,proto3" json:"usedBytes,omitempty"`
+	FileCount int64                  `protobuf:"varint,2,opt,name=fileCount,proto3" json:"fileCount,omitempty"`
+	// Space left on the disk holding the storage directory.
+	FreeBytes int64 `protobuf:"varint,3,opt,name=freeBytes,proto3" json:"freeBytes,omitempty"`
+	// Configured limit on usedBytes; 0 means no quota.
+	QuotaBytes int64 `protobuf:"varint,4,opt,name=quotaBytes,proto3" json:"quotaBytes,omitempty"`
+	// Size of the disk holding the storage directory.
+	DiskBytes     int64 `protobuf:"varint,5,opt,name=diskBytes,proto3" json:"diskBytes,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatResponse) Reset() {
+	*x = StatResponse{}
+	mi := &file_proto_storage_proto_msgTypes[12]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatResponse) ProtoMessage() {}
+
+func (x *StatResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_proto_storage_proto_msgTypes[12]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatResponse.ProtoReflect.Descriptor instead.
+func (*StatResponse) Descriptor() ([]byte, []int) {
+	return file_proto_storage_proto_rawDescGZIP(), []int{12}
+}
+
+func (x *StatResponse) GetUsedBytes() int64 {
+	if x != nil {
+		return x.UsedBytes
+	}
+	return 0
+}
+
+func (x *StatResponse) GetFileCount() int64 {
+	if x != nil {
+		return x.FileCount
+	}
+	return 0
+}
+
+func (x *StatResponse) GetFreeBytes() int64 {
+	if x != nil {
+		return x.FreeBytes
+	}
+	return 0
+}
+
+func (x *StatResponse) GetQuotaBytes() int64 {
+	if x != nil {
+		return x.QuotaBytes
+	}
+	return 0
+}
+
+func (x *StatResponse) GetDiskBytes() int64 {
+	if x != nil {
+		return x.DiskBytes
+	}
+	return 0
+}
+
 var File_proto_storage_proto protoreflect.FileDescriptor
 
 const file_proto_storage_proto_rawDesc = "" +
 	"\n" +
-	"\x13proto/storage.proto\x12\astorage\"^\n" +
+	"\x13proto/storage.proto\x12\astorage\"v\n" +
 	"\fWriteRequest\x12\x18\n" +
 	"\avideoId\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
 	"\bfilename\x18\x02 \x01(\tR\bfilename\x12\x18\n" +
-	"\acontent\x18\x03 \x01(\fR\acontent\"C\n" +
+	"\acontent\x18\x03 \x01(\fR\acontent\x12\x16\n" +
+	"\x06sha256\x18\x04 \x01(\fR\x06sha256\"C\n" +
 	"\vReadRequest\x12\x18\n" +
 	"\avideoId\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
 	"\bfilename\x18\x02 \x01(\tR\bfilename\"'\n" +
 	"\rWriteResponse\x12\x16\n" +
-	"\x06status\x18\x01 \x01(\tR\x06status\"@\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\"X\n" +
 	"\fReadResponse\x12\x16\n" +
 	"\x06status\x18\x01 \x01(\tR\x06status\x12\x18\n" +
-	"\acontent\x18\x02 \x01(\fR\acontent\"\r\n" +
-	"\vListRequest\"<\n" +
+	"\acontent\x18\x02 \x01(\fR\acontent\x12\x16\n" +
+	"\x06sha256\x18\x03 \x01(\fR\x06sha256\"\r\n" +
+	"\vListRequest\"t\n" +
 	"\x04File\x12\x18\n" +
 	"\avideoId\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
-	"\bfilename\x18\x02 \x01(\tR\bfilename\";\n" +
+	"\bfilename\x18\x02 \x01(\tR\bfilename\x12\x12\n" +
+	"\x04size\x18\x03 \x01(\x03R\x04size\x12\"\n" +
+	"\fmodifiedUnix\x18\x04 \x01(\x03R\fmodifiedUnix\";\n" +
 	"\fListResponse\x12+\n" +
 	"\tfilesList\x18\x01 \x03(\v2\r.storage.FileR\tfilesList\"\x0f\n" +
 	"\rRemoveRequest\"(\n" +
@@ -567,14 +723,24 @@ const file_proto_storage_proto_rawDesc = "" +
 	"\avideoId\x18\x01 \x01(\tR\avideoId\x12\x1a\n" +
 	"\bfilename\x18\x02 \x01(\tR\bfilename\"(\n" +
 	"\x0eDeleteResponse\x12\x16\n" +
-	"\x06status\x18\x01 \x01(\tR\x06status2\xc4\x02\n" +
+	"\x06status\x18\x01 \x01(\tR\x06status\"\r\n" +
+	"\vStatRequest\"\xa6\x01\n" +
+	"\fStatResponse\x12\x1c\n" +
+	"\tusedBytes\x18\x01 \x01(\x03R\tusedBytes\x12\x1c\n" +
+	"\tfileCount\x18\x02 \x01(\x03R\tfileCount\x12\x1c\n" +
+	"\tfreeBytes\x18\x03 \x01(\x03R\tfreeBytes\x12\x1e\n" +
+	"\n" +
+	"quotaBytes\x18\x04 \x01(\x03R\n" +
+	"quotaBytes\x12\x1c\n" +
+	"\tdiskBytes\x18\x05 \x01(\x03R\tdiskBytes2\xf9\x02\n" +
 	"\x0eStorageService\x12;\n" +
 	"\n" +
 	"WriteVideo\x12\x15.storage.WriteRequest\x1a\x16.storage.WriteResponse\x128\n" +
 	"\tReadVideo\x12\x14.storage.ReadRequest\x1a\x15.storage.ReadResponse\x128\n" +
 	"\tListFiles\x12\x14.storage.ListRequest\x1a\x15.storage.ListResponse\x12A\n" +
 	"\x0eRemoveAllFiles\x12\x16.storage.RemoveRequest\x1a\x17.storage.RemoveResponse\x12>\n" +
-	"\vDeleteVideo\x12\x16.storage.DeleteRequest\x1a\x17.storage.DeleteResponseB\x16Z\x14internal/proto;protob\x06proto3"
+	"\vDeleteVideo\x12\x16.storage.DeleteRequest\x1a\x17.storage.DeleteResponse\x123\n" +
+	"\x04Stat\x12\x14.storage.StatRequest\x1a\x15.storage.StatResponseB\x16Z\x14internal/proto;protob\x06proto3"
 
 var (
 	file_proto_storage_proto_rawDescOnce sync.Once
@@ -588,7 +754,7 @@ func file_proto_storage_proto_rawDescGZIP() []byte {
 	return file_proto_storage_proto_rawDescData
 }
 
-var file_proto_storage_proto_msgTypes = make([]protoimpl.MessageInfo, 11)
+var file_proto_storage_proto_msgTypes = make([]protoimpl.MessageInfo, 13)
 var file_proto_storage_proto_goTypes = []any{
 	(*WriteRequest)(nil),   // 0: storage.WriteRequest
 	(*ReadRequest)(nil),    // 1: storage.ReadRequest
@@ -601,6 +767,8 @@ var file_proto_storage_proto_goTypes = []any{
 	(*RemoveResponse)(nil), // 8: storage.RemoveResponse
 	(*DeleteRequest)(nil),  // 9: storage.DeleteRequest
 	(*DeleteResponse)(nil), // 10: storage.DeleteResponse
+	(*StatRequest)(nil),    // 11: storage.StatRequest
+	(*StatResponse)(nil),   // 12: storage.StatResponse
 }
 var file_proto_storage_proto_depIdxs = []int32{
 	5,  // 0: storage.ListResponse.filesList:type_name -> storage.File
@@ -609,13 +777,15 @@ var file_proto_storage_proto_depIdxs = []int32{
 	4,  // 3: storage.StorageService.ListFiles:input_type -> storage.ListRequest
 	7,  // 4: storage.StorageService.RemoveAllFiles:input_type -> storage.RemoveRequest
 	9,  // 5: storage.StorageService.DeleteVideo:input_type -> storage.DeleteRequest
-	2,  // 6: storage.StorageService.WriteVideo:output_type -> storage.WriteResponse
-	3,  // 7: storage.StorageService.ReadVideo:output_type -> storage.ReadResponse
-	6,  // 8: storage.StorageService.ListFiles:output_type -> storage.ListResponse
-	8,  // 9: storage.StorageService.RemoveAllFiles:output_type -> storage.RemoveResponse
-	10, // 10: storage.StorageService.DeleteVideo:output_type -> storage.DeleteResponse
-	6,  // [6:11] is the sub-list for method output_type
-	1,  // [1:6] is the sub-list for method input_type
+	11, // 6: storage.StorageService.Stat:input_type -> storage.StatRequest
+	2,  // 7: storage.StorageService.WriteVideo:output_type -> storage.WriteResponse
+	3,  // 8: storage.StorageService.ReadVideo:output_type -> storage.ReadResponse
+	6,  // 9: storage.StorageService.ListFiles:output_type -> storage.ListResponse
+	8,  // 10: storage.StorageService.RemoveAllFiles:output_type -> storage.RemoveResponse
+	10, // 11: storage.StorageService.DeleteVideo:output_type -> storage.DeleteResponse
+	12, // 12: storage.StorageService.Stat:output_type -> storage.StatResponse
+	7,  // [7:13] is the sub-list for method output_type
+	1,  // [1:7] is the sub-list for method input_type
 	1,  // [1:1] is the sub-list for extension type_name
 	1,  // [1:1] is the sub-list for extension extendee
 	0,  // [0:1] is the sub-list for field type_name
@@ -632,7 +802,7 @@ func file_proto_storage_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: unsafe.Slice(unsafe.StringData(file_proto_storage_proto_rawDesc), len(file_proto_storage_proto_rawDesc)),
 			NumEnums:      0,
-			NumMessages:   11,
+			NumMessages:   13,
 			NumExtensions: 0,
 			NumServices:   1,
 		},
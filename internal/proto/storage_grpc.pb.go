@@ -24,6 +24,7 @@ const (
 	StorageService_ListFiles_FullMethodName      = "/storage.StorageService/ListFiles"
 	StorageService_RemoveAllFiles_FullMethodName = "/storage.StorageService/RemoveAllFiles"
 	StorageService_DeleteVideo_FullMethodName    = "/storage.StorageService/DeleteVideo"
+	StorageService_Stat_FullMethodName           = "/storage.StorageService/Stat"
 )
 
 // StorageServiceClient is the client API for StorageService service.
@@ -35,6 +36,7 @@ type StorageServiceClient interface {
 	ListFiles(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResponse, error)
 	RemoveAllFiles(ctx context.Context, in *RemoveRequest, opts ...grpc.CallOption) (*RemoveResponse, error)
 	DeleteVideo(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*DeleteResponse, error)
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error)
 }
 
 type storageServiceClient struct {
@@ -95,6 +97,16 @@ func (c *storageServiceClient) DeleteVideo(ctx context.Context, in *DeleteReques
 	return out, nil
 }
 
+func (c *storageServiceClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*StatResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(StatResponse)
+	err := c.cc.Invoke(ctx, StorageService_Stat_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // StorageServiceServer is the server API for StorageService service.
 // All implementations must embed UnimplementedStorageServiceServer
 // for forward compatibility.
@@ -104,6 +116,7 @@ type StorageServiceServer interface {
 	ListFiles(context.Context, *ListRequest) (*ListResponse, error)
 	RemoveAllFiles(context.Context, *RemoveRequest) (*RemoveResponse, error)
 	DeleteVideo(context.Context, *DeleteRequest) (*DeleteResponse, error)
+	Stat(context.Context, *StatRequest) (*StatResponse, error)
 	mustEmbedUnimplementedStorageServiceServer()
 }
 
@@ -129,6 +142,9 @@ func (UnimplementedStorageServiceServer) RemoveAllFiles(context.Context, *Remove
 func (UnimplementedStorageServiceServer) DeleteVideo(context.Context, *DeleteRequest) (*DeleteResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method DeleteVideo not implemented")
 }
+func (UnimplementedStorageServiceServer) Stat(context.Context, *StatRequest) (*StatResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
 func (UnimplementedStorageServiceServer) mustEmbedUnimplementedStorageServiceServer() {}
 func (UnimplementedStorageServiceServer) testEmbeddedByValue()                        {}
 
@@ -240,6 +256,24 @@ func _StorageService_DeleteVideo_Handler(srv interface{}, ctx context.Context, d
 	return interceptor(ctx, in, info, handler)
 }
 
+func _StorageService_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(StorageServiceServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: StorageService_Stat_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(StorageServiceServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // StorageService_ServiceDesc is the grpc.ServiceDesc for StorageService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -267,6 +301,10 @@ var StorageService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "DeleteVideo",
 			Handler:    _StorageService_DeleteVideo_Handler,
 		},
+		{
+			MethodName: "Stat",
+			Handler:    _StorageService_Stat_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "proto/storage.proto",
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package storage
+
+import "errors"
+
+// diskSpace is not implemented on this platform; only quotas are enforced.
+func diskSpace(dir string) (free, total int64, err error) {
+	return 0, 0, errors.New("disk space is not available on this platform")
+}
@@ -0,0 +1,72 @@
+// Prometheus metrics of a storage node
+
+package storage
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	bytesRead = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tritontube_storage_read_bytes_total",
+		Help: "Bytes of video files served to readers.",
+	})
+	bytesWritten = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tritontube_storage_written_bytes_total",
+		Help: "Bytes of video files written.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(bytesRead, bytesWritten)
+}
+
+// RegisterMetrics exports the disk usage of s, as Stat reports it, to reg.
+func (s *StorageService) RegisterMetrics(reg prometheus.Registerer) error {
+	usage := func(f func() int64) func() float64 {
+		return func() float64 {
+			s.usageMu.Lock()
+			defer s.usageMu.Unlock()
+			return float64(f())
+		}
+	}
+	disk := func(free bool) func() float64 {
+		return func() float64 {
+			f, total, err := diskSpace(s.StorageDirectory)
+			switch {
+			case err != nil:
+				return -1
+			case free:
+				return float64(f)
+			}
+			return float64(total)
+		}
+	}
+	for _, c := range []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "tritontube_storage_used_bytes",
+			Help: "Bytes of video files stored.",
+		}, usage(func() int64 { return s.used })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "tritontube_storage_files",
+			Help: "Video files stored.",
+		}, usage(func() int64 { return s.files })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "tritontube_storage_quota_bytes",
+			Help: "Bytes the node may store; 0 means no limit.",
+		}, usage(func() int64 { return s.Quota })),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "tritontube_storage_disk_free_bytes",
+			Help: "Free bytes on the file system of the storage directory.",
+		}, disk(true)),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "tritontube_storage_disk_bytes",
+			Help: "Size of the file system of the storage directory.",
+		}, disk(false)),
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+// Background verification of stored files against their checksums
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"tritontube/internal/atomicfile"
+	"tritontube/internal/checksum"
+)
+
+// quarantineDir is the directory under the storage directory that corrupted
+// files are moved into. It is hidden from ListFiles, so the web tier sees a
+// quarantined file as missing.
+const quarantineDir = ".quarantine"
+
+// ScrubReport counts what one pass of the scrubber found.
+type ScrubReport struct {
+	Checked int
+	// Corrupt files did not match their sidecar.
+	Corrupt int
+	// Adopted files had no sidecar; one was written from their contents.
+	Adopted int
+	// Quarantined is how many of the corrupt files were moved aside.
+	Quarantined int
+}
+
+// Scrub re-hashes every stored file and compares it with its sidecar.
+// Corrupt files are logged and, if quarantine is set, moved into the
+// quarantine directory along with their sidecar.
+func (s *StorageService) Scrub(ctx context.Context, quarantine bool) (ScrubReport, error) {
+	var report ScrubReport
+	videos, err := os.ReadDir(s.StorageDirectory)
+	if err != nil {
+		return report, fmt.Errorf("read storage directory: %v", err)
+	}
+	for _, v := range videos {
+		if !v.IsDir() || v.Name() == quarantineDir {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(s.StorageDirectory, v.Name()))
+		if err != nil {
+			continue
+		}
+		for _, f := range files {
+			if ctx.Err() != nil {
+				return report, ctx.Err()
+			}
+			if f.IsDir() || checksum.IsSidecar(f.Name()) || atomicfile.IsTemp(f.Name()) {
+				continue
+			}
+			report.Checked++
+			s.scrubFile(ctx, v.Name(), f.Name(), quarantine, &report)
+		}
+	}
+	return report, nil
+}
+
+// scrubFile checks one file, holding its lock so that a write cannot
+// change the file or its sidecar halfway through.
+func (s *StorageService) scrubFile(ctx context.Context, videoId, filename string, quarantine bool, report *ScrubReport) {
+	path := filepath.Join(s.StorageDirectory, videoId, filename)
+	unlock := s.locks.Lock(path)
+	defer unlock()
+	_, err := checksum.ReadSidecar(path)
+	if os.IsNotExist(err) {
+		if s.adopt(path) == nil {
+			report.Adopted++
+		}
+		return
+	}
+	if err == nil {
+		_, _, err = checksum.ReadFile(path)
+	}
+	if err == nil || os.IsNotExist(err) {
+		return
+	}
+	report.Corrupt++
+	slog.ErrorContext(ctx, "scrub: corrupt file", "video", videoId, "file", filename, "err", err)
+	if !quarantine {
+		return
+	}
+	if err := s.quarantine(videoId, filename); err != nil {
+		slog.ErrorContext(ctx, "scrub: quarantine failed", "video", videoId, "file", filename, "err", err)
+		return
+	}
+	report.Quarantined++
+}
+
+// adopt writes a sidecar for a file stored before checksums were kept, or
+// whose write a crash cut off before its sidecar. The caller holds the
+// file's lock, so no write is in progress.
+func (s *StorageService) adopt(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return checksum.WriteSidecar(path, checksum.Sum(data))
+}
+
+// quarantine moves a corrupt file and its sidecar out of the served tree.
+// The caller holds the file's lock.
+func (s *StorageService) quarantine(videoId, filename string) error {
+	path := filepath.Join(s.StorageDirectory, videoId, filename)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(s.StorageDirectory, quarantineDir, videoId)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Rename(path, filepath.Join(dir, filename)); err != nil {
+		return err
+	}
+	s.removed(info.Size())
+	if err := os.Rename(checksum.SidecarPath(path), checksum.SidecarPath(filepath.Join(dir, filename))); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	slog.Info("scrub: quarantined", "video", videoId, "file", filename)
+	return nil
+}
+
+// RunScrubber scrubs the storage directory every interval until ctx is done.
+func (s *StorageService) RunScrubber(ctx context.Context, interval time.Duration, quarantine bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		report, err := s.Scrub(ctx, quarantine)
+		if err != nil {
+			slog.ErrorContext(ctx, "scrub failed", "err", err)
+			continue
+		}
+		slog.InfoContext(ctx, "scrub: done", "checked", report.Checked, "duration", time.Since(start).Round(time.Millisecond),
+			"corrupt", report.Corrupt, "quarantined", report.Quarantined, "adopted", report.Adopted)
+	}
+}
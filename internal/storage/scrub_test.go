@@ -0,0 +1,80 @@
+package storage
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"tritontube/internal/checksum"
+	pb "tritontube/internal/proto"
+)
+
+// TestScrub stores a good file, a file that rots on disk and a file without
+// a sidecar. The scrubber must report the rotten file, quarantine it only
+// when asked to, and adopt the file without a sidecar.
+func TestScrub(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStorageService(dir)
+	ctx := context.Background()
+	for _, name := range []string{"good.m4s", "rotten.m4s"} {
+		content := []byte(name)
+		if _, err := s.WriteVideo(ctx, &pb.WriteRequest{VideoId: "v", Filename: name, Content: content, Sha256: checksum.Sum(content)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, "v", "rotten.m4s"), []byte("rotted.m4s"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "v", "legacy.m4s"), []byte("legacy.m4s"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s = NewStorageService(dir)
+	read := func(name string) error {
+		_, err := s.ReadVideo(ctx, &pb.ReadRequest{VideoId: "v", Filename: name})
+		return err
+	}
+	if err := read("rotten.m4s"); status.Code(err) != codes.DataLoss {
+		t.Fatalf("read rotten file: %v, want DataLoss", err)
+	}
+
+	report, err := s.Scrub(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ScrubReport{Checked: 3, Corrupt: 1, Adopted: 1}); report != want {
+		t.Fatalf("scrub: %+v, want %+v", report, want)
+	}
+	if _, err := checksum.ReadSidecar(filepath.Join(dir, "v", "legacy.m4s")); err != nil {
+		t.Fatalf("adopted file has no sidecar: %v", err)
+	}
+	if err := read("rotten.m4s"); status.Code(err) != codes.DataLoss {
+		t.Fatalf("read rotten file after scrub without quarantine: %v, want DataLoss", err)
+	}
+
+	report, err = s.Scrub(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (ScrubReport{Checked: 3, Corrupt: 1, Quarantined: 1}); report != want {
+		t.Fatalf("scrub with quarantine: %+v, want %+v", report, want)
+	}
+	if err := read("rotten.m4s"); status.Code(err) != codes.NotFound {
+		t.Fatalf("read quarantined file: %v, want NotFound", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, quarantineDir, "v", "rotten.m4s")); err != nil {
+		t.Fatalf("quarantined file: %v", err)
+	}
+	for _, name := range []string{"good.m4s", "legacy.m4s"} {
+		if err := read(name); err != nil {
+			t.Fatalf("read %s: %v", name, err)
+		}
+	}
+	list, _ := s.ListFiles(ctx, &pb.ListRequest{})
+	stat, _ := s.Stat(ctx, &pb.StatRequest{})
+	if len(list.FilesList) != 2 || stat.FileCount != 2 {
+		t.Fatalf("%d files listed, %d counted after quarantine, want 2", len(list.FilesList), stat.FileCount)
+	}
+}
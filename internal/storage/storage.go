@@ -4,60 +4,144 @@ package storage
 
 // Implement a network video content service (server)
 import (
+	"errors"
 	"fmt"
 	"os"
 	"context"
-	"io"
+	"log/slog"
 	"path/filepath"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"tritontube/internal/atomicfile"
+	"tritontube/internal/checksum"
+	"tritontube/internal/keylock"
 	pb "tritontube/internal/proto"
+	"tritontube/internal/videokey"
 )
 
 type StorageService struct {
 	pb.UnimplementedStorageServiceServer
 	StorageDirectory string
+	// Quota caps the bytes stored on this node; 0 means no limit.
+	Quota int64
+
+	usageMu sync.Mutex
+	used    int64
+	files   int64
+
+	// locks holds a lock per stored path. A file and its sidecar change
+	// together under the write lock, so readers and the scrubber never
+	// pair one version of a file with the other's sidecar.
+	locks keylock.Map
 }
 
+// NewStorageService serves the files under directoryPath. It first removes
+// temporary files left by writes that a crash interrupted.
 func NewStorageService(directoryPath string) *StorageService {
-	return &StorageService{StorageDirectory: directoryPath}
+	s := &StorageService{StorageDirectory: directoryPath}
+	if n, err := atomicfile.Sweep(directoryPath); err != nil {
+		slog.Warn("sweep unfinished writes failed", "dir", directoryPath, "err", err)
+	} else if n > 0 {
+		slog.Info("removed unfinished writes", "dir", directoryPath, "files", n)
+	}
+	s.scanUsage()
+	return s
+}
+
+// path returns where a file is stored, failing with InvalidArgument for
+// names that are not valid video keys.
+func (s *StorageService) path(videoId, filename string) (string, error) {
+	k, err := videokey.NewStored(videoId, filename)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+	return k.Path(s.StorageDirectory), nil
 }
 
 func (s *StorageService) WriteVideo(ctx context.Context, req *pb.WriteRequest) (*pb.WriteResponse, error) {
-	videoDir := filepath.Join(s.StorageDirectory, req.VideoId)
+	fullPath, err := s.path(req.VideoId, req.Filename)
+	if err != nil {
+		return &pb.WriteResponse{Status: err.Error()}, err
+	}
+	if checksum.IsSidecar(req.Filename) {
+		err := status.Errorf(codes.InvalidArgument, "filename %q is reserved for checksums", req.Filename)
+		return &pb.WriteResponse{Status: err.Error()}, err
+	}
+	videoDir := filepath.Dir(fullPath)
 	if err := os.MkdirAll(videoDir, os.ModePerm); err != nil {
-		fmt.Printf( "error: %v" , err)
+		slog.ErrorContext(ctx, "create video directory failed", "video", req.VideoId, "err", err)
 		return &pb.WriteResponse{Status: fmt.Sprintf("mkdir fail: %v", err)}, err
 	}
-	fullPath := filepath.Join(videoDir, req.Filename)
-	file, err := os.Create(fullPath)
+	if err := checksum.Verify(req.Content, req.Sha256); err != nil {
+		err = status.Errorf(codes.DataLoss, "%s/%s arrived corrupted: %v", req.VideoId, req.Filename, err)
+		return &pb.WriteResponse{Status: err.Error()}, err
+	}
+	unlock := s.locks.Lock(fullPath)
+	defer unlock()
+	undo, err := s.reserve(fullPath, int64(len(req.Content)))
+	if err != nil {
+		return &pb.WriteResponse{Status: err.Error()}, err
+	}
+	// The new sidecar is ready on disk before anything changes, so a write
+	// that cannot record its checksum fails with the old file untouched.
+	sidecar, err := checksum.PrepareSidecar(fullPath, checksum.Sum(req.Content))
 	if err != nil {
-		fmt.Printf( "Create error %v" , err)
-		return &pb.WriteResponse{Status: fmt.Sprintf("create file error: %v", err)}, err
+		undo()
+		slog.ErrorContext(ctx, "write failed", "video", req.VideoId, "file", req.Filename, "err", err)
+		return &pb.WriteResponse{Status: fmt.Sprintf("write error: %v", err)}, err
+	}
+	// The old sidecar goes next: if we crash before the new one is in
+	// place, the file is only unchecked until the scrubber adopts it,
+	// whereas a sidecar ahead of its data would look like corruption.
+	if err := os.Remove(checksum.SidecarPath(fullPath)); err != nil && !os.IsNotExist(err) {
+		sidecar.Discard()
+		undo()
+		return &pb.WriteResponse{Status: fmt.Sprintf("write error: %v", err)}, err
 	}
-	defer file.Close()
-	_, err = file.Write(req.Content)
+	// Readers see the old file until the new one is complete on disk.
+	err = atomicfile.WriteFile(fullPath, req.Content, 0644)
 	if err != nil {
-		fmt.Printf( "error: %v" , err)
+		sidecar.Discard()
+		undo()
+		slog.ErrorContext(ctx, "write failed", "video", req.VideoId, "file", req.Filename, "err", err)
 		return &pb.WriteResponse{Status: fmt.Sprintf("write error: %v", err)}, err
 	}
+	if err := sidecar.Commit(); err != nil {
+		// The new contents are stored and the old ones are gone, so keep
+		// them; the scrubber adopts a file that has no sidecar.
+		slog.WarnContext(ctx, "write checksum failed", "video", req.VideoId, "file", req.Filename, "err", err)
+	}
+	bytesWritten.Add(float64(len(req.Content)))
 	return &pb.WriteResponse{Status: "ok"}, nil
 }
 
 func (s *StorageService) ReadVideo(ctx context.Context, req *pb.ReadRequest) (*pb.ReadResponse, error) {
-	fullPath := filepath.Join(s.StorageDirectory, req.VideoId, req.Filename)
-	file, err := os.Open(fullPath)
+	fullPath, err := s.path(req.VideoId, req.Filename)
 	if err != nil {
-		fmt.Printf( "Writeerror: %v" , err)
-		return &pb.ReadResponse{Status: fmt.Sprintf("open error: %v", err)}, err
+		return &pb.ReadResponse{Status: err.Error()}, err
+	}
+	unlock := s.locks.RLock(fullPath)
+	content, sum, err := checksum.ReadFile(fullPath)
+	unlock()
+	if os.IsNotExist(err) {
+		err = status.Errorf(codes.NotFound, "%s/%s does not exist", req.VideoId, req.Filename)
+		return &pb.ReadResponse{Status: err.Error()}, err
+	}
+	if errors.Is(err, checksum.ErrMismatch) {
+		slog.ErrorContext(ctx, "corrupt file", "video", req.VideoId, "file", req.Filename, "err", err)
+		err = status.Errorf(codes.DataLoss, "%v", err)
+		return &pb.ReadResponse{Status: err.Error()}, err
 	}
-	defer file.Close()
-	content, err := io.ReadAll(file)
 	if err != nil {
-		fmt.Printf( "Writeerror: %v" , err)
 		return &pb.ReadResponse{Status: fmt.Sprintf("read error: %v", err)}, err
 	}
+	bytesRead.Add(float64(len(content)))
 	return &pb.ReadResponse{
 		Status:  "ok",
 		Content: content,
+		Sha256:  sum,
 	}, nil
 }
 
@@ -69,7 +153,7 @@ func (s *StorageService) ListFiles(ctx context.Context, req *pb.ListRequest) (*p
 		return nil, fmt.Errorf("Read error: %v", err)
 	}
 	for _, d := range storageFolder {
-		if !d.IsDir() {
+		if !d.IsDir() || d.Name() == quarantineDir {
 			continue
 		}
 		videoId := d.Name()
@@ -79,9 +163,18 @@ func (s *StorageService) ListFiles(ctx context.Context, req *pb.ListRequest) (*p
 			continue
 		}
 		for _, f := range fileEntries {
+			if checksum.IsSidecar(f.Name()) || atomicfile.IsTemp(f.Name()) {
+				continue
+			}
+			info, err := f.Info()
+			if err != nil {
+				continue
+			}
 			files = append(files, &pb.File{
-				VideoId:  videoId,
-				Filename: f.Name(),
+				VideoId:      videoId,
+				Filename:     f.Name(),
+				Size:         info.Size(),
+				ModifiedUnix: info.ModTime().Unix(),
 			})
 		}
 	}
@@ -93,6 +186,7 @@ func (s *StorageService) RemoveAllFiles(ctx context.Context, req *pb.RemoveReque
 	if err != nil {
 		return &pb.RemoveResponse{Status: fmt.Sprintf("delete %v", err)}, err
 	}
+	s.scanUsage()
 	err = os.MkdirAll(s.StorageDirectory, os.ModePerm)
 	if err != nil {
 		return &pb.RemoveResponse{Status: fmt.Sprintf("leave dir %v", err)}, err
@@ -101,10 +195,25 @@ func (s *StorageService) RemoveAllFiles(ctx context.Context, req *pb.RemoveReque
 }
 
 func (s *StorageService) DeleteVideo(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
-	fullPath := filepath.Join(s.StorageDirectory, req.VideoId, req.Filename)
-	err := os.Remove(fullPath)
+	fullPath, err := s.path(req.VideoId, req.Filename)
+	if err != nil {
+		return &pb.DeleteResponse{Status: err.Error()}, err
+	}
+	unlock := s.locks.Lock(fullPath)
+	defer unlock()
+	info, err := os.Stat(fullPath)
+	if os.IsNotExist(err) {
+		err = status.Errorf(codes.NotFound, "%s/%s does not exist", req.VideoId, req.Filename)
+		return &pb.DeleteResponse{Status: err.Error()}, err
+	}
+	if err != nil {
+		return &pb.DeleteResponse{Status: fmt.Sprintf("delete error: %v", err)}, err
+	}
+	err = os.Remove(fullPath)
 	if err != nil {
 		return &pb.DeleteResponse{Status: fmt.Sprintf("delete error: %v", err)}, err
 	}
+	os.Remove(checksum.SidecarPath(fullPath))
+	s.removed(info.Size())
 	return &pb.DeleteResponse{Status: "ok"}, nil
 }
\ No newline at end of file
@@ -0,0 +1,153 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"tritontube/internal/atomicfile"
+	"tritontube/internal/checksum"
+	pb "tritontube/internal/proto"
+	"tritontube/internal/videokey"
+	"tritontube/internal/writetest"
+)
+
+func TestWriter(t *testing.T) {
+	dir := writetest.ChildArg()
+	if dir == "" {
+		t.Skip("only runs as the child of TestKillDuringWriteVideo")
+	}
+	s := NewStorageService(dir)
+	v := writetest.Versions()
+	for i := 0; ; i++ {
+		content := v[i%2]
+		req := &pb.WriteRequest{VideoId: "v", Filename: "video.mp4", Content: content, Sha256: checksum.Sum(content)}
+		if _, err := s.WriteVideo(context.Background(), req); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestKillDuringWriteVideo runs TestWriter in a child that overwrites one
+// file in a loop until it is killed, then checks that a restarted node
+// serves one of the two versions and has swept the temporary files.
+func TestKillDuringWriteVideo(t *testing.T) {
+	dir := t.TempDir()
+	s := NewStorageService(dir)
+	req := &pb.WriteRequest{VideoId: "v", Filename: "video.mp4", Content: writetest.Versions()[0]}
+	if _, err := s.WriteVideo(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	writetest.KillLoop(t, "TestWriter", dir, func(round int) {
+		s := NewStorageService(dir)
+		resp, err := s.ReadVideo(context.Background(), &pb.ReadRequest{VideoId: "v", Filename: "video.mp4"})
+		if err != nil {
+			t.Fatalf("round %d: read after crash: %v", round, err)
+		}
+		writetest.Check(t, "read after crash", resp.Content)
+		entries, err := os.ReadDir(filepath.Join(dir, "v"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if atomicfile.IsTemp(e.Name()) {
+				t.Fatalf("round %d: restart left %s", round, e.Name())
+			}
+		}
+		stat, _ := s.Stat(context.Background(), &pb.StatRequest{})
+		if stat.FileCount != 1 || stat.UsedBytes != int64(len(resp.Content)) {
+			t.Fatalf("round %d: usage is %d files, %d bytes; want 1 file, %d bytes", round, stat.FileCount, stat.UsedBytes, len(resp.Content))
+		}
+	})
+}
+
+// TestReadDuringWriteVideo reads a file while it is overwritten. A read
+// that paired one version with the other's checksum would fail as
+// corrupt.
+func TestReadDuringWriteVideo(t *testing.T) {
+	s := NewStorageService(t.TempDir())
+	ctx := context.Background()
+	write := func(content []byte) error {
+		_, err := s.WriteVideo(ctx, &pb.WriteRequest{VideoId: "v", Filename: "video.mp4", Content: content, Sha256: checksum.Sum(content)})
+		return err
+	}
+	if err := write(writetest.Versions()[0]); err != nil {
+		t.Fatal(err)
+	}
+	writetest.ReadWhileWriting(t, write, func() ([]byte, error) {
+		resp, err := s.ReadVideo(ctx, &pb.ReadRequest{VideoId: "v", Filename: "video.mp4"})
+		if err != nil {
+			return nil, err
+		}
+		return resp.Content, nil
+	})
+}
+
+// TestLongestNames stores and scrubs the shard with the longest suffix of
+// the longest filename a client may use. Its sidecar and temporary files
+// must still fit the filesystem's name limit.
+func TestLongestNames(t *testing.T) {
+	s := NewStorageService(t.TempDir())
+	ctx := context.Background()
+	name := strings.Repeat("f", videokey.MaxFilenameLen) + ".shard255of256"
+	content := []byte("shard")
+	req := &pb.WriteRequest{VideoId: "v", Filename: name, Content: content, Sha256: checksum.Sum(content)}
+	if _, err := s.WriteVideo(ctx, req); err != nil {
+		t.Fatalf("write %d-byte name: %v", len(name), err)
+	}
+	resp, err := s.ReadVideo(ctx, &pb.ReadRequest{VideoId: "v", Filename: name})
+	if err != nil || !bytes.Equal(resp.Content, content) {
+		t.Fatalf("read %d-byte name: %v", len(name), err)
+	}
+	if _, err := os.Stat(checksum.SidecarPath(filepath.Join(s.StorageDirectory, "v", name))); err != nil {
+		t.Fatalf("sidecar of %d-byte name: %v", len(name), err)
+	}
+	if report, err := s.Scrub(ctx, true); err != nil || report.Checked != 1 || report.Corrupt != 0 {
+		t.Fatalf("scrub %d-byte name: %+v, %v", len(name), report, err)
+	}
+	req.Filename = name + "x"
+	if _, err := s.WriteVideo(ctx, req); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("write %d-byte name: %v, want InvalidArgument", len(req.Filename), err)
+	}
+}
+
+// TestQuota fills a node up to its quota. A write that would exceed it must
+// fail without storing anything, while overwrites that fit and writes after
+// a delete go through.
+func TestQuota(t *testing.T) {
+	s := NewStorageService(t.TempDir())
+	s.Quota = 100
+	ctx := context.Background()
+	write := func(name string, size int) error {
+		content := bytes.Repeat([]byte("x"), size)
+		_, err := s.WriteVideo(ctx, &pb.WriteRequest{VideoId: "v", Filename: name, Content: content, Sha256: checksum.Sum(content)})
+		return err
+	}
+	if err := write("a.m4s", 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("b.m4s", 50); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("write past the quota: %v, want ResourceExhausted", err)
+	}
+	if _, err := s.ReadVideo(ctx, &pb.ReadRequest{VideoId: "v", Filename: "b.m4s"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("read the refused file: %v, want NotFound", err)
+	}
+	if err := write("a.m4s", 90); err != nil {
+		t.Fatalf("overwrite within the quota: %v", err)
+	}
+	if _, err := s.DeleteVideo(ctx, &pb.DeleteRequest{VideoId: "v", Filename: "a.m4s"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("b.m4s", 50); err != nil {
+		t.Fatalf("write after freeing space: %v", err)
+	}
+	stat, _ := s.Stat(ctx, &pb.StatRequest{})
+	if stat.UsedBytes != 50 || stat.FileCount != 1 || stat.QuotaBytes != 100 {
+		t.Fatalf("usage is %d bytes in %d files of %d, want 50 bytes in 1 file of 100", stat.UsedBytes, stat.FileCount, stat.QuotaBytes)
+	}
+}
@@ -0,0 +1,101 @@
+// Disk usage accounting and quota enforcement for a storage node
+
+package storage
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"tritontube/internal/atomicfile"
+	"tritontube/internal/checksum"
+	pb "tritontube/internal/proto"
+)
+
+// scanUsage adds up the files under the storage directory. It runs once at
+// startup; after that writes and deletes keep the totals current. Checksum
+// sidecars, temporary files and quarantined files do not count.
+func (s *StorageService) scanUsage() {
+	var used, files int64
+	filepath.WalkDir(s.StorageDirectory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && d.Name() == quarantineDir {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || checksum.IsSidecar(d.Name()) || atomicfile.IsTemp(d.Name()) {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			used += info.Size()
+			files++
+		}
+		return nil
+	})
+	s.usageMu.Lock()
+	s.used, s.files = used, files
+	s.usageMu.Unlock()
+}
+
+// reserve accounts for writing size bytes to path before the write happens,
+// failing with ResourceExhausted if that would exceed the quota or the free
+// space on disk. The returned function undoes the reservation if the write
+// then fails.
+func (s *StorageService) reserve(path string, size int64) (func(), error) {
+	var old int64
+	existed := false
+	if info, err := os.Stat(path); err == nil {
+		old, existed = info.Size(), true
+	}
+	grow := size - old
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	if s.Quota > 0 && grow > 0 && s.used+grow > s.Quota {
+		return nil, status.Errorf(codes.ResourceExhausted, "quota exceeded: %d of %d bytes used, %d more needed", s.used, s.Quota, grow)
+	}
+	if grow > 0 {
+		if free, _, err := diskSpace(s.StorageDirectory); err == nil && free < grow {
+			return nil, status.Errorf(codes.ResourceExhausted, "disk full: %d bytes free, %d more needed", free, grow)
+		}
+	}
+	s.used += grow
+	if !existed {
+		s.files++
+	}
+	return func() {
+		s.usageMu.Lock()
+		defer s.usageMu.Unlock()
+		s.used -= grow
+		if !existed {
+			s.files--
+		}
+	}, nil
+}
+
+// removed accounts for a deleted file of size bytes.
+func (s *StorageService) removed(size int64) {
+	s.usageMu.Lock()
+	defer s.usageMu.Unlock()
+	s.used -= size
+	s.files--
+}
+
+func (s *StorageService) Stat(ctx context.Context, req *pb.StatRequest) (*pb.StatResponse, error) {
+	s.usageMu.Lock()
+	resp := &pb.StatResponse{
+		UsedBytes:  s.used,
+		FileCount:  s.files,
+		QuotaBytes: s.Quota,
+	}
+	s.usageMu.Unlock()
+	free, disk, err := diskSpace(s.StorageDirectory)
+	if err != nil {
+		free, disk = -1, -1
+	}
+	resp.FreeBytes, resp.DiskBytes = free, disk
+	return resp, nil
+}
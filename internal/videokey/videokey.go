@@ -0,0 +1,119 @@
+// Package videokey validates the video ids and filenames that name stored
+// files, so that no request can reach outside a storage directory.
+package videokey
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+)
+
+const (
+	// MaxVideoIdLen is the longest video id in bytes.
+	MaxVideoIdLen = 128
+	// MaxStoredNameLen is the longest name a storage node stores a file
+	// under. Writing it also creates a checksum sidecar and temporary
+	// files, whose names add up to StorageSuffixLen bytes to it, and all
+	// of them must stay within the 255-byte name limit of most
+	// filesystems.
+	MaxStoredNameLen = 255 - StorageSuffixLen
+	// MaxFilenameLen is the longest filename in bytes. It leaves room for
+	// the suffix of an erasure-coded shard, so every shard of a file can
+	// be stored too.
+	MaxFilenameLen = MaxStoredNameLen - ShardSuffixLen
+
+	// StorageSuffixLen is the most a storage node adds to a name: the
+	// temporary file of a sidecar, ".tmp-<name>.sha256.<random>", where
+	// the random part has up to 10 digits.
+	StorageSuffixLen = len(".tmp-") + len(".sha256") + len(".") + 10
+	// ShardSuffixLen is the length of the longest shard suffix,
+	// ".shard255of256"; Reed-Solomon codes have at most 256 shards.
+	ShardSuffixLen = len(".shard255of256")
+)
+
+// shardSuffix matches the names erasure coding stores shards under,
+// "<filename>.shard<i>of<n>". A file named like one would be mistaken for a
+// shard of another file.
+var shardSuffix = regexp.MustCompile(`\.shard\d+of\d+$`)
+
+// ErrInvalid is returned, wrapped, for every id or filename that fails
+// validation.
+var ErrInvalid = errors.New("invalid video key")
+
+// Key names one stored file. The zero Key is not valid; build keys with New.
+type Key struct {
+	VideoId  string
+	Filename string
+}
+
+// New validates videoId and filename and returns their key.
+func New(videoId, filename string) (Key, error) {
+	if err := ValidateVideoId(videoId); err != nil {
+		return Key{}, err
+	}
+	if err := ValidateFilename(filename); err != nil {
+		return Key{}, err
+	}
+	return Key{VideoId: videoId, Filename: filename}, nil
+}
+
+// NewStored validates a key as a storage node gets it, whose filename may
+// be the name of a shard and so is allowed to be longer.
+func NewStored(videoId, name string) (Key, error) {
+	if err := ValidateVideoId(videoId); err != nil {
+		return Key{}, err
+	}
+	if err := validate("filename", name, MaxStoredNameLen); err != nil {
+		return Key{}, err
+	}
+	return Key{VideoId: videoId, Filename: name}, nil
+}
+
+// String is the key as used in URLs and for placement: "<videoId>/<filename>".
+func (k Key) String() string {
+	return k.VideoId + "/" + k.Filename
+}
+
+// Path is where the file is stored under root.
+func (k Key) Path(root string) string {
+	return filepath.Join(root, k.VideoId, k.Filename)
+}
+
+// ValidateVideoId checks a video id.
+func ValidateVideoId(id string) error {
+	return validate("video id", id, MaxVideoIdLen)
+}
+
+// ValidateFilename checks a filename. Names of shards are refused.
+func ValidateFilename(name string) error {
+	if err := validate("filename", name, MaxFilenameLen); err != nil {
+		return err
+	}
+	if shardSuffix.MatchString(name) {
+		return fmt.Errorf("%w: filename %q is named like a shard", ErrInvalid, name)
+	}
+	return nil
+}
+
+// validate allows ASCII letters, digits, '-', '_' and '.', but not a
+// leading '.', which rules out "." and ".." as well as the hidden files
+// storage keeps for itself.
+func validate(what, s string, maxLen int) error {
+	if s == "" {
+		return fmt.Errorf("%w: empty %s", ErrInvalid, what)
+	}
+	if len(s) > maxLen {
+		return fmt.Errorf("%w: %s is longer than %d bytes", ErrInvalid, what, maxLen)
+	}
+	if s[0] == '.' {
+		return fmt.Errorf("%w: %s %q starts with '.'", ErrInvalid, what, s)
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("%w: %s %q contains %q", ErrInvalid, what, s, c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package videokey
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// FuzzValidate checks that every key New accepts names a file directly
+// inside its video's directory under the storage root, and that every key
+// it refuses fails with ErrInvalid.
+func FuzzValidate(f *testing.F) {
+	seeds := [][2]string{
+		{"abc", "index.m3u8"},
+		{"..", "index.m3u8"},
+		{"abc", ".."},
+		{".", "x"},
+		{"abc", ".hidden"},
+		{"a/b", "x"},
+		{"abc", "../../etc/passwd"},
+		{"abc", `..\..\boot.ini`},
+		{"abc", "seg/ment.m4s"},
+		{"/abs", "x"},
+		{"abc", "x\x00.m4s"},
+		{"abc\x00", "x"},
+		{strings.Repeat("v", MaxVideoIdLen), strings.Repeat("f", MaxFilenameLen)},
+		{strings.Repeat("v", MaxVideoIdLen+1), "x"},
+		{"abc", strings.Repeat("f", MaxFilenameLen+1)},
+		{"", "x"},
+		{"abc", ""},
+		{"vidé", "x"},
+		{"abc", "seg.m4s.shard0of3"},
+	}
+	for _, s := range seeds {
+		f.Add(s[0], s[1])
+	}
+	const root = "/srv/storage"
+	f.Fuzz(func(t *testing.T, videoId, filename string) {
+		k, err := New(videoId, filename)
+		if err != nil {
+			if !errors.Is(err, ErrInvalid) {
+				t.Fatalf("New(%q, %q) failed with %v, which does not wrap ErrInvalid", videoId, filename, err)
+			}
+			return
+		}
+		if len(videoId) > MaxVideoIdLen || len(filename) > MaxFilenameLen {
+			t.Fatalf("New accepted an overlong key %d/%d bytes", len(videoId), len(filename))
+		}
+		if strings.ContainsAny(videoId+filename, "/\\\x00") {
+			t.Fatalf("New accepted %q/%q, which holds a separator or NUL", videoId, filename)
+		}
+		p := k.Path(root)
+		if filepath.Dir(filepath.Dir(p)) != root || filepath.Base(filepath.Dir(p)) != videoId || filepath.Base(p) != filename {
+			t.Fatalf("New accepted %q/%q, stored at %s outside its video directory", videoId, filename, p)
+		}
+	})
+}
+
+// TestFilenameLimit checks the longest filename a client may use and that
+// its shards still pass as stored names.
+func TestFilenameLimit(t *testing.T) {
+	longest := strings.Repeat("f", MaxFilenameLen)
+	if _, err := New("v", longest); err != nil {
+		t.Fatalf("%d-byte filename: %v", len(longest), err)
+	}
+	if _, err := New("v", longest+"f"); !errors.Is(err, ErrInvalid) {
+		t.Fatalf("%d-byte filename: %v, want ErrInvalid", len(longest)+1, err)
+	}
+	if _, err := NewStored("v", longest+".shard255of256"); err != nil {
+		t.Fatalf("shard of %d-byte filename: %v", len(longest), err)
+	}
+	if sidecarTemp := len(".tmp-") + MaxStoredNameLen + len(".sha256.4294967295"); sidecarTemp > 255 {
+		t.Fatalf("temporary sidecar of the longest stored name is %d bytes", sidecarTemp)
+	}
+}
+
+// TestShardNamesRefused checks that a client cannot use a filename a shard
+// is stored under, while a storage node still accepts it.
+func TestShardNamesRefused(t *testing.T) {
+	for _, name := range []string{"seg.m4s.shard0of3", "x.shard12of16", "x.shard255of256"} {
+		if _, err := New("v", name); !errors.Is(err, ErrInvalid) {
+			t.Errorf("New(%q): %v, want ErrInvalid", name, err)
+		}
+		if _, err := NewStored("v", name); err != nil {
+			t.Errorf("NewStored(%q): %v", name, err)
+		}
+	}
+	for _, name := range []string{"x.shard", "x.shard1of", "x.shard0of3.m4s", "shard0of3"} {
+		if _, err := New("v", name); err != nil {
+			t.Errorf("New(%q): %v", name, err)
+		}
+	}
+}
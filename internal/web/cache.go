@@ -0,0 +1,395 @@
+// Read-through cache of video files in front of any content service
+
+package web
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"tritontube/internal/atomicfile"
+)
+
+// lruCache holds byte slices up to a total size, evicting the least
+// recently used first. Entries of the disk tier keep only their size.
+type lruCache struct {
+	mu    sync.Mutex
+	max   int64
+	size  int64
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	data []byte
+	size int64
+}
+
+func newLRU(max int64) *lruCache {
+	return &lruCache{max: max, ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *lruCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*lruEntry).data, true
+}
+
+// add stores data of size bytes under key and returns the entries evicted
+// to make room. Entries larger than the whole cache are not stored.
+func (c *lruCache) add(key string, data []byte, size int64) []*lruEntry {
+	if size > c.max {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.size -= e.Value.(*lruEntry).size
+		c.ll.Remove(e)
+	}
+	c.items[key] = c.ll.PushFront(&lruEntry{key: key, data: data, size: size})
+	c.size += size
+	var evicted []*lruEntry
+	for c.size > c.max {
+		e := c.ll.Back()
+		ent := e.Value.(*lruEntry)
+		c.ll.Remove(e)
+		delete(c.items, ent.key)
+		c.size -= ent.size
+		evicted = append(evicted, ent)
+	}
+	return evicted
+}
+
+func (c *lruCache) remove(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return false
+	}
+	c.size -= e.Value.(*lruEntry).size
+	c.ll.Remove(e)
+	delete(c.items, key)
+	return true
+}
+
+func (c *lruCache) usage() (entries, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return int64(c.ll.Len()), c.size
+}
+
+// diskCache keeps files evicted from memory in a directory, named by the
+// SHA-256 of their key.
+type diskCache struct {
+	dir string
+	lru *lruCache
+}
+
+// newDiskCache empties dir of the files an earlier run cached there; the
+// cache does not survive restarts. Other files in dir are left alone.
+func newDiskCache(dir string, max int64) (*diskCache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, fmt.Errorf("cache dir: %v", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("cache dir: %v", err)
+	}
+	for _, e := range entries {
+		if b, err := hex.DecodeString(e.Name()); (err == nil && len(b) == sha256.Size) || atomicfile.IsTemp(e.Name()) {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+	return &diskCache{dir: dir, lru: newLRU(max)}, nil
+}
+
+func (d *diskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(d.dir, hex.EncodeToString(sum[:]))
+}
+
+func (d *diskCache) get(key string) ([]byte, bool) {
+	if _, ok := d.lru.get(key); !ok {
+		return nil, false
+	}
+	data, err := os.ReadFile(d.path(key))
+	if err != nil {
+		d.remove(key)
+		return nil, false
+	}
+	return data, true
+}
+
+// put stores data under key and returns the keys evicted to make room.
+func (d *diskCache) put(key string, data []byte) []string {
+	if int64(len(data)) > d.lru.max {
+		return nil
+	}
+	if err := atomicfile.WriteFile(d.path(key), data, 0644); err != nil {
+		slog.Warn("cache: spill to disk failed", "key", key, "err", err)
+		return nil
+	}
+	var evicted []string
+	for _, e := range d.lru.add(key, nil, int64(len(data))) {
+		os.Remove(d.path(e.key))
+		evicted = append(evicted, e.key)
+	}
+	return evicted
+}
+
+func (d *diskCache) remove(key string) {
+	d.lru.remove(key)
+	os.Remove(d.path(key))
+}
+
+// CacheConfig sizes a CachedVideoContentService.
+type CacheConfig struct {
+	// MaxBytes bounds the files kept in memory.
+	MaxBytes int64
+	// Dir, if set, keeps files evicted from memory on disk, up to
+	// DiskMaxBytes. Files cached there by an earlier run are discarded.
+	Dir          string
+	DiskMaxBytes int64
+}
+
+// CacheStats counts the work of a CachedVideoContentService.
+type CacheStats struct {
+	Hits     int64 `json:"hits"`
+	DiskHits int64 `json:"disk_hits"`
+	Misses   int64 `json:"misses"`
+	// Collapsed reads waited for a miss of the same file already being
+	// loaded instead of loading it again.
+	Collapsed   int64 `json:"collapsed"`
+	Evictions   int64 `json:"evictions"`
+	Entries     int64 `json:"entries"`
+	Bytes       int64 `json:"bytes"`
+	DiskEntries int64 `json:"disk_entries"`
+	DiskBytes   int64 `json:"disk_bytes"`
+}
+
+// flight is one load of a file that concurrent misses wait for.
+type flight struct {
+	done chan struct{}
+	data []byte
+	err  error
+	// stale is set if the file was written while it was being loaded, so
+	// the result must not be cached.
+	stale bool
+	// waiters counts the reads waiting for the load; when the last one
+	// gives up, cancel stops it.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// CachedVideoContentService serves reads from memory, and optionally disk,
+// before going to the wrapped content service. Writes and deletes go
+// straight through and drop the cached copy. The slices Read returns are
+// shared and must not be modified.
+type CachedVideoContentService struct {
+	store VideoContentService
+	mem   *lruCache
+	disk  *diskCache
+
+	flightsMu sync.Mutex
+	flights   map[string]*flight
+
+	hits, diskHits, misses, collapsed, evictions atomic.Int64
+}
+
+var _ VideoContentService = (*CachedVideoContentService)(nil)
+var _ VideoContentDeleter = (*CachedVideoContentService)(nil)
+var _ VideoContentLister = (*CachedVideoContentService)(nil)
+var _ VideoContentPlacer = (*CachedVideoContentService)(nil)
+
+func NewCachedVideoContentService(store VideoContentService, config CacheConfig) (*CachedVideoContentService, error) {
+	s := &CachedVideoContentService{
+		store:   store,
+		mem:     newLRU(config.MaxBytes),
+		flights: make(map[string]*flight),
+	}
+	if config.Dir != "" && config.DiskMaxBytes > 0 {
+		var err error
+		if s.disk, err = newDiskCache(config.Dir, config.DiskMaxBytes); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Read shares one load of a missing file among every read of it. The load
+// runs until the last of them gives up.
+func (s *CachedVideoContentService) Read(ctx context.Context, videoId string, filename string) ([]byte, error) {
+	key := fmt.Sprintf("%s/%s", videoId, filename)
+	if data, ok := s.mem.get(key); ok {
+		s.hits.Add(1)
+		return data, nil
+	}
+	s.flightsMu.Lock()
+	if f, ok := s.flights[key]; ok {
+		f.waiters++
+		s.flightsMu.Unlock()
+		s.collapsed.Add(1)
+		return s.wait(ctx, key, f)
+	}
+	f := &flight{done: make(chan struct{}), waiters: 1}
+	var loadCtx context.Context
+	loadCtx, f.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	s.flights[key] = f
+	s.flightsMu.Unlock()
+
+	go s.load(loadCtx, key, videoId, filename, f)
+	return s.wait(ctx, key, f)
+}
+
+func (s *CachedVideoContentService) wait(ctx context.Context, key string, f *flight) ([]byte, error) {
+	select {
+	case <-f.done:
+		return f.data, f.err
+	case <-ctx.Done():
+		s.flightsMu.Lock()
+		f.waiters--
+		if f.waiters == 0 {
+			f.cancel()
+			// Later reads start a load of their own.
+			if s.flights[key] == f {
+				delete(s.flights, key)
+			}
+		}
+		s.flightsMu.Unlock()
+		return nil, ctx.Err()
+	}
+}
+
+// load reads a file that is not in memory, from disk if it is there, and
+// caches it.
+func (s *CachedVideoContentService) load(ctx context.Context, key, videoId, filename string, f *flight) {
+	defer f.cancel()
+	loaded := false
+	if s.disk != nil {
+		f.data, loaded = s.disk.get(key)
+		if loaded {
+			s.diskHits.Add(1)
+		}
+	}
+	if !loaded {
+		s.misses.Add(1)
+		f.data, f.err = s.store.Read(ctx, videoId, filename)
+	}
+	s.flightsMu.Lock()
+	if s.flights[key] == f {
+		delete(s.flights, key)
+	}
+	stale := f.stale
+	s.flightsMu.Unlock()
+	if f.err == nil && !stale {
+		s.keep(key, f.data)
+	}
+	close(f.done)
+}
+
+// keep puts data in memory, moving what it evicts to disk.
+func (s *CachedVideoContentService) keep(key string, data []byte) {
+	evicted := s.mem.add(key, data, int64(len(data)))
+	s.evictions.Add(int64(len(evicted)))
+	if s.disk == nil {
+		return
+	}
+	for _, e := range evicted {
+		s.disk.put(e.key, e.data)
+	}
+}
+
+// invalidate drops every cached copy of key, including one still being
+// loaded.
+func (s *CachedVideoContentService) invalidate(videoId, filename string) {
+	key := fmt.Sprintf("%s/%s", videoId, filename)
+	s.flightsMu.Lock()
+	if f, ok := s.flights[key]; ok {
+		f.stale = true
+	}
+	s.flightsMu.Unlock()
+	s.mem.remove(key)
+	if s.disk != nil {
+		s.disk.remove(key)
+	}
+}
+
+func (s *CachedVideoContentService) Write(ctx context.Context, videoId string, filename string, data []byte) error {
+	err := s.store.Write(ctx, videoId, filename, data)
+	s.invalidate(videoId, filename)
+	return err
+}
+
+func (s *CachedVideoContentService) Delete(ctx context.Context, videoId string, filename string) error {
+	deleter, ok := s.store.(VideoContentDeleter)
+	if !ok {
+		return fmt.Errorf("content store %T cannot delete files", s.store)
+	}
+	err := deleter.Delete(ctx, videoId, filename)
+	s.invalidate(videoId, filename)
+	return err
+}
+
+// CheckHealth checks the content store; the cache has nothing to check.
+func (s *CachedVideoContentService) CheckHealth(ctx context.Context) error {
+	if c, ok := s.store.(HealthChecker); ok {
+		return c.CheckHealth(ctx)
+	}
+	return nil
+}
+
+func (s *CachedVideoContentService) NodeFor(videoId string, filename string) string {
+	if placer, ok := s.store.(VideoContentPlacer); ok {
+		return placer.NodeFor(videoId, filename)
+	}
+	return ""
+}
+
+func (s *CachedVideoContentService) ListStored(ctx context.Context) ([]StoredFile, error) {
+	lister, ok := s.store.(VideoContentLister)
+	if !ok {
+		return nil, fmt.Errorf("content store %T cannot list files", s.store)
+	}
+	return lister.ListStored(ctx)
+}
+
+func (s *CachedVideoContentService) DeleteStored(ctx context.Context, f StoredFile) error {
+	lister, ok := s.store.(VideoContentLister)
+	if !ok {
+		return fmt.Errorf("content store %T cannot delete files", s.store)
+	}
+	err := lister.DeleteStored(ctx, f)
+	s.invalidate(f.VideoId, f.Filename)
+	return err
+}
+
+// Stats returns the cache's counters and current size.
+func (s *CachedVideoContentService) Stats() CacheStats {
+	st := CacheStats{
+		Hits:      s.hits.Load(),
+		DiskHits:  s.diskHits.Load(),
+		Misses:    s.misses.Load(),
+		Collapsed: s.collapsed.Load(),
+		Evictions: s.evictions.Load(),
+	}
+	st.Entries, st.Bytes = s.mem.usage()
+	if s.disk != nil {
+		st.DiskEntries, st.DiskBytes = s.disk.lru.usage()
+	}
+	return st
+}
@@ -0,0 +1,165 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testStore keeps files in a map and counts the reads that reach it. While
+// gate is set, reads wait until it is closed and then return the file as it
+// was when they started.
+type testStore struct {
+	mu    sync.Mutex
+	files map[string]string
+	reads map[string]int
+	gate  chan struct{}
+}
+
+func newTestStore() *testStore {
+	return &testStore{files: make(map[string]string), reads: make(map[string]int)}
+}
+
+func (s *testStore) Read(ctx context.Context, videoId string, filename string) ([]byte, error) {
+	key := videoId + "/" + filename
+	s.mu.Lock()
+	s.reads[key]++
+	data, ok := s.files[key]
+	gate := s.gate
+	s.mu.Unlock()
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s does not exist", key)
+	}
+	return []byte(data), nil
+}
+
+func (s *testStore) Write(ctx context.Context, videoId string, filename string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[videoId+"/"+filename] = string(data)
+	return nil
+}
+
+func (s *testStore) readsOf(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reads[key]
+}
+
+func readString(t *testing.T, s VideoContentService, videoId, filename string) string {
+	t.Helper()
+	data, err := s.Read(context.Background(), videoId, filename)
+	if err != nil {
+		t.Fatalf("read %s/%s: %v", videoId, filename, err)
+	}
+	return string(data)
+}
+
+// TestCacheEvictsLeastRecentlyUsed fills a cache of three files and reads
+// a fourth. The file read longest ago must be evicted to disk and the
+// others stay in memory.
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	store := newTestStore()
+	for _, name := range []string{"a", "b", "c", "d"} {
+		store.files["v/"+name] = strings.Repeat(name, 10)
+	}
+	cache, err := NewCachedVideoContentService(store, CacheConfig{MaxBytes: 30, Dir: t.TempDir(), DiskMaxBytes: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b", "c", "a", "d", "a", "c", "d"} {
+		if got := readString(t, cache, "v", name); got != strings.Repeat(name, 10) {
+			t.Fatalf("read %s: %q", name, got)
+		}
+	}
+	for name, want := range map[string]int{"a": 1, "b": 1, "c": 1, "d": 1} {
+		if got := store.readsOf("v/" + name); got != want {
+			t.Errorf("%s was read from the store %d times, want %d", name, got, want)
+		}
+	}
+	st := cache.Stats()
+	if st.Evictions != 1 || st.Entries != 3 || st.Bytes != 30 || st.DiskEntries != 1 {
+		t.Fatalf("stats after evicting one file: %+v", st)
+	}
+	readString(t, cache, "v", "b")
+	if st := cache.Stats(); st.DiskHits != 1 || st.Misses != 4 {
+		t.Fatalf("reading the evicted file: %+v, want a disk hit", st)
+	}
+	if got := store.readsOf("v/b"); got != 1 {
+		t.Fatalf("the evicted file was read from the store again")
+	}
+}
+
+// TestCacheCollapsesMisses reads one missing file from many goroutines at
+// once. Only one read may reach the store.
+func TestCacheCollapsesMisses(t *testing.T) {
+	store := newTestStore()
+	store.files["v/a"] = "contents"
+	store.gate = make(chan struct{})
+	cache, err := NewCachedVideoContentService(store, CacheConfig{MaxBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const readers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if data, err := cache.Read(context.Background(), "v", "a"); err != nil || string(data) != "contents" {
+				t.Errorf("read: %q, %v", data, err)
+			}
+		}()
+	}
+	waitFor(t, "reads to collapse", func() bool { return cache.Stats().Collapsed == readers-1 })
+	close(store.gate)
+	wg.Wait()
+	if got := store.readsOf("v/a"); got != 1 {
+		t.Fatalf("%d reads reached the store, want 1", got)
+	}
+}
+
+// TestCacheWriteInvalidates overwrites a cached file and a file whose load
+// is still running. Both must be read again from the store afterwards.
+func TestCacheWriteInvalidates(t *testing.T) {
+	store := newTestStore()
+	store.files["v/a"] = "old"
+	store.files["v/b"] = "old"
+	cache, err := NewCachedVideoContentService(store, CacheConfig{MaxBytes: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	readString(t, cache, "v", "a")
+	if err := cache.Write(ctx, "v", "a", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, cache, "v", "a"); got != "new" {
+		t.Fatalf("read after overwrite: %q, want new", got)
+	}
+
+	store.gate = make(chan struct{})
+	loaded := make(chan struct{})
+	go func() {
+		defer close(loaded)
+		cache.Read(ctx, "v", "b")
+	}()
+	waitFor(t, "load to start", func() bool { return store.readsOf("v/b") == 1 })
+	if err := cache.Write(ctx, "v", "b", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	close(store.gate)
+	<-loaded
+	if got := readString(t, cache, "v", "b"); got != "new" {
+		t.Fatalf("read after overwrite during a load: %q, want new", got)
+	}
+}
@@ -0,0 +1,180 @@
+// Capacity reporting and capacity-weighted placement
+
+package web
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	pb "tritontube/internal/proto"
+)
+
+// statTimeout bounds how long a usage query waits for one storage node.
+const statTimeout = 500 * time.Millisecond
+
+// statNodes asks every node in nodes for its usage at once. Nodes that do
+// not answer in time are missing from the result.
+func (s *NetworkVideoContentService) statNodes(ctx context.Context, nodes []StorageNode) map[string]*pb.StatResponse {
+	ctx, cancel := context.WithTimeout(ctx, statTimeout)
+	defer cancel()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	stats := make(map[string]*pb.StatResponse, len(nodes))
+	for _, n := range nodes {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			c, err := s.client(addr)
+			if err != nil {
+				return
+			}
+			resp, err := c.Stat(ctx, &pb.StatRequest{})
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			stats[addr] = resp
+			mu.Unlock()
+		}(n.Address)
+	}
+	wg.Wait()
+	return stats
+}
+
+// fillRatio is how full a node is: the larger of its share of quota used
+// and its share of disk used.
+func fillRatio(st *pb.StatResponse) float64 {
+	fill := 0.0
+	if st.QuotaBytes > 0 && st.UsedBytes >= 0 {
+		fill = float64(st.UsedBytes) / float64(st.QuotaBytes)
+	}
+	if st.DiskBytes > 0 && st.FreeBytes >= 0 {
+		fill = max(fill, 1-float64(st.FreeBytes)/float64(st.DiskBytes))
+	}
+	return fill
+}
+
+// capacityFor maps how full a node is to the percentage of its weight
+// placement should use. The steps are coarse so small changes in usage do
+// not start a rebalance every time.
+func capacityFor(fill float64) int {
+	switch {
+	case fill < 0.80:
+		return 100
+	case fill < 0.90:
+		return 50
+	case fill < 0.95:
+		return 25
+	default:
+		return 10
+	}
+}
+
+// capacityHysteresis is how far below a step's threshold a node must empty
+// before its capacity goes back up, so a node sitting at a threshold does
+// not flip between two steps.
+const capacityHysteresis = 0.05
+
+// nextCapacity is the capacity a node at capacity cur and fill should move
+// to. It drops as soon as the node crosses a threshold but only rises once
+// the node is capacityHysteresis below it.
+func nextCapacity(cur int, fill float64) int {
+	c := capacityFor(fill)
+	if c > cur {
+		c = max(cur, capacityFor(fill+capacityHysteresis))
+	}
+	return c
+}
+
+// capacityCooldown is how many monitor intervals must pass before a node's
+// capacity may move the opposite way to its last change. Moving files off a
+// node empties it, so without this a node can go back and forth, with a
+// migration each time.
+const capacityCooldown = 10
+
+// capacityChange is the last capacity change made to a node.
+type capacityChange struct {
+	at   time.Time
+	down bool
+}
+
+// WeightedPlacement reports whether the service's placement uses node
+// weights, which capacity monitoring needs.
+func (s *NetworkVideoContentService) WeightedPlacement() bool {
+	return spreadName(s.placement, false) != PlacementRing
+}
+
+// MonitorCapacity checks the usage of every active node each interval until
+// ctx is done. When a node crosses into a different capacity step, the
+// leader lowers or restores its share of placement and migrates files to
+// match. Only weighted placements can do this; with the single-point ring
+// MonitorCapacity logs and returns at once.
+func (s *NetworkVideoContentService) MonitorCapacity(ctx context.Context, interval time.Duration) {
+	if !s.WeightedPlacement() {
+		slog.WarnContext(ctx, "capacity monitor not started: placement ignores weights", "placement", s.placement)
+		return
+	}
+	last := make(map[string]capacityChange)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if s.leading() {
+			s.rebalanceCapacity(ctx, last, capacityCooldown*interval)
+		}
+	}
+}
+
+// rebalanceCapacity applies the capacities that current usage calls for,
+// recording each change in last. A change the opposite way to a node's last
+// one waits until cooldown has passed. It does nothing while a migration
+// runs, or for nodes that did not answer.
+func (s *NetworkVideoContentService) rebalanceCapacity(ctx context.Context, last map[string]capacityChange, cooldown time.Duration) {
+	if s.checkIdle() != nil {
+		return
+	}
+	cur := s.ring.Load()
+	stats := s.statNodes(ctx, cur.active)
+	nodes := make([]StorageNode, len(cur.nodes))
+	changes := make(map[string]capacityChange)
+	now := time.Now()
+	for i, n := range cur.nodes {
+		nodes[i] = n
+		st, ok := stats[n.Address]
+		if !ok {
+			continue
+		}
+		c := nextCapacity(n.Capacity, fillRatio(st))
+		if c == n.Capacity {
+			continue
+		}
+		down := c < n.Capacity
+		if prev, ok := last[n.Address]; ok && prev.down != down && now.Sub(prev.at) < cooldown {
+			continue
+		}
+		slog.InfoContext(ctx, "capacity changed", "node", n.Address, "from", n.Capacity, "to", c, "full_percent", int(100*fillRatio(st)))
+		nodes[i].Capacity = c
+		changes[n.Address] = capacityChange{at: now, down: down}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+	if s.checkIdle() != nil || s.ring.Load() != cur {
+		return
+	}
+	if _, _, err := s.changeMembership("rebalance", "", nodes, false); err != nil {
+		slog.ErrorContext(ctx, "capacity rebalance failed", "err", err)
+		return
+	}
+	for addr, c := range changes {
+		last[addr] = c
+	}
+}
@@ -0,0 +1,79 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	pb "tritontube/internal/proto"
+	"tritontube/internal/storage"
+)
+
+func TestNextCapacity(t *testing.T) {
+	for _, c := range []struct {
+		cur  int
+		fill float64
+		want int
+	}{
+		{100, 0.5, 100},
+		{100, 0.85, 50},
+		{100, 0.99, 10},
+		{50, 0.92, 25},
+		// Rising needs the node to be capacityHysteresis below the step.
+		{50, 0.78, 50},
+		{50, 0.70, 100},
+		{10, 0.93, 10},
+		{10, 0.89, 25},
+	} {
+		if got := nextCapacity(c.cur, c.fill); got != c.want {
+			t.Errorf("nextCapacity(%d, %.2f) = %d, want %d", c.cur, c.fill, got, c.want)
+		}
+	}
+}
+
+// TestFullNodeIsDownWeighted fills one node's quota and checks that the
+// capacity monitor lowers its share of placement and moves files off it.
+func TestFullNodeIsDownWeighted(t *testing.T) {
+	full := storage.NewStorageService(t.TempDir())
+	full.Quota = 90
+	fullNode, _ := serveStorage(t, full)
+	nodes := []StorageNode{fullNode, startStorageNode(t), startStorageNode(t)}
+	s, err := NewNetworkVideoContentService(nil, nil, nodes, NetworkConfig{Placement: PlacementVnode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	files := make(map[string]string)
+	for i := 0; i < 60; i++ {
+		name := fmt.Sprintf("seg%02d.m4s", i)
+		// Writes to the full node fail once its quota is used up.
+		if err := s.Write(ctx, "v", name, []byte(name)); err == nil {
+			files[name] = name
+		}
+	}
+	before, _ := full.Stat(ctx, &pb.StatRequest{})
+	if before.UsedBytes < full.Quota*95/100 {
+		t.Fatalf("the full node holds only %d bytes; the test needs more files", before.UsedBytes)
+	}
+
+	monitorCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	go s.MonitorCapacity(monitorCtx, 20*time.Millisecond)
+	waitFor(t, "full node down-weighted", func() bool {
+		n, _ := s.ring.Load().node(fullNode.Address)
+		return n.Capacity == capacityFor(1)
+	})
+	stop()
+	waitMigrated(t, s)
+	after, _ := full.Stat(ctx, &pb.StatRequest{})
+	if after.UsedBytes >= before.UsedBytes {
+		t.Fatalf("the full node holds %d bytes after down-weighting, %d before", after.UsedBytes, before.UsedBytes)
+	}
+	for name, want := range files {
+		if got, err := s.Read(ctx, "v", name); err != nil || string(got) != want {
+			t.Errorf("read %s after down-weighting: %v", name, err)
+		}
+	}
+}
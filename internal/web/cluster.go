@@ -0,0 +1,195 @@
+// Coordination between web servers that share one ring through etcd
+
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	pb "tritontube/internal/proto"
+	"tritontube/internal/tracing"
+)
+
+// errNotLeader pauses a migration when this web server loses the election.
+var errNotLeader = errors.New("no longer the leader")
+
+// clusterSessionTTL is how long, in seconds, a crashed leader keeps its
+// leadership and migration lease before another web server takes over.
+const clusterSessionTTL = 10
+
+// cluster is the state of a web server that shares its ring with others.
+// One of them is elected leader: it applies membership changes and runs
+// migrations. The others watch the ring and forward admin calls to it.
+// The leader's move guard only sees writes made through the leader, so the
+// others refuse writes and deletes of files a running migration may move.
+type cluster struct {
+	client    *clientv3.Client
+	adminAddr string
+	leader    atomic.Bool
+	// session is the leader's etcd session; migration leases are bound to it.
+	session atomic.Pointer[concurrency.Session]
+
+	connsMu sync.Mutex
+	conns   map[string]pb.VideoContentAdminServiceClient
+}
+
+// leading reports whether this web server may change the ring and run
+// migrations. A web server that does not share its ring always may.
+func (s *NetworkVideoContentService) leading() bool {
+	return s.cluster == nil || s.cluster.leader.Load()
+}
+
+// JoinCluster shares the ring with every other web server using the same
+// etcd cluster. adminAddr is where the others reach this server's admin API
+// when it is the leader. The membership store must be a RingWatcher on the
+// same etcd cluster. JoinCluster runs until ctx is done; until this server
+// is elected it does not run migrations.
+func (s *NetworkVideoContentService) JoinCluster(ctx context.Context, client *clientv3.Client, adminAddr string) error {
+	watcher, ok := s.membership.(RingWatcher)
+	if !ok {
+		return fmt.Errorf("membership store %T cannot be shared", s.membership)
+	}
+	s.cluster = &cluster{
+		client:    client,
+		adminAddr: adminAddr,
+		conns:     make(map[string]pb.VideoContentAdminServiceClient),
+	}
+	go watcher.WatchRing(ctx, s.applyRing)
+	go s.campaign(ctx)
+	return nil
+}
+
+// applyRing makes a ring saved by any web server the current ring, unless
+// this server already has a newer one.
+func (s *NetworkVideoContentService) applyRing(state *RingState) {
+	cur := s.ring.Load()
+	if cur != nil && state.Version < cur.version {
+		return
+	}
+	if cur == nil || state.Version > cur.version {
+		slog.Info("ring from etcd", "version", state.Version, "nodes", len(state.Nodes))
+	}
+	s.setRing(ringFromState(state))
+}
+
+// campaign runs for leadership until ctx is done. When elected it resumes
+// unfinished migrations; when its session expires it pauses them and
+// campaigns again.
+func (s *NetworkVideoContentService) campaign(ctx context.Context) {
+	c := s.cluster
+	for ctx.Err() == nil {
+		session, err := concurrency.NewSession(c.client, concurrency.WithTTL(clusterSessionTTL), concurrency.WithContext(ctx))
+		if err != nil {
+			slog.WarnContext(ctx, "etcd session failed", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		election := concurrency.NewElection(session, etcdElectionPrefix)
+		if err := election.Campaign(ctx, c.adminAddr); err != nil {
+			session.Close()
+			continue
+		}
+		slog.InfoContext(ctx, "elected leader of the web servers", "admin_addr", c.adminAddr)
+		c.session.Store(session)
+		c.leader.Store(true)
+		if err := s.ResumeMigrations(); err != nil {
+			slog.ErrorContext(ctx, "resume migrations failed", "err", err)
+		}
+		select {
+		case <-session.Done():
+			slog.WarnContext(ctx, "lost leadership: etcd session expired")
+		case <-ctx.Done():
+		}
+		c.leader.Store(false)
+		s.pauseMigration()
+		c.session.Store(nil)
+		resignCtx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+		election.Resign(resignCtx)
+		cancel()
+		session.Close()
+	}
+}
+
+// holdMigrationLease records in etcd that this leader is running migration
+// id. The lease dies with the leader's session, so a crashed leader's
+// migration can be resumed by the next one, but two leaders can never run
+// one at the same time.
+func (c *cluster) holdMigrationLease(ctx context.Context, id string) (func(), error) {
+	session := c.session.Load()
+	if session == nil {
+		return nil, errNotLeader
+	}
+	tctx, cancel := context.WithTimeout(ctx, etcdTimeout)
+	defer cancel()
+	value := fmt.Sprintf("%s %s", id, c.adminAddr)
+	resp, err := c.client.Txn(tctx).
+		If(clientv3.Compare(clientv3.CreateRevision(etcdMigrationLeaseKey), "=", 0)).
+		Then(clientv3.OpPut(etcdMigrationLeaseKey, value, clientv3.WithLease(session.Lease()))).
+		Else(clientv3.OpGet(etcdMigrationLeaseKey)).
+		Commit()
+	if err != nil {
+		return nil, fmt.Errorf("take migration lease: %v", err)
+	}
+	if !resp.Succeeded {
+		holder := ""
+		if kvs := resp.Responses[0].GetResponseRange().Kvs; len(kvs) > 0 {
+			holder = string(kvs[0].Value)
+		}
+		return nil, fmt.Errorf("migration lease is held by %q", holder)
+	}
+	release := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+		defer cancel()
+		_, err := c.client.Txn(ctx).
+			If(clientv3.Compare(clientv3.Value(etcdMigrationLeaseKey), "=", value)).
+			Then(clientv3.OpDelete(etcdMigrationLeaseKey)).
+			Commit()
+		if err != nil {
+			slog.Warn("release migration lease failed", "migration", id, "err", err)
+		}
+	}
+	return release, nil
+}
+
+// leaderAdmin returns a client for the leader's admin API, or nil if this
+// web server should handle admin calls itself.
+func (s *NetworkVideoContentService) leaderAdmin(ctx context.Context) (pb.VideoContentAdminServiceClient, error) {
+	c := s.cluster
+	if c == nil || c.leader.Load() {
+		return nil, nil
+	}
+	resp, err := c.client.Get(ctx, etcdElectionPrefix+"/", clientv3.WithFirstCreate()...)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "find leader: %v", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, status.Errorf(codes.Unavailable, "no web server is the leader yet")
+	}
+	addr := string(resp.Kvs[0].Value)
+	if addr == c.adminAddr {
+		return nil, status.Errorf(codes.Unavailable, "leadership is changing; try again")
+	}
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+	if client, ok := c.conns[addr]; ok {
+		return client, nil
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()), tracing.DialOption())
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "connect to leader %s: %v", addr, err)
+	}
+	client := pb.NewVideoContentAdminServiceClient(conn)
+	c.conns[addr] = client
+	return client, nil
+}
@@ -0,0 +1,211 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pb "tritontube/internal/proto"
+	"tritontube/internal/storage"
+)
+
+// startEtcd runs a single-member etcd in the test's temporary directory and
+// returns its client endpoint.
+func startEtcd(t *testing.T) string {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	local, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls = []url.URL{*local}
+	cfg.ListenPeerUrls = []url.URL{*local}
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("start etcd: %v", err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("etcd did not start")
+	}
+	return e.Clients[0].Addr().String()
+}
+
+func newEtcdClient(t *testing.T, endpoint string) *clientv3.Client {
+	t.Helper()
+	client, err := clientv3.New(clientv3.Config{Endpoints: []string{endpoint}, DialTimeout: 5 * time.Second})
+	if err != nil {
+		t.Fatalf("etcd client: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// startStorageNode serves a storage node from a temporary directory and
+// returns it as a ring node.
+func startStorageNode(t *testing.T) StorageNode {
+	t.Helper()
+	n, _ := startStorageServer(t)
+	return n
+}
+
+// startStorageServer is startStorageNode for tests that take the node down
+// by stopping the returned server.
+func startStorageServer(t *testing.T) (StorageNode, *grpc.Server) {
+	t.Helper()
+	return serveStorage(t, storage.NewStorageService(t.TempDir()))
+}
+
+// serveStorage serves svc as a storage node, for tests that need to set it
+// up themselves.
+func serveStorage(t *testing.T, svc *storage.StorageService) (StorageNode, *grpc.Server) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterStorageServiceServer(srv, svc)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+	n, err := ParseStorageNode(lis.Addr().String())
+	if err != nil {
+		t.Fatalf("storage node: %v", err)
+	}
+	return n, srv
+}
+
+// waitFor polls cond until it holds or fails the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(15 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// joinWebServer starts a web server's content service that shares its ring
+// through etcd. Cancelling the returned function leaves the cluster.
+func joinWebServer(t *testing.T, endpoint, adminAddr string, seed []StorageNode) (*NetworkVideoContentService, context.CancelFunc) {
+	t.Helper()
+	client := newEtcdClient(t, endpoint)
+	nw, err := NewNetworkVideoContentService(NewEtcdMembershipStore(client), NewEtcdMigrationStore(client), seed, NetworkConfig{})
+	if err != nil {
+		t.Fatalf("nw: %v", err)
+	}
+	t.Cleanup(func() { nw.Close() })
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := nw.JoinCluster(ctx, client, adminAddr); err != nil {
+		t.Fatalf("join cluster: %v", err)
+	}
+	return nw, cancel
+}
+
+func TestClusterElectsOneLeader(t *testing.T) {
+	endpoint := startEtcd(t)
+	seed := []StorageNode{startStorageNode(t)}
+	a, leaveA := joinWebServer(t, endpoint, "web-a", seed)
+	b, leaveB := joinWebServer(t, endpoint, "web-b", seed)
+
+	waitFor(t, "a leader", func() bool { return a.leading() || b.leading() })
+	if a.leading() && b.leading() {
+		t.Fatal("both web servers lead")
+	}
+	leader, follower, leave := a, b, leaveA
+	if b.leading() {
+		leader, follower, leave = b, a, leaveB
+	}
+	leave()
+	waitFor(t, "the follower to take over", follower.leading)
+	waitFor(t, "the old leader to step down", func() bool { return !leader.leading() })
+}
+
+func TestClusterSharesRing(t *testing.T) {
+	endpoint := startEtcd(t)
+	n1, n2 := startStorageNode(t), startStorageNode(t)
+	a, _ := joinWebServer(t, endpoint, "web-a", []StorageNode{n1})
+	b, _ := joinWebServer(t, endpoint, "web-b", []StorageNode{n1})
+	waitFor(t, "a leader", func() bool { return a.leading() || b.leading() })
+	leader, follower := a, b
+	if b.leading() {
+		leader, follower = b, a
+	}
+
+	if _, err := leader.AddNode(context.Background(), &pb.AddNodeRequest{NodeAddress: n2.Address}); err != nil {
+		t.Fatalf("add node: %v", err)
+	}
+	want := leader.ring.Load().version
+	waitFor(t, "the follower to see the new ring", func() bool {
+		r := follower.ring.Load()
+		return r.version >= want && r.contains(n2.Address)
+	})
+}
+
+// A web server that is not the leader must not write a file the running
+// migration may move: the leader's move guard would not see the write, and
+// the copy could overwrite it with the stale source.
+func TestClusterFollowerRefusesMovingWrites(t *testing.T) {
+	endpoint := startEtcd(t)
+	n1, n2 := startStorageNode(t), startStorageNode(t)
+	a, _ := joinWebServer(t, endpoint, "web-a", []StorageNode{n1})
+	b, _ := joinWebServer(t, endpoint, "web-b", []StorageNode{n1})
+	waitFor(t, "a leader", func() bool { return a.leading() || b.leading() })
+	leader, follower := a, b
+	if b.leading() {
+		leader, follower = b, a
+	}
+
+	// Save a ring in the middle of adding n2, as the leader does while the
+	// migration runs.
+	cur := leader.ring.Load()
+	state := &RingState{
+		Version:   cur.version + 1,
+		Placement: cur.placement,
+		Nodes:     []StorageNode{n1, n2},
+		Prev:      []StorageNode{n1},
+	}
+	if err := leader.membership.SaveRing(state); err != nil {
+		t.Fatalf("save ring: %v", err)
+	}
+	waitFor(t, "the follower to see the migration", func() bool {
+		r := follower.ring.Load()
+		return r.version == state.Version && r.prev != nil
+	})
+
+	var moving, staying string
+	for i := 0; moving == "" || staying == ""; i++ {
+		name := fmt.Sprintf("chunk-%d.m4s", i)
+		if follower.ring.Load().moves("v/"+name, 0) {
+			moving = name
+		} else {
+			staying = name
+		}
+	}
+	ctx := context.Background()
+	if err := follower.Write(ctx, "v", moving, []byte("new")); status.Code(err) != codes.Unavailable {
+		t.Errorf("follower write of a moving file: got %v, want Unavailable", err)
+	}
+	if err := follower.Delete(ctx, "v", moving); status.Code(err) != codes.Unavailable {
+		t.Errorf("follower delete of a moving file: got %v, want Unavailable", err)
+	}
+	if err := follower.Write(ctx, "v", staying, []byte("new")); err != nil {
+		t.Errorf("follower write of a file that stays: %v", err)
+	}
+	waitFor(t, "the leader to see the migration", func() bool { return leader.ring.Load().prev != nil })
+	if err := leader.Write(ctx, "v", moving, []byte("new")); err != nil {
+		t.Errorf("leader write of a moving file: %v", err)
+	}
+}
@@ -0,0 +1,138 @@
+// Connections from the web tier to the storage nodes
+
+package web
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/status"
+	"tritontube/internal/logging"
+	"tritontube/internal/metrics"
+	pb "tritontube/internal/proto"
+	"tritontube/internal/tracing"
+)
+
+// DefaultRPCTimeout bounds a storage RPC when neither the caller nor the
+// NetworkConfig sets a deadline.
+const DefaultRPCTimeout = 10 * time.Second
+
+// storageServiceConfig lets gRPC retry the storage RPCs that are safe to
+// repeat when a node is briefly unavailable. Writes and deletes are not
+// retried here; uploads retry writes themselves.
+const storageServiceConfig = `{
+	"methodConfig": [{
+		"name": [
+			{"service": "storage.StorageService", "method": "ReadVideo"},
+			{"service": "storage.StorageService", "method": "ListFiles"},
+			{"service": "storage.StorageService", "method": "Stat"}
+		],
+		"retryPolicy": {
+			"maxAttempts": 3,
+			"initialBackoff": "0.05s",
+			"maxBackoff": "0.5s",
+			"backoffMultiplier": 2,
+			"retryableStatusCodes": ["UNAVAILABLE"]
+		}
+	}]
+}`
+
+// StorageKeepalive pings idle connections to storage nodes so that a node
+// that went away is noticed before the next request to it. Storage servers
+// must permit pings this often; see cmd/storage.
+var StorageKeepalive = keepalive.ClientParameters{
+	Time:                30 * time.Second,
+	Timeout:             10 * time.Second,
+	PermitWithoutStream: true,
+}
+
+type storageConn struct {
+	conn   *grpc.ClientConn
+	client pb.StorageServiceClient
+}
+
+// client returns the storage client for addr, connecting to it if needed.
+// Migrations use it to reach nodes that have already left the ring. It fails
+// with InvalidArgument for an address gRPC cannot connect to at all, which
+// is not cached, so every use reports it.
+func (s *NetworkVideoContentService) client(addr string) (pb.StorageServiceClient, error) {
+	s.clientsMu.RLock()
+	c, ok := s.clients[addr]
+	s.clientsMu.RUnlock()
+	if ok {
+		return c.client, nil
+	}
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	if c, ok := s.clients[addr]; ok {
+		return c.client, nil
+	}
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultServiceConfig(storageServiceConfig),
+		grpc.WithKeepaliveParams(StorageKeepalive),
+		grpc.WithChainUnaryInterceptor(s.withDeadline, metrics.UnaryClientInterceptor, logging.UnaryClientInterceptor),
+		tracing.DialOption(),
+	)
+	if err != nil {
+		// NewClient only fails on a malformed target.
+		return nil, status.Errorf(codes.InvalidArgument, "connect to storage node %s: %v", addr, err)
+	}
+	c = &storageConn{conn: conn, client: pb.NewStorageServiceClient(conn)}
+	s.clients[addr] = c
+	return c.client, nil
+}
+
+// listFiles lists the files stored on addr.
+func (s *NetworkVideoContentService) listFiles(ctx context.Context, addr string) (*pb.ListResponse, error) {
+	c, err := s.client(addr)
+	if err != nil {
+		return nil, err
+	}
+	return c.ListFiles(ctx, &pb.ListRequest{})
+}
+
+// withDeadline gives every storage RPC without a deadline the service's
+// RPC timeout.
+func (s *NetworkVideoContentService) withDeadline(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.rpcTimeout)
+		defer cancel()
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+// setRing makes r the current ring and closes the connections to nodes
+// that are in neither r nor the rings it is migrating from.
+func (s *NetworkVideoContentService) setRing(r *ring) {
+	s.ring.Store(r)
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	for addr, c := range s.clients {
+		if r.known(addr) {
+			continue
+		}
+		delete(s.clients, addr)
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	}
+}
+
+// Close closes the connections to every storage node.
+func (s *NetworkVideoContentService) Close() error {
+	s.clientsMu.Lock()
+	defer s.clientsMu.Unlock()
+	for addr, c := range s.clients {
+		delete(s.clients, addr)
+		if c.conn != nil {
+			c.conn.Close()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+// Content-addressed storage of video segments, deduplicated by digest
+
+package web
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"tritontube/internal/checksum"
+	pb "tritontube/internal/proto"
+)
+
+// DedupBlob is one stored piece of content, named by its SHA-256 digest.
+type DedupBlob struct {
+	Digest string
+	Size   int64
+	// Stored is false until the blob has been written to the content store.
+	Stored bool
+}
+
+// DedupStats sums up a dedup index.
+type DedupStats struct {
+	Files        int64
+	Blobs        int64
+	LogicalBytes int64
+	StoredBytes  int64
+}
+
+// blobVideoPrefix starts the video id of every blob. Blobs are spread over
+// 256 such ids by the first byte of their digest, and their filename is the
+// digest, so the ring places them by content.
+const blobVideoPrefix = "_cas-"
+
+// dedupSuffix marks the files worth deduplicating: media segments, which
+// repeat across uploads of the same or similar videos. Manifests are small
+// and differ per upload, so they are stored as they are.
+const dedupSuffix = ".m4s"
+
+func blobKey(digest string) (videoId, filename string) {
+	return blobVideoPrefix + digest[:2], digest
+}
+
+// DedupVideoContentService stores each distinct segment once in the wrapped
+// content service, under its digest, and keeps the names of segments in an
+// index. Other files, and segments written before deduplication was turned
+// on, are passed through unchanged.
+type DedupVideoContentService struct {
+	pb.UnimplementedDedupAdminServiceServer
+	store VideoContentService
+	index DedupIndex
+	// gcMu keeps garbage collection from deleting a blob between a write
+	// finding it already stored and the write taking its reference.
+	gcMu sync.RWMutex
+}
+
+var _ VideoContentService = (*DedupVideoContentService)(nil)
+var _ VideoContentLister = (*DedupVideoContentService)(nil)
+var _ VideoContentPlacer = (*DedupVideoContentService)(nil)
+var _ VideoContentDeleter = (*DedupVideoContentService)(nil)
+var _ pb.DedupAdminServiceServer = (*DedupVideoContentService)(nil)
+
+func NewDedupVideoContentService(store VideoContentService, index DedupIndex) *DedupVideoContentService {
+	return &DedupVideoContentService{store: store, index: index}
+}
+
+func (s *DedupVideoContentService) Read(ctx context.Context, videoId string, filename string) ([]byte, error) {
+	if !strings.HasSuffix(filename, dedupSuffix) {
+		return s.store.Read(ctx, videoId, filename)
+	}
+	digest, err := s.index.Resolve(videoId, filename)
+	if err != nil {
+		return nil, fmt.Errorf("dedup read: %v", err)
+	}
+	if digest == "" {
+		return s.store.Read(ctx, videoId, filename)
+	}
+	blobVideo, blobName := blobKey(digest)
+	data, err := s.store.Read(ctx, blobVideo, blobName)
+	if err != nil {
+		return nil, fmt.Errorf("dedup read %s/%s: %v", videoId, filename, err)
+	}
+	if got := hex.EncodeToString(checksum.Sum(data)); got != digest {
+		return nil, fmt.Errorf("dedup read %s/%s: blob %s has digest %s", videoId, filename, digest, got)
+	}
+	return data, nil
+}
+
+func (s *DedupVideoContentService) Write(ctx context.Context, videoId string, filename string, data []byte) error {
+	if strings.HasPrefix(videoId, blobVideoPrefix) {
+		return fmt.Errorf("dedup write: video id %q is reserved for blobs", videoId)
+	}
+	if !strings.HasSuffix(filename, dedupSuffix) {
+		return s.store.Write(ctx, videoId, filename, data)
+	}
+	digest := hex.EncodeToString(checksum.Sum(data))
+	s.gcMu.RLock()
+	defer s.gcMu.RUnlock()
+	old, err := s.index.Resolve(videoId, filename)
+	if err != nil {
+		return fmt.Errorf("dedup write: %v", err)
+	}
+	store, err := s.index.Link(videoId, filename, digest, int64(len(data)))
+	if err != nil {
+		return fmt.Errorf("dedup write: %v", err)
+	}
+	if !store {
+		return nil
+	}
+	blobVideo, blobName := blobKey(digest)
+	if err := s.store.Write(ctx, blobVideo, blobName, data); err != nil {
+		s.relink(ctx, videoId, filename, old)
+		return err
+	}
+	if err := s.index.Stored(digest); err != nil {
+		return fmt.Errorf("dedup write: %v", err)
+	}
+	return nil
+}
+
+// relink points a name back at the digest it had before a write that
+// failed, or unlinks it if it had none or that blob is not stored. The
+// caller holds gcMu, so the old blob cannot have been collected meanwhile.
+func (s *DedupVideoContentService) relink(ctx context.Context, videoId, filename, digest string) {
+	if digest != "" {
+		store, err := s.index.Link(videoId, filename, digest, 0)
+		if err == nil && !store {
+			return
+		}
+		if err != nil {
+			slog.WarnContext(ctx, "dedup write: relink failed", "video", videoId, "file", filename, "err", err)
+		}
+	}
+	if err := s.index.Unlink(videoId, filename); err != nil {
+		slog.WarnContext(ctx, "dedup write: unlink failed", "video", videoId, "file", filename, "err", err)
+	}
+}
+
+// Delete unlinks a deduplicated segment, leaving its blob to
+// CollectGarbage, or deletes a file of the wrapped store.
+func (s *DedupVideoContentService) Delete(ctx context.Context, videoId string, filename string) error {
+	if strings.HasSuffix(filename, dedupSuffix) {
+		digest, err := s.index.Resolve(videoId, filename)
+		if err != nil {
+			return fmt.Errorf("dedup delete: %v", err)
+		}
+		if digest != "" {
+			if err := s.index.Unlink(videoId, filename); err != nil {
+				return fmt.Errorf("dedup unlink: %v", err)
+			}
+			return nil
+		}
+	}
+	deleter, ok := s.store.(VideoContentDeleter)
+	if !ok {
+		return fmt.Errorf("content store %T cannot delete files", s.store)
+	}
+	return deleter.Delete(ctx, videoId, filename)
+}
+
+// NodeFor places files passed through to the store; where a segment goes
+// depends on its digest, so it is unknown.
+func (s *DedupVideoContentService) NodeFor(videoId string, filename string) string {
+	if placer, ok := s.store.(VideoContentPlacer); ok && !strings.HasSuffix(filename, dedupSuffix) {
+		return placer.NodeFor(videoId, filename)
+	}
+	return ""
+}
+
+// CheckHealth checks the content store the blobs are kept in.
+func (s *DedupVideoContentService) CheckHealth(ctx context.Context) error {
+	if c, ok := s.store.(HealthChecker); ok {
+		return c.CheckHealth(ctx)
+	}
+	return nil
+}
+
+// dedupNode is the Node of the names ListStored returns from the index.
+const dedupNode = "dedup-index"
+
+// ListStored lists the deduplicated names and the files of the wrapped
+// store other than blobs, which CollectGarbage looks after. The store must
+// be a VideoContentLister.
+func (s *DedupVideoContentService) ListStored(ctx context.Context) ([]StoredFile, error) {
+	lister, ok := s.store.(VideoContentLister)
+	if !ok {
+		return nil, fmt.Errorf("content store %T cannot list files", s.store)
+	}
+	stored, err := lister.ListStored(ctx)
+	if err != nil {
+		return nil, err
+	}
+	files, err := s.index.Names()
+	if err != nil {
+		return nil, fmt.Errorf("dedup list: %v", err)
+	}
+	for i := range files {
+		files[i].Node = dedupNode
+	}
+	for _, f := range stored {
+		if !strings.HasPrefix(f.VideoId, blobVideoPrefix) {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// DeleteStored unlinks a deduplicated name, leaving its blob to
+// CollectGarbage, or deletes a file of the wrapped store.
+func (s *DedupVideoContentService) DeleteStored(ctx context.Context, f StoredFile) error {
+	if f.Node == dedupNode {
+		if err := s.index.Unlink(f.VideoId, f.Filename); err != nil {
+			return fmt.Errorf("dedup unlink: %v", err)
+		}
+		return nil
+	}
+	return s.store.(VideoContentLister).DeleteStored(ctx, f)
+}
+
+// CollectGarbage deletes every blob that has had no references since
+// before the given time from the content store, and returns how many blobs
+// and bytes it freed. The content store must be a VideoContentDeleter.
+func (s *DedupVideoContentService) CollectGarbage(ctx context.Context, before time.Time) (int, int64, error) {
+	deleter, ok := s.store.(VideoContentDeleter)
+	if !ok {
+		return 0, 0, fmt.Errorf("content store %T cannot delete blobs", s.store)
+	}
+	blobs, err := s.index.Unreferenced(before)
+	if err != nil {
+		return 0, 0, fmt.Errorf("list unreferenced blobs: %v", err)
+	}
+	freed, bytes := 0, int64(0)
+	for _, b := range blobs {
+		if ctx.Err() != nil {
+			return freed, bytes, ctx.Err()
+		}
+		s.gcMu.Lock()
+		forgotten, err := s.index.Forget(b.Digest)
+		if err == nil && forgotten && b.Stored {
+			blobVideo, blobName := blobKey(b.Digest)
+			err = deleter.Delete(ctx, blobVideo, blobName)
+		}
+		s.gcMu.Unlock()
+		if err != nil {
+			slog.WarnContext(ctx, "dedup gc: delete blob failed", "digest", b.Digest, "err", err)
+			continue
+		}
+		if forgotten {
+			freed++
+			bytes += b.Size
+		}
+	}
+	return freed, bytes, nil
+}
+
+// RunGarbageCollector collects unreferenced blobs every interval until ctx
+// is done.
+func (s *DedupVideoContentService) RunGarbageCollector(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		freed, bytes, err := s.CollectGarbage(ctx, time.Now())
+		if err != nil {
+			slog.ErrorContext(ctx, "dedup gc failed", "err", err)
+			continue
+		}
+		if freed > 0 {
+			slog.InfoContext(ctx, "dedup gc: deleted unreferenced blobs", "blobs", freed, "bytes", bytes)
+		}
+	}
+}
+
+func (s *DedupVideoContentService) GetDedupStats(ctx context.Context, req *pb.GetDedupStatsRequest) (*pb.GetDedupStatsResponse, error) {
+	st, err := s.index.Stats()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	return &pb.GetDedupStatsResponse{
+		FileCount:    st.Files,
+		BlobCount:    st.Blobs,
+		LogicalBytes: st.LogicalBytes,
+		StoredBytes:  st.StoredBytes,
+		SavedBytes:   st.LogicalBytes - st.StoredBytes,
+	}, nil
+}
@@ -0,0 +1,100 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"tritontube/internal/checksum"
+)
+
+func newDedupService(t *testing.T) (*DedupVideoContentService, *FSVideoContentService) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	index, err := NewSQLiteDedupIndex(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewFSVideoContentService(t.TempDir())
+	return NewDedupVideoContentService(store, index), store
+}
+
+// TestDedupReferenceCounts shares one segment between two videos, then
+// overwrites and deletes the names. A blob must be stored once, survive as
+// long as any name refers to it, and be collected only after it has had no
+// references since before the time given to CollectGarbage.
+func TestDedupReferenceCounts(t *testing.T) {
+	s, store := newDedupService(t)
+	ctx := context.Background()
+	shared, other := []byte("shared segment"), []byte("other segment")
+	blobStored := func(data []byte) bool {
+		video, name := blobKey(hex.EncodeToString(checksum.Sum(data)))
+		_, err := store.Read(ctx, video, name)
+		return err == nil
+	}
+	checkStats := func(when string, want DedupStats) {
+		t.Helper()
+		got, err := s.index.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Fatalf("stats %s: %+v, want %+v", when, got, want)
+		}
+	}
+	collect := func(when string, before time.Time, want int) {
+		t.Helper()
+		freed, _, err := s.CollectGarbage(ctx, before)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if freed != want {
+			t.Fatalf("gc %s freed %d blobs, want %d", when, freed, want)
+		}
+	}
+	for _, video := range []string{"a", "b"} {
+		if err := s.Write(ctx, video, "seg0.m4s", shared); err != nil {
+			t.Fatal(err)
+		}
+	}
+	n := int64(len(shared))
+	checkStats("after writing one segment twice", DedupStats{Files: 2, Blobs: 1, LogicalBytes: 2 * n, StoredBytes: n})
+
+	if err := s.Write(ctx, "a", "seg0.m4s", other); err != nil {
+		t.Fatal(err)
+	}
+	collect("after an overwrite", time.Now().Add(time.Second), 0)
+	if !blobStored(shared) || !blobStored(other) {
+		t.Fatal("a blob still referred to was deleted")
+	}
+
+	if err := s.Delete(ctx, "b", "seg0.m4s"); err != nil {
+		t.Fatal(err)
+	}
+	collect("with a grace period", time.Now().Add(-time.Minute), 0)
+	if !blobStored(shared) {
+		t.Fatal("a blob released within the grace period was deleted")
+	}
+	collect("after the last reference went", time.Now().Add(time.Second), 1)
+	if blobStored(shared) {
+		t.Fatal("the unreferenced blob is still stored")
+	}
+	if got, err := s.Read(ctx, "a", "seg0.m4s"); err != nil || string(got) != string(other) {
+		t.Fatalf("read the overwritten segment: %q, %v", got, err)
+	}
+	checkStats("after the collection", DedupStats{Files: 1, Blobs: 1, LogicalBytes: int64(len(other)), StoredBytes: int64(len(other))})
+
+	if err := s.Write(ctx, "a", "index.m3u8", []byte("#EXTM3U")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Read(ctx, "a", "index.m3u8"); err != nil || string(got) != "#EXTM3U" {
+		t.Fatalf("manifest was not passed through: %q, %v", got, err)
+	}
+}
@@ -0,0 +1,407 @@
+// Edge cache that serves video content from a local disk in front of an
+// origin web server
+
+package web
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"tritontube/internal/logging"
+	"tritontube/internal/videokey"
+)
+
+// EdgeConfig configures an EdgeServer.
+type EdgeConfig struct {
+	// Dir holds the cached files, up to MaxBytes. Files cached there by an
+	// earlier run are discarded.
+	Dir      string
+	MaxBytes int64
+	// TTL is how long a file is served without asking the origin when the
+	// origin sends no max-age. MaxTTL, if set, caps the origin's max-age.
+	TTL    time.Duration
+	MaxTTL time.Duration
+	// Prefetch is how many segments following a requested one are fetched
+	// ahead, by at most PrefetchWorkers requests at a time.
+	Prefetch        int
+	PrefetchWorkers int
+	// Timeout bounds each request to the origin.
+	Timeout time.Duration
+}
+
+// EdgeStats counts the work of an EdgeServer.
+type EdgeStats struct {
+	Hits int64 `json:"hits"`
+	// Revalidated files had expired but the origin answered that they had
+	// not changed.
+	Revalidated int64 `json:"revalidated"`
+	Misses      int64 `json:"misses"`
+	Collapsed   int64 `json:"collapsed"`
+	// Prefetched files were fetched ahead; PrefetchHits of them were then
+	// requested while still cached.
+	Prefetched   int64 `json:"prefetched"`
+	PrefetchHits int64 `json:"prefetch_hits"`
+	OriginErrors int64 `json:"origin_errors"`
+	Entries      int64 `json:"entries"`
+	Bytes        int64 `json:"bytes"`
+}
+
+// edgeEntry describes a cached file; its content is in the disk cache.
+type edgeEntry struct {
+	etag         string
+	contentType  string
+	cacheControl string
+	expires      time.Time
+	prefetched   bool
+}
+
+// edgeObject is what the edge answers for a content file: the cached
+// file, or an origin response that was not cached.
+type edgeObject struct {
+	status int
+	entry  edgeEntry
+	data   []byte
+	// hit is set if the file was served from the cache.
+	hit bool
+}
+
+type edgeFlight struct {
+	done chan struct{}
+	obj  *edgeObject
+	err  error
+}
+
+// EdgeServer serves /content/ from its disk cache, fetching misses from the
+// origin, and passes every other request through to the origin.
+type EdgeServer struct {
+	origin *url.URL
+	config EdgeConfig
+	client *http.Client
+	disk   *diskCache
+	proxy  *httputil.ReverseProxy
+	// prefetchSlots holds a token for every prefetch running.
+	prefetchSlots chan struct{}
+
+	mu      sync.Mutex
+	entries map[string]*edgeEntry
+	flights map[string]*edgeFlight
+
+	hits, revalidated, misses, collapsed, prefetched, prefetchHits, originErrors atomic.Int64
+}
+
+func NewEdgeServer(origin string, config EdgeConfig) (*EdgeServer, error) {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid origin %q", origin)
+	}
+	disk, err := newDiskCache(config.Dir, config.MaxBytes)
+	if err != nil {
+		return nil, err
+	}
+	if config.PrefetchWorkers <= 0 {
+		config.PrefetchWorkers = 1
+	}
+	return &EdgeServer{
+		origin:        u,
+		config:        config,
+		client:        &http.Client{Timeout: config.Timeout},
+		disk:          disk,
+		proxy:         httputil.NewSingleHostReverseProxy(u),
+		prefetchSlots: make(chan struct{}, config.PrefetchWorkers),
+		entries:       make(map[string]*edgeEntry),
+		flights:       make(map[string]*edgeFlight),
+	}, nil
+}
+
+func (e *EdgeServer) Start(lis net.Listener) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/content/", e.handleContent)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/", e.proxy)
+	return http.Serve(lis, logging.Handler(mux))
+}
+
+func (e *EdgeServer) handleContent(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path[len("/content/"):], "/")
+	if len(parts) != 2 {
+		http.Error(w, "Path error", http.StatusBadRequest)
+		return
+	}
+	videoId, filename := parts[0], parts[1]
+	if _, err := videokey.New(videoId, filename); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	obj, err := e.get(videoId, filename, false)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "edge: fetch from origin failed", "path", r.URL.Path, "err", err)
+		http.Error(w, "Origin unavailable", http.StatusBadGateway)
+		return
+	}
+	if obj.status != http.StatusOK {
+		w.WriteHeader(obj.status)
+		w.Write(obj.data)
+		return
+	}
+	go e.prefetchAfter(videoId, filename)
+
+	w.Header().Set("Content-Type", obj.entry.contentType)
+	if obj.entry.etag != "" {
+		w.Header().Set("ETag", obj.entry.etag)
+	}
+	if obj.entry.cacheControl != "" {
+		w.Header().Set("Cache-Control", obj.entry.cacheControl)
+	}
+	if obj.hit {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && match == obj.entry.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Length", fmt.Sprint(len(obj.data)))
+	w.Write(obj.data)
+}
+
+// get returns a content file from the cache, or from the origin if it is
+// not cached or has expired. Concurrent misses of a file share one origin
+// request.
+func (e *EdgeServer) get(videoId, filename string, prefetch bool) (*edgeObject, error) {
+	key := fmt.Sprintf("%s/%s", videoId, filename)
+	e.mu.Lock()
+	ent := e.entries[key]
+	if ent != nil && time.Now().Before(ent.expires) {
+		if ent.prefetched && !prefetch {
+			ent.prefetched = false
+			e.prefetchHits.Add(1)
+		}
+		cached := *ent
+		e.mu.Unlock()
+		if data, ok := e.disk.get(key); ok {
+			if !prefetch {
+				e.hits.Add(1)
+			}
+			return &edgeObject{status: http.StatusOK, entry: cached, data: data, hit: true}, nil
+		}
+		// Evicted from disk since; fetch it again.
+		e.mu.Lock()
+		if e.entries[key] == ent {
+			delete(e.entries, key)
+		}
+		ent = nil
+	}
+	if f, ok := e.flights[key]; ok {
+		e.mu.Unlock()
+		e.collapsed.Add(1)
+		<-f.done
+		return f.obj, f.err
+	}
+	var stale *edgeEntry
+	if ent != nil {
+		c := *ent
+		stale = &c
+	}
+	f := &edgeFlight{done: make(chan struct{})}
+	e.flights[key] = f
+	e.mu.Unlock()
+
+	f.obj, f.err = e.fetch(key, videoId, filename, stale)
+	if f.err != nil {
+		e.originErrors.Add(1)
+	} else if prefetch && !f.obj.hit && f.obj.status == http.StatusOK {
+		e.prefetched.Add(1)
+	}
+	e.mu.Lock()
+	delete(e.flights, key)
+	if ent, ok := e.entries[key]; ok && prefetch && f.err == nil && !f.obj.hit {
+		ent.prefetched = true
+	}
+	e.mu.Unlock()
+	close(f.done)
+	return f.obj, f.err
+}
+
+// fetch asks the origin for a file, revalidating the stale entry if there
+// is one, and caches what the origin allows.
+func (e *EdgeServer) fetch(key, videoId, filename string, stale *edgeEntry) (*edgeObject, error) {
+	u := *e.origin
+	u.Path = "/content/" + videoId + "/" + filename
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if stale != nil && stale.etag != "" {
+		req.Header.Set("If-None-Match", stale.etag)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %v", key, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && stale != nil {
+		if data, ok := e.disk.get(key); ok {
+			e.revalidated.Add(1)
+			ent := *stale
+			if cc := resp.Header.Get("Cache-Control"); cc != "" {
+				ent.cacheControl = cc
+			}
+			ent.expires = time.Now().Add(e.ttl(ent.cacheControl))
+			e.mu.Lock()
+			e.entries[key] = &ent
+			e.mu.Unlock()
+			return &edgeObject{status: http.StatusOK, entry: ent, data: data, hit: true}, nil
+		}
+		// The cached copy is gone; fetch the file unconditionally.
+		return e.fetch(key, videoId, filename, nil)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetch %s: %v", key, err)
+	}
+	e.misses.Add(1)
+	ent := edgeEntry{
+		etag:         resp.Header.Get("ETag"),
+		contentType:  resp.Header.Get("Content-Type"),
+		cacheControl: resp.Header.Get("Cache-Control"),
+	}
+	obj := &edgeObject{status: resp.StatusCode, entry: ent, data: data}
+	if resp.StatusCode != http.StatusOK || !cacheable(ent.cacheControl) {
+		e.mu.Lock()
+		delete(e.entries, key)
+		e.mu.Unlock()
+		e.disk.remove(key)
+		return obj, nil
+	}
+	ent.expires = time.Now().Add(e.ttl(ent.cacheControl))
+	evicted := e.disk.put(key, data)
+	e.mu.Lock()
+	e.entries[key] = &ent
+	for _, k := range evicted {
+		delete(e.entries, k)
+	}
+	e.mu.Unlock()
+	return obj, nil
+}
+
+// cacheable reports whether a response with the given Cache-Control may be
+// kept by a shared cache.
+func cacheable(cacheControl string) bool {
+	for _, d := range strings.Split(cacheControl, ",") {
+		switch strings.ToLower(strings.TrimSpace(d)) {
+		case "no-store", "private":
+			return false
+		}
+	}
+	return true
+}
+
+// ttl is how long a response with the given Cache-Control stays fresh.
+// no-cache makes it expire at once, so every request revalidates it.
+func (e *EdgeServer) ttl(cacheControl string) time.Duration {
+	ttl := e.config.TTL
+	for _, d := range strings.Split(cacheControl, ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d == "no-cache" {
+			return 0
+		}
+		if v, ok := strings.CutPrefix(d, "s-maxage="); ok {
+			if secs, err := strconv.Atoi(v); err == nil {
+				ttl = time.Duration(secs) * time.Second
+				break
+			}
+		}
+		if v, ok := strings.CutPrefix(d, "max-age="); ok {
+			if secs, err := strconv.Atoi(v); err == nil {
+				ttl = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	if e.config.MaxTTL > 0 && ttl > e.config.MaxTTL {
+		ttl = e.config.MaxTTL
+	}
+	return ttl
+}
+
+// The names ffmpeg gives segments on upload; see handleUpload.
+var (
+	initSegment  = regexp.MustCompile(`^init-(.+)\.m4s$`)
+	mediaSegment = regexp.MustCompile(`^(chunk-.+-)(\d+)\.m4s$`)
+)
+
+// nextSegments names the n segments of the same representation that follow
+// filename, or none if filename is not a segment.
+func nextSegments(filename string, n int) []string {
+	prefix, first, width := "", 0, 5
+	if m := initSegment.FindStringSubmatch(filename); m != nil {
+		prefix, first = "chunk-"+m[1]+"-", 1
+	} else if m := mediaSegment.FindStringSubmatch(filename); m != nil {
+		num, err := strconv.Atoi(m[2])
+		if err != nil {
+			return nil
+		}
+		prefix, first, width = m[1], num+1, len(m[2])
+	} else {
+		return nil
+	}
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s%0*d.m4s", prefix, width, first+i)
+	}
+	return names
+}
+
+// prefetchAfter fetches the segments following filename into the cache.
+// Segments are skipped while all prefetch workers are busy, so prefetching
+// never queues up behind slow origin requests.
+func (e *EdgeServer) prefetchAfter(videoId, filename string) {
+	for _, name := range nextSegments(filename, e.config.Prefetch) {
+		key := fmt.Sprintf("%s/%s", videoId, name)
+		e.mu.Lock()
+		ent, cached := e.entries[key]
+		_, loading := e.flights[key]
+		e.mu.Unlock()
+		if loading || (cached && time.Now().Before(ent.expires)) {
+			continue
+		}
+		select {
+		case e.prefetchSlots <- struct{}{}:
+		default:
+			return
+		}
+		go func() {
+			defer func() { <-e.prefetchSlots }()
+			if _, err := e.get(videoId, name, true); err != nil {
+				slog.Debug("edge prefetch failed", "video", videoId, "err", err)
+			}
+		}()
+	}
+}
+
+// Stats returns the edge's counters and the size of its cache.
+func (e *EdgeServer) Stats() EdgeStats {
+	st := EdgeStats{
+		Hits:         e.hits.Load(),
+		Revalidated:  e.revalidated.Load(),
+		Misses:       e.misses.Load(),
+		Collapsed:    e.collapsed.Load(),
+		Prefetched:   e.prefetched.Load(),
+		PrefetchHits: e.prefetchHits.Load(),
+		OriginErrors: e.originErrors.Load(),
+	}
+	st.Entries, st.Bytes = e.disk.lru.usage()
+	return st
+}
@@ -0,0 +1,173 @@
+package web
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testOrigin serves /content/ files from a map, with an ETag per version,
+// and counts the requests that reach it.
+type testOrigin struct {
+	mu           sync.Mutex
+	files        map[string]string
+	versions     map[string]int
+	cacheControl string
+	fail         bool
+	requests     int
+	conditional  int
+}
+
+func (o *testOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests++
+	if o.fail {
+		http.Error(w, "storage unavailable", http.StatusInternalServerError)
+		return
+	}
+	body, ok := o.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	etag := fmt.Sprintf(`"v%d"`, o.versions[r.URL.Path])
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "video/mp4")
+	if o.cacheControl != "" {
+		w.Header().Set("Cache-Control", o.cacheControl)
+	}
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		o.conditional++
+		if inm == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	io.WriteString(w, body)
+}
+
+func (o *testOrigin) set(path, body string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.files[path] = body
+	o.versions[path]++
+}
+
+func (o *testOrigin) counts() (requests, conditional int) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.requests, o.conditional
+}
+
+// startEdge starts an origin and an edge in front of it.
+func startEdge(t *testing.T, ttl time.Duration) (*testOrigin, *httptest.Server, *EdgeServer, *httptest.Server) {
+	t.Helper()
+	origin := &testOrigin{files: make(map[string]string), versions: make(map[string]int)}
+	originSrv := httptest.NewServer(origin)
+	t.Cleanup(originSrv.Close)
+	edge, err := NewEdgeServer(originSrv.URL, EdgeConfig{
+		Dir:      t.TempDir(),
+		MaxBytes: 1 << 20,
+		TTL:      ttl,
+		Timeout:  2 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	edgeSrv := httptest.NewServer(http.HandlerFunc(edge.handleContent))
+	t.Cleanup(edgeSrv.Close)
+	return origin, originSrv, edge, edgeSrv
+}
+
+// getEdge fetches path from the edge and returns the status, X-Cache and body.
+func getEdge(t *testing.T, srv *httptest.Server, path string) (int, string, string) {
+	t.Helper()
+	resp, err := http.Get(srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, resp.Header.Get("X-Cache"), string(body)
+}
+
+func TestEdgeMissThenHit(t *testing.T) {
+	origin, _, edge, srv := startEdge(t, time.Minute)
+	origin.set("/content/v/index.m3u8", "manifest")
+
+	if code, cache, body := getEdge(t, srv, "/content/v/index.m3u8"); code != http.StatusOK || cache != "MISS" || body != "manifest" {
+		t.Fatalf("first request: %d %s %q; want 200 MISS manifest", code, cache, body)
+	}
+	if code, cache, body := getEdge(t, srv, "/content/v/index.m3u8"); code != http.StatusOK || cache != "HIT" || body != "manifest" {
+		t.Fatalf("second request: %d %s %q; want 200 HIT manifest", code, cache, body)
+	}
+	if requests, _ := origin.counts(); requests != 1 {
+		t.Errorf("origin got %d requests, want 1", requests)
+	}
+	if st := edge.Stats(); st.Hits != 1 || st.Misses != 1 {
+		t.Errorf("stats %+v, want 1 hit and 1 miss", st)
+	}
+}
+
+func TestEdgeRevalidates(t *testing.T) {
+	origin, _, edge, srv := startEdge(t, time.Minute)
+	// no-cache makes every request check with the origin.
+	origin.cacheControl = "no-cache"
+	origin.set("/content/v/seg.m4s", "one")
+
+	getEdge(t, srv, "/content/v/seg.m4s")
+	if code, cache, body := getEdge(t, srv, "/content/v/seg.m4s"); code != http.StatusOK || cache != "HIT" || body != "one" {
+		t.Fatalf("unchanged file: %d %s %q; want 200 HIT one", code, cache, body)
+	}
+	if _, conditional := origin.counts(); conditional != 1 {
+		t.Errorf("origin got %d conditional requests, want 1", conditional)
+	}
+	if st := edge.Stats(); st.Revalidated != 1 {
+		t.Errorf("revalidated %d, want 1", st.Revalidated)
+	}
+
+	origin.set("/content/v/seg.m4s", "two")
+	if code, cache, body := getEdge(t, srv, "/content/v/seg.m4s"); code != http.StatusOK || cache != "MISS" || body != "two" {
+		t.Fatalf("changed file: %d %s %q; want 200 MISS two", code, cache, body)
+	}
+}
+
+func TestEdgeOriginFailure(t *testing.T) {
+	origin, originSrv, edge, srv := startEdge(t, time.Minute)
+	origin.set("/content/v/cached.m4s", "cached")
+	getEdge(t, srv, "/content/v/cached.m4s")
+
+	// Errors from the origin are passed on and not cached.
+	origin.mu.Lock()
+	origin.fail = true
+	origin.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		if code, _, _ := getEdge(t, srv, "/content/v/other.m4s"); code != http.StatusInternalServerError {
+			t.Fatalf("origin error: got %d, want 500", code)
+		}
+	}
+	if requests, _ := origin.counts(); requests != 3 {
+		t.Errorf("origin got %d requests, want 3: errors must not be cached", requests)
+	}
+
+	// With the origin gone, cached files are still served and others fail
+	// with Bad Gateway.
+	originSrv.Close()
+	if code, cache, body := getEdge(t, srv, "/content/v/cached.m4s"); code != http.StatusOK || cache != "HIT" || body != "cached" {
+		t.Errorf("cached file with origin down: %d %s %q; want 200 HIT cached", code, cache, body)
+	}
+	if code, _, _ := getEdge(t, srv, "/content/v/other.m4s"); code != http.StatusBadGateway {
+		t.Errorf("uncached file with origin down: got %d, want 502", code)
+	}
+	if st := edge.Stats(); st.OriginErrors != 1 {
+		t.Errorf("origin errors %d, want 1", st.OriginErrors)
+	}
+}
@@ -0,0 +1,373 @@
+// Reed-Solomon erasure coding of large files across storage nodes
+
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/klauspost/reedsolomon"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"tritontube/internal/checksum"
+	pb "tritontube/internal/proto"
+)
+
+// ErasureConfig turns on erasure coding. A coded file is split into
+// DataShards pieces plus ParityShards parity pieces, each stored on a
+// different node, and stays readable while any ParityShards of those nodes
+// are missing. Like the placement, the shard counts cannot change once
+// coded files have been written.
+type ErasureConfig struct {
+	DataShards   int
+	ParityShards int
+	// MinSize codes every file of at least this many bytes; 0 codes no
+	// file because of its size.
+	MinSize int
+	// Videos are coded whatever the size of their files.
+	Videos []string
+}
+
+// Shards are stored next to where the file would be, as
+// "<filename>.shard<i>of<n>", and start with a header so a reader can check
+// that they belong together.
+var shardNameRe = regexp.MustCompile(`^(.+)\.shard(\d+)of(\d+)$`)
+
+const (
+	shardMagic      = "TTRS"
+	shardVersion    = 1
+	shardHeaderSize = 16
+)
+
+func shardName(filename string, i, n int) string {
+	return fmt.Sprintf("%s.shard%dof%d", filename, i, n)
+}
+
+// parseShardName splits a shard's filename into the coded file's name, the
+// shard index and the shard count.
+func parseShardName(name string) (filename string, i, n int, ok bool) {
+	m := shardNameRe.FindStringSubmatch(name)
+	if m == nil {
+		return "", 0, 0, false
+	}
+	i, _ = strconv.Atoi(m[2])
+	n, _ = strconv.Atoi(m[3])
+	if n == 0 || i >= n {
+		return "", 0, 0, false
+	}
+	return m[1], i, n, true
+}
+
+type shardHeader struct {
+	data, parity, index int
+	size                int64
+}
+
+func (h shardHeader) encode(payload []byte) []byte {
+	b := make([]byte, shardHeaderSize, shardHeaderSize+len(payload))
+	copy(b, shardMagic)
+	b[4] = shardVersion
+	b[5] = byte(h.data)
+	b[6] = byte(h.parity)
+	b[7] = byte(h.index)
+	binary.BigEndian.PutUint64(b[8:], uint64(h.size))
+	return append(b, payload...)
+}
+
+func decodeShard(b []byte) (shardHeader, []byte, error) {
+	if len(b) < shardHeaderSize || string(b[:4]) != shardMagic {
+		return shardHeader{}, nil, fmt.Errorf("not a shard")
+	}
+	if b[4] != shardVersion {
+		return shardHeader{}, nil, fmt.Errorf("unknown shard version %d", b[4])
+	}
+	h := shardHeader{
+		data:   int(b[5]),
+		parity: int(b[6]),
+		index:  int(b[7]),
+		size:   int64(binary.BigEndian.Uint64(b[8:16])),
+	}
+	return h, b[shardHeaderSize:], nil
+}
+
+// erasureCoder holds the settings and encoder of a service that codes files.
+type erasureCoder struct {
+	enc          reedsolomon.Encoder
+	data, parity int
+	minSize      int
+	videos       map[string]bool
+}
+
+func newErasureCoder(config ErasureConfig) (*erasureCoder, error) {
+	if config.DataShards <= 0 || config.ParityShards <= 0 {
+		return nil, fmt.Errorf("erasure coding needs at least one data and one parity shard")
+	}
+	if config.DataShards+config.ParityShards > 255 {
+		return nil, fmt.Errorf("erasure coding supports at most 255 shards")
+	}
+	enc, err := reedsolomon.New(config.DataShards, config.ParityShards)
+	if err != nil {
+		return nil, fmt.Errorf("erasure coder: %v", err)
+	}
+	c := &erasureCoder{
+		enc:     enc,
+		data:    config.DataShards,
+		parity:  config.ParityShards,
+		minSize: config.MinSize,
+		videos:  make(map[string]bool),
+	}
+	for _, v := range config.Videos {
+		c.videos[v] = true
+	}
+	return c, nil
+}
+
+func (c *erasureCoder) shards() int {
+	return c.data + c.parity
+}
+
+// coded reports whether a file of size bytes in videoId should be coded.
+func (c *erasureCoder) coded(videoId string, size int) bool {
+	return c.videos[videoId] || (c.minSize > 0 && size >= c.minSize)
+}
+
+// shardOwners returns the nodes that hold the shards of key in r, or nil if
+// r has too few active nodes to put every shard on a different one.
+func shardOwners(r *ring, key string, n int) []StorageNode {
+	if r == nil || r.place == nil || len(r.active) < n {
+		return nil
+	}
+	return r.place.Owners(key, n)
+}
+
+// writeCoded splits data into shards and writes shard i to the i-th owner
+// of the file. With fewer active nodes than shards the file is written
+// whole instead.
+func (s *NetworkVideoContentService) writeCoded(ctx context.Context, videoId, filename string, data []byte) error {
+	c := s.erasure
+	key := fmt.Sprintf("%s/%s", videoId, filename)
+	owners := shardOwners(s.ring.Load(), key, c.shards())
+	if owners == nil {
+		slog.WarnContext(ctx, "nw write: too few active nodes for shards, storing whole", "key", key, "shards", c.shards())
+		return s.writeWhole(ctx, videoId, filename, data)
+	}
+	shards, err := c.enc.Split(data)
+	if err != nil {
+		return fmt.Errorf("nw write error: split: %v", err)
+	}
+	if err := c.enc.Encode(shards); err != nil {
+		return fmt.Errorf("nw write error: encode: %v", err)
+	}
+	var wg sync.WaitGroup
+	errs := make([]error, len(shards))
+	for i := range shards {
+		name := shardName(filename, i, len(shards))
+		content := shardHeader{data: c.data, parity: c.parity, index: i, size: int64(len(data))}.encode(shards[i])
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.guard.write(fmt.Sprintf("%s/%s", videoId, name))
+			c, err := s.client(owners[i].Address)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			_, errs[i] = c.WriteVideo(ctx, &pb.WriteRequest{
+				VideoId:  videoId,
+				Filename: name,
+				Content:  content,
+				Sha256:   checksum.Sum(content),
+			})
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		// Shards that did get written are useless without the others.
+		written := make(map[string][]string)
+		for j := range shards {
+			if errs[j] == nil {
+				written[shardName(filename, j, len(shards))] = []string{owners[j].Address}
+			}
+		}
+		if _, derr := s.deleteCopies(context.WithoutCancel(ctx), videoId, written); derr != nil {
+			slog.WarnContext(ctx, "nw write: cannot remove shards of failed write", "key", key, "err", derr)
+		}
+		return fmt.Errorf("nw write error: shard %d on %s: %w", i, owners[i].Address, err)
+	}
+	// Reads try a whole copy first, so one left from before the file was
+	// coded would be served instead of the new contents.
+	addrs, err := s.ring.Load().owners(key)
+	if err != nil {
+		return fmt.Errorf("nw write error: %v", err)
+	}
+	if _, err := s.deleteCopies(ctx, videoId, map[string][]string{filename: addrs}); err != nil {
+		return fmt.Errorf("nw write error: remove whole copy: %w", err)
+	}
+	return nil
+}
+
+// shardCopies returns the name of every shard of key, with the nodes in r
+// and its earlier rings that may hold it.
+func (s *NetworkVideoContentService) shardCopies(r *ring, key, filename string) map[string][]string {
+	n := s.erasure.shards()
+	copies := make(map[string][]string)
+	for _, rr := range r.history() {
+		for i, o := range shardOwners(rr, key, n) {
+			name := shardName(filename, i, n)
+			copies[name] = append(copies[name], o.Address)
+		}
+	}
+	return copies
+}
+
+// inRings reports whether addr is in the current ring or an earlier one.
+func (s *NetworkVideoContentService) inRings(addr string) bool {
+	return s.ring.Load().known(addr)
+}
+
+// deleteCopies deletes each name in copies from the nodes listed for it.
+// Nodes that do not have the file are skipped. It reports whether any copy
+// was deleted. Like a write, a delete keeps a running migration from
+// copying the file back.
+func (s *NetworkVideoContentService) deleteCopies(ctx context.Context, videoId string, copies map[string][]string) (bool, error) {
+	deleted := false
+	for name, addrs := range copies {
+		s.guard.write(fmt.Sprintf("%s/%s", videoId, name))
+		for _, addr := range addrs {
+			c, err := s.client(addr)
+			if err == nil {
+				_, err = c.DeleteVideo(ctx, &pb.DeleteRequest{VideoId: videoId, Filename: name})
+			}
+			if status.Code(err) == codes.NotFound {
+				continue
+			}
+			if err != nil && !s.inRings(addr) {
+				// The node left when a migration finished meanwhile; its
+				// files are no longer read.
+				continue
+			}
+			if err != nil {
+				return deleted, fmt.Errorf("%s on %s: %w", name, addr, err)
+			}
+			deleted = true
+		}
+	}
+	return deleted, nil
+}
+
+// readShards fetches the shards of a coded file. Shard i is looked for on
+// the i-th owner in the current ring and then in the earlier ones, where
+// it may still be while a migration runs. Missing shards are nil; skip is
+// not fetched at all. It fails unless at least DataShards shards agree on
+// the file's layout.
+func (s *NetworkVideoContentService) readShards(ctx context.Context, videoId, filename string, skip int) ([][]byte, shardHeader, error) {
+	c := s.erasure
+	n := c.shards()
+	key := fmt.Sprintf("%s/%s", videoId, filename)
+	var owners [][]StorageNode
+	for _, r := range s.ring.Load().history() {
+		if o := shardOwners(r, key, n); o != nil {
+			owners = append(owners, o)
+		}
+	}
+	if len(owners) == 0 {
+		return nil, shardHeader{}, fmt.Errorf("fewer than %d active nodes", n)
+	}
+	shards := make([][]byte, n)
+	headers := make([]*shardHeader, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		if i == skip {
+			continue
+		}
+		var addrs []string
+		for _, o := range owners {
+			if !slices.Contains(addrs, o[i].Address) {
+				addrs = append(addrs, o[i].Address)
+			}
+		}
+		wg.Add(1)
+		go func(i int, addrs []string) {
+			defer wg.Done()
+			for _, addr := range addrs {
+				client, err := s.client(addr)
+				if err != nil {
+					continue
+				}
+				resp, err := client.ReadVideo(ctx, &pb.ReadRequest{VideoId: videoId, Filename: shardName(filename, i, n)})
+				if err == nil {
+					err = checksum.Verify(resp.Content, resp.Sha256)
+				}
+				if err != nil {
+					continue
+				}
+				h, payload, err := decodeShard(resp.Content)
+				if err != nil || h.index != i || h.data != c.data || h.parity != c.parity {
+					slog.WarnContext(ctx, "nw read: ignoring bad shard", "key", key, "shard", i, "node", addr)
+					continue
+				}
+				shards[i], headers[i] = payload, &h
+				return
+			}
+		}(i, addrs)
+	}
+	wg.Wait()
+	var found *shardHeader
+	have := 0
+	for i, h := range headers {
+		if h == nil {
+			continue
+		}
+		if found != nil && h.size != found.size {
+			slog.WarnContext(ctx, "nw read: shard disagrees on size, ignoring it", "key", key, "shard", i)
+			shards[i] = nil
+			continue
+		}
+		found = h
+		have++
+	}
+	if have < c.data {
+		return nil, shardHeader{}, fmt.Errorf("only %d of %d shards of %s are readable, need %d", have, n, key, c.data)
+	}
+	return shards, *found, nil
+}
+
+// readCoded reassembles a coded file from any DataShards of its shards.
+func (s *NetworkVideoContentService) readCoded(ctx context.Context, videoId, filename string) ([]byte, error) {
+	shards, h, err := s.readShards(ctx, videoId, filename, -1)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.erasure.enc.ReconstructData(shards); err != nil {
+		return nil, fmt.Errorf("reconstruct: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := s.erasure.enc.Join(&buf, shards, int(h.size)); err != nil {
+		return nil, fmt.Errorf("join shards: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// rebuildShard recomputes shard i of a coded file from the other shards,
+// for when its own copy has been lost. It returns the shard with header.
+func (s *NetworkVideoContentService) rebuildShard(ctx context.Context, videoId, filename string, i int) ([]byte, error) {
+	shards, h, err := s.readShards(ctx, videoId, filename, i)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.erasure.enc.Reconstruct(shards); err != nil {
+		return nil, fmt.Errorf("reconstruct: %v", err)
+	}
+	h.index = i
+	return h.encode(shards[i]), nil
+}
@@ -0,0 +1,55 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+// TestReadWithShardNodesDown stops the nodes of a 3+2 coded cluster one by
+// one. Every file has a shard on each node, so files must stay readable
+// with up to two nodes down and become unreadable with three.
+func TestReadWithShardNodesDown(t *testing.T) {
+	const data, parity = 3, 2
+	var nodes []StorageNode
+	var servers []*grpc.Server
+	for i := 0; i < data+parity; i++ {
+		n, srv := startStorageServer(t)
+		nodes = append(nodes, n)
+		servers = append(servers, srv)
+	}
+	config := NetworkConfig{Erasure: ErasureConfig{DataShards: data, ParityShards: parity, MinSize: 1}}
+	s, err := NewNetworkVideoContentService(nil, nil, nodes, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	files := make(map[string]string)
+	for i := 0; i < 10; i++ {
+		name := fmt.Sprintf("seg%d.m4s", i)
+		files[name] = strings.Repeat(name, 100)
+		if err := s.Write(ctx, "v", name, []byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for down := 0; down <= parity; down++ {
+		if down > 0 {
+			servers[down-1].Stop()
+		}
+		for name, want := range files {
+			if got, err := s.Read(ctx, "v", name); err != nil || string(got) != want {
+				t.Fatalf("read %s with %d nodes down: %v", name, down, err)
+			}
+		}
+	}
+	servers[parity].Stop()
+	for name := range files {
+		if _, err := s.Read(ctx, "v", name); err == nil {
+			t.Fatalf("read %s with %d nodes down, want an error", name, parity+1)
+		}
+	}
+}
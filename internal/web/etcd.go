@@ -2,8 +2,106 @@
 
 package web
 
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdVideoPrefix holds one key per video, named by its id.
+const etcdVideoPrefix = "/tritontube/videos/"
+
+// EtcdVideoMetadataService keeps video metadata in etcd, so every web
+// server sharing the endpoints sees the same videos.
 type EtcdVideoMetadataService struct {
+	Client *clientv3.Client
 }
 
 // Uncomment the following line to ensure EtcdVideoMetadataService implements VideoMetadataService
-// var _ VideoMetadataService = (*EtcdVideoMetadataService)(nil)
+var _ VideoMetadataService = (*EtcdVideoMetadataService)(nil)
+
+func NewEtcdVideoMetadataService(client *clientv3.Client) *EtcdVideoMetadataService {
+	return &EtcdVideoMetadataService{Client: client}
+}
+
+// CheckHealth fails unless etcd answers a read of the videos.
+func (s *EtcdVideoMetadataService) CheckHealth(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, etcdTimeout)
+	defer cancel()
+	if _, err := s.Client.Get(ctx, etcdVideoPrefix, clientv3.WithPrefix(), clientv3.WithCountOnly()); err != nil {
+		return fmt.Errorf("read videos from etcd: %v", err)
+	}
+	return nil
+}
+
+type etcdVideo struct {
+	UploadedAt time.Time `json:"uploadedAt"`
+}
+
+// Create fails if the video already exists.
+func (s *EtcdVideoMetadataService) Create(ctx context.Context, videoId string, uploadedAt time.Time) error {
+	value, err := json.Marshal(etcdVideo{UploadedAt: uploadedAt})
+	if err != nil {
+		return fmt.Errorf("failed to encode video metadata: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, etcdTimeout)
+	defer cancel()
+	key := etcdVideoPrefix + videoId
+	resp, err := s.Client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, string(value))).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("failed to insert video metadata: %v", err)
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("failed to insert video metadata: video %s already exists", videoId)
+	}
+	return nil
+}
+
+// List returns the videos newest first.
+func (s *EtcdVideoMetadataService) List(ctx context.Context) ([]VideoMetadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, etcdTimeout)
+	defer cancel()
+	resp, err := s.Client.Get(ctx, etcdVideoPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list videos: %v", err)
+	}
+	videos := []VideoMetadata{}
+	for _, kv := range resp.Kvs {
+		var v etcdVideo
+		if err := json.Unmarshal(kv.Value, &v); err != nil {
+			return nil, fmt.Errorf("failed to decode video %s: %v", kv.Key, err)
+		}
+		videos = append(videos, VideoMetadata{
+			Id:         string(kv.Key[len(etcdVideoPrefix):]),
+			UploadedAt: v.UploadedAt,
+		})
+	}
+	sort.Slice(videos, func(i, j int) bool {
+		return videos[i].UploadedAt.After(videos[j].UploadedAt)
+	})
+	return videos, nil
+}
+
+func (s *EtcdVideoMetadataService) Read(ctx context.Context, id string) (*VideoMetadata, error) {
+	ctx, cancel := context.WithTimeout(ctx, etcdTimeout)
+	defer cancel()
+	resp, err := s.Client.Get(ctx, etcdVideoPrefix+id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read video metadata: %v", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrVideoNotFound
+	}
+	var v etcdVideo
+	if err := json.Unmarshal(resp.Kvs[0].Value, &v); err != nil {
+		return nil, fmt.Errorf("failed to decode video %s: %v", id, err)
+	}
+	return &VideoMetadata{Id: id, UploadedAt: v.UploadedAt}, nil
+}
@@ -0,0 +1,322 @@
+// etcd-backed stores for ring membership and migration plans, shared by
+// every web server in a cluster
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	etcdRingKey           = "/tritontube/ring"
+	etcdMigrationPrefix   = "/tritontube/migrations/"
+	etcdMovePrefix        = "/tritontube/migration-moves/"
+	etcdElectionPrefix    = "/tritontube/leader"
+	etcdMigrationLeaseKey = "/tritontube/migration-lease"
+
+	// etcdTimeout bounds every request a store makes.
+	etcdTimeout = 5 * time.Second
+	// etcdMaxTxnOps stays below etcd's default limit of 128 operations per
+	// transaction.
+	etcdMaxTxnOps = 100
+)
+
+// EtcdMembershipStore keeps the ring under one key. Saves are compare-and-swap
+// against the last revision this store has seen, so two web servers cannot
+// overwrite each other's changes unnoticed.
+type EtcdMembershipStore struct {
+	Client *clientv3.Client
+
+	mu  sync.Mutex
+	rev int64
+}
+
+var _ MembershipStore = (*EtcdMembershipStore)(nil)
+var _ RingWatcher = (*EtcdMembershipStore)(nil)
+
+func NewEtcdMembershipStore(client *clientv3.Client) *EtcdMembershipStore {
+	return &EtcdMembershipStore{Client: client}
+}
+
+func (s *EtcdMembershipStore) LoadRing() (*RingState, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	resp, err := s.Client.Get(ctx, etcdRingKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get ring: %v", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	kv := resp.Kvs[0]
+	var state RingState
+	if err := json.Unmarshal(kv.Value, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode ring: %v", err)
+	}
+	s.seen(kv.ModRevision)
+	return &state, nil
+}
+
+func (s *EtcdMembershipStore) SaveRing(state *RingState) error {
+	value, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode ring: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	s.mu.Lock()
+	rev := s.rev
+	s.mu.Unlock()
+	resp, err := s.Client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(etcdRingKey), "=", rev)).
+		Then(clientv3.OpPut(etcdRingKey, string(value))).
+		Commit()
+	if err != nil {
+		return fmt.Errorf("failed to put ring: %v", err)
+	}
+	if !resp.Succeeded {
+		return fmt.Errorf("ring was changed by another web server")
+	}
+	s.seen(resp.Header.Revision)
+	return nil
+}
+
+func (s *EtcdMembershipStore) seen(rev int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rev > s.rev {
+		s.rev = rev
+	}
+}
+
+// WatchRing calls fn with the saved ring and then with every later save. It
+// reconnects after errors such as compaction, starting again from the
+// current ring.
+func (s *EtcdMembershipStore) WatchRing(ctx context.Context, fn func(*RingState)) error {
+	for ctx.Err() == nil {
+		state, err := s.LoadRing()
+		if err != nil {
+			slog.WarnContext(ctx, "watch ring failed", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		if state != nil {
+			fn(state)
+		}
+		s.mu.Lock()
+		rev := s.rev
+		s.mu.Unlock()
+		for wresp := range s.Client.Watch(ctx, etcdRingKey, clientv3.WithRev(rev+1)) {
+			if err := wresp.Err(); err != nil {
+				slog.WarnContext(ctx, "watch ring failed", "err", err)
+				break
+			}
+			for _, ev := range wresp.Events {
+				if ev.Type != clientv3.EventTypePut {
+					continue
+				}
+				var state RingState
+				if err := json.Unmarshal(ev.Kv.Value, &state); err != nil {
+					slog.ErrorContext(ctx, "watch ring: failed to decode ring", "err", err)
+					continue
+				}
+				s.seen(ev.Kv.ModRevision)
+				fn(&state)
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// EtcdMigrationStore keeps each migration under etcdMigrationPrefix and its
+// moves under etcdMovePrefix, one key per file, so that updating a move only
+// rewrites that file's key.
+type EtcdMigrationStore struct {
+	Client *clientv3.Client
+}
+
+var _ MigrationStore = (*EtcdMigrationStore)(nil)
+
+func NewEtcdMigrationStore(client *clientv3.Client) *EtcdMigrationStore {
+	return &EtcdMigrationStore{Client: client}
+}
+
+// etcdMigration is the stored header of a migration, without its moves.
+type etcdMigration struct {
+	Id        string
+	Kind      string
+	Node      string
+	State     MigrationState
+	CreatedAt time.Time
+	From      *RingState
+}
+
+// moveKey is where a move is stored. A file can have copies on several
+// nodes, each its own move, so the source is part of the key.
+func moveKey(id string, mv FileMove) string {
+	return fmt.Sprintf("%s%s/%s/%s/%s", etcdMovePrefix, id, mv.VideoId, mv.Filename, mv.Source)
+}
+
+// legacyMoveKey is where moves were stored before their key had the source.
+func legacyMoveKey(id string, mv FileMove) string {
+	return fmt.Sprintf("%s%s/%s/%s", etcdMovePrefix, id, mv.VideoId, mv.Filename)
+}
+
+// Create writes the moves first, in batches, and the migration last, so a
+// migration is never listed before its plan is complete.
+func (s *EtcdMigrationStore) Create(m *Migration) error {
+	var ops []clientv3.Op
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+		defer cancel()
+		if _, err := s.Client.Txn(ctx).Then(ops...).Commit(); err != nil {
+			return fmt.Errorf("failed to put moves: %v", err)
+		}
+		ops = ops[:0]
+		return nil
+	}
+	for _, mv := range m.Moves {
+		value, err := json.Marshal(mv)
+		if err != nil {
+			return fmt.Errorf("failed to encode move: %v", err)
+		}
+		ops = append(ops, clientv3.OpPut(moveKey(m.Id, mv), string(value)))
+		if len(ops) == etcdMaxTxnOps {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	return s.putHeader(ctx, &etcdMigration{Id: m.Id, Kind: m.Kind, Node: m.Node, State: m.State, CreatedAt: m.CreatedAt, From: m.From})
+}
+
+func (s *EtcdMigrationStore) putHeader(ctx context.Context, h *etcdMigration) error {
+	value, err := json.Marshal(h)
+	if err != nil {
+		return fmt.Errorf("failed to encode migration: %v", err)
+	}
+	if _, err := s.Client.Put(ctx, etcdMigrationPrefix+h.Id, string(value)); err != nil {
+		return fmt.Errorf("failed to put migration: %v", err)
+	}
+	return nil
+}
+
+func (s *EtcdMigrationStore) readHeader(ctx context.Context, id string) (*etcdMigration, error) {
+	resp, err := s.Client.Get(ctx, etcdMigrationPrefix+id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get migration: %v", err)
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, fmt.Errorf("no migration %s", id)
+	}
+	var h etcdMigration
+	if err := json.Unmarshal(resp.Kvs[0].Value, &h); err != nil {
+		return nil, fmt.Errorf("failed to decode migration: %v", err)
+	}
+	return &h, nil
+}
+
+func (s *EtcdMigrationStore) Read(id string) (*Migration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	h, err := s.readHeader(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.Client.Get(ctx, etcdMovePrefix+id+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get moves: %v", err)
+	}
+	m := &Migration{Id: h.Id, Kind: h.Kind, Node: h.Node, State: h.State, CreatedAt: h.CreatedAt, From: h.From}
+	for _, kv := range resp.Kvs {
+		var mv FileMove
+		if err := json.Unmarshal(kv.Value, &mv); err != nil {
+			return nil, fmt.Errorf("failed to decode move: %v", err)
+		}
+		m.Moves = append(m.Moves, mv)
+	}
+	return m, nil
+}
+
+// ListUnfinished returns the migrations that were still running, oldest first.
+func (s *EtcdMigrationStore) ListUnfinished() ([]*Migration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	resp, err := s.Client.Get(ctx, etcdMigrationPrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list migrations: %v", err)
+	}
+	var headers []etcdMigration
+	for _, kv := range resp.Kvs {
+		var h etcdMigration
+		if err := json.Unmarshal(kv.Value, &h); err != nil {
+			return nil, fmt.Errorf("failed to decode migration: %v", err)
+		}
+		if h.State == MigrationRunning {
+			headers = append(headers, h)
+		}
+	}
+	sort.Slice(headers, func(i, j int) bool {
+		return headers[i].CreatedAt.Before(headers[j].CreatedAt)
+	})
+	var migrations []*Migration
+	for _, h := range headers {
+		m, err := s.Read(h.Id)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, m)
+	}
+	return migrations, nil
+}
+
+func (s *EtcdMigrationStore) UpdateMove(id string, move FileMove) error {
+	value, err := json.Marshal(move)
+	if err != nil {
+		return fmt.Errorf("failed to encode move: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	// Migrations planned before moves were keyed by source are still
+	// updated under their old keys.
+	for _, key := range []string{moveKey(id, move), legacyMoveKey(id, move)} {
+		resp, err := s.Client.Txn(ctx).
+			If(clientv3.Compare(clientv3.CreateRevision(key), ">", 0)).
+			Then(clientv3.OpPut(key, string(value))).
+			Commit()
+		if err != nil {
+			return fmt.Errorf("failed to update move: %v", err)
+		}
+		if resp.Succeeded {
+			return nil
+		}
+	}
+	return fmt.Errorf("migration %s has no move for %s/%s from %s", id, move.VideoId, move.Filename, move.Source)
+}
+
+func (s *EtcdMigrationStore) UpdateState(id string, state MigrationState) error {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	h, err := s.readHeader(ctx, id)
+	if err != nil {
+		return err
+	}
+	h.State = state
+	return s.putHeader(ctx, h)
+}
@@ -0,0 +1,63 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestEtcdVideoMetadata checks the etcd metadata backend against what the
+// web server expects of any VideoMetadataService, and that two web servers
+// sharing etcd see each other's videos.
+func TestEtcdVideoMetadata(t *testing.T) {
+	endpoint := startEtcd(t)
+	a := NewEtcdVideoMetadataService(newEtcdClient(t, endpoint))
+	b := NewEtcdVideoMetadataService(newEtcdClient(t, endpoint))
+	ctx := context.Background()
+
+	if err := a.CheckHealth(ctx); err != nil {
+		t.Fatalf("health: %v", err)
+	}
+	videos, err := a.List(ctx)
+	if err != nil || videos == nil || len(videos) != 0 {
+		t.Fatalf("list with no videos: %v, %v; want an empty list", videos, err)
+	}
+	if _, err := a.Read(ctx, "missing"); !errors.Is(err, ErrVideoNotFound) {
+		t.Fatalf("read a missing video: %v, want ErrVideoNotFound", err)
+	}
+
+	first := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	if err := a.Create(ctx, "first", first); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Create(ctx, "second", first.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Create(ctx, "first", first.Add(2*time.Hour)); err == nil {
+		t.Fatal("created a video that already exists")
+	}
+	v, err := b.Read(ctx, "first")
+	if err != nil || v.Id != "first" || !v.UploadedAt.Equal(first) {
+		t.Fatalf("read the other server's video: %+v, %v", v, err)
+	}
+	videos, err = a.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 2 || videos[0].Id != "second" || videos[1].Id != "first" {
+		t.Fatalf("list: %+v, want second then first", videos)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := a.Create(cancelled, "late", first); err == nil {
+		t.Fatal("create with a cancelled context succeeded")
+	}
+	if _, err := a.Read(ctx, "late"); !errors.Is(err, ErrVideoNotFound) {
+		t.Fatalf("read the video of a cancelled create: %v, want ErrVideoNotFound", err)
+	}
+	if _, err := a.List(cancelled); err == nil {
+		t.Fatal("list with a cancelled context succeeded")
+	}
+}
@@ -3,35 +3,169 @@
 package web
 
 import (
+	"context"
 	"os"
 	"fmt"
+	"log/slog"
 	"path/filepath"
+
+	"tritontube/internal/atomicfile"
+	"tritontube/internal/checksum"
+	"tritontube/internal/keylock"
+	"tritontube/internal/videokey"
 )
 
 // FSVideoContentService implements VideoContentService using the local filesystem.
+// Each file has a checksum sidecar next to it that every read is checked
+// against.
 type FSVideoContentService struct{
 	StorageDirectory string
+
+	// locks keeps a file and its sidecar consistent for readers while a
+	// write replaces both.
+	locks keylock.Map
+}
+
+// NewFSVideoContentService serves the files under dir. It first removes
+// temporary files left by writes that a crash interrupted.
+func NewFSVideoContentService(dir string) *FSVideoContentService {
+	if n, err := atomicfile.Sweep(dir); err != nil {
+		slog.Warn("sweep unfinished writes failed", "dir", dir, "err", err)
+	} else if n > 0 {
+		slog.Info("removed unfinished writes", "dir", dir, "files", n)
+	}
+	return &FSVideoContentService{StorageDirectory: dir}
 }
 
 // Uncomment the following line to ensure FSVideoContentService implements VideoContentService
 var _ VideoContentService = (*FSVideoContentService)(nil)
+var _ VideoContentDeleter = (*FSVideoContentService)(nil)
+var _ VideoContentLister = (*FSVideoContentService)(nil)
+
+// File operations cannot be interrupted, so the FS methods only check ctx
+// before they start.
 
-func (s *FSVideoContentService) Read(videoId string, filename string) ([]byte, error) {
-	filePath := filepath.Join(s.StorageDirectory, videoId, filename)
-	data, err := os.ReadFile(filePath)
+func (s *FSVideoContentService) Read(ctx context.Context, videoId string, filename string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	k, err := videokey.New(videoId, filename)
+	if err != nil {
+		return nil, err
+	}
+	filePath := k.Path(s.StorageDirectory)
+	unlock := s.locks.RLock(filePath)
+	data, _, err := checksum.ReadFile(filePath)
+	unlock()
 	if err != nil {
 		return nil, fmt.Errorf("faiol to read file: %v", err)
 	}
 	return data, nil
 }
 
-func (s *FSVideoContentService) Write(videoId string, filename string, data []byte) error {
-	videoDir := filepath.Join(s.StorageDirectory, videoId)
-	os.MkdirAll(videoDir, os.ModePerm)
-	filePath := filepath.Join(videoDir, filename)
-	err := os.WriteFile(filePath, data, os.ModePerm)
+func (s *FSVideoContentService) Write(ctx context.Context, videoId string, filename string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	k, err := videokey.New(videoId, filename)
 	if err != nil {
+		return err
+	}
+	if checksum.IsSidecar(filename) {
+		return fmt.Errorf("%w: filename %q is reserved for checksums", videokey.ErrInvalid, filename)
+	}
+	filePath := k.Path(s.StorageDirectory)
+	os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+	unlock := s.locks.Lock(filePath)
+	defer unlock()
+	sidecar, err := checksum.PrepareSidecar(filePath, checksum.Sum(data))
+	if err != nil {
+		return fmt.Errorf("fail to write file: %v", err)
+	}
+	if err := os.Remove(checksum.SidecarPath(filePath)); err != nil && !os.IsNotExist(err) {
+		sidecar.Discard()
+		return fmt.Errorf("fail to write file: %v", err)
+	}
+	err = atomicfile.WriteFile(filePath, data, 0644)
+	if err != nil {
+		sidecar.Discard()
 		return fmt.Errorf("fail to write file: %v", err)
 	}
+	// The data is in place; without its sidecar it is read unchecked.
+	if err := sidecar.Commit(); err != nil {
+		slog.WarnContext(ctx, "write checksum failed", "video", videoId, "file", filename, "err", err)
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+func (s *FSVideoContentService) Delete(ctx context.Context, videoId string, filename string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	k, err := videokey.New(videoId, filename)
+	if err != nil {
+		return err
+	}
+	filePath := k.Path(s.StorageDirectory)
+	unlock := s.locks.Lock(filePath)
+	defer unlock()
+	if err := os.Remove(filePath); err != nil {
+		return fmt.Errorf("fail to delete file: %v", err)
+	}
+	os.Remove(checksum.SidecarPath(filePath))
+	return nil
+}
+
+// ListStored lists the files of every video, leaving out checksums,
+// temporary files and hidden directories.
+func (s *FSVideoContentService) ListStored(ctx context.Context) ([]StoredFile, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	videos, err := os.ReadDir(s.StorageDirectory)
+	if err != nil {
+		return nil, fmt.Errorf("fail to list videos: %v", err)
+	}
+	var files []StoredFile
+	for _, v := range videos {
+		if !v.IsDir() || videokey.ValidateVideoId(v.Name()) != nil {
+			continue
+		}
+		entries, err := os.ReadDir(filepath.Join(s.StorageDirectory, v.Name()))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if e.IsDir() || checksum.IsSidecar(e.Name()) || atomicfile.IsTemp(e.Name()) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			files = append(files, StoredFile{
+				VideoId:  v.Name(),
+				Filename: e.Name(),
+				Size:     info.Size(),
+				ModTime:  info.ModTime(),
+			})
+		}
+	}
+	return files, nil
+}
+
+func (s *FSVideoContentService) DeleteStored(ctx context.Context, f StoredFile) error {
+	return s.Delete(ctx, f.VideoId, f.Filename)
+}
+
+// CheckHealth fails if the storage directory is gone.
+func (s *FSVideoContentService) CheckHealth(ctx context.Context) error {
+	info, err := os.Stat(s.StorageDirectory)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", s.StorageDirectory)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+// Liveness and readiness endpoints for load balancers
+
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultReadyTimeout bounds each readiness check.
+const DefaultReadyTimeout = 2 * time.Second
+
+// HealthCheck reports whether something the web server needs works.
+type HealthCheck func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check HealthCheck
+}
+
+// CheckResult is the outcome of one readiness check.
+type CheckResult struct {
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// ReadyReport is the body /readyz answers with.
+type ReadyReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks"`
+}
+
+// AddCheck makes /readyz run check under name. The metadata and content
+// services are checked without being added if they are HealthCheckers, and
+// the transcoder always is.
+func (s *server) AddCheck(name string, check HealthCheck) {
+	s.checksMu.Lock()
+	defer s.checksMu.Unlock()
+	s.checks = append(s.checks, namedCheck{name, check})
+}
+
+// defaultChecks adds the checks of the services s was created with.
+func (s *server) defaultChecks(metadata VideoMetadataService, content VideoContentService) {
+	if c, ok := metadata.(HealthChecker); ok {
+		s.AddCheck("metadata", c.CheckHealth)
+	}
+	if c, ok := content.(HealthChecker); ok {
+		s.AddCheck("content", c.CheckHealth)
+	}
+	s.AddCheck("transcoder", checkFFmpeg)
+}
+
+// checkFFmpeg fails if uploads cannot be converted because ffmpeg is not
+// installed.
+func checkFFmpeg(ctx context.Context) error {
+	_, err := exec.LookPath("ffmpeg")
+	return err
+}
+
+// ready runs every check at once and reports each one's result.
+func (s *server) ready(ctx context.Context) ReadyReport {
+	s.checksMu.Lock()
+	checks := append([]namedCheck(nil), s.checks...)
+	s.checksMu.Unlock()
+	timeout := s.ReadyTimeout
+	if timeout <= 0 {
+		timeout = DefaultReadyTimeout
+	}
+	report := ReadyReport{Status: "ready", Checks: make(map[string]CheckResult, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			err := c.check(ctx)
+			res := CheckResult{Status: "ok", Duration: time.Since(start).Round(time.Microsecond).String()}
+			if err != nil {
+				res.Status, res.Error = "failed", err.Error()
+			}
+			mu.Lock()
+			report.Checks[c.name] = res
+			if err != nil {
+				report.Status = "unavailable"
+			}
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return report
+}
+
+// handleHealthz answers as long as the process serves HTTP.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz answers 200 when every check passes and 503 otherwise, so a
+// load balancer stops sending traffic to a web server that cannot serve it.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	report := s.ready(r.Context())
+	code := http.StatusOK
+	if report.Status != "ready" {
+		code = http.StatusServiceUnavailable
+	}
+	writeJSON(w, code, report)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// CheckHealth fails unless a quorum, more than half, of the active storage
+// nodes answers.
+func (s *NetworkVideoContentService) CheckHealth(ctx context.Context) error {
+	active := s.ring.Load().active
+	if len(active) == 0 {
+		return fmt.Errorf("no active storage nodes")
+	}
+	stats := s.statNodes(ctx, active)
+	var down []string
+	for _, n := range active {
+		if _, ok := stats[n.Address]; !ok {
+			down = append(down, n.Address)
+		}
+	}
+	if len(stats) <= len(active)/2 {
+		sort.Strings(down)
+		return fmt.Errorf("%d of %d storage nodes answer, need %d; down: %v", len(stats), len(active), len(active)/2+1, down)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+// pathWithFFmpeg sets PATH to a directory that holds an ffmpeg only if
+// installed is set.
+func pathWithFFmpeg(t *testing.T, installed bool) {
+	t.Helper()
+	dir := t.TempDir()
+	if installed {
+		if err := os.WriteFile(filepath.Join(dir, "ffmpeg"), []byte("#!/bin/sh\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir)
+}
+
+func getReadyz(t *testing.T, s *server) (int, ReadyReport) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.handleReadyz(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var report ReadyReport
+	if err := json.NewDecoder(w.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, report
+}
+
+func newTestMetadata(t *testing.T) *SQLiteVideoMetadataService {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "videos.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &SQLiteVideoMetadataService{DB: db}
+}
+
+// TestReadyzNeedsStorageQuorum takes down the storage nodes of a web server
+// one by one. It must stay ready while most of them answer.
+func TestReadyzNeedsStorageQuorum(t *testing.T) {
+	pathWithFFmpeg(t, true)
+	var nodes []StorageNode
+	var servers []*grpc.Server
+	for i := 0; i < 3; i++ {
+		n, srv := startStorageServer(t)
+		nodes = append(nodes, n)
+		servers = append(servers, srv)
+	}
+	content, err := NewNetworkVideoContentService(nil, nil, nodes, NetworkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer content.Close()
+	s := NewServer(newTestMetadata(t), content)
+
+	for down := 0; down <= 1; down++ {
+		if down > 0 {
+			servers[down-1].Stop()
+		}
+		if code, report := getReadyz(t, s); code != http.StatusOK {
+			t.Fatalf("readyz with %d of 3 nodes down: %d %+v", down, code, report)
+		}
+	}
+	servers[1].Stop()
+	code, report := getReadyz(t, s)
+	if code != http.StatusServiceUnavailable || report.Checks["content"].Status != "failed" {
+		t.Fatalf("readyz with 2 of 3 nodes down: %d %+v", code, report)
+	}
+	for _, name := range []string{"metadata", "transcoder"} {
+		if report.Checks[name].Status != "ok" {
+			t.Errorf("%s check: %+v", name, report.Checks[name])
+		}
+	}
+}
+
+// TestReadyzChecksTranscoder checks that a web server without ffmpeg is not
+// ready, though it is still alive.
+func TestReadyzChecksTranscoder(t *testing.T) {
+	s := NewServer(newTestMetadata(t), NewFSVideoContentService(t.TempDir()))
+	pathWithFFmpeg(t, true)
+	if code, report := getReadyz(t, s); code != http.StatusOK {
+		t.Fatalf("readyz with ffmpeg installed: %d %+v", code, report)
+	}
+	pathWithFFmpeg(t, false)
+	code, report := getReadyz(t, s)
+	if code != http.StatusServiceUnavailable || report.Checks["transcoder"].Status != "failed" {
+		t.Fatalf("readyz without ffmpeg: %d %+v", code, report)
+	}
+	w := httptest.NewRecorder()
+	s.handleHealthz(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("healthz without ffmpeg: %d", w.Code)
+	}
+}
@@ -1,19 +1,136 @@
 package web
 
-import "time"
+import (
+	"context"
+	"errors"
+	"time"
+)
 
 type VideoMetadata struct {
 	Id         string
 	UploadedAt time.Time
 }
 
+// The methods of the metadata and content services give up when ctx is
+// done, such as when the viewer who asked goes away.
+
+// ErrVideoNotFound is returned by VideoMetadataService.Read for a video
+// that does not exist.
+var ErrVideoNotFound = errors.New("no vids")
+
 type VideoMetadataService interface {
-	Read(id string) (*VideoMetadata, error)
-	List() ([]VideoMetadata, error)
-	Create(videoId string, uploadedAt time.Time) error
+	Read(ctx context.Context, id string) (*VideoMetadata, error)
+	List(ctx context.Context) ([]VideoMetadata, error)
+	Create(ctx context.Context, videoId string, uploadedAt time.Time) error
 }
 
 type VideoContentService interface {
-	Read(videoId string, filename string) ([]byte, error)
-	Write(videoId string, filename string, data []byte) error
+	Read(ctx context.Context, videoId string, filename string) ([]byte, error)
+	Write(ctx context.Context, videoId string, filename string, data []byte) error
+}
+
+// VideoContentDeleter is implemented by content services that can remove
+// a file. Deleting a file that does not exist is an error.
+type VideoContentDeleter interface {
+	Delete(ctx context.Context, videoId string, filename string) error
+}
+
+// VideoContentPlacer is implemented by content services that spread files
+// over nodes. NodeFor names the node a file goes to, or "" if unknown.
+type VideoContentPlacer interface {
+	NodeFor(videoId string, filename string) string
+}
+
+// HealthChecker is implemented by metadata and content services that can
+// tell whether their backend is reachable. CheckHealth returns an error
+// describing what is wrong, or nil.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// StoredFile is one file as a content service stores it.
+type StoredFile struct {
+	// Node is the storage node holding the file, if there are several.
+	Node     string
+	VideoId  string
+	Filename string
+	Size     int64
+	ModTime  time.Time
+}
+
+// VideoContentLister is implemented by content services whose files can be
+// listed and removed one by one, which garbage collection needs.
+type VideoContentLister interface {
+	ListStored(ctx context.Context) ([]StoredFile, error)
+	DeleteStored(ctx context.Context, f StoredFile) error
+}
+
+// DedupIndex maps the names of deduplicated files to the digests of their
+// content and counts the references to every blob.
+type DedupIndex interface {
+	// Link points videoId/filename at the blob digest of size bytes and
+	// takes a reference to it, dropping the name's reference to its old
+	// blob. It reports whether the blob still has to be stored.
+	Link(videoId, filename, digest string, size int64) (store bool, err error)
+	// Unlink removes the name and drops its reference.
+	Unlink(videoId, filename string) error
+	// Stored records that the blob for digest has been written.
+	Stored(digest string) error
+	// Resolve returns the digest videoId/filename points at, or "" if the
+	// name is not deduplicated.
+	Resolve(videoId, filename string) (string, error)
+	// Unreferenced returns the blobs that have had no references since
+	// before the given time.
+	Unreferenced(before time.Time) ([]DedupBlob, error)
+	// Forget removes the blob for digest if it still has no references and
+	// reports whether it did.
+	Forget(digest string) (bool, error)
+	Stats() (DedupStats, error)
+	// Names lists every deduplicated name, with the time it was linked as
+	// its ModTime.
+	Names() ([]StoredFile, error)
+}
+
+type MigrationStore interface {
+	Create(m *Migration) error
+	Read(id string) (*Migration, error)
+	ListUnfinished() ([]*Migration, error)
+	UpdateMove(id string, move FileMove) error
+	UpdateState(id string, state MigrationState) error
+}
+
+// RingState is the saved form of the storage ring.
+type RingState struct {
+	Version uint64
+	// Placement is the name of the strategy the ring places keys with.
+	Placement string
+	Nodes     []StorageNode
+	// Prev holds the nodes from before the last change while its
+	// migration is still running.
+	Prev []StorageNode
+	// PrevPlacement is the placement of Prev if it differs from Placement.
+	PrevPlacement string
+	// Earlier holds the rings before Prev, newest first, that failed
+	// migrations may have left files on.
+	Earlier []SavedRing
+}
+
+// SavedRing is the saved form of an earlier ring.
+type SavedRing struct {
+	Placement string
+	Nodes     []StorageNode
+}
+
+// MembershipStore persists the storage ring so that it survives restarts.
+// LoadRing returns nil when nothing has been saved yet.
+type MembershipStore interface {
+	LoadRing() (*RingState, error)
+	SaveRing(state *RingState) error
+}
+
+// RingWatcher is implemented by membership stores that several web servers
+// share. WatchRing calls fn with every ring saved by any of them until ctx
+// is done.
+type RingWatcher interface {
+	WatchRing(ctx context.Context, fn func(*RingState)) error
 }
@@ -0,0 +1,81 @@
+// Prometheus metrics of the web tier
+
+package web
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	uploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tritontube_upload_duration_seconds",
+		Help:    "Time to handle uploads, transcoding included, by result.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+	}, []string{"result"})
+	transcodeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tritontube_transcode_duration_seconds",
+		Help:    "Time ffmpeg takes to convert an upload to DASH.",
+		Buckets: prometheus.ExponentialBuckets(0.5, 2, 12),
+	})
+	transcodeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "tritontube_transcode_failures_total",
+		Help: "Uploads ffmpeg failed to convert.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(uploadDuration, transcodeDuration, transcodeFailures)
+}
+
+// statFunc is one number of a stats snapshot.
+type statFunc struct {
+	name, help string
+	counter    bool
+	value      func() float64
+}
+
+func registerStats(prefix string, stats []statFunc) error {
+	for _, st := range stats {
+		var c prometheus.Collector
+		if st.counter {
+			c = prometheus.NewCounterFunc(prometheus.CounterOpts{Name: prefix + st.name, Help: st.help}, st.value)
+		} else {
+			c = prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: prefix + st.name, Help: st.help}, st.value)
+		}
+		if err := prometheus.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterCacheMetrics exports the counters and size of a content cache.
+func RegisterCacheMetrics(c *CachedVideoContentService) error {
+	stat := func(f func(CacheStats) int64) func() float64 {
+		return func() float64 { return float64(f(c.Stats())) }
+	}
+	return registerStats("tritontube_cache_", []statFunc{
+		{"hits_total", "Reads served from memory.", true, stat(func(s CacheStats) int64 { return s.Hits })},
+		{"disk_hits_total", "Reads served from the disk tier.", true, stat(func(s CacheStats) int64 { return s.DiskHits })},
+		{"misses_total", "Reads passed to the content service.", true, stat(func(s CacheStats) int64 { return s.Misses })},
+		{"collapsed_total", "Reads that waited for a load of the same file.", true, stat(func(s CacheStats) int64 { return s.Collapsed })},
+		{"evictions_total", "Files evicted from memory.", true, stat(func(s CacheStats) int64 { return s.Evictions })},
+		{"entries", "Files in memory.", false, stat(func(s CacheStats) int64 { return s.Entries })},
+		{"bytes", "Bytes in memory.", false, stat(func(s CacheStats) int64 { return s.Bytes })},
+		{"disk_entries", "Files in the disk tier.", false, stat(func(s CacheStats) int64 { return s.DiskEntries })},
+		{"disk_bytes", "Bytes in the disk tier.", false, stat(func(s CacheStats) int64 { return s.DiskBytes })},
+	})
+}
+
+// RegisterPrefetchMetrics exports how often nw's read-ahead is used.
+func RegisterPrefetchMetrics(s *NetworkVideoContentService) error {
+	stat := func(f func(PrefetchStats) int64) func() float64 {
+		return func() float64 { return float64(f(s.PrefetchStats())) }
+	}
+	return registerStats("tritontube_prefetch_", []statFunc{
+		{"fetched_total", "Segments read ahead.", true, stat(func(s PrefetchStats) int64 { return s.Prefetched })},
+		{"hits_total", "Segment reads served by a read ahead.", true, stat(func(s PrefetchStats) int64 { return s.Hits })},
+		{"misses_total", "Segment reads not read ahead.", true, stat(func(s PrefetchStats) int64 { return s.Misses })},
+		{"skipped_total", "Segments not read ahead because every worker was busy.", true, stat(func(s PrefetchStats) int64 { return s.Skipped })},
+	})
+}
@@ -0,0 +1,693 @@
+// Persisted, resumable file migration between storage nodes
+
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"tritontube/internal/checksum"
+	pb "tritontube/internal/proto"
+)
+
+type MigrationState string
+
+const (
+	MigrationRunning MigrationState = "running"
+	MigrationDone    MigrationState = "done"
+	MigrationFailed  MigrationState = "failed"
+	// MigrationCancelled migrations were stopped by a later change, such as
+	// undraining the node they were draining. They are not resumed.
+	MigrationCancelled MigrationState = "cancelled"
+)
+
+type MoveState string
+
+const (
+	MovePending MoveState = "pending"
+	MoveDone    MoveState = "done"
+	MoveFailed  MoveState = "failed"
+)
+
+// FileMove is one file that has to be copied from Source to Destination.
+type FileMove struct {
+	VideoId     string
+	Filename    string
+	Source      string
+	Destination string
+	Size        int64
+	State       MoveState
+	Error       string
+}
+
+// Migration is the plan produced by a membership change. It is persisted
+// before any file is touched so it can be resumed after a restart.
+type Migration struct {
+	Id string
+	// Kind is the change that produced it: "add", "remove", "drain",
+	// "undrain" or "rebalance".
+	Kind      string
+	Node      string
+	State     MigrationState
+	CreatedAt time.Time
+	Moves     []FileMove
+	// From is the ring the files are moved from, with its earlier rings,
+	// so reads can fall back to it when the migration is resumed. It is
+	// nil for migrations saved before it was recorded.
+	From *RingState
+}
+
+func (m *Migration) counts() (done, failed int) {
+	for _, mv := range m.Moves {
+		switch mv.State {
+		case MoveDone:
+			done++
+		case MoveFailed:
+			failed++
+		}
+	}
+	return done, failed
+}
+
+func (m *Migration) bytes() (planned, moved int64) {
+	for _, mv := range m.Moves {
+		planned += mv.Size
+		if mv.State == MoveDone {
+			moved += mv.Size
+		}
+	}
+	return planned, moved
+}
+
+func newMigrationId() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%d-%s", time.Now().Unix(), hex.EncodeToString(b))
+}
+
+// codedFile collects the shards of one erasure-coded file seen while
+// planning a migration.
+type codedFile struct {
+	videoId, filename string
+	shards            int
+	size              int64
+	have              map[int]bool
+}
+
+// planMigration lists the files on every node in from and returns a move for
+// each file whose owner in r is a different node. Nodes that are leaving the
+// ring may be unreachable, so a dead node can still be drained or removed:
+// its whole files cannot be saved, but every shard missing from the
+// reachable nodes is planned as a move from it, which rebuilds the shard
+// from the others. A node that stays in r must be reachable.
+func (s *NetworkVideoContentService) planMigration(from []string, r *ring) ([]FileMove, error) {
+	var moves []FileMove
+	var lost string
+	coded := make(map[string]*codedFile)
+	for _, addr := range from {
+		resp, err := s.listFiles(context.Background(), addr)
+		if err != nil {
+			if n, ok := r.node(addr); !ok || n.State != NodeActive {
+				slog.Warn("plan migration: cannot list leaving node, skipping it", "node", addr, "err", err)
+				if lost == "" {
+					lost = addr
+				}
+				continue
+			}
+			return nil, fmt.Errorf("list files on %s: %v", addr, err)
+		}
+		for _, file := range resp.FilesList {
+			dest, err := s.fileDestination(r, addr, file.VideoId, file.Filename)
+			if err != nil {
+				return nil, err
+			}
+			if base, i, n, ok := parseShardName(file.Filename); ok {
+				key := fmt.Sprintf("%s/%s", file.VideoId, base)
+				if coded[key] == nil {
+					coded[key] = &codedFile{videoId: file.VideoId, filename: base, shards: n, size: file.Size, have: make(map[int]bool)}
+				}
+				coded[key].have[i] = true
+			}
+			if dest == addr {
+				continue
+			}
+			moves = append(moves, FileMove{
+				VideoId:     file.VideoId,
+				Filename:    file.Filename,
+				Source:      addr,
+				Destination: dest,
+				Size:        file.Size,
+				State:       MovePending,
+			})
+		}
+	}
+	if lost == "" || s.erasure == nil {
+		return moves, nil
+	}
+	for key, f := range coded {
+		owners := shardOwners(r, key, f.shards)
+		if owners == nil {
+			continue
+		}
+		for i := 0; i < f.shards; i++ {
+			if f.have[i] {
+				continue
+			}
+			moves = append(moves, FileMove{
+				VideoId:     f.videoId,
+				Filename:    shardName(f.filename, i, f.shards),
+				Source:      lost,
+				Destination: owners[i].Address,
+				Size:        f.size,
+				State:       MovePending,
+			})
+		}
+	}
+	return moves, nil
+}
+
+// fileDestination returns the node that should hold a file in r, or addr,
+// where it is now, if it should stay. Shards go to the owner matching their
+// index; they stay put if r has too few active nodes to spread them.
+func (s *NetworkVideoContentService) fileDestination(r *ring, addr, videoId, filename string) (string, error) {
+	if base, i, n, ok := parseShardName(filename); ok {
+		owners := shardOwners(r, fmt.Sprintf("%s/%s", videoId, base), n)
+		if owners == nil {
+			return addr, nil
+		}
+		return owners[i].Address, nil
+	}
+	dest, err := r.owner(fmt.Sprintf("%s/%s", videoId, filename))
+	if err != nil {
+		return "", err
+	}
+	return dest.Address, nil
+}
+
+// runMigration executes every unfinished move of m. Only one migration runs
+// at a time. Once every file has moved the previous ring is dropped, so reads
+// stop falling back to the old owners, and the change is finished.
+func (s *NetworkVideoContentService) runMigration(m *Migration) {
+	s.migrateMu.Lock()
+	defer s.migrateMu.Unlock()
+	start := time.Now()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	if s.cluster != nil {
+		release, err := s.cluster.holdMigrationLease(ctx, m.Id)
+		if err != nil {
+			slog.Warn("migration not run", "migration", m.Id, "err", err)
+			s.clearRunning(m.Id)
+			return
+		}
+		defer release()
+	}
+	s.mu.Lock()
+	s.live = &liveMigration{id: m.Id, kind: m.Kind, node: m.Node, started: time.Now(), cancel: cancel}
+	s.mu.Unlock()
+	defer s.clearRunning(m.Id)
+	for i := range m.Moves {
+		mv := &m.Moves[i]
+		if mv.State == MoveDone {
+			continue
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if err := s.moveFile(ctx, *mv); err != nil {
+			slog.Warn("migration move failed", "migration", m.Id, "video", mv.VideoId, "file", mv.Filename, "from", mv.Source, "to", mv.Destination, "err", err)
+			mv.State = MoveFailed
+			mv.Error = err.Error()
+		} else {
+			mv.State = MoveDone
+			mv.Error = ""
+			s.mu.Lock()
+			s.live.moved += mv.Size
+			s.mu.Unlock()
+		}
+		if err := s.migrations.UpdateMove(m.Id, *mv); err != nil {
+			slog.Error("migration: save move state failed", "migration", m.Id, "err", err)
+		}
+	}
+	s.guard.stop()
+	done, failed := m.counts()
+	if context.Cause(ctx) == errNotLeader {
+		// The plan stays running for the next leader to resume.
+		slog.Info("migration paused: this web server is no longer the leader", "migration", m.Id)
+		return
+	}
+	switch {
+	case ctx.Err() != nil:
+		m.State = MigrationCancelled
+	case failed > 0:
+		// Failed files are still on their old owner; keep the previous
+		// ring so they stay readable.
+		m.State = MigrationFailed
+	default:
+		m.State = MigrationDone
+		if err := s.finishMigration(m); err != nil {
+			slog.Error("migration failed", "migration", m.Id, "err", err)
+			m.State = MigrationFailed
+		}
+	}
+	if err := s.migrations.UpdateState(m.Id, m.State); err != nil {
+		slog.Error("migration: save state failed", "migration", m.Id, "err", err)
+	}
+	slog.Info("migration finished", "migration", m.Id, "state", m.State, "moved", done, "failed", failed, "duration", time.Since(start))
+}
+
+func (s *NetworkVideoContentService) clearRunning(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running == id {
+		s.running = ""
+	}
+	s.live = nil
+}
+
+// finishMigration drops the previous ring and, for drains and removals,
+// checks that the node is really empty before marking it drained or
+// dropping it from the ring. The final ring is installed in one step, so a
+// node that still holds files keeps the previous ring for reads.
+func (s *NetworkVideoContentService) finishMigration(m *Migration) error {
+	cur := s.ring.Load()
+	if m.Kind != "drain" && m.Kind != "remove" {
+		return s.installRing(cur.withoutPrev())
+	}
+	resp, err := s.listFiles(context.Background(), m.Node)
+	switch {
+	case err != nil:
+		// planMigration plans around a leaving node it cannot reach, and
+		// whatever it held cannot be moved, so keeping it would only
+		// leave it draining for good.
+		slog.Warn("cannot verify node is empty, finishing anyway", "migration", m.Id, "node", m.Node, "err", err)
+	case len(resp.FilesList) > 0:
+		return fmt.Errorf("%s still holds %d files; leaving it draining", m.Node, len(resp.FilesList))
+	}
+	if m.Kind == "drain" {
+		if err := s.installRing(newRing(cur.placement, cur.version+1, cur.withState(m.Node, NodeDrained), nil)); err != nil {
+			return err
+		}
+		slog.Info("node drained", "ring_version", cur.version+1, "node", m.Node)
+	} else {
+		if err := s.installRing(newRing(cur.placement, cur.version+1, cur.without(m.Node), nil)); err != nil {
+			return err
+		}
+		slog.Info("node decommissioned", "ring_version", cur.version+1, "node", m.Node)
+	}
+	return nil
+}
+
+// cancelMigrationOf stops a running drain or removal of addr and waits for it
+// to finish its current file.
+func (s *NetworkVideoContentService) cancelMigrationOf(addr string) {
+	s.mu.Lock()
+	live := s.live
+	s.mu.Unlock()
+	if live == nil || live.node != addr || (live.kind != "drain" && live.kind != "remove") {
+		return
+	}
+	slog.Info("cancelling migration", "migration", live.id, "kind", live.kind, "node", addr)
+	live.cancel(nil)
+	s.migrateMu.Lock()
+	s.migrateMu.Unlock()
+}
+
+// pauseMigration stops the running migration without finishing it, because
+// another web server is about to take it over.
+func (s *NetworkVideoContentService) pauseMigration() {
+	s.mu.Lock()
+	live := s.live
+	s.mu.Unlock()
+	if live == nil {
+		return
+	}
+	live.cancel(errNotLeader)
+	s.migrateMu.Lock()
+	s.migrateMu.Unlock()
+}
+
+// moveFile copies one file, reads it back from the destination to verify the
+// copy and only then deletes the source.
+func (s *NetworkVideoContentService) moveFile(ctx context.Context, mv FileMove) error {
+	key := fmt.Sprintf("%s/%s", mv.VideoId, mv.Filename)
+	src, err := s.client(mv.Source)
+	if err != nil {
+		return fmt.Errorf("source: %v", err)
+	}
+	dst, err := s.client(mv.Destination)
+	if err != nil {
+		return fmt.Errorf("destination: %v", err)
+	}
+	readReq := &pb.ReadRequest{VideoId: mv.VideoId, Filename: mv.Filename}
+	deleteReq := &pb.DeleteRequest{VideoId: mv.VideoId, Filename: mv.Filename}
+
+	if s.guard.beginMove(key) {
+		// The file was rewritten on its new owner during the migration, so
+		// the source copy is stale. Drop it once the new copy is there.
+		if _, err := dst.ReadVideo(ctx, readReq); err != nil {
+			// A delete, or a rewrite stored the other way (whole or
+			// coded), removes the source copy too: nothing is left to move.
+			if _, serr := src.ReadVideo(ctx, readReq); status.Code(serr) == codes.NotFound {
+				return nil
+			}
+			return fmt.Errorf("rewritten during migration but not on destination yet: %v", err)
+		}
+		if _, err := src.DeleteVideo(ctx, deleteReq); err != nil && status.Code(err) != codes.NotFound {
+			return fmt.Errorf("delete source: %v", err)
+		}
+		return nil
+	}
+	defer s.guard.endMove(key)
+
+	rebuilt := false
+	resp, err := src.ReadVideo(ctx, readReq)
+	if err == nil {
+		// A corrupt source is treated like a missing one: shards are rebuilt
+		// from the others and whole files fail the move.
+		err = checksum.Verify(resp.Content, resp.Sha256)
+	}
+	if err != nil {
+		// A previous run may have copied and deleted the file before it
+		// could record the move as done.
+		if _, derr := dst.ReadVideo(ctx, readReq); derr == nil {
+			return nil
+		}
+		base, i, n, ok := parseShardName(mv.Filename)
+		if !ok || s.erasure == nil || n != s.erasure.shards() {
+			return fmt.Errorf("read source: %v", err)
+		}
+		content, rerr := s.rebuildShard(ctx, mv.VideoId, base, i)
+		if rerr != nil {
+			return fmt.Errorf("read source: %v; rebuild shard: %v", err, rerr)
+		}
+		slog.InfoContext(ctx, "rebuilt shard", "video", mv.VideoId, "file", base, "shard", i, "node", mv.Destination)
+		resp = &pb.ReadResponse{Content: content, Sha256: checksum.Sum(content)}
+		rebuilt = true
+	}
+	sum := resp.Sha256
+	if len(sum) == 0 {
+		sum = checksum.Sum(resp.Content)
+	}
+	_, err = dst.WriteVideo(ctx, &pb.WriteRequest{
+		VideoId:  mv.VideoId,
+		Filename: mv.Filename,
+		Content:  resp.Content,
+		Sha256:   sum,
+	})
+	if err != nil {
+		return fmt.Errorf("write destination: %v", err)
+	}
+	check, err := dst.ReadVideo(ctx, readReq)
+	if err != nil {
+		return fmt.Errorf("verify destination: %v", err)
+	}
+	if !bytes.Equal(check.Sha256, sum) {
+		return fmt.Errorf("verify destination: checksum %x, want %x", check.Sha256, sum)
+	}
+	if err := checksum.Verify(check.Content, sum); err != nil {
+		return fmt.Errorf("verify destination: %v", err)
+	}
+	if rebuilt {
+		// The source copy is gone or unreadable; clean it up if possible.
+		src.DeleteVideo(ctx, deleteReq)
+		return nil
+	}
+	if _, err := src.DeleteVideo(ctx, deleteReq); err != nil && status.Code(err) != codes.NotFound {
+		return fmt.Errorf("delete source: %v", err)
+	}
+	return nil
+}
+
+// ResumeMigrations restarts every migration that was still running when the
+// web server last stopped. If the store did not keep the ring from before
+// the change, the one the migration recorded is restored as prev for reads;
+// migrations saved before that was recorded rebuild it from the kind of
+// change.
+func (s *NetworkVideoContentService) ResumeMigrations() error {
+	unfinished, err := s.migrations.ListUnfinished()
+	if err != nil {
+		return fmt.Errorf("list unfinished migrations: %v", err)
+	}
+	if len(unfinished) == 0 {
+		go s.switchPlacement()
+		return nil
+	}
+	s.mu.Lock()
+	s.running = unfinished[0].Id
+	s.mu.Unlock()
+	go func() {
+		for _, m := range unfinished {
+			if !s.leading() {
+				s.clearRunning(m.Id)
+				return
+			}
+			slog.Info("resuming migration", "migration", m.Id, "kind", m.Kind, "node", m.Node)
+			if cur := s.ring.Load(); cur.prev == nil {
+				s.setRing(newRing(cur.placement, cur.version, cur.nodes, migratedFrom(m, cur)))
+			}
+			s.mu.Lock()
+			s.running = m.Id
+			s.mu.Unlock()
+			s.guard.start()
+			s.runMigration(m)
+		}
+		s.switchPlacement()
+	}()
+	return nil
+}
+
+// migratedFrom returns the ring m moves files from, for a resumed
+// migration whose ring cur was saved without it.
+func migratedFrom(m *Migration, cur *ring) *ring {
+	if m.From != nil {
+		return ringFromState(m.From)
+	}
+	var before []StorageNode
+	placement := cur.placement
+	switch m.Kind {
+	case "add":
+		before = cur.without(m.Node)
+	case "undrain":
+		before = cur.withState(m.Node, NodeDraining)
+	case "rebalance":
+		// The old capacities are gone; unmoved files stay readable only
+		// once they are moved.
+		slog.Warn("migration: no saved ring from before the rebalance", "migration", m.Id)
+		before = cur.nodes
+	case "placement":
+		before = cur.nodes
+		placement = spreadName(cur.placement, !strings.HasSuffix(cur.placement, spreadSuffix))
+	default:
+		before = cur.with(m.Node)
+	}
+	return newRing(placement, cur.version-1, before, nil)
+}
+
+// switchPlacement migrates a ring saved with spreading turned the other way
+// to the configured placement. Only the leader does this, once no other
+// migration is running; any membership change also switches it.
+func (s *NetworkVideoContentService) switchPlacement() {
+	if !s.leading() {
+		return
+	}
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+	cur := s.ring.Load()
+	if cur.placement == s.placement || s.checkIdle() != nil {
+		return
+	}
+	id, moves, err := s.changeMembership("placement", "", cur.nodes, false)
+	if err != nil {
+		slog.Error("switch placement failed", "from", cur.placement, "to", s.placement, "err", err)
+		return
+	}
+	slog.Info("switching placement", "from", cur.placement, "to", s.placement, "migration", id, "moves", len(moves))
+}
+
+// liveMigration tracks the throughput of the migration this process is
+// running, which is what the ETA is estimated from.
+type liveMigration struct {
+	id      string
+	kind    string
+	node    string
+	started time.Time
+	moved   int64
+	cancel  context.CancelCauseFunc
+}
+
+// migrationStatus summarizes m for the admin API.
+func (s *NetworkVideoContentService) migrationStatus(m *Migration) *pb.GetMigrationResponse {
+	done, failed := m.counts()
+	planned, moved := m.bytes()
+	eta := int64(-1)
+	switch {
+	case m.State != MigrationRunning:
+		eta = 0
+	default:
+		s.mu.Lock()
+		live := s.live
+		if live != nil && live.id == m.Id && live.moved > 0 {
+			elapsed := time.Since(live.started)
+			left := time.Duration(float64(elapsed) * float64(planned-moved) / float64(live.moved))
+			eta = int64(left.Seconds())
+		}
+		s.mu.Unlock()
+	}
+	return &pb.GetMigrationResponse{
+		MigrationId:       m.Id,
+		Kind:              m.Kind,
+		NodeAddress:       m.Node,
+		State:             string(m.State),
+		PlannedFileCount:  int32(len(m.Moves)),
+		MigratedFileCount: int32(done),
+		FailedFileCount:   int32(failed),
+		PlannedBytes:      planned,
+		MigratedBytes:     moved,
+		EtaSeconds:        eta,
+	}
+}
+
+// moveGuard stops a migration from overwriting a file that was written to its
+// new owner while the migration was running.
+type moveGuard struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	active  bool
+	moving  map[string]bool
+	written map[string]bool
+}
+
+func newMoveGuard() *moveGuard {
+	g := &moveGuard{moving: make(map[string]bool)}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// start begins tracking writes for a new migration.
+func (g *moveGuard) start() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active = true
+	g.moving = make(map[string]bool)
+	g.written = make(map[string]bool)
+}
+
+func (g *moveGuard) stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active = false
+	g.written = nil
+}
+
+// write waits until key is not being copied and records that it was written.
+func (g *moveGuard) write(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.moving[key] {
+		g.cond.Wait()
+	}
+	if g.active {
+		g.written[key] = true
+	}
+}
+
+// beginMove marks key as being copied. It reports whether key was written
+// since the migration started.
+func (g *moveGuard) beginMove(key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.written[key] {
+		return true
+	}
+	g.moving[key] = true
+	return false
+}
+
+func (g *moveGuard) endMove(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.moving, key)
+	g.cond.Broadcast()
+}
+
+// memoryMigrationStore is used when no persistent store is configured.
+type memoryMigrationStore struct {
+	mu         sync.Mutex
+	migrations map[string]*Migration
+}
+
+func newMemoryMigrationStore() *memoryMigrationStore {
+	return &memoryMigrationStore{migrations: make(map[string]*Migration)}
+}
+
+func copyMigration(m *Migration) *Migration {
+	c := *m
+	c.Moves = append([]FileMove(nil), m.Moves...)
+	return &c
+}
+
+func (s *memoryMigrationStore) Create(m *Migration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.migrations[m.Id] = copyMigration(m)
+	return nil
+}
+
+func (s *memoryMigrationStore) Read(id string) (*Migration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.migrations[id]
+	if !ok {
+		return nil, fmt.Errorf("no migration %s", id)
+	}
+	return copyMigration(m), nil
+}
+
+func (s *memoryMigrationStore) ListUnfinished() ([]*Migration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out []*Migration
+	for _, m := range s.migrations {
+		if m.State == MigrationRunning {
+			out = append(out, copyMigration(m))
+		}
+	}
+	return out, nil
+}
+
+func (s *memoryMigrationStore) UpdateMove(id string, move FileMove) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.migrations[id]
+	if !ok {
+		return fmt.Errorf("no migration %s", id)
+	}
+	for i, mv := range m.Moves {
+		if mv.VideoId == move.VideoId && mv.Filename == move.Filename && mv.Source == move.Source {
+			m.Moves[i] = move
+			return nil
+		}
+	}
+	return fmt.Errorf("migration %s has no move for %s/%s from %s", id, move.VideoId, move.Filename, move.Source)
+}
+
+func (s *memoryMigrationStore) UpdateState(id string, state MigrationState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.migrations[id]
+	if !ok {
+		return fmt.Errorf("no migration %s", id)
+	}
+	m.State = state
+	return nil
+}
@@ -0,0 +1,87 @@
+package web
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMigrationStoresKeyMovesBySource plans two moves of the same file from
+// different nodes, as when a failed delete left a second copy behind, and
+// checks that every store keeps and updates them separately.
+func TestMigrationStoresKeyMovesBySource(t *testing.T) {
+	_, sqlite := openStores(t)
+	stores := map[string]MigrationStore{
+		"memory": newMemoryMigrationStore(),
+		"sqlite": sqlite,
+		"etcd":   NewEtcdMigrationStore(newEtcdClient(t, startEtcd(t))),
+	}
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			m := &Migration{
+				Id:        "m1",
+				Kind:      "add",
+				State:     MigrationRunning,
+				CreatedAt: time.Now(),
+				Moves: []FileMove{
+					{VideoId: "v", Filename: "seg1.m4s", Source: "a:1", Destination: "c:1", State: MovePending},
+					{VideoId: "v", Filename: "seg1.m4s", Source: "b:1", Destination: "c:1", State: MovePending},
+				},
+			}
+			if err := store.Create(m); err != nil {
+				t.Fatal(err)
+			}
+			done := m.Moves[1]
+			done.State = MoveDone
+			if err := store.UpdateMove(m.Id, done); err != nil {
+				t.Fatal(err)
+			}
+			got, err := store.Read(m.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			states := make(map[string]MoveState)
+			for _, mv := range got.Moves {
+				states[mv.Source] = mv.State
+			}
+			if len(got.Moves) != 2 || states["a:1"] != MovePending || states["b:1"] != MoveDone {
+				t.Fatalf("moves after update: %+v", got.Moves)
+			}
+		})
+	}
+}
+
+// TestSQLiteMovesTableGainsSourceKey opens a database whose moves table was
+// keyed without the source and checks its moves survive the rebuild.
+func TestSQLiteMovesTableGainsSourceKey(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, stmt := range []string{
+		`CREATE TABLE migration_moves (migrationId TEXT, videoId TEXT, filename TEXT, source TEXT, destination TEXT,
+			size INTEGER DEFAULT 0, state TEXT, error TEXT, PRIMARY KEY (migrationId, videoId, filename))`,
+		`INSERT INTO migration_moves VALUES ('m1', 'v', 'seg1.m4s', 'a:1', 'c:1', 10, 'pending', '')`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store, err := NewSQLiteMigrationStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moves, err := store.readMoves("m1")
+	if err != nil || len(moves) != 1 || moves[0].Size != 10 {
+		t.Fatalf("moves after rebuild: %+v, %v", moves, err)
+	}
+	_, err = db.Exec(`INSERT INTO migration_moves (migrationId, videoId, filename, source) VALUES ('m1', 'v', 'seg1.m4s', 'b:1')`)
+	if err != nil {
+		t.Fatalf("second copy of the same file: %v", err)
+	}
+	if _, err := NewSQLiteMigrationStore(db); err != nil {
+		t.Fatalf("reopen after rebuild: %v", err)
+	}
+}
@@ -3,220 +3,454 @@
 package web
 
 import (
-	"fmt"
 	"context"
-	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
 	"sync"
-	"crypto/sha256"
-	"sort"
-	"log"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"tritontube/internal/checksum"
 	pb "tritontube/internal/proto"
+	"tritontube/internal/tracing"
+	"tritontube/internal/videokey"
 )
 
-type StorageNode struct {
-	Address string
-	Hash    uint64
-}
-
 // NetworkVideoContentService implements VideoContentService using a network of nodes.
-type NetworkVideoContentService struct{
+type NetworkVideoContentService struct {
 	pb.UnimplementedVideoContentAdminServiceServer
-	Nodes   []StorageNode
-	Clients map[string]pb.StorageServiceClient
-	mu      sync.Mutex
+	ring       atomic.Pointer[ring]
+	clientsMu  sync.RWMutex
+	clients    map[string]*storageConn
+	membership MembershipStore
+	migrations MigrationStore
+	guard      *moveGuard
+	// adminMu serializes membership changes; migrateMu lets only one
+	// migration move files at a time.
+	adminMu   sync.Mutex
+	migrateMu sync.Mutex
+	mu        sync.Mutex
+	// running is the id of the migration in progress, if any. The ring is
+	// not changed again until it finishes.
+	running string
+	live    *liveMigration
+	// cluster is set when the ring is shared with other web servers.
+	cluster *cluster
+	// placement names the strategy every ring of this service is built with.
+	placement string
+	// erasure is nil unless some files are erasure coded.
+	erasure *erasureCoder
+	// prefetch is nil unless segments are read ahead.
+	prefetch *prefetcher
+	// rpcTimeout bounds every storage RPC not given a deadline already.
+	rpcTimeout time.Duration
+}
+
+// NetworkConfig holds the optional settings of a NetworkVideoContentService.
+type NetworkConfig struct {
+	// Placement is the strategy that maps keys to nodes: PlacementRing (the
+	// default), PlacementVnode or PlacementRendezvous. It is saved with the
+	// ring and cannot change once the cluster holds files.
+	Placement string
+	// Spread chooses the owners of a key's shards from as many zones, racks
+	// and hosts as it can. Turning it on or off for an existing cluster
+	// migrates the shards that move.
+	Spread bool
+	// Erasure codes large files, or all files of some videos, instead of
+	// storing them whole. It is off when DataShards is 0.
+	Erasure ErasureConfig
+	// Prefetch reads ahead the segments that follow a requested one.
+	Prefetch PrefetchConfig
+	// RPCTimeout bounds each storage RPC whose context has no deadline;
+	// it defaults to DefaultRPCTimeout.
+	RPCTimeout time.Duration
 }
 
 // Uncomment the following line to ensure NetworkVideoContentService implements VideoContentService
 var _ VideoContentService = (*NetworkVideoContentService)(nil)
+var _ VideoContentDeleter = (*NetworkVideoContentService)(nil)
+var _ VideoContentLister = (*NetworkVideoContentService)(nil)
+var _ VideoContentPlacer = (*NetworkVideoContentService)(nil)
 var _ pb.VideoContentAdminServiceServer = (*NetworkVideoContentService)(nil)
 
-func (s *NetworkVideoContentService) getHashRingNode(key string) StorageNode {
-	if len(s.Nodes) == 0 {
-		log.Fatalf("No nodes")
+// NewNetworkVideoContentService loads the ring from membership. If nothing
+// has been saved yet, the cluster is seeded with the seed nodes. A nil
+// membership store keeps the ring in memory only, and a nil migrations store
+// does the same for migration plans.
+func NewNetworkVideoContentService(membership MembershipStore, migrations MigrationStore, seed []StorageNode, config NetworkConfig) (*NetworkVideoContentService, error) {
+	if migrations == nil {
+		migrations = newMemoryMigrationStore()
 	}
-	sortedNodes := make([]StorageNode, len(s.Nodes))
-	copy(sortedNodes, s.Nodes)
-	sort.Slice(sortedNodes, func(i, j int) bool {
-		return sortedNodes[i].Hash < sortedNodes[j].Hash
-	})
-	sum := sha256.Sum256([]byte(key))
-	hashVal := binary.BigEndian.Uint64(sum[:8])
-	for _, n := range sortedNodes {
-		if hashVal <= n.Hash {
-			return n
+	if config.Placement == "" {
+		config.Placement = PlacementRing
+	}
+	if config.RPCTimeout <= 0 {
+		config.RPCTimeout = DefaultRPCTimeout
+	}
+	if _, err := PlacementByName(config.Placement); err != nil {
+		return nil, err
+	}
+	s := &NetworkVideoContentService{
+		clients:    make(map[string]*storageConn),
+		rpcTimeout: config.RPCTimeout,
+		membership: membership,
+		migrations: migrations,
+		guard:      newMoveGuard(),
+		placement:  spreadName(config.Placement, config.Spread),
+	}
+	if config.Erasure.DataShards > 0 {
+		var err error
+		if s.erasure, err = newErasureCoder(config.Erasure); err != nil {
+			return nil, err
+		}
+	}
+	if config.Prefetch.Segments > 0 {
+		s.prefetch = newPrefetcher(config.Prefetch)
+	}
+	var state *RingState
+	if membership != nil {
+		var err error
+		state, err = membership.LoadRing()
+		if err != nil {
+			return nil, fmt.Errorf("load ring: %v", err)
 		}
 	}
-	return sortedNodes[0]
+	if state == nil || state.Version == 0 {
+		nodes := make([]StorageNode, len(seed))
+		for i, n := range seed {
+			n.Hash = hashKey(n.Address)
+			nodes[i] = n
+		}
+		if err := s.installRing(newRing(s.placement, 1, nodes, nil)); err != nil {
+			// Another web server sharing the store may have seeded it first.
+			if state, lerr := membership.LoadRing(); lerr == nil && state != nil {
+				s.ring.Store(ringFromState(state))
+				return s, nil
+			}
+			return nil, err
+		}
+		return s, nil
+	}
+	p := savedPlacement(state)
+	if base := spreadName(p, false); base != config.Placement {
+		return nil, fmt.Errorf("the saved ring uses placement %q, not %q", base, config.Placement)
+	}
+	if p != s.placement {
+		slog.Info("saved ring spreads owners differently; the leader will migrate it", "saved", p, "configured", s.placement)
+	}
+	slog.Info("loaded ring", "version", state.Version, "nodes", len(state.Nodes))
+	s.ring.Store(ringFromState(state))
+	return s, nil
 }
 
-func (s *NetworkVideoContentService) Read(videoId string, filename string) ([]byte, error) {
-	key := fmt.Sprintf("%s/%s", videoId, filename)
-	n := s.getHashRingNode(key)
-	client := s.Clients[n.Address]
-	resp, err := client.ReadVideo(context.Background(), &pb.ReadRequest{
-		VideoId:  videoId,
-		Filename: filename,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("nw read err %v", err)
+// savedPlacement is the placement of a saved ring. Rings saved before the
+// placement was recorded use the single-point ring.
+func savedPlacement(state *RingState) string {
+	if state.Placement == "" {
+		return PlacementRing
 	}
-	return resp.Content, nil
+	return state.Placement
 }
 
-func (s *NetworkVideoContentService) Write(videoId string, filename string, data []byte) error {
-	key := fmt.Sprintf("%s/%s", videoId, filename)
-	n := s.getHashRingNode(key)
-	client := s.Clients[n.Address]
-	_, err := client.WriteVideo(context.Background(), &pb.WriteRequest{
-		VideoId:  videoId,
-		Filename: filename,
-		Content:     data,
-	})
-	if err != nil {
-		return fmt.Errorf("nw write error: %v", err)
+// ringFromState rebuilds a saved ring, including its earlier rings if the
+// store kept them.
+func ringFromState(state *RingState) *ring {
+	placement := savedPlacement(state)
+	var prev *ring
+	if state.Prev != nil {
+		for i := len(state.Earlier) - 1; i >= 0; i-- {
+			e := state.Earlier[i]
+			prev = newRing(e.Placement, state.Version-2-uint64(i), e.Nodes, prev)
+		}
+		prevPlacement := placement
+		if state.PrevPlacement != "" {
+			prevPlacement = state.PrevPlacement
+		}
+		prev = newRing(prevPlacement, state.Version-1, state.Prev, prev)
 	}
-	return nil
+	return newRing(placement, state.Version, state.Nodes, prev)
 }
 
-func (s *NetworkVideoContentService) ListNodes(ctx context.Context, req *pb.ListNodesRequest) (*pb.ListNodesResponse, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	addresses := make([]string, len(s.Nodes))
-	for i, node := range s.Nodes {
-		addresses[i] = node.Address
+// ringState is the saved form of r.
+func ringState(r *ring) *RingState {
+	state := &RingState{Version: r.version, Placement: r.placement, Nodes: r.nodes}
+	if r.prev != nil {
+		state.Prev = r.prev.nodes
+		if r.prev.placement != r.placement {
+			state.PrevPlacement = r.prev.placement
+		}
+		for _, e := range r.prev.history()[1:] {
+			state.Earlier = append(state.Earlier, SavedRing{Placement: e.placement, Nodes: e.nodes})
+		}
 	}
-	return &pb.ListNodesResponse{
-		Nodes: addresses,
-	}, nil
+	return state
 }
 
-func (s *NetworkVideoContentService) AddNode(ctx context.Context, req *pb.AddNodeRequest) (*pb.AddNodeResponse, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	addr := req.NodeAddress
-	sum := sha256.Sum256([]byte(addr))
-	hash := binary.BigEndian.Uint64(sum[:8])
-	s.Nodes = append(s.Nodes, StorageNode{Address: addr, Hash: hash})
-	sort.Slice(s.Nodes, func(i, j int) bool {
-		return s.Nodes[i].Hash < s.Nodes[j].Hash
-	})
-	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
-	if err != nil {
-		return nil, fmt.Errorf("Failed to add: %v", err)
+// installRing saves r's membership and then makes it the current ring.
+func (s *NetworkVideoContentService) installRing(r *ring) error {
+	if s.membership != nil {
+		if err := s.membership.SaveRing(ringState(r)); err != nil {
+			return fmt.Errorf("save ring: %v", err)
+		}
 	}
-	s.Clients[addr] = pb.NewStorageServiceClient(conn)
-	filesMoved := s.addFilesToThisNode()
-	return &pb.AddNodeResponse{MigratedFileCount: int32(filesMoved)}, nil
+	s.setRing(r)
+	return nil
 }
 
-func (s *NetworkVideoContentService) addFilesToThisNode() int {
-	totalFilesMoved := 0
-	for addr, client := range s.Clients {
-		isValid := false
-		for _, n := range s.Nodes {
-			if n.Address == addr {
-				isValid = true
-				break
-			}
+// Read asks the owner of the file first. While a migration is running the
+// file may not have moved yet, so its owners in the previous rings are tried next.
+// A file that is not stored whole is reassembled from its erasure-coded
+// shards; videos that are always coded are looked up that way first.
+func (s *NetworkVideoContentService) Read(ctx context.Context, videoId string, filename string) ([]byte, error) {
+	if _, err := videokey.New(videoId, filename); err != nil {
+		return nil, err
+	}
+	if s.prefetch == nil || !isSegment(filename) {
+		return s.read(ctx, videoId, filename)
+	}
+	data, ok := s.prefetch.take(ctx, fmt.Sprintf("%s/%s", videoId, filename))
+	// Reads ahead outlive the request that started them.
+	go s.prefetch.after(videoId, filename, s.read)
+	if ok {
+		return data, nil
+	}
+	return s.read(ctx, videoId, filename)
+}
+
+func (s *NetworkVideoContentService) read(ctx context.Context, videoId string, filename string) ([]byte, error) {
+	if s.erasure == nil {
+		return s.readWhole(ctx, videoId, filename)
+	}
+	if s.erasure.videos[videoId] {
+		if data, err := s.readCoded(ctx, videoId, filename); err == nil {
+			return data, nil
 		}
-		if !isValid {
+		return s.readWhole(ctx, videoId, filename)
+	}
+	data, err := s.readWhole(ctx, videoId, filename)
+	if err == nil {
+		return data, nil
+	}
+	data, cerr := s.readCoded(ctx, videoId, filename)
+	if cerr != nil {
+		return nil, fmt.Errorf("%v; as shards: %v", err, cerr)
+	}
+	return data, nil
+}
+
+func (s *NetworkVideoContentService) readWhole(ctx context.Context, videoId string, filename string) ([]byte, error) {
+	key := fmt.Sprintf("%s/%s", videoId, filename)
+	_, span := tracing.Start(ctx, "ring.owners", attribute.String("ring.key", key))
+	addrs, err := s.ring.Load().owners(key)
+	span.SetAttributes(attribute.StringSlice("storage.nodes", addrs))
+	tracing.End(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("nw read err %v", err)
+	}
+	for _, addr := range addrs {
+		c, rerr := s.client(addr)
+		if rerr != nil {
+			err = rerr
 			continue
 		}
-		resp, err := client.ListFiles(context.Background(), &pb.ListRequest{})
-		if err != nil {
-			continue
+		resp, rerr := c.ReadVideo(ctx, &pb.ReadRequest{
+			VideoId:  videoId,
+			Filename: filename,
+		})
+		if rerr == nil {
+			rerr = checksum.Verify(resp.Content, resp.Sha256)
 		}
-		for _, file := range resp.FilesList {
-			key := fmt.Sprintf("%s/%s", file.VideoId, file.Filename)
-			destinationNode := s.getHashRingNode(key)
-			// if target node is diff
-			if destinationNode.Address != addr {
-				readResponse, err := client.ReadVideo(context.Background(), &pb.ReadRequest{
-					VideoId:  file.VideoId,
-					Filename: file.Filename,
-				})
-				if err != nil {
-					continue
-				}
-				newOwner := s.Clients[destinationNode.Address]
-				_, err = newOwner.WriteVideo(context.Background(), &pb.WriteRequest{
-					VideoId:  file.VideoId,
-					Filename: file.Filename,
-					Content:  readResponse.Content,
-				})
-				if err != nil {
-					continue
-				}
-				_, err = client.DeleteVideo(context.Background(), &pb.DeleteRequest{
-					VideoId:  file.VideoId,
-					Filename: file.Filename,
-				})
-				if err != nil {
-					log.Printf("Failed delete %v", err)
-				}
-				totalFilesMoved += 1
-			}
+		if rerr == nil {
+			return resp.Content, nil
+		}
+		if errors.Is(rerr, checksum.ErrMismatch) {
+			slog.WarnContext(ctx, "nw read: corrupt file", "key", key, "node", addr, "err", rerr)
+		}
+		err = rerr
+		if ctx.Err() != nil {
+			break
 		}
 	}
-	return totalFilesMoved
+	return nil, fmt.Errorf("nw read err %v", err)
 }
 
-func (s *NetworkVideoContentService) RemoveNode(ctx context.Context, req *pb.RemoveNodeRequest) (*pb.RemoveNodeResponse, error) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	addr := req.NodeAddress
-	var newNodes []StorageNode
-	for _, node := range s.Nodes {
-		if node.Address != addr {
-			newNodes = append(newNodes, node)
-		}
+// Write always goes to the owner in the current ring, or to the owners of
+// its shards if the file is erasure coded. A copy stored the other way from
+// an earlier write is then removed, so reads cannot find the old contents.
+func (s *NetworkVideoContentService) Write(ctx context.Context, videoId string, filename string, data []byte) error {
+	if _, err := videokey.New(videoId, filename); err != nil {
+		return err
+	}
+	if err := s.checkNotMoving(videoId, filename); err != nil {
+		return err
+	}
+	s.invalidatePrefetch(videoId, filename)
+	if s.erasure != nil && s.erasure.coded(videoId, len(data)) {
+		return s.writeCoded(ctx, videoId, filename, data)
+	}
+	return s.writeWhole(ctx, videoId, filename, data)
+}
+
+// checkNotMoving refuses, with Unavailable, a write or delete that a web
+// server other than the leader gets for a file the running migration may
+// move. Only the leader's move guard can hold back the copy of a file, so
+// letting the change through could see it overwritten by the stale source
+// or brought back after a delete. Uploads retry Unavailable writes.
+func (s *NetworkVideoContentService) checkNotMoving(videoId, filename string) error {
+	if s.leading() {
+		return nil
+	}
+	shards := 0
+	if s.erasure != nil {
+		shards = s.erasure.shards()
+	}
+	key := fmt.Sprintf("%s/%s", videoId, filename)
+	if s.ring.Load().moves(key, shards) {
+		return status.Errorf(codes.Unavailable, "%s is being migrated; try again when the migration finishes", key)
 	}
-	s.Nodes = newNodes
-	sort.Slice(s.Nodes, func(i, j int) bool {
-		return s.Nodes[i].Hash < s.Nodes[j].Hash
+	return nil
+}
+
+func (s *NetworkVideoContentService) writeWhole(ctx context.Context, videoId string, filename string, data []byte) error {
+	key := fmt.Sprintf("%s/%s", videoId, filename)
+	r := s.ring.Load()
+	_, span := tracing.Start(ctx, "ring.owner", attribute.String("ring.key", key))
+	n, err := r.owner(key)
+	if err == nil {
+		span.SetAttributes(attribute.String("storage.node", n.Address))
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return fmt.Errorf("nw write error: %v", err)
+	}
+	s.guard.write(key)
+	c, err := s.client(n.Address)
+	if err != nil {
+		return fmt.Errorf("nw write error: %w", err)
+	}
+	_, err = c.WriteVideo(ctx, &pb.WriteRequest{
+		VideoId:  videoId,
+		Filename: filename,
+		Content:  data,
+		Sha256:   checksum.Sum(data),
 	})
-	migratedCount := s.sendFilesOut(addr)
+	if err != nil {
+		// Wrapped so callers can retry on the status code.
+		return fmt.Errorf("nw write error: %w", err)
+	}
+	if s.erasure != nil {
+		// Shards from when the file was coded would otherwise outlive it.
+		if _, err := s.deleteCopies(ctx, videoId, s.shardCopies(r, key, filename)); err != nil {
+			return fmt.Errorf("nw write error: remove old shards: %w", err)
+		}
+	}
+	return nil
+}
 
-	return &pb.RemoveNodeResponse{MigratedFileCount: int32(migratedCount)}, nil
+// NodeFor returns the node a whole file is written to. Erasure-coded files
+// are spread over several nodes, of which this is one.
+func (s *NetworkVideoContentService) NodeFor(videoId string, filename string) string {
+	n, err := s.ring.Load().owner(fmt.Sprintf("%s/%s", videoId, filename))
+	if err != nil {
+		return ""
+	}
+	return n.Address
 }
 
-func (s *NetworkVideoContentService) sendFilesOut(addr string) int {
-	client := s.Clients[addr]
-	resp, err := client.ListFiles(context.Background(), &pb.ListRequest{})
+// Delete removes a file from every node that may hold it: its owners in the
+// current and previous rings, and the owners of its shards.
+func (s *NetworkVideoContentService) Delete(ctx context.Context, videoId string, filename string) error {
+	if _, err := videokey.New(videoId, filename); err != nil {
+		return err
+	}
+	if err := s.checkNotMoving(videoId, filename); err != nil {
+		return err
+	}
+	s.invalidatePrefetch(videoId, filename)
+	key := fmt.Sprintf("%s/%s", videoId, filename)
+	r := s.ring.Load()
+	addrs, err := r.owners(key)
 	if err != nil {
-		return 0
+		return fmt.Errorf("nw delete error: %v", err)
 	}
-	totalFilesMoved := 0
-	for _, file := range resp.FilesList {
-		key := fmt.Sprintf("%s/%s", file.VideoId, file.Filename)
-		newNode := s.getHashRingNode(key)
-		if newNode.Address == addr {
-			continue
+	s.guard.write(key)
+	// Each name to delete, with the nodes that may hold it.
+	targets := map[string][]string{filename: addrs}
+	if s.erasure != nil {
+		for name, addrs := range s.shardCopies(r, key, filename) {
+			targets[name] = addrs
 		}
-		readResponse, err := client.ReadVideo(context.Background(), &pb.ReadRequest{
-			VideoId:  file.VideoId,
-			Filename: file.Filename,
-		})
-		if err != nil {
-			continue
+	}
+	deleted, err := s.deleteCopies(ctx, videoId, targets)
+	if err != nil {
+		return fmt.Errorf("nw delete error: %v", err)
+	}
+	if !deleted {
+		return fmt.Errorf("nw delete error: %s not found", key)
+	}
+	return nil
+}
+
+// ListStored lists the files on every node of the current and earlier
+// rings. Nodes that cannot be listed are skipped.
+func (s *NetworkVideoContentService) ListStored(ctx context.Context) ([]StoredFile, error) {
+	addrs := s.ring.Load().allAddresses()
+	var files []StoredFile
+	listed := 0
+	for _, addr := range addrs {
+		resp, err := s.listFiles(ctx, addr)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
 		}
-		newStorageNode := s.Clients[newNode.Address]
-		_, err = newStorageNode.WriteVideo(context.Background(), &pb.WriteRequest{
-			VideoId:  file.VideoId,
-			Filename: file.Filename,
-			Content:  readResponse.Content,
-		})
 		if err != nil {
+			slog.WarnContext(ctx, "nw list failed", "node", addr, "err", err)
 			continue
 		}
-		totalFilesMoved += 1
+		listed++
+		for _, f := range resp.FilesList {
+			files = append(files, StoredFile{
+				Node:     addr,
+				VideoId:  f.VideoId,
+				Filename: f.Filename,
+				Size:     f.Size,
+				ModTime:  time.Unix(f.ModifiedUnix, 0),
+			})
+		}
+	}
+	if listed == 0 && len(addrs) > 0 {
+		return nil, fmt.Errorf("nw list: no storage node could be listed")
+	}
+	return files, nil
+}
+
+// DeleteStored removes the file from the one node that was listed as
+// holding it.
+func (s *NetworkVideoContentService) DeleteStored(ctx context.Context, f StoredFile) error {
+	s.invalidatePrefetch(f.VideoId, f.Filename)
+	c, err := s.client(f.Node)
+	if err == nil {
+		_, err = c.DeleteVideo(ctx, &pb.DeleteRequest{VideoId: f.VideoId, Filename: f.Filename})
 	}
-	_, err = client.RemoveAllFiles(context.Background(), &pb.RemoveRequest{})
 	if err != nil {
-		log.Printf("Delet all fail %v", err)
+		return fmt.Errorf("nw delete error: %s/%s on %s: %v", f.VideoId, f.Filename, f.Node, err)
 	}
-		
-	return totalFilesMoved
-}
\ No newline at end of file
+	return nil
+}
+
+func (s *NetworkVideoContentService) invalidatePrefetch(videoId, filename string) {
+	if s.prefetch != nil {
+		s.prefetch.invalidate(fmt.Sprintf("%s/%s", videoId, filename))
+	}
+}
+
+// PrefetchStats reports how often reads were served by segments read ahead.
+func (s *NetworkVideoContentService) PrefetchStats() PrefetchStats {
+	if s.prefetch == nil {
+		return PrefetchStats{}
+	}
+	return s.prefetch.stats()
+}
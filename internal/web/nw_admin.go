@@ -0,0 +1,365 @@
+// Admin API of the network video content service: ring membership changes
+
+package web
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pb "tritontube/internal/proto"
+)
+
+func (s *NetworkVideoContentService) ListNodes(ctx context.Context, req *pb.ListNodesRequest) (*pb.ListNodesResponse, error) {
+	if leader, err := s.leaderAdmin(ctx); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.ListNodes(ctx, req)
+	}
+	r := s.ring.Load()
+	stats := s.statNodes(ctx, r.nodes)
+	info := make([]*pb.NodeInfo, len(r.nodes))
+	for i, n := range r.nodes {
+		info[i] = &pb.NodeInfo{
+			Address:         n.Address,
+			State:           string(n.State),
+			Weight:          int32(n.Weight),
+			Zone:            n.Zone,
+			Rack:            n.Rack,
+			Host:            n.Host,
+			UsedBytes:       -1,
+			FileCount:       -1,
+			FreeBytes:       -1,
+			CapacityPercent: int32(n.Capacity),
+		}
+		if st, ok := stats[n.Address]; ok {
+			info[i].UsedBytes = st.UsedBytes
+			info[i].FileCount = st.FileCount
+			info[i].FreeBytes = st.FreeBytes
+			info[i].QuotaBytes = st.QuotaBytes
+		}
+	}
+	s.mu.Lock()
+	running := s.running
+	s.mu.Unlock()
+	return &pb.ListNodesResponse{
+		Nodes:       r.addresses(),
+		NodeInfo:    info,
+		MigrationId: running,
+	}, nil
+}
+
+// swapRing installs a new ring built from nodes. The current ring is kept as
+// its prev so files that have not been migrated yet stay readable. If the
+// last migration failed, the current ring still has its own prev, where
+// the files it could not move are; that is kept too until a migration
+// moves them.
+func (s *NetworkVideoContentService) swapRing(nodes []StorageNode) (*ring, error) {
+	cur := s.ring.Load()
+	next := newRing(s.placement, cur.version+1, nodes, cur)
+	if err := s.installRing(next); err != nil {
+		return nil, err
+	}
+	slog.Info("ring changed", "version", next.version, "nodes", next.addresses())
+	return next, nil
+}
+
+// rollBack undoes a swapRing whose migration could not be started. The
+// ring goes back to old's nodes under a new version, with old's earlier
+// rings: nothing was moved, so files are where they were before the swap.
+func (s *NetworkVideoContentService) rollBack(old *ring) {
+	s.guard.stop()
+	back := newRing(old.placement, s.ring.Load().version+1, old.nodes, old.prev)
+	if err := s.installRing(back); err != nil {
+		slog.Error("roll back ring failed", "version", old.version, "err", err)
+		return
+	}
+	slog.Info("ring rolled back", "version", back.version, "nodes", back.addresses())
+}
+
+// checkIdle fails if a migration is still moving files for an earlier change.
+func (s *NetworkVideoContentService) checkIdle() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running != "" {
+		return status.Errorf(codes.FailedPrecondition, "migration %s is still running", s.running)
+	}
+	return nil
+}
+
+// changeMembership moves the ring to nodes. For a dry run it only plans the
+// moves; otherwise it switches the ring, plans the moves from the nodes of
+// the previous rings, persists the plan and moves the files in the
+// background. Files a failed migration left behind are planned again.
+func (s *NetworkVideoContentService) changeMembership(kind, addr string, nodes []StorageNode, dryRun bool) (string, []FileMove, error) {
+	old := s.ring.Load()
+	if len(newRing(s.placement, 0, nodes, nil).active) == 0 {
+		return "", nil, status.Errorf(codes.FailedPrecondition, "at least one active node must remain")
+	}
+	if dryRun {
+		moves, err := s.planMigration(old.allAddresses(), newRing(s.placement, old.version+1, nodes, nil))
+		if err != nil {
+			return "", nil, status.Errorf(codes.Unavailable, "plan migration: %v", err)
+		}
+		return "", moves, nil
+	}
+	s.guard.start()
+	r, err := s.swapRing(nodes)
+	if err != nil {
+		s.guard.stop()
+		return "", nil, status.Errorf(codes.Internal, "%v", err)
+	}
+	moves, err := s.planMigration(old.allAddresses(), r)
+	if err != nil {
+		s.rollBack(old)
+		return "", nil, status.Errorf(codes.Unavailable, "plan migration: %v", err)
+	}
+	m := &Migration{
+		Id:        newMigrationId(),
+		Kind:      kind,
+		Node:      addr,
+		State:     MigrationRunning,
+		CreatedAt: time.Now(),
+		Moves:     moves,
+		From:      ringState(old),
+	}
+	if err := s.migrations.Create(m); err != nil {
+		s.rollBack(old)
+		return "", nil, status.Errorf(codes.Internal, "save migration plan: %v", err)
+	}
+	s.mu.Lock()
+	s.running = m.Id
+	s.mu.Unlock()
+	slog.Info("migration planned", "migration", m.Id, "kind", kind, "node", addr, "moves", len(moves))
+	go s.runMigration(m)
+	return m.Id, moves, nil
+}
+
+func plannedMoves(moves []FileMove, dryRun bool) []*pb.PlannedMove {
+	if !dryRun {
+		return nil
+	}
+	planned := make([]*pb.PlannedMove, len(moves))
+	for i, mv := range moves {
+		planned[i] = &pb.PlannedMove{
+			VideoId:     mv.VideoId,
+			Filename:    mv.Filename,
+			Source:      mv.Source,
+			Destination: mv.Destination,
+			Size:        mv.Size,
+		}
+	}
+	return planned
+}
+
+func (s *NetworkVideoContentService) AddNode(ctx context.Context, req *pb.AddNodeRequest) (*pb.AddNodeResponse, error) {
+	if leader, err := s.leaderAdmin(ctx); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.AddNode(ctx, req)
+	}
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+	if err := s.checkIdle(); err != nil {
+		return nil, err
+	}
+	addr := req.NodeAddress
+	cur := s.ring.Load()
+	if cur.contains(addr) {
+		return nil, status.Errorf(codes.AlreadyExists, "node %s is already in the ring", addr)
+	}
+	if req.Weight < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "weight must not be negative")
+	}
+	if _, err := s.client(addr); err != nil {
+		return nil, err
+	}
+	n := StorageNode{
+		Address: addr,
+		Hash:    hashKey(addr),
+		State:   NodeActive,
+		Weight:  int(req.Weight),
+		Zone:    req.Zone,
+		Rack:    req.Rack,
+		Host:    req.Host,
+	}
+	if n.Weight == 0 {
+		n.Weight = 1
+	}
+	id, moves, err := s.changeMembership("add", addr, cur.withNode(n), req.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.AddNodeResponse{
+		MigratedFileCount: int32(len(moves)),
+		MigrationId:       id,
+		PlannedMoves:      plannedMoves(moves, req.DryRun),
+	}, nil
+}
+
+// RemoveNode drains the node and, once all of its files are verified on
+// their new owners, drops it from the ring.
+func (s *NetworkVideoContentService) RemoveNode(ctx context.Context, req *pb.RemoveNodeRequest) (*pb.RemoveNodeResponse, error) {
+	if leader, err := s.leaderAdmin(ctx); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.RemoveNode(ctx, req)
+	}
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+	if err := s.checkIdle(); err != nil {
+		return nil, err
+	}
+	addr := req.NodeAddress
+	cur := s.ring.Load()
+	if !cur.contains(addr) {
+		return nil, status.Errorf(codes.NotFound, "node %s is not in the ring", addr)
+	}
+	id, moves, err := s.changeMembership("remove", addr, cur.withState(addr, NodeDraining), req.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.RemoveNodeResponse{
+		MigratedFileCount: int32(len(moves)),
+		MigrationId:       id,
+		PlannedMoves:      plannedMoves(moves, req.DryRun),
+	}, nil
+}
+
+func (s *NetworkVideoContentService) DrainNode(ctx context.Context, req *pb.DrainNodeRequest) (*pb.DrainNodeResponse, error) {
+	if leader, err := s.leaderAdmin(ctx); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.DrainNode(ctx, req)
+	}
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+	if err := s.checkIdle(); err != nil {
+		return nil, err
+	}
+	addr := req.NodeAddress
+	n, ok := s.ring.Load().node(addr)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "node %s is not in the ring", addr)
+	}
+	if n.State != NodeActive {
+		return nil, status.Errorf(codes.FailedPrecondition, "node %s is already %s", addr, n.State)
+	}
+	id, moves, err := s.changeMembership("drain", addr, s.ring.Load().withState(addr, NodeDraining), req.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DrainNodeResponse{
+		MigratedFileCount: int32(len(moves)),
+		MigrationId:       id,
+		PlannedMoves:      plannedMoves(moves, req.DryRun),
+	}, nil
+}
+
+// UndrainNode makes the node active again, cancelling its drain if one is
+// still running, and moves the files it owns back onto it.
+func (s *NetworkVideoContentService) UndrainNode(ctx context.Context, req *pb.UndrainNodeRequest) (*pb.UndrainNodeResponse, error) {
+	if leader, err := s.leaderAdmin(ctx); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.UndrainNode(ctx, req)
+	}
+	s.adminMu.Lock()
+	defer s.adminMu.Unlock()
+	addr := req.NodeAddress
+	n, ok := s.ring.Load().node(addr)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "node %s is not in the ring", addr)
+	}
+	if n.State == NodeActive {
+		return nil, status.Errorf(codes.FailedPrecondition, "node %s is not draining", addr)
+	}
+	if !req.DryRun {
+		s.cancelMigrationOf(addr)
+	}
+	if err := s.checkIdle(); err != nil {
+		return nil, err
+	}
+	id, moves, err := s.changeMembership("undrain", addr, s.ring.Load().withState(addr, NodeActive), req.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.UndrainNodeResponse{
+		MigratedFileCount: int32(len(moves)),
+		MigrationId:       id,
+		PlannedMoves:      plannedMoves(moves, req.DryRun),
+	}, nil
+}
+
+func (s *NetworkVideoContentService) GetMigration(ctx context.Context, req *pb.GetMigrationRequest) (*pb.GetMigrationResponse, error) {
+	if leader, err := s.leaderAdmin(ctx); leader != nil || err != nil {
+		if err != nil {
+			return nil, err
+		}
+		return leader.GetMigration(ctx, req)
+	}
+	m, err := s.migrations.Read(req.MigrationId)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "%v", err)
+	}
+	return s.migrationStatus(m), nil
+}
+
+// WatchMigration sends the migration's status every half second until it is
+// no longer running or the client goes away.
+func (s *NetworkVideoContentService) WatchMigration(req *pb.GetMigrationRequest, stream pb.VideoContentAdminService_WatchMigrationServer) error {
+	leader, err := s.leaderAdmin(stream.Context())
+	if err != nil {
+		return err
+	}
+	if leader != nil {
+		return relayMigration(leader, req, stream)
+	}
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		m, err := s.migrations.Read(req.MigrationId)
+		if err != nil {
+			return status.Errorf(codes.NotFound, "%v", err)
+		}
+		if err := stream.Send(s.migrationStatus(m)); err != nil {
+			return err
+		}
+		if m.State != MigrationRunning {
+			return nil
+		}
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// relayMigration streams the leader's WatchMigration to the client.
+func relayMigration(leader pb.VideoContentAdminServiceClient, req *pb.GetMigrationRequest, stream pb.VideoContentAdminService_WatchMigrationServer) error {
+	upstream, err := leader.WatchMigration(stream.Context(), req)
+	if err != nil {
+		return err
+	}
+	for {
+		m, err := upstream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(m); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,442 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pb "tritontube/internal/proto"
+)
+
+// waitMigrated waits until the migration s is running has finished and its
+// previous ring is gone.
+func waitMigrated(t *testing.T, s *NetworkVideoContentService) {
+	t.Helper()
+	waitFor(t, "migration to finish", func() bool {
+		return s.checkIdle() == nil && s.ring.Load().prev == nil
+	})
+}
+
+// TestMigrationsWithConcurrentClients adds and removes nodes while readers
+// and a writer keep using the service. Run it with -race: it is there as
+// much for the race detector as for its own checks. Readers must never miss
+// a file, and every rewritten file must end up with its last contents.
+func TestMigrationsWithConcurrentClients(t *testing.T) {
+	var nodes []StorageNode
+	for i := 0; i < 6; i++ {
+		nodes = append(nodes, startStorageNode(t))
+	}
+	config := NetworkConfig{
+		Placement: PlacementVnode,
+		// Files of 1000 bytes or more are coded, the rest stored whole.
+		Erasure: ErasureConfig{DataShards: 2, ParityShards: 1, MinSize: 1000},
+	}
+	s, err := NewNetworkVideoContentService(nil, nil, nodes[:4], config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+
+	static := make(map[string]string)
+	for i := 0; i < 40; i++ {
+		name := fmt.Sprintf("static%d.m4s", i)
+		static[name] = strings.Repeat(name, 1+i*5)
+		if err := s.Write(ctx, "v", name, []byte(static[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const rewritten = 5
+	var last [rewritten]atomic.Int64
+	for i := 0; i < rewritten; i++ {
+		if err := s.Write(ctx, "v", fmt.Sprintf("rw%d.m4s", i), []byte(fmt.Sprintf("rw%d v0 ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	// Stop the clients before the storage nodes go away, even on failure.
+	stopClients := sync.OnceFunc(func() {
+		close(stop)
+		wg.Wait()
+	})
+	defer stopClients()
+	var failures atomic.Int64
+	fail := func(format string, args ...any) {
+		failures.Add(1)
+		t.Errorf(format, args...)
+	}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				for name, want := range static {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					got, err := s.Read(ctx, "v", name)
+					if err != nil || string(got) != want {
+						fail("read %s during migration: %v", name, err)
+					}
+				}
+				for i := 0; i < rewritten; i++ {
+					got, err := s.Read(ctx, "v", fmt.Sprintf("rw%d.m4s", i))
+					if err != nil || !strings.HasPrefix(string(got), fmt.Sprintf("rw%d v", i)) {
+						fail("read rw%d.m4s during migration: %q, %v", i, got, err)
+					}
+				}
+				if failures.Load() > 10 {
+					return
+				}
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for v := int64(1); ; v++ {
+			for i := 0; i < rewritten; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Some versions are big enough to be coded, so rewrites
+				// switch files between whole and coded.
+				content := fmt.Sprintf("rw%d v%d ", i, v) + strings.Repeat("x", int(v%2)*1000)
+				if err := s.Write(ctx, "v", fmt.Sprintf("rw%d.m4s", i), []byte(content)); err != nil {
+					fail("rewrite rw%d.m4s: %v", i, err)
+					continue
+				}
+				last[i].Store(v)
+			}
+		}
+	}()
+
+	steps := []func() error{
+		func() error {
+			_, err := s.AddNode(ctx, &pb.AddNodeRequest{NodeAddress: nodes[4].Address})
+			return err
+		},
+		func() error {
+			_, err := s.RemoveNode(ctx, &pb.RemoveNodeRequest{NodeAddress: nodes[0].Address})
+			return err
+		},
+		func() error {
+			_, err := s.AddNode(ctx, &pb.AddNodeRequest{NodeAddress: nodes[5].Address, Weight: 2})
+			return err
+		},
+		func() error {
+			_, err := s.RemoveNode(ctx, &pb.RemoveNodeRequest{NodeAddress: nodes[1].Address})
+			return err
+		},
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		waitMigrated(t, s)
+	}
+	stopClients()
+
+	for _, n := range nodes[:2] {
+		if s.ring.Load().contains(n.Address) {
+			t.Errorf("%s is still in the ring", n.Address)
+		}
+	}
+	for i := 0; i < rewritten; i++ {
+		got, err := s.Read(ctx, "v", fmt.Sprintf("rw%d.m4s", i))
+		want := fmt.Sprintf("rw%d v%d ", i, last[i].Load())
+		if err != nil || !strings.HasPrefix(string(got), want) {
+			t.Errorf("rw%d.m4s ends as %.20q, %v; want version %d", i, got, err, last[i].Load())
+		}
+	}
+	for name, want := range static {
+		if got, err := s.Read(ctx, "v", name); err != nil || string(got) != want {
+			t.Errorf("read %s after migrations: %v", name, err)
+		}
+	}
+}
+
+// TestRemovingDeadNode removes a node that is down. Its shards are rebuilt
+// from the other nodes and the node leaves the ring even though it cannot
+// be checked for leftover files.
+func TestRemovingDeadNode(t *testing.T) {
+	var nodes []StorageNode
+	for i := 0; i < 3; i++ {
+		nodes = append(nodes, startStorageNode(t))
+	}
+	dead, srv := startStorageServer(t)
+	nodes = append(nodes, dead)
+	config := NetworkConfig{Erasure: ErasureConfig{DataShards: 2, ParityShards: 1, MinSize: 1}}
+	s, err := NewNetworkVideoContentService(nil, nil, nodes, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	files := make(map[string]string)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("seg%d.m4s", i)
+		files[name] = strings.Repeat(name, 10)
+		if err := s.Write(ctx, "v", name, []byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srv.Stop()
+
+	if _, err := s.RemoveNode(ctx, &pb.RemoveNodeRequest{NodeAddress: dead.Address}); err != nil {
+		t.Fatal(err)
+	}
+	waitMigrated(t, s)
+	if s.ring.Load().contains(dead.Address) {
+		t.Fatalf("%s is still in the ring", dead.Address)
+	}
+	for name, want := range files {
+		if got, err := s.Read(ctx, "v", name); err != nil || string(got) != want {
+			t.Errorf("read %s after removing the dead node: %v", name, err)
+		}
+	}
+}
+
+// openStores opens SQLite membership and migration stores in the test's
+// temporary directory.
+func openStores(t *testing.T) (*SQLiteMembershipStore, *SQLiteMigrationStore) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	membership, err := NewSQLiteMembershipStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := NewSQLiteMigrationStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return membership, migrations
+}
+
+// TestChangeAfterFailedMigrationKeepsFilesReadable swaps in a ring as a
+// migration that moved nothing would leave it, and then changes the ring
+// again. Every file is still on its owner from before both changes and must
+// stay readable, also from a web server that loads the saved ring.
+func TestChangeAfterFailedMigrationKeepsFilesReadable(t *testing.T) {
+	var nodes []StorageNode
+	for i := 0; i < 5; i++ {
+		nodes = append(nodes, startStorageNode(t))
+	}
+	membership, migrations := openStores(t)
+	s, err := NewNetworkVideoContentService(membership, migrations, nodes[:3], NetworkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	files := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("seg%d.m4s", i)
+		files[name] = strings.Repeat(name, 3)
+		if err := s.Write(ctx, "v", name, []byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cur := s.ring.Load()
+	if err := s.installRing(newRing(cur.placement, cur.version+1, nodes[:4], cur)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.swapRing(nodes); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := NewNetworkVideoContentService(membership, migrations, nil, NetworkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for name, want := range files {
+		for _, svc := range []*NetworkVideoContentService{s, reopened} {
+			if got, err := svc.Read(ctx, "v", name); err != nil || string(got) != want {
+				t.Errorf("read %s after the second change: %v", name, err)
+			}
+		}
+	}
+}
+
+// TestResumedRebalanceReadsFromOldRing resumes a rebalance whose saved ring
+// lost its previous ring. The ring from before the rebalance is rebuilt from
+// the migration, capacities and all.
+func TestResumedRebalanceReadsFromOldRing(t *testing.T) {
+	var nodes []StorageNode
+	for i := 0; i < 4; i++ {
+		nodes = append(nodes, startStorageNode(t))
+	}
+	membership, migrations := openStores(t)
+	s, err := NewNetworkVideoContentService(membership, migrations, nodes, NetworkConfig{Placement: PlacementVnode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	before := s.ring.Load()
+	lowered := before.withNode(StorageNode{Address: nodes[0].Address, Hash: nodes[0].Hash, State: NodeActive, Weight: 1, Capacity: 10})
+	after := newRing(before.placement, before.version+1, lowered, nil)
+	if err := s.installRing(after); err != nil {
+		t.Fatal(err)
+	}
+	err = migrations.Create(&Migration{Id: "rebalance", Kind: "rebalance", State: MigrationRunning, CreatedAt: time.Now(), From: ringState(before)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unfinished, err := migrations.ListUnfinished()
+	if err != nil || len(unfinished) != 1 {
+		t.Fatalf("unfinished migrations: %v, %v", unfinished, err)
+	}
+	from := migratedFrom(unfinished[0], after)
+	moved := 0
+	for i := 0; i < 500; i++ {
+		key := fmt.Sprintf("v/seg%d.m4s", i)
+		want, _ := before.owner(key)
+		got, _ := from.owner(key)
+		if got.Address != want.Address {
+			t.Fatalf("%s: resumed prev ring owner is %s, want %s", key, got.Address, want.Address)
+		}
+		if now, _ := after.owner(key); now.Address != want.Address {
+			moved++
+		}
+	}
+	if moved == 0 {
+		t.Fatal("lowering the capacity moved no key; the test proves nothing")
+	}
+}
+
+// TestMalformedNodeAddress checks that a node gRPC cannot connect to fails
+// each request instead of being cached as a broken client, and that it
+// cannot be added to the ring.
+func TestMalformedNodeAddress(t *testing.T) {
+	good := startStorageNode(t)
+	bad := StorageNode{Address: "%zz", Hash: hashKey("%zz"), State: NodeActive, Weight: 1}
+	s, err := NewNetworkVideoContentService(nil, nil, []StorageNode{good, bad}, NetworkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		if _, err := s.client(bad.Address); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("client for %q: %v, want InvalidArgument", bad.Address, err)
+		}
+	}
+	owned := 0
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("seg%d.m4s", i)
+		if s.NodeFor("v", name) != bad.Address {
+			continue
+		}
+		owned++
+		if err := s.Write(ctx, "v", name, []byte("data")); err == nil {
+			t.Errorf("write %s to %q succeeded", name, bad.Address)
+		}
+		if _, err := s.Read(ctx, "v", name); err == nil {
+			t.Errorf("read %s from %q succeeded", name, bad.Address)
+		}
+	}
+	if owned == 0 {
+		t.Fatalf("%q owns none of the files", bad.Address)
+	}
+	_, err = s.AddNode(ctx, &pb.AddNodeRequest{NodeAddress: "dns:///%zz"})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("add malformed node: %v, want InvalidArgument", err)
+	}
+}
+
+// TestDrainAndUndrain drains a node, which must end up holding no files
+// while every file stays readable, and then undrains it, which must move
+// the files it owns back onto it.
+func TestDrainAndUndrain(t *testing.T) {
+	var nodes []StorageNode
+	for i := 0; i < 3; i++ {
+		nodes = append(nodes, startStorageNode(t))
+	}
+	s, err := NewNetworkVideoContentService(nil, nil, nodes, NetworkConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	files := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("seg%d.m4s", i)
+		files[name] = strings.Repeat(name, 3)
+		if err := s.Write(ctx, "v", name, []byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stored := func(addr string) int {
+		resp, err := s.listFiles(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(resp.FilesList)
+	}
+	readAll := func(when string) {
+		for name, want := range files {
+			if got, err := s.Read(ctx, "v", name); err != nil || string(got) != want {
+				t.Errorf("read %s %s: %v", name, when, err)
+			}
+		}
+	}
+	addr := nodes[0].Address
+	owned := stored(addr)
+	if owned == 0 {
+		t.Fatalf("%s owns no file; the test needs other keys", addr)
+	}
+
+	if _, err := s.DrainNode(ctx, &pb.DrainNodeRequest{NodeAddress: addr}); err != nil {
+		t.Fatal(err)
+	}
+	waitMigrated(t, s)
+	if n, _ := s.ring.Load().node(addr); n.State != NodeDrained {
+		t.Fatalf("%s is %s after draining, want %s", addr, n.State, NodeDrained)
+	}
+	if n := stored(addr); n != 0 {
+		t.Fatalf("%s still holds %d files after draining", addr, n)
+	}
+	readAll("after draining")
+	if _, err := s.DrainNode(ctx, &pb.DrainNodeRequest{NodeAddress: addr}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("drain a drained node: %v, want FailedPrecondition", err)
+	}
+	if err := s.Write(ctx, "v", "late.m4s", []byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	files["late.m4s"] = "late"
+	if n := stored(addr); n != 0 {
+		t.Fatalf("a write went to the drained node %s", addr)
+	}
+
+	if _, err := s.UndrainNode(ctx, &pb.UndrainNodeRequest{NodeAddress: addr}); err != nil {
+		t.Fatal(err)
+	}
+	waitMigrated(t, s)
+	if n, _ := s.ring.Load().node(addr); n.State != NodeActive {
+		t.Fatalf("%s is %s after undraining, want %s", addr, n.State, NodeActive)
+	}
+	if n := stored(addr); n < owned {
+		t.Fatalf("%s holds %d files after undraining, want at least the %d it owned", addr, n, owned)
+	}
+	readAll("after undraining")
+}
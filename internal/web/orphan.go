@@ -0,0 +1,147 @@
+// Garbage collection of content that no video's metadata refers to
+
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	pb "tritontube/internal/proto"
+)
+
+// OrphanReport is the outcome of one orphan collection.
+type OrphanReport struct {
+	// Orphans are the files that belong to no video and are older than the
+	// grace period; on a dry run none of them was deleted.
+	Orphans      []StoredFile
+	Deleted      int
+	DeletedBytes int64
+	Failed       int
+}
+
+// OrphanCollector deletes files whose video id has no metadata, such as
+// the segments of an upload that failed before its metadata was created.
+// Files younger than the grace period are kept, since their upload may
+// still be running. A file under an id that has metadata is never an
+// orphan, so the collector cannot undo an upload that wrote over an
+// existing video; handleUpload refuses those before writing anything.
+type OrphanCollector struct {
+	pb.UnimplementedOrphanAdminServiceServer
+	metadata VideoMetadataService
+	content  VideoContentLister
+	grace    time.Duration
+	// dedup is set when content is a DedupVideoContentService. Its blobs
+	// belong to no video and are collected by the dedup layer, which
+	// leaves them out of its listing; dedup keeps them safe here too.
+	// Without it, an id starting with the blob prefix is a video like any
+	// other.
+	dedup bool
+	// mu lets only one collection run at a time.
+	mu sync.Mutex
+}
+
+var _ pb.OrphanAdminServiceServer = (*OrphanCollector)(nil)
+
+// NewOrphanCollector fails unless content can list and delete its files.
+func NewOrphanCollector(metadata VideoMetadataService, content VideoContentService, grace time.Duration) (*OrphanCollector, error) {
+	lister, ok := content.(VideoContentLister)
+	if !ok {
+		return nil, fmt.Errorf("content service %T cannot list its files", content)
+	}
+	_, dedup := content.(*DedupVideoContentService)
+	return &OrphanCollector{metadata: metadata, content: lister, grace: grace, dedup: dedup}, nil
+}
+
+// Collect finds the orphans older than grace and, unless dryRun is set,
+// deletes them. A grace of 0 uses the collector's own.
+func (c *OrphanCollector) Collect(ctx context.Context, grace time.Duration, dryRun bool) (*OrphanReport, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if grace <= 0 {
+		grace = c.grace
+	}
+	// List the content before the metadata, so a video whose upload
+	// finishes in between is seen as known rather than orphaned.
+	files, err := c.content.ListStored(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list content: %v", err)
+	}
+	videos, err := c.metadata.List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list videos: %v", err)
+	}
+	known := make(map[string]bool, len(videos))
+	for _, v := range videos {
+		known[v.Id] = true
+	}
+	cutoff := time.Now().Add(-grace)
+	report := &OrphanReport{}
+	for _, f := range files {
+		if known[f.VideoId] || (c.dedup && strings.HasPrefix(f.VideoId, blobVideoPrefix)) || f.ModTime.After(cutoff) {
+			continue
+		}
+		report.Orphans = append(report.Orphans, f)
+		if dryRun {
+			continue
+		}
+		if err := c.content.DeleteStored(ctx, f); err != nil {
+			slog.WarnContext(ctx, "orphan gc: delete failed", "err", err)
+			report.Failed++
+			continue
+		}
+		report.Deleted++
+		report.DeletedBytes += f.Size
+	}
+	return report, nil
+}
+
+// Run collects orphans every interval until ctx is done.
+func (c *OrphanCollector) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		report, err := c.Collect(ctx, 0, false)
+		if err != nil {
+			slog.ErrorContext(ctx, "orphan gc failed", "err", err)
+			continue
+		}
+		if len(report.Orphans) > 0 {
+			slog.InfoContext(ctx, "orphan gc: deleted orphaned files", "files", report.Deleted, "bytes", report.DeletedBytes, "failed", report.Failed)
+		}
+	}
+}
+
+func (c *OrphanCollector) CollectOrphans(ctx context.Context, req *pb.CollectOrphansRequest) (*pb.CollectOrphansResponse, error) {
+	if req.GraceSeconds < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "grace must not be negative")
+	}
+	report, err := c.Collect(ctx, time.Duration(req.GraceSeconds)*time.Second, req.DryRun)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "%v", err)
+	}
+	resp := &pb.CollectOrphansResponse{
+		DeletedCount: int32(report.Deleted),
+		DeletedBytes: report.DeletedBytes,
+		FailedCount:  int32(report.Failed),
+	}
+	for _, f := range report.Orphans {
+		resp.Orphans = append(resp.Orphans, &pb.OrphanFile{
+			Node:     f.Node,
+			VideoId:  f.VideoId,
+			Filename: f.Filename,
+			Size:     f.Size,
+		})
+	}
+	return resp, nil
+}
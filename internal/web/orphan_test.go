@@ -0,0 +1,98 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestOrphanCollection stores the files of a video with metadata and of one
+// without, through the dedup layer. Files of the second are orphans, but
+// only once they are older than the grace period; the blob only they refer
+// to is left to the dedup collector, and the blob both share survives it.
+func TestOrphanCollection(t *testing.T) {
+	s, _ := newDedupService(t)
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "videos.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	metadata := &SQLiteVideoMetadataService{DB: db}
+	ctx := context.Background()
+	if err := metadata.Create(ctx, "kept", time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"kept/seg0.m4s":     "shared segment",
+		"kept/index.m3u8":   "#EXTM3U kept",
+		"orphan/seg0.m4s":   "shared segment",
+		"orphan/seg1.m4s":   "orphaned segment",
+		"orphan/index.m3u8": "#EXTM3U orphan",
+	}
+	for key, content := range files {
+		video, name, _ := strings.Cut(key, "/")
+		if err := s.Write(ctx, video, name, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := NewOrphanCollector(metadata, s, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := c.Collect(ctx, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 0 {
+		t.Fatalf("collected %d files within the grace period", len(report.Orphans))
+	}
+
+	report, err = c.Collect(ctx, time.Nanosecond, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var orphans []string
+	for _, f := range report.Orphans {
+		orphans = append(orphans, f.VideoId+"/"+f.Filename)
+	}
+	sort.Strings(orphans)
+	if want := []string{"orphan/index.m3u8", "orphan/seg0.m4s", "orphan/seg1.m4s"}; strings.Join(orphans, " ") != strings.Join(want, " ") {
+		t.Fatalf("dry run found orphans %v, want %v", orphans, want)
+	}
+	if report.Deleted != 0 {
+		t.Fatalf("dry run deleted %d files", report.Deleted)
+	}
+	if _, err := s.Read(ctx, "orphan", "seg1.m4s"); err != nil {
+		t.Fatalf("read after dry run: %v", err)
+	}
+
+	report, err = c.Collect(ctx, time.Nanosecond, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Deleted != 3 || report.Failed != 0 {
+		t.Fatalf("deleted %d orphans, %d failed; want 3 deleted", report.Deleted, report.Failed)
+	}
+	for key, content := range files {
+		video, name, _ := strings.Cut(key, "/")
+		got, err := s.Read(ctx, video, name)
+		if video == "kept" && (err != nil || string(got) != content) {
+			t.Errorf("read %s after collection: %v", key, err)
+		}
+		if video == "orphan" && err == nil {
+			t.Errorf("orphan %s is still readable", key)
+		}
+	}
+	freed, bytes, err := s.CollectGarbage(ctx, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if freed != 1 || bytes != int64(len("orphaned segment")) {
+		t.Fatalf("dedup gc freed %d blobs of %d bytes, want the orphaned segment's blob", freed, bytes)
+	}
+}
@@ -0,0 +1,257 @@
+// Placement strategies: which storage nodes own a key
+
+package web
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Placement maps keys to the active nodes of a ring. A placement is built
+// once per ring and is read-only afterwards, so lookups never lock or sort.
+// It is never built from an empty node list.
+type Placement interface {
+	// Owner returns the node that stores key.
+	Owner(key string) StorageNode
+	// Owners returns up to n distinct nodes for key, starting with its owner.
+	Owners(key string, n int) []StorageNode
+}
+
+// PlacementStrategy builds a Placement from the active nodes of a ring.
+type PlacementStrategy func(nodes []StorageNode) Placement
+
+const (
+	PlacementRing       = "ring"
+	PlacementVnode      = "vnode"
+	PlacementRendezvous = "rendezvous"
+)
+
+var placementStrategies = map[string]PlacementStrategy{
+	PlacementRing:       NewConsistentPlacement,
+	PlacementVnode:      NewVnodePlacement,
+	PlacementRendezvous: NewRendezvousPlacement,
+}
+
+// spreadSuffix ends the placement name of a ring whose strategy is wrapped
+// in a spreadPlacement. Spreading changes which node holds each shard, so
+// it is part of the name saved with the ring and only changes through a
+// migration.
+const spreadSuffix = "+spread"
+
+// spreadName returns placement with spreading turned on or off.
+func spreadName(placement string, spread bool) string {
+	base := strings.TrimSuffix(placement, spreadSuffix)
+	if spread {
+		return base + spreadSuffix
+	}
+	return base
+}
+
+// PlacementByName returns the strategy called name. An empty name is the
+// single-point consistent ring.
+func PlacementByName(name string) (PlacementStrategy, error) {
+	if name == "" {
+		name = PlacementRing
+	}
+	p, ok := placementStrategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown placement %q (want %s, %s or %s)", name, PlacementRing, PlacementVnode, PlacementRendezvous)
+	}
+	return p, nil
+}
+
+// ringPoint is one position on a hash ring.
+type ringPoint struct {
+	hash uint64
+	node int
+}
+
+// hashRing is a sorted circle of points, each belonging to one node.
+type hashRing struct {
+	nodes  []StorageNode
+	points []ringPoint
+}
+
+func newHashRing(nodes []StorageNode, points []ringPoint) *hashRing {
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+	return &hashRing{nodes: nodes, points: points}
+}
+
+// search returns the index of the first point at or after hash, wrapping
+// around to 0.
+func (r *hashRing) search(hash uint64) int {
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+func (r *hashRing) Owner(key string) StorageNode {
+	return r.nodes[r.points[r.search(hashKey(key))].node]
+}
+
+// Owners walks clockwise from key and collects the first n distinct nodes.
+func (r *hashRing) Owners(key string, n int) []StorageNode {
+	if n > len(r.nodes) {
+		n = len(r.nodes)
+	}
+	owners := make([]StorageNode, 0, n)
+	seen := make(map[int]bool, n)
+	start := r.search(hashKey(key))
+	for i := 0; len(owners) < n && i < len(r.points); i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if !seen[p.node] {
+			seen[p.node] = true
+			owners = append(owners, r.nodes[p.node])
+		}
+	}
+	return owners
+}
+
+// NewConsistentPlacement puts each node at a single point, the hash of its
+// address. It ignores weights. This is the original placement, so existing
+// clusters keep their layout.
+func NewConsistentPlacement(nodes []StorageNode) Placement {
+	points := make([]ringPoint, len(nodes))
+	for i, n := range nodes {
+		points[i] = ringPoint{hash: n.Hash, node: i}
+	}
+	return newHashRing(nodes, points)
+}
+
+// vnodesPerWeight is how many points a node of weight 1 gets on a vnode ring.
+const vnodesPerWeight = 64
+
+// NewVnodePlacement gives each node vnodesPerWeight points per unit of
+// weight, which evens out the share of keys each node owns and lets bigger
+// nodes own proportionally more. Every node gets at least one point.
+func NewVnodePlacement(nodes []StorageNode) Placement {
+	var points []ringPoint
+	for i, n := range nodes {
+		count := max(int(n.placementWeight()*vnodesPerWeight), 1)
+		for v := 0; v < count; v++ {
+			points = append(points, ringPoint{hash: hashKey(fmt.Sprintf("%s#%d", n.Address, v)), node: i})
+		}
+	}
+	return newHashRing(nodes, points)
+}
+
+// rendezvous implements highest-random-weight hashing: every node scores
+// the key and the highest score wins. Adding or removing a node only moves
+// the keys that node wins or won.
+type rendezvous struct {
+	nodes []StorageNode
+}
+
+// NewRendezvousPlacement scores each node with -weight/ln(u), where u is a
+// per-node hash of the key mapped into (0, 1). It needs no ring at all, but
+// every lookup scores every node: O(n) in the number of nodes against
+// O(log n) for the hash rings, about five times slower already at 64 nodes
+// (see BenchmarkLookup). It suits clusters of tens of nodes, not thousands.
+func NewRendezvousPlacement(nodes []StorageNode) Placement {
+	return &rendezvous{nodes: nodes}
+}
+
+func (r *rendezvous) score(keyHash uint64, n StorageNode) float64 {
+	h := mix64(keyHash ^ n.Hash)
+	// Use the top 53 bits so u is exact and never 0 or 1.
+	u := (float64(h>>11) + 0.5) / (1 << 53)
+	return -n.placementWeight() / math.Log(u)
+}
+
+func (r *rendezvous) Owner(key string) StorageNode {
+	keyHash := hashKey(key)
+	best, bestScore := 0, math.Inf(-1)
+	for i, n := range r.nodes {
+		if s := r.score(keyHash, n); s > bestScore {
+			best, bestScore = i, s
+		}
+	}
+	return r.nodes[best]
+}
+
+func (r *rendezvous) Owners(key string, n int) []StorageNode {
+	keyHash := hashKey(key)
+	scores := make([]float64, len(r.nodes))
+	order := make([]int, len(r.nodes))
+	for i, node := range r.nodes {
+		scores[i] = r.score(keyHash, node)
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return scores[order[i]] > scores[order[j]]
+	})
+	if n > len(order) {
+		n = len(order)
+	}
+	owners := make([]StorageNode, n)
+	for i := range owners {
+		owners[i] = r.nodes[order[i]]
+	}
+	return owners
+}
+
+// spreadPlacement keeps the owner a strategy picks but chooses the other
+// owners of a key to cover as many distinct zones, then racks, then hosts as
+// possible, going down the strategy's preference order.
+type spreadPlacement struct {
+	Placement
+	nodes int
+}
+
+func (p spreadPlacement) Owners(key string, n int) []StorageNode {
+	if n <= 1 {
+		return p.Placement.Owners(key, n)
+	}
+	candidates := p.Placement.Owners(key, p.nodes)
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	owners := make([]StorageNode, 0, n)
+	zones := make(map[string]bool)
+	racks := make(map[[2]string]bool)
+	hosts := make(map[[3]string]bool)
+	for len(owners) < n {
+		best, bestScore := 0, -1
+		for i, c := range candidates {
+			score := 0
+			if !zones[c.Zone] {
+				score += 4
+			}
+			if !racks[[2]string{c.Zone, c.Rack}] {
+				score += 2
+			}
+			if !hosts[[3]string{c.Zone, c.Rack, c.Host}] {
+				score++
+			}
+			if score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		c := candidates[best]
+		owners = append(owners, c)
+		zones[c.Zone] = true
+		racks[[2]string{c.Zone, c.Rack}] = true
+		hosts[[3]string{c.Zone, c.Rack, c.Host}] = true
+		candidates = append(candidates[:best:best], candidates[best+1:]...)
+	}
+	return owners
+}
+
+// mix64 is the splitmix64 finalizer. It spreads the combined key and node
+// hashes so nearby inputs get unrelated scores.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,235 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// zonedNodes returns two nodes in each of zones zones.
+func zonedNodes(zones int) []StorageNode {
+	var nodes []StorageNode
+	for z := 0; z < zones; z++ {
+		for i := 0; i < 2; i++ {
+			addr := fmt.Sprintf("10.0.%d.%d:8090", z, i)
+			nodes = append(nodes, StorageNode{Address: addr, Hash: hashKey(addr), Weight: 1, Zone: fmt.Sprintf("z%d", z)})
+		}
+	}
+	return nodes
+}
+
+func TestSpreadOwnersShareNoZone(t *testing.T) {
+	for _, placement := range []string{PlacementRing, PlacementVnode, PlacementRendezvous} {
+		r := newRing(spreadName(placement, true), 1, zonedNodes(3), nil)
+		for k := 0; k < 1000; k++ {
+			key := fmt.Sprintf("video%d/segment.m4s", k)
+			owners := r.place.Owners(key, 3)
+			if owners[0].Address != r.place.Owner(key).Address {
+				t.Fatalf("%s: %s: first owner %s is not the owner %s", placement, key, owners[0].Address, r.place.Owner(key).Address)
+			}
+			zones := make(map[string]bool)
+			for _, o := range owners {
+				if zones[o.Zone] {
+					t.Fatalf("%s: %s: two owners in zone %s: %v", placement, key, o.Zone, owners)
+				}
+				zones[o.Zone] = true
+			}
+		}
+	}
+}
+
+// Without labels spreading has nothing to choose between, so it must keep
+// the strategy's order and not move any shard of an unlabeled cluster.
+func TestSpreadKeepsOrderWithoutLabels(t *testing.T) {
+	nodes := zonedNodes(3)
+	for i := range nodes {
+		nodes[i].Zone = ""
+	}
+	for _, placement := range []string{PlacementRing, PlacementVnode, PlacementRendezvous} {
+		plain := newRing(placement, 1, nodes, nil)
+		spread := newRing(spreadName(placement, true), 1, nodes, nil)
+		for k := 0; k < 1000; k++ {
+			key := fmt.Sprintf("video%d/segment.m4s", k)
+			a, b := plain.place.Owners(key, 4), spread.place.Owners(key, 4)
+			for i := range a {
+				if a[i].Address != b[i].Address {
+					t.Fatalf("%s: %s: owner %d is %s when spread, %s when not", placement, key, i, b[i].Address, a[i].Address)
+				}
+			}
+		}
+	}
+}
+
+// Turning spreading on for a cluster that already holds erasure-coded files
+// must migrate the shards whose owners change, not leave them where the
+// new ring cannot find them.
+func TestEnablingSpreadMigratesShards(t *testing.T) {
+	var seed []StorageNode
+	for i := 0; i < 6; i++ {
+		seed = append(seed, startStorageNode(t))
+	}
+	// Neighbours on the ring share a zone, so the plain ring puts some
+	// shards of a file in the same zone and spreading has to move them.
+	sort.Slice(seed, func(i, j int) bool { return seed[i].Hash < seed[j].Hash })
+	for i := range seed {
+		seed[i].Zone = fmt.Sprintf("z%d", i/3)
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "meta.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	membership, err := NewSQLiteMembershipStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := NewSQLiteMigrationStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := NetworkConfig{Erasure: ErasureConfig{DataShards: 2, ParityShards: 1, MinSize: 1}}
+	before, err := NewNetworkVideoContentService(membership, migrations, seed, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	files := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("segment%d.m4s", i)
+		files[name] = strings.Repeat(name, 100)
+		if err := before.Write(ctx, "v", name, []byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before.Close()
+	old, spread := before.ring.Load(), newRing(spreadName(PlacementRing, true), 1, seed, nil)
+	moving := 0
+	for name := range files {
+		a, b := shardOwners(old, "v/"+name, 3), shardOwners(spread, "v/"+name, 3)
+		for i := range a {
+			if a[i].Address != b[i].Address {
+				moving++
+			}
+		}
+	}
+	if moving == 0 {
+		t.Fatal("spreading moves no shard; the test needs other nodes or zones")
+	}
+
+	config.Spread = true
+	after, err := NewNetworkVideoContentService(membership, migrations, nil, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer after.Close()
+	if err := after.ResumeMigrations(); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "spread placement migrated", func() bool {
+		r := after.ring.Load()
+		return strings.HasSuffix(r.placement, spreadSuffix) && r.prev == nil && after.checkIdle() == nil
+	})
+
+	r := after.ring.Load()
+	for _, n := range seed {
+		resp, err := after.listFiles(ctx, n.Address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range resp.FilesList {
+			dest, err := after.fileDestination(r, n.Address, f.VideoId, f.Filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dest != n.Address {
+				t.Errorf("%s/%s is on %s, want %s", f.VideoId, f.Filename, n.Address, dest)
+			}
+		}
+	}
+	for name, want := range files {
+		got, err := after.Read(ctx, "v", name)
+		if err != nil || string(got) != want {
+			t.Errorf("read %s after migration: %v", name, err)
+		}
+	}
+}
+
+// BenchmarkLookup measures Owner on 64 nodes. The hash rings binary search
+// their points; rendezvous scores every node, so it grows with the cluster.
+func BenchmarkLookup(b *testing.B) {
+	var nodes []StorageNode
+	for i := 0; i < 64; i++ {
+		addr := fmt.Sprintf("10.0.0.%d:8090", i)
+		nodes = append(nodes, StorageNode{Address: addr, Hash: hashKey(addr), Weight: 1, Capacity: 100})
+	}
+	for _, placement := range []string{PlacementRing, PlacementVnode, PlacementRendezvous} {
+		p := placementStrategies[placement](nodes)
+		b.Run(placement, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				p.Owner(fmt.Sprintf("video%d/segment.m4s", i%1024))
+			}
+		})
+	}
+}
+
+// Adding a node must only move keys onto it, and about its share of them.
+func TestAddingNodeMovesOnlyItsShare(t *testing.T) {
+	const keys = 10000
+	nodes := zonedNodes(5)[:9]
+	added := zonedNodes(5)[9]
+	for _, placement := range []string{PlacementRing, PlacementVnode, PlacementRendezvous} {
+		before := newRing(placement, 1, nodes, nil)
+		after := newRing(placement, 2, append(append([]StorageNode{}, nodes...), added), nil)
+		moved := 0
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("video%d/segment.m4s", k)
+			a, b := before.place.Owner(key), after.place.Owner(key)
+			if a.Address == b.Address {
+				continue
+			}
+			if b.Address != added.Address {
+				t.Fatalf("%s: %s moved from %s to %s, not to the new node", placement, key, a.Address, b.Address)
+			}
+			moved++
+		}
+		// The single-point ring gives nodes uneven arcs, so it only has to
+		// stay well under moving everything.
+		limit := keys / 4
+		if placement != PlacementRing {
+			limit = 2 * keys / 10
+		}
+		if moved == 0 || moved > limit {
+			t.Errorf("%s: %d of %d keys moved to the new node, want 1..%d", placement, moved, keys, limit)
+		}
+	}
+}
+
+// Removing a node must only move the keys it owned.
+func TestRemovingNodeMovesOnlyItsShare(t *testing.T) {
+	const keys = 10000
+	nodes := zonedNodes(5)
+	removed := nodes[4]
+	for _, placement := range []string{PlacementRing, PlacementVnode, PlacementRendezvous} {
+		before := newRing(placement, 1, nodes, nil)
+		after := newRing(placement, 2, before.without(removed.Address), nil)
+		moved := 0
+		for k := 0; k < keys; k++ {
+			key := fmt.Sprintf("video%d/segment.m4s", k)
+			a, b := before.place.Owner(key), after.place.Owner(key)
+			if a.Address == b.Address {
+				continue
+			}
+			if a.Address != removed.Address {
+				t.Fatalf("%s: %s moved from %s to %s, not off the removed node", placement, key, a.Address, b.Address)
+			}
+			moved++
+		}
+		if moved == 0 {
+			t.Errorf("%s: no key moved off the removed node", placement)
+		}
+	}
+}
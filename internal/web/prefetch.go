@@ -0,0 +1,151 @@
+// Reading ahead the segments a viewer is likely to request next
+
+package web
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// PrefetchConfig configures the read-ahead of a NetworkVideoContentService.
+type PrefetchConfig struct {
+	// Segments is how many segments following a requested one are read
+	// ahead. Prefetching is off when it is 0.
+	Segments int
+	// Workers bounds the reads ahead running at a time.
+	Workers int
+	// CacheBytes bounds the prefetched segments kept until requested.
+	CacheBytes int64
+}
+
+// PrefetchStats counts the work of the read-ahead.
+type PrefetchStats struct {
+	// Prefetched segments were read ahead; Hits requests were served by
+	// them and Misses were not.
+	Prefetched int64 `json:"prefetched"`
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	// Skipped segments were not read ahead because every worker was busy.
+	Skipped int64   `json:"skipped"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+// prefetcher reads segments ahead into a small cache of its own.
+type prefetcher struct {
+	config PrefetchConfig
+	cache  *lruCache
+	// slots holds a token for every read ahead running.
+	slots chan struct{}
+
+	mu      sync.Mutex
+	flights map[string]*flight
+
+	prefetched, hits, misses, skipped atomic.Int64
+}
+
+func newPrefetcher(config PrefetchConfig) *prefetcher {
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	return &prefetcher{
+		config:  config,
+		cache:   newLRU(config.CacheBytes),
+		slots:   make(chan struct{}, config.Workers),
+		flights: make(map[string]*flight),
+	}
+}
+
+// isSegment reports whether filename is a media segment worth counting
+// and reading ahead from.
+func isSegment(filename string) bool {
+	return strings.HasSuffix(filename, ".m4s")
+}
+
+// take returns a prefetched segment, waiting for it if it is being read
+// unless ctx is done first.
+func (p *prefetcher) take(ctx context.Context, key string) ([]byte, bool) {
+	if data, ok := p.cache.get(key); ok {
+		p.hits.Add(1)
+		return data, true
+	}
+	p.mu.Lock()
+	f := p.flights[key]
+	p.mu.Unlock()
+	if f != nil {
+		select {
+		case <-f.done:
+			if f.err == nil && !f.stale {
+				p.hits.Add(1)
+				return f.data, true
+			}
+		case <-ctx.Done():
+		}
+	}
+	p.misses.Add(1)
+	return nil, false
+}
+
+// after reads ahead the segments that follow filename with read. Segments
+// past the last one fail to read and are simply not cached. The reads are
+// not tied to the request that started them.
+func (p *prefetcher) after(videoId, filename string, read func(ctx context.Context, videoId, filename string) ([]byte, error)) {
+	for _, name := range nextSegments(filename, p.config.Segments) {
+		key := videoId + "/" + name
+		if _, ok := p.cache.get(key); ok {
+			continue
+		}
+		p.mu.Lock()
+		if _, ok := p.flights[key]; ok {
+			p.mu.Unlock()
+			continue
+		}
+		select {
+		case p.slots <- struct{}{}:
+		default:
+			p.mu.Unlock()
+			p.skipped.Add(1)
+			continue
+		}
+		f := &flight{done: make(chan struct{})}
+		p.flights[key] = f
+		p.mu.Unlock()
+		go func() {
+			defer func() { <-p.slots }()
+			f.data, f.err = read(context.Background(), videoId, name)
+			p.mu.Lock()
+			delete(p.flights, key)
+			stale := f.stale
+			p.mu.Unlock()
+			if f.err == nil && !stale {
+				p.cache.add(key, f.data, int64(len(f.data)))
+				p.prefetched.Add(1)
+			}
+			close(f.done)
+		}()
+	}
+}
+
+// invalidate drops a segment that was written or deleted.
+func (p *prefetcher) invalidate(key string) {
+	p.mu.Lock()
+	if f, ok := p.flights[key]; ok {
+		f.stale = true
+	}
+	p.mu.Unlock()
+	p.cache.remove(key)
+}
+
+func (p *prefetcher) stats() PrefetchStats {
+	st := PrefetchStats{
+		Prefetched: p.prefetched.Load(),
+		Hits:       p.hits.Load(),
+		Misses:     p.misses.Load(),
+		Skipped:    p.skipped.Load(),
+	}
+	if total := st.Hits + st.Misses; total > 0 {
+		st.HitRate = float64(st.Hits) / float64(total)
+	}
+	return st
+}
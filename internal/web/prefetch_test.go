@@ -0,0 +1,54 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// TestPrefetchNextSegments reads one segment of a video and checks that the
+// next Segments, and only those, are read ahead and then served without
+// going to the storage nodes, unless they were written since.
+func TestPrefetchNextSegments(t *testing.T) {
+	config := NetworkConfig{Prefetch: PrefetchConfig{Segments: 2, Workers: 2, CacheBytes: 1 << 20}}
+	s, err := NewNetworkVideoContentService(nil, nil, []StorageNode{startStorageNode(t)}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	ctx := context.Background()
+	segment := func(i int) string { return fmt.Sprintf("chunk-0-%05d.m4s", i) }
+	for i := 1; i <= 5; i++ {
+		if err := s.Write(ctx, "v", segment(i), []byte(segment(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got, err := s.Read(ctx, "v", segment(1)); err != nil || string(got) != segment(1) {
+		t.Fatalf("read %s: %q, %v", segment(1), got, err)
+	}
+	waitFor(t, "two segments read ahead", func() bool { return s.PrefetchStats().Prefetched == 2 })
+	for _, i := range []int{2, 3} {
+		if _, ok := s.prefetch.cache.get("v/" + segment(i)); !ok {
+			t.Fatalf("%s was not read ahead", segment(i))
+		}
+	}
+	if _, ok := s.prefetch.cache.get("v/" + segment(4)); ok {
+		t.Fatalf("%s was read ahead, further than %d segments", segment(4), config.Prefetch.Segments)
+	}
+
+	if got, err := s.Read(ctx, "v", segment(2)); err != nil || string(got) != segment(2) {
+		t.Fatalf("read %s: %q, %v", segment(2), got, err)
+	}
+	if st := s.PrefetchStats(); st.Hits != 1 || st.Misses != 1 {
+		t.Fatalf("stats after reading a segment read ahead: %+v, want 1 hit after 1 miss", st)
+	}
+	waitFor(t, "the next segment read ahead", func() bool { return s.PrefetchStats().Prefetched == 3 })
+
+	if err := s.Write(ctx, "v", segment(3), []byte("rewritten")); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.Read(ctx, "v", segment(3)); err != nil || string(got) != "rewritten" {
+		t.Fatalf("read %s after rewriting it: %q, %v", segment(3), got, err)
+	}
+}
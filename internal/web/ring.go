@@ -0,0 +1,268 @@
+// Versioned storage ring snapshots
+
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+type NodeState string
+
+const (
+	// NodeActive nodes own keys and take writes.
+	NodeActive NodeState = "active"
+	// NodeDraining nodes still serve reads while their files are copied away.
+	NodeDraining NodeState = "draining"
+	// NodeDrained nodes hold no files and can be removed or undrained.
+	NodeDrained NodeState = "drained"
+)
+
+type StorageNode struct {
+	Address string
+	Hash    uint64
+	State   NodeState
+	// Weight is the node's relative share of keys for weighted placements.
+	Weight int
+	// Capacity is the percentage of Weight that placement uses. It is
+	// lowered as the node's disk fills up; 0 means 100.
+	Capacity int
+	// Zone, Rack and Host are the node's failure domains. Empty labels are
+	// unknown and all count as the same domain.
+	Zone string
+	Rack string
+	Host string
+}
+
+// ParseStorageNode reads a node given as ADDR[@ZONE[/RACK[/HOST]]], such as
+// "10.0.1.5:8090@us-east-1a/r12/h3".
+func ParseStorageNode(spec string) (StorageNode, error) {
+	addr, labels, _ := strings.Cut(spec, "@")
+	if addr == "" {
+		return StorageNode{}, fmt.Errorf("node %q has no address", spec)
+	}
+	n := StorageNode{Address: addr, Hash: hashKey(addr), State: NodeActive, Weight: 1}
+	if labels != "" {
+		parts := strings.Split(labels, "/")
+		if len(parts) > 3 {
+			return StorageNode{}, fmt.Errorf("node %q has more labels than zone/rack/host", spec)
+		}
+		parts = append(parts, "", "")
+		n.Zone, n.Rack, n.Host = parts[0], parts[1], parts[2]
+	}
+	return n, nil
+}
+
+// placementWeight is the node's weight scaled down by its capacity.
+func (n StorageNode) placementWeight() float64 {
+	return float64(n.Weight) * float64(n.Capacity) / 100
+}
+
+func hashKey(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// ring is an immutable snapshot of the cluster. Every membership change
+// builds a new ring and swaps it in, so readers never lock.
+type ring struct {
+	version uint64
+	nodes   []StorageNode
+	// active is the subset of nodes that own keys.
+	active []StorageNode
+	// placement is the name of the strategy place was built with.
+	placement string
+	place     Placement
+	// prev is the ring before the last change. It is kept while files are
+	// being migrated so reads can fall back to the old owner. A migration
+	// that fails keeps its prev, so after several changes prev has a prev
+	// of its own until one of them finishes.
+	prev *ring
+}
+
+// newRing builds a ring whose keys are placed by the named strategy, which
+// must be one of the Placement* names, followed by spreadSuffix if owners
+// are spread across failure domains.
+func newRing(placement string, version uint64, nodes []StorageNode, prev *ring) *ring {
+	sorted := make([]StorageNode, len(nodes))
+	copy(sorted, nodes)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Hash < sorted[j].Hash
+	})
+	r := &ring{version: version, nodes: sorted, placement: placement, prev: prev}
+	for i, n := range r.nodes {
+		if n.State == "" {
+			r.nodes[i].State = NodeActive
+		}
+		if n.Weight <= 0 {
+			r.nodes[i].Weight = 1
+		}
+		if n.Capacity <= 0 || n.Capacity > 100 {
+			r.nodes[i].Capacity = 100
+		}
+		if r.nodes[i].State == NodeActive {
+			r.active = append(r.active, r.nodes[i])
+		}
+	}
+	if len(r.active) > 0 {
+		base, spread := strings.CutSuffix(placement, spreadSuffix)
+		r.place = placementStrategies[base](r.active)
+		if spread {
+			r.place = spreadPlacement{r.place, len(r.active)}
+		}
+	}
+	return r
+}
+
+// withoutPrev returns r with its previous rings dropped.
+func (r *ring) withoutPrev() *ring {
+	return &ring{version: r.version, nodes: r.nodes, active: r.active, placement: r.placement, place: r.place}
+}
+
+// history returns r followed by every earlier ring it still keeps, newest
+// first.
+func (r *ring) history() []*ring {
+	var rings []*ring
+	for ; r != nil; r = r.prev {
+		rings = append(rings, r)
+	}
+	return rings
+}
+
+func (r *ring) owner(key string) (StorageNode, error) {
+	if len(r.active) == 0 {
+		return StorageNode{}, fmt.Errorf("no active storage nodes")
+	}
+	return r.place.Owner(key), nil
+}
+
+// moves reports whether the migration from the earlier rings to r may move
+// a copy of key: the owner of the whole file or of one of its shards
+// changed.
+func (r *ring) moves(key string, shards int) bool {
+	for _, old := range r.history()[1:] {
+		if r.movedFrom(old, key, shards) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ring) movedFrom(old *ring, key string, shards int) bool {
+	if len(r.active) == 0 || len(old.active) == 0 {
+		return true
+	}
+	if r.place.Owner(key).Address != old.place.Owner(key).Address {
+		return true
+	}
+	if shards == 0 {
+		return false
+	}
+	cur, prev := shardOwners(r, key, shards), shardOwners(old, key, shards)
+	if len(cur) != len(prev) {
+		return true
+	}
+	for i := range cur {
+		if cur[i].Address != prev[i].Address {
+			return true
+		}
+	}
+	return false
+}
+
+// owners returns the owner of key in this ring followed by its owners in
+// the earlier rings that are different nodes.
+func (r *ring) owners(key string) ([]string, error) {
+	n, err := r.owner(key)
+	if err != nil {
+		return nil, err
+	}
+	addrs := []string{n.Address}
+	for _, old := range r.history()[1:] {
+		if o, err := old.owner(key); err == nil && !slices.Contains(addrs, o.Address) {
+			addrs = append(addrs, o.Address)
+		}
+	}
+	return addrs, nil
+}
+
+// allAddresses returns the nodes of r and of every earlier ring, each once.
+func (r *ring) allAddresses() []string {
+	var addrs []string
+	for _, rr := range r.history() {
+		for _, addr := range rr.addresses() {
+			if !slices.Contains(addrs, addr) {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// known reports whether addr is in r or in any earlier ring.
+func (r *ring) known(addr string) bool {
+	for _, rr := range r.history() {
+		if rr.contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ring) addresses() []string {
+	addrs := make([]string, len(r.nodes))
+	for i, n := range r.nodes {
+		addrs[i] = n.Address
+	}
+	return addrs
+}
+
+func (r *ring) node(addr string) (StorageNode, bool) {
+	for _, n := range r.nodes {
+		if n.Address == addr {
+			return n, true
+		}
+	}
+	return StorageNode{}, false
+}
+
+func (r *ring) contains(addr string) bool {
+	_, ok := r.node(addr)
+	return ok
+}
+
+// with returns the nodes of r plus addr as an active node.
+func (r *ring) with(addr string) []StorageNode {
+	return r.withState(addr, NodeActive)
+}
+
+// withState returns the nodes of r with addr in state, adding it if needed.
+func (r *ring) withState(addr string, state NodeState) []StorageNode {
+	n, ok := r.node(addr)
+	if !ok {
+		n = StorageNode{Address: addr, Hash: hashKey(addr), Weight: 1}
+	}
+	n.State = state
+	return r.withNode(n)
+}
+
+// withNode returns the nodes of r with n added or replacing the node with
+// the same address.
+func (r *ring) withNode(n StorageNode) []StorageNode {
+	return append(r.without(n.Address), n)
+}
+
+// without returns the nodes of r except addr.
+func (r *ring) without(addr string) []StorageNode {
+	var nodes []StorageNode
+	for _, n := range r.nodes {
+		if n.Address != addr {
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
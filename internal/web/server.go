@@ -3,11 +3,16 @@
 package web
 
 import (
-	"log"
+	"context"
+	"errors"
+	"encoding/hex"
+	"expvar"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"html/template"
 	"os"
 	"io"
@@ -15,15 +20,34 @@ import (
 	"time"
 	"fmt"
 	"os/exec"
+
+	"go.opentelemetry.io/otel/attribute"
+
+	"tritontube/internal/checksum"
+	"tritontube/internal/logging"
+	"tritontube/internal/metrics"
+	"tritontube/internal/tracing"
+	"tritontube/internal/videokey"
 )
 
 type server struct {
 	Addr string
 	Port int
+	// Upload bounds the parallel writes of an upload's files.
+	Upload UploadConfig
+	// ReadyTimeout bounds each check /readyz runs.
+	ReadyTimeout time.Duration
 
 	metadataService VideoMetadataService
 	contentService  VideoContentService
 
+	checksMu sync.Mutex
+	checks   []namedCheck
+
+	// uploading holds the ids of the uploads this server is running.
+	uploadingMu sync.Mutex
+	uploading   map[string]bool
+
 	mux *http.ServeMux
 }
 
@@ -31,10 +55,17 @@ func NewServer(
 	metadataService VideoMetadataService,
 	contentService VideoContentService,
 ) *server {
-	return &server{
-		metadataService: metadataService,
-		contentService:  contentService,
+	s := &server{Upload: DefaultUploadConfig, ReadyTimeout: DefaultReadyTimeout}
+	s.defaultChecks(metadataService, contentService)
+	// Every call to the services is traced; the spans are only recorded
+	// once tracing.Setup installs an exporter.
+	if metadataService != nil {
+		s.metadataService = NewTracedVideoMetadataService(metadataService)
+	}
+	if contentService != nil {
+		s.contentService = NewTracedVideoContentService(contentService)
 	}
+	return s
 }
 
 type VideoInfo struct {
@@ -53,12 +84,25 @@ type VideoInfoVideoPage struct {
 
 func (s *server) Start(lis net.Listener) error {
 	s.mux = http.NewServeMux()
-	s.mux.HandleFunc("/upload", s.handleUpload)
-	s.mux.HandleFunc("/videos/", s.handleVideo)
-	s.mux.HandleFunc("/content/", s.handleVideoContent)
-	s.mux.HandleFunc("/", s.handleIndex)
+	s.route("/upload", s.handleUpload)
+	s.route("/videos/", s.handleVideo)
+	s.route("/content/", s.handleVideoContent)
+	s.route("/", s.handleIndex)
+	s.mux.Handle("/metrics", metrics.Handler())
+	// Counters published with expvar, such as those of the content cache.
+	s.mux.Handle("/debug/vars", expvar.Handler())
 
-	return http.Serve(lis, s.mux)
+	// Health checks bypass the request log, which they would flood.
+	root := http.NewServeMux()
+	root.HandleFunc("/healthz", s.handleHealthz)
+	root.HandleFunc("/readyz", s.handleReadyz)
+	root.Handle("/", logging.Handler(s.mux))
+	return http.Serve(lis, root)
+}
+
+// route serves pattern with h, measured and traced.
+func (s *server) route(pattern string, h http.HandlerFunc) {
+	s.mux.Handle(pattern, tracing.Handler(pattern, metrics.InstrumentHandler(pattern, h)))
 }
 
 func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
@@ -71,9 +115,9 @@ func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	tmplIndex := template.Must(template.New("index").Parse(indexHTML))
-	vids, err := s.metadataService.List()
+	vids, err := s.metadataService.List(r.Context())
 	if err != nil {
-		log.Printf("%s", err)
+		slog.ErrorContext(r.Context(), "list videos failed", "err", err)
 		http.Error(w, "Error list", http.StatusInternalServerError)
 		return
 	}
@@ -95,6 +139,13 @@ func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	result := "failed"
+	videoID := ""
+	defer func() {
+		uploadDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+		slog.InfoContext(r.Context(), "upload", "video", videoID, "result", result, "duration", time.Since(start))
+	}()
 	if s.contentService == nil {
 		http.Error(w, "", http.StatusInternalServerError)
 		return
@@ -114,7 +165,26 @@ func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer f.Close()
-	videoID := strings.TrimSuffix(h.Filename, filepath.Ext(h.Filename))
+	videoID = strings.TrimSuffix(h.Filename, filepath.Ext(h.Filename))
+	if err := videokey.ValidateVideoId(videoID); err != nil {
+		http.Error(w, fmt.Sprintf("Bad file name: %v", err), http.StatusBadRequest)
+		return
+	}
+	// Writing the files of an existing video would overwrite it, and the
+	// cleanup after Create fails on the duplicate would then delete it.
+	if _, err := s.metadataService.Read(r.Context(), videoID); err == nil {
+		http.Error(w, "Video already exists", http.StatusConflict)
+		return
+	} else if !errors.Is(err, ErrVideoNotFound) {
+		slog.ErrorContext(r.Context(), "upload: read video metadata failed", "video", videoID, "err", err)
+		http.Error(w, "Metadata fail", http.StatusInternalServerError)
+		return
+	}
+	if !s.claimUpload(videoID) {
+		http.Error(w, "Video is being uploaded", http.StatusConflict)
+		return
+	}
+	defer s.releaseUpload(videoID)
 	videoData, err := io.ReadAll(f)
 	if err != nil {
 		http.Error(w, "Read file fail", http.StatusInternalServerError)
@@ -134,7 +204,7 @@ func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer os.Remove(tempVid)
 	manifestPath := filepath.Join(tempDir, "manifest.mpd")
-	cmd := exec.Command("ffmpeg",
+	cmd := exec.CommandContext(r.Context(), "ffmpeg",
 		"-i", tempVid,
 		"-c:v", "libx264",
 		"-c:a", "aac",
@@ -154,8 +224,15 @@ func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
 	)
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
+	transcodeStart := time.Now()
+	_, span := tracing.Start(r.Context(), "ffmpeg.transcode",
+		attribute.String("video.id", videoID), attribute.Int("video.bytes", len(videoData)))
 	err = cmd.Run()
+	tracing.End(span, err)
+	transcodeDuration.Observe(time.Since(transcodeStart).Seconds())
 	if err != nil {
+		transcodeFailures.Inc()
+		slog.ErrorContext(r.Context(), "transcode failed", "video", videoID, "duration", time.Since(transcodeStart), "err", err)
 		http.Error(w, "Video conversion error", http.StatusInternalServerError)
 		return
 	}
@@ -164,46 +241,61 @@ func (s *server) handleUpload(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Manifest read fail", http.StatusInternalServerError)
 		return
 	}
-	err = s.contentService.Write(videoID, "manifest.mpd", manifestData)
-	if err != nil {
-		http.Error(w, "Manifest write fail", http.StatusInternalServerError)
-		return
-	}
 	segmentFiles, err := filepath.Glob(filepath.Join(tempDir, "*.m4s"))
 	if err != nil {
 		http.Error(w, "Segment read fail", http.StatusInternalServerError)
 		return
 	}
+	var segments []uploadFile
+	var names []string
 	for _, segmentPath := range segmentFiles {
-		segmentName := filepath.Base(segmentPath)
-		segmentData, err := os.ReadFile(segmentPath)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Segment %s fail", segmentName), http.StatusInternalServerError)
-			return
-		}
-		err = s.contentService.Write(videoID, segmentName, segmentData)
-		log.Printf("Write to file: %s", segmentName)
-		if err != nil {
-			log.Printf("Write fail: %v", err)
-			http.Error(w, "Segment write fail", http.StatusInternalServerError)
-			return
-		}
-		os.Remove(segmentPath)
+		segments = append(segments, uploadFile{name: filepath.Base(segmentPath), path: segmentPath})
+		names = append(names, filepath.Base(segmentPath))
+	}
+	// The segments are written first and the manifest last, so the video
+	// is never playable with segments missing. A failure removes every
+	// file written so far.
+	err = uploadFiles(r.Context(), s.contentService, videoID, segments, s.Upload)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "upload: write segments failed", "video", videoID, "err", err)
+		http.Error(w, "Segment write fail", http.StatusInternalServerError)
+		return
 	}
+	slog.InfoContext(r.Context(), "upload: wrote segments", "video", videoID, "segments", len(segments))
+	err = writeWithRetry(r.Context(), s.contentService, videoID, "manifest.mpd", manifestData, s.Upload)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "upload: write manifest failed", "video", videoID, "err", err)
+		removeFiles(r.Context(), s.contentService, videoID, names)
+		http.Error(w, "Manifest write fail", http.StatusInternalServerError)
+		return
+	}
+	names = append(names, "manifest.mpd")
 	uploadTime := time.Now()
-	log.Printf("TIME: %s", uploadTime)
-	err = s.metadataService.Create(videoID, uploadTime)
+	err = s.metadataService.Create(r.Context(), videoID, uploadTime)
 	if err != nil {
+		// If another web server created the video meanwhile, the files
+		// are its video's now and must stay.
+		if _, rerr := s.metadataService.Read(context.WithoutCancel(r.Context()), videoID); rerr == nil {
+			slog.ErrorContext(r.Context(), "upload: video created concurrently by another upload", "video", videoID, "err", err)
+			http.Error(w, "Video already exists", http.StatusConflict)
+			return
+		}
+		removeFiles(r.Context(), s.contentService, videoID, names)
 		http.Error(w, "Metadata fail", http.StatusInternalServerError)
 		return
 	}
+	result = "ok"
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
 func (s *server) handleVideo(w http.ResponseWriter, r *http.Request) {
 	videoId := r.URL.Path[len("/videos/"):]
+	if err := videokey.ValidateVideoId(videoId); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	tmplIndex := template.Must(template.New("video").Parse(videoHTML))
-	readVideo, err := s.metadataService.Read(videoId)
+	readVideo, err := s.metadataService.Read(r.Context(), videoId)
 	if err != nil {
 		http.Error(w, "Video not found", http.StatusNotFound)
 		return
@@ -213,7 +305,7 @@ func (s *server) handleVideo(w http.ResponseWriter, r *http.Request) {
 	readVideoDict.UploadedAt = readVideo.UploadedAt.Format("2006-01-02 15:04:05")
 	err = tmplIndex.Execute(w, readVideoDict)
 	if err != nil {
-		log.Printf("%s", err)
+		slog.WarnContext(r.Context(), "read video metadata failed", "video", videoId, "err", err)
 		http.Error(w, "Error loading page", http.StatusInternalServerError)
 		return
 	}
@@ -228,14 +320,39 @@ func (s *server) handleVideoContent(w http.ResponseWriter, r *http.Request) {
 	}
 	videoId = parts[0]
 	filename := parts[1]
+	if _, err := videokey.New(videoId, filename); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	// log.Println("Video ID:", videoId, "Filename:", filename)
-	data, err := s.contentService.Read(videoId, filename)
+	data, err := s.contentService.Read(r.Context(), videoId, filename)
 	if err != nil {
-		log.Printf("%s", err)
+		slog.WarnContext(r.Context(), "read video content failed", "video", videoId, "file", filename, "err", err)
 		http.Error(w, "No file found", http.StatusInternalServerError)
 		return
 	}
-	w.Header().Set("Content-Type", "video/mp4")
+	// Edge caches revalidate with the ETag once max-age has passed. A
+	// video's files never change after upload, but a manifest is written
+	// last, so it gets a short max-age in case it was read mid-upload.
+	etag := fmt.Sprintf("%q", hex.EncodeToString(checksum.Sum(data)))
+	w.Header().Set("ETag", etag)
+	if strings.HasSuffix(filename, ".mpd") {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", manifestMaxAge))
+		w.Header().Set("Content-Type", "application/dash+xml")
+	} else {
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", segmentMaxAge))
+		w.Header().Set("Content-Type", "video/mp4")
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && match == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
 	w.Header().Set("Content-Length", fmt.Sprint(len(data)))
 	w.Write(data)
 }
+
+// Seconds that caches may serve content files without revalidating.
+const (
+	manifestMaxAge = 60
+	segmentMaxAge  = 24 * 60 * 60
+)
@@ -3,11 +3,12 @@
 package web
 
 import (
+	"context"
 	"time"
 	_ "github.com/mattn/go-sqlite3"
 	"database/sql"
 	"fmt"
-	"log"
+	"log/slog"
 )
 
 type SQLiteVideoMetadataService struct{
@@ -17,15 +18,22 @@ type SQLiteVideoMetadataService struct{
 // Uncomment the following line to ensure SQLiteVideoMetadataService implements VideoMetadataService
 var _ VideoMetadataService = (*SQLiteVideoMetadataService)(nil)
 
-func (s *SQLiteVideoMetadataService) Create(videoId string, uploadedAt time.Time) error {
-	_, err := s.DB.Exec(`CREATE TABLE IF NOT EXISTS videos (
+func (s *SQLiteVideoMetadataService) CheckHealth(ctx context.Context) error {
+	if err := s.DB.PingContext(ctx); err != nil {
+		return fmt.Errorf("ping metadata database: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteVideoMetadataService) Create(ctx context.Context, videoId string, uploadedAt time.Time) error {
+	_, err := s.DB.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS videos (
 						videoId TEXT PRIMARY KEY,
 						uploadedTime TIMESTAMP);`)
 	if err != nil {
-		log.Println("Error creating table")
+		slog.ErrorContext(ctx, "create videos table failed", "err", err)
 		return fmt.Errorf("Failed create table%v", err)
 	}
-	_, err = s.DB.Exec(`INSERT INTO videos (videoId, uploadedTime) VALUES (?, ?)`, videoId, uploadedAt)
+	_, err = s.DB.ExecContext(ctx, `INSERT INTO videos (videoId, uploadedTime) VALUES (?, ?)`, videoId, uploadedAt)
 	if err != nil {
 		return fmt.Errorf("failed to insert video metadata: %v", err)
 	}
@@ -33,15 +41,15 @@ func (s *SQLiteVideoMetadataService) Create(videoId string, uploadedAt time.Time
 }
 
 // List retrieves all video metadata records
-func (s *SQLiteVideoMetadataService) List() ([]VideoMetadata, error) {
-	_, err := s.DB.Exec(`CREATE TABLE IF NOT EXISTS videos (
+func (s *SQLiteVideoMetadataService) List(ctx context.Context) ([]VideoMetadata, error) {
+	_, err := s.DB.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS videos (
 						videoId TEXT PRIMARY KEY,
 						uploadedTime TIMESTAMP);`)
 	if err != nil {
-		log.Println("Error creating table")
+		slog.ErrorContext(ctx, "create videos table failed", "err", err)
 		return nil, fmt.Errorf("Failed create table%v", err)
 	}
-	rows, err := s.DB.Query(`SELECT videoId, uploadedTime FROM videos ORDER BY uploadedTime DESC`)
+	rows, err := s.DB.QueryContext(ctx, `SELECT videoId, uploadedTime FROM videos ORDER BY uploadedTime DESC`)
 	if err != nil {
 		return nil, fmt.Errorf("Failed select %v", err)
 	}
@@ -50,7 +58,6 @@ func (s *SQLiteVideoMetadataService) List() ([]VideoMetadata, error) {
 	for rows.Next() {
 		var video VideoMetadata
 		err = rows.Scan(&video.Id, &video.UploadedAt)
-		log.Printf("%s %s", video.Id, video.UploadedAt)
 		if err != nil {
 			return nil, fmt.Errorf("%v", err)
 		}
@@ -62,17 +69,17 @@ func (s *SQLiteVideoMetadataService) List() ([]VideoMetadata, error) {
 	return videos, nil
 }
 
-func (s *SQLiteVideoMetadataService) Read(id string) (*VideoMetadata, error) {
-	_, err := s.DB.Exec(` CREATE TABLE IF NOT EXISTS videos (videoId TEXT PRIMARY KEY, uploadedTime TIMESTAMP);`)
+func (s *SQLiteVideoMetadataService) Read(ctx context.Context, id string) (*VideoMetadata, error) {
+	_, err := s.DB.ExecContext(ctx, ` CREATE TABLE IF NOT EXISTS videos (videoId TEXT PRIMARY KEY, uploadedTime TIMESTAMP);`)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create videos table: %v", err)
 	}
-	row := s.DB.QueryRow(`SELECT videoId, uploadedTime FROM videos WHERE videoId = ?`, id)
+	row := s.DB.QueryRowContext(ctx, `SELECT videoId, uploadedTime FROM videos WHERE videoId = ?`, id)
 	var metadata VideoMetadata
 	err = row.Scan(&metadata.Id, &metadata.UploadedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("no vids")}
+		return nil, ErrVideoNotFound}
 		return nil, fmt.Errorf("failed to read video metadata: %v", err)
 	}
 	return &metadata, nil
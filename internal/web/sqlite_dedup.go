@@ -0,0 +1,205 @@
+// SQLite-backed index of deduplicated segments
+
+package web
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SQLiteDedupIndex struct {
+	DB *sql.DB
+	// mu serializes changes to reference counts, so concurrent uploads do
+	// not fail with a busy database.
+	mu sync.Mutex
+}
+
+var _ DedupIndex = (*SQLiteDedupIndex)(nil)
+
+func NewSQLiteDedupIndex(db *sql.DB) (*SQLiteDedupIndex, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS dedup_files (
+						videoId TEXT,
+						filename TEXT,
+						digest TEXT,
+						linkedAt TIMESTAMP,
+						PRIMARY KEY (videoId, filename));`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dedup_files table: %v", err)
+	}
+	// Tables created before garbage collection needed it lack linkedAt.
+	_, err = db.Exec(`ALTER TABLE dedup_files ADD COLUMN linkedAt TIMESTAMP`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return nil, fmt.Errorf("failed to add linkedAt column: %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS dedup_blobs (
+						digest TEXT PRIMARY KEY,
+						size INTEGER,
+						refs INTEGER,
+						stored INTEGER DEFAULT 0,
+						releasedAt TIMESTAMP);`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dedup_blobs table: %v", err)
+	}
+	return &SQLiteDedupIndex{DB: db}, nil
+}
+
+// release drops one reference to digest, noting when the last one went.
+func releaseBlob(tx *sql.Tx, digest string) error {
+	_, err := tx.Exec(`UPDATE dedup_blobs SET refs = refs - 1, releasedAt = CASE WHEN refs = 1 THEN ? ELSE releasedAt END WHERE digest = ?`,
+		time.Now().UTC(), digest)
+	if err != nil {
+		return fmt.Errorf("failed to release blob: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteDedupIndex) Link(videoId, filename, digest string, size int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin: %v", err)
+	}
+	defer tx.Rollback()
+	var old string
+	err = tx.QueryRow(`SELECT digest FROM dedup_files WHERE videoId = ? AND filename = ?`, videoId, filename).Scan(&old)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("failed to read file: %v", err)
+	}
+	if old != digest {
+		_, err = tx.Exec(`INSERT INTO dedup_blobs (digest, size, refs, stored) VALUES (?, ?, 1, 0)
+						ON CONFLICT(digest) DO UPDATE SET refs = refs + 1, releasedAt = NULL`, digest, size)
+		if err != nil {
+			return false, fmt.Errorf("failed to reference blob: %v", err)
+		}
+		if old != "" {
+			if err := releaseBlob(tx, old); err != nil {
+				return false, err
+			}
+		}
+		_, err = tx.Exec(`INSERT INTO dedup_files (videoId, filename, digest, linkedAt) VALUES (?, ?, ?, ?)
+						ON CONFLICT(videoId, filename) DO UPDATE SET digest = excluded.digest, linkedAt = excluded.linkedAt`,
+			videoId, filename, digest, time.Now().UTC())
+		if err != nil {
+			return false, fmt.Errorf("failed to save file: %v", err)
+		}
+	}
+	var stored bool
+	if err := tx.QueryRow(`SELECT stored FROM dedup_blobs WHERE digest = ?`, digest).Scan(&stored); err != nil {
+		return false, fmt.Errorf("failed to read blob: %v", err)
+	}
+	return !stored, tx.Commit()
+}
+
+func (s *SQLiteDedupIndex) Unlink(videoId, filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin: %v", err)
+	}
+	defer tx.Rollback()
+	var digest string
+	err = tx.QueryRow(`SELECT digest FROM dedup_files WHERE videoId = ? AND filename = ?`, videoId, filename).Scan(&digest)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read file: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM dedup_files WHERE videoId = ? AND filename = ?`, videoId, filename); err != nil {
+		return fmt.Errorf("failed to delete file: %v", err)
+	}
+	if err := releaseBlob(tx, digest); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteDedupIndex) Stored(digest string) error {
+	if _, err := s.DB.Exec(`UPDATE dedup_blobs SET stored = 1 WHERE digest = ?`, digest); err != nil {
+		return fmt.Errorf("failed to mark blob stored: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteDedupIndex) Resolve(videoId, filename string) (string, error) {
+	var digest string
+	err := s.DB.QueryRow(`SELECT digest FROM dedup_files WHERE videoId = ? AND filename = ?`, videoId, filename).Scan(&digest)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read file: %v", err)
+	}
+	return digest, nil
+}
+
+func (s *SQLiteDedupIndex) Unreferenced(before time.Time) ([]DedupBlob, error) {
+	rows, err := s.DB.Query(`SELECT digest, size, stored FROM dedup_blobs WHERE refs <= 0 AND releasedAt <= ?`, before.UTC())
+	if err != nil {
+		return nil, fmt.Errorf("failed to select blobs: %v", err)
+	}
+	defer rows.Close()
+	var blobs []DedupBlob
+	for rows.Next() {
+		var b DedupBlob
+		if err := rows.Scan(&b.Digest, &b.Size, &b.Stored); err != nil {
+			return nil, fmt.Errorf("failed to scan blob: %v", err)
+		}
+		blobs = append(blobs, b)
+	}
+	return blobs, rows.Err()
+}
+
+func (s *SQLiteDedupIndex) Forget(digest string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res, err := s.DB.Exec(`DELETE FROM dedup_blobs WHERE digest = ? AND refs <= 0`, digest)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete blob: %v", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("failed to delete blob: %v", err)
+	}
+	return n > 0, nil
+}
+
+func (s *SQLiteDedupIndex) Stats() (DedupStats, error) {
+	var st DedupStats
+	err := s.DB.QueryRow(`SELECT COUNT(*), COALESCE(SUM(b.size), 0) FROM dedup_files f JOIN dedup_blobs b ON f.digest = b.digest`).
+		Scan(&st.Files, &st.LogicalBytes)
+	if err != nil {
+		return st, fmt.Errorf("failed to count files: %v", err)
+	}
+	err = s.DB.QueryRow(`SELECT COUNT(*), COALESCE(SUM(size), 0) FROM dedup_blobs WHERE stored = 1`).
+		Scan(&st.Blobs, &st.StoredBytes)
+	if err != nil {
+		return st, fmt.Errorf("failed to count blobs: %v", err)
+	}
+	return st, nil
+}
+
+func (s *SQLiteDedupIndex) Names() ([]StoredFile, error) {
+	rows, err := s.DB.Query(`SELECT f.videoId, f.filename, COALESCE(b.size, 0), f.linkedAt FROM dedup_files f LEFT JOIN dedup_blobs b ON f.digest = b.digest`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select files: %v", err)
+	}
+	defer rows.Close()
+	var files []StoredFile
+	for rows.Next() {
+		var f StoredFile
+		var linkedAt sql.NullTime
+		if err := rows.Scan(&f.VideoId, &f.Filename, &f.Size, &linkedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan file: %v", err)
+		}
+		// Names linked before linkedAt was recorded count as old.
+		f.ModTime = linkedAt.Time
+		files = append(files, f)
+	}
+	return files, rows.Err()
+}
@@ -0,0 +1,140 @@
+// SQLite-backed store for storage ring membership
+
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type SQLiteMembershipStore struct {
+	DB *sql.DB
+}
+
+var _ MembershipStore = (*SQLiteMembershipStore)(nil)
+
+func NewSQLiteMembershipStore(db *sql.DB) (*SQLiteMembershipStore, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ring_nodes (
+						address TEXT PRIMARY KEY,
+						weight INTEGER,
+						state TEXT,
+						zone TEXT DEFAULT '',
+						rack TEXT DEFAULT '',
+						host TEXT DEFAULT '',
+						capacity INTEGER DEFAULT 100);`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ring_nodes table: %v", err)
+	}
+	// Tables created before nodes had labels and capacities lack their
+	// columns.
+	for _, col := range []string{"zone TEXT DEFAULT ''", "rack TEXT DEFAULT ''", "host TEXT DEFAULT ''", "capacity INTEGER DEFAULT 100"} {
+		_, err = db.Exec(`ALTER TABLE ring_nodes ADD COLUMN ` + col)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return nil, fmt.Errorf("failed to add %s column: %v", strings.Fields(col)[0], err)
+		}
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS ring_meta (
+						id INTEGER PRIMARY KEY CHECK (id = 1),
+						version INTEGER,
+						placement TEXT DEFAULT '',
+						prev TEXT DEFAULT '',
+						prev_placement TEXT DEFAULT '',
+						earlier TEXT DEFAULT '');`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create ring_meta table: %v", err)
+	}
+	// Tables created before the placement and earlier rings were recorded
+	// lack their columns.
+	for _, col := range []string{"placement", "prev", "prev_placement", "earlier"} {
+		_, err = db.Exec(`ALTER TABLE ring_meta ADD COLUMN ` + col + ` TEXT DEFAULT ''`)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			return nil, fmt.Errorf("failed to add %s column: %v", col, err)
+		}
+	}
+	return &SQLiteMembershipStore{DB: db}, nil
+}
+
+// LoadRing returns the saved ring. Databases written before Prev was saved
+// have none; the unfinished migration's kind is used to rebuild it then.
+func (s *SQLiteMembershipStore) LoadRing() (*RingState, error) {
+	var state RingState
+	var prev, earlier sql.NullString
+	err := s.DB.QueryRow(`SELECT version, placement, prev, prev_placement, earlier FROM ring_meta WHERE id = 1`).Scan(&state.Version, &state.Placement, &prev, &state.PrevPlacement, &earlier)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ring version: %v", err)
+	}
+	if prev.String != "" {
+		if err := json.Unmarshal([]byte(prev.String), &state.Prev); err != nil {
+			return nil, fmt.Errorf("failed to decode previous ring: %v", err)
+		}
+	}
+	if earlier.String != "" {
+		if err := json.Unmarshal([]byte(earlier.String), &state.Earlier); err != nil {
+			return nil, fmt.Errorf("failed to decode earlier rings: %v", err)
+		}
+	}
+	rows, err := s.DB.Query(`SELECT address, weight, state, zone, rack, host, capacity FROM ring_nodes`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select ring nodes: %v", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var n StorageNode
+		var nodeState string
+		if err := rows.Scan(&n.Address, &n.Weight, &nodeState, &n.Zone, &n.Rack, &n.Host, &n.Capacity); err != nil {
+			return nil, fmt.Errorf("failed to scan ring node: %v", err)
+		}
+		n.Hash = hashKey(n.Address)
+		n.State = NodeState(nodeState)
+		state.Nodes = append(state.Nodes, n)
+	}
+	return &state, rows.Err()
+}
+
+// SaveRing replaces the stored ring in one transaction.
+func (s *SQLiteMembershipStore) SaveRing(state *RingState) error {
+	nodes := state.Nodes
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM ring_nodes`); err != nil {
+		return fmt.Errorf("failed to clear ring nodes: %v", err)
+	}
+	for _, n := range nodes {
+		_, err := tx.Exec(`INSERT INTO ring_nodes (address, weight, state, zone, rack, host, capacity) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			n.Address, n.Weight, string(n.State), n.Zone, n.Rack, n.Host, n.Capacity)
+		if err != nil {
+			return fmt.Errorf("failed to insert ring node: %v", err)
+		}
+	}
+	prev := ""
+	if state.Prev != nil {
+		b, err := json.Marshal(state.Prev)
+		if err != nil {
+			return fmt.Errorf("failed to encode previous ring: %v", err)
+		}
+		prev = string(b)
+	}
+	earlier := ""
+	if state.Earlier != nil {
+		b, err := json.Marshal(state.Earlier)
+		if err != nil {
+			return fmt.Errorf("failed to encode earlier rings: %v", err)
+		}
+		earlier = string(b)
+	}
+	_, err = tx.Exec(`INSERT INTO ring_meta (id, version, placement, prev, prev_placement, earlier) VALUES (1, ?, ?, ?, ?, ?)
+					ON CONFLICT(id) DO UPDATE SET version = excluded.version, placement = excluded.placement, prev = excluded.prev, prev_placement = excluded.prev_placement, earlier = excluded.earlier`,
+		state.Version, state.Placement, prev, state.PrevPlacement, earlier)
+	if err != nil {
+		return fmt.Errorf("failed to save ring version: %v", err)
+	}
+	return tx.Commit()
+}
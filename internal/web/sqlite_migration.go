@@ -0,0 +1,216 @@
+// SQLite-backed store for node migration plans
+
+package web
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type SQLiteMigrationStore struct {
+	DB *sql.DB
+}
+
+var _ MigrationStore = (*SQLiteMigrationStore)(nil)
+
+func NewSQLiteMigrationStore(db *sql.DB) (*SQLiteMigrationStore, error) {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS migrations (
+						id TEXT PRIMARY KEY,
+						kind TEXT,
+						nodeAddress TEXT,
+						state TEXT,
+						createdAt TIMESTAMP,
+						fromRing TEXT DEFAULT '');`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create migrations table: %v", err)
+	}
+	// Tables created before the ring migrated from was recorded lack its
+	// column.
+	_, err = db.Exec(`ALTER TABLE migrations ADD COLUMN fromRing TEXT DEFAULT ''`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return nil, fmt.Errorf("failed to add fromRing column: %v", err)
+	}
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS migration_moves (` + movesColumns + `);`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create migration_moves table: %v", err)
+	}
+	// Tables created before sizes were tracked lack the size column.
+	_, err = db.Exec(`ALTER TABLE migration_moves ADD COLUMN size INTEGER DEFAULT 0`)
+	if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+		return nil, fmt.Errorf("failed to add size column: %v", err)
+	}
+	if err := keyMovesBySource(db); err != nil {
+		return nil, err
+	}
+	return &SQLiteMigrationStore{DB: db}, nil
+}
+
+// movesColumns defines the migration_moves table. A file can have copies on
+// several nodes, such as one left behind by a failed delete, so each copy is
+// its own move and the source is part of the key.
+const movesColumns = `
+						migrationId TEXT,
+						videoId TEXT,
+						filename TEXT,
+						source TEXT,
+						destination TEXT,
+						size INTEGER DEFAULT 0,
+						state TEXT,
+						error TEXT,
+						PRIMARY KEY (migrationId, videoId, filename, source)`
+
+// keyMovesBySource rebuilds a migration_moves table created when moves were
+// keyed without their source, since SQLite cannot change a primary key in
+// place.
+func keyMovesBySource(db *sql.DB) error {
+	var pk int
+	err := db.QueryRow(`SELECT pk FROM pragma_table_info('migration_moves') WHERE name = 'source'`).Scan(&pk)
+	if err != nil {
+		return fmt.Errorf("failed to read migration_moves columns: %v", err)
+	}
+	if pk > 0 {
+		return nil
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin: %v", err)
+	}
+	defer tx.Rollback()
+	for _, stmt := range []string{
+		`CREATE TABLE migration_moves_keyed (` + movesColumns + `);`,
+		`INSERT INTO migration_moves_keyed (migrationId, videoId, filename, source, destination, size, state, error)
+			SELECT migrationId, videoId, filename, source, destination, size, state, error FROM migration_moves`,
+		`DROP TABLE migration_moves`,
+		`ALTER TABLE migration_moves_keyed RENAME TO migration_moves`,
+	} {
+		if _, err := tx.Exec(stmt); err != nil {
+			return fmt.Errorf("failed to key moves by source: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Create saves the migration and all of its moves in one transaction.
+func (s *SQLiteMigrationStore) Create(m *Migration) error {
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin: %v", err)
+	}
+	defer tx.Rollback()
+	from := ""
+	if m.From != nil {
+		b, err := json.Marshal(m.From)
+		if err != nil {
+			return fmt.Errorf("failed to encode ring: %v", err)
+		}
+		from = string(b)
+	}
+	_, err = tx.Exec(`INSERT INTO migrations (id, kind, nodeAddress, state, createdAt, fromRing) VALUES (?, ?, ?, ?, ?, ?)`,
+		m.Id, m.Kind, m.Node, string(m.State), m.CreatedAt, from)
+	if err != nil {
+		return fmt.Errorf("failed to insert migration: %v", err)
+	}
+	stmt, err := tx.Prepare(`INSERT INTO migration_moves (migrationId, videoId, filename, source, destination, size, state, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return fmt.Errorf("failed to prepare move insert: %v", err)
+	}
+	defer stmt.Close()
+	for _, mv := range m.Moves {
+		_, err = stmt.Exec(m.Id, mv.VideoId, mv.Filename, mv.Source, mv.Destination, mv.Size, string(mv.State), mv.Error)
+		if err != nil {
+			return fmt.Errorf("failed to insert move: %v", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteMigrationStore) Read(id string) (*Migration, error) {
+	row := s.DB.QueryRow(`SELECT id, kind, nodeAddress, state, createdAt, fromRing FROM migrations WHERE id = ?`, id)
+	var m Migration
+	var state string
+	var from sql.NullString
+	err := row.Scan(&m.Id, &m.Kind, &m.Node, &state, &m.CreatedAt, &from)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("no migration %s", id)
+		}
+		return nil, fmt.Errorf("failed to read migration: %v", err)
+	}
+	m.State = MigrationState(state)
+	if from.String != "" {
+		if err := json.Unmarshal([]byte(from.String), &m.From); err != nil {
+			return nil, fmt.Errorf("failed to decode ring: %v", err)
+		}
+	}
+	m.Moves, err = s.readMoves(id)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func (s *SQLiteMigrationStore) readMoves(id string) ([]FileMove, error) {
+	rows, err := s.DB.Query(`SELECT videoId, filename, source, destination, size, state, error FROM migration_moves WHERE migrationId = ? ORDER BY videoId, filename, source`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to select moves: %v", err)
+	}
+	defer rows.Close()
+	var moves []FileMove
+	for rows.Next() {
+		var mv FileMove
+		var state string
+		err = rows.Scan(&mv.VideoId, &mv.Filename, &mv.Source, &mv.Destination, &mv.Size, &state, &mv.Error)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan move: %v", err)
+		}
+		mv.State = MoveState(state)
+		moves = append(moves, mv)
+	}
+	return moves, rows.Err()
+}
+
+// ListUnfinished returns the migrations that were still running, oldest first.
+func (s *SQLiteMigrationStore) ListUnfinished() ([]*Migration, error) {
+	rows, err := s.DB.Query(`SELECT id FROM migrations WHERE state = ? ORDER BY createdAt`, string(MigrationRunning))
+	if err != nil {
+		return nil, fmt.Errorf("failed to select migrations: %v", err)
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan migration: %v", err)
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	var migrations []*Migration
+	for _, id := range ids {
+		m, err := s.Read(id)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, m)
+	}
+	return migrations, nil
+}
+
+func (s *SQLiteMigrationStore) UpdateMove(id string, move FileMove) error {
+	_, err := s.DB.Exec(`UPDATE migration_moves SET state = ?, error = ? WHERE migrationId = ? AND videoId = ? AND filename = ? AND source = ?`,
+		string(move.State), move.Error, id, move.VideoId, move.Filename, move.Source)
+	if err != nil {
+		return fmt.Errorf("failed to update move: %v", err)
+	}
+	return nil
+}
+
+func (s *SQLiteMigrationStore) UpdateState(id string, state MigrationState) error {
+	_, err := s.DB.Exec(`UPDATE migrations SET state = ? WHERE id = ?`, string(state), id)
+	if err != nil {
+		return fmt.Errorf("failed to update migration: %v", err)
+	}
+	return nil
+}
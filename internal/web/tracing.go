@@ -0,0 +1,110 @@
+// Tracing the calls the web server makes to its metadata and content services
+
+package web
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"tritontube/internal/tracing"
+)
+
+// TracedVideoMetadataService records a span for every call to a metadata
+// service.
+type TracedVideoMetadataService struct {
+	store VideoMetadataService
+	attrs []attribute.KeyValue
+}
+
+var _ VideoMetadataService = (*TracedVideoMetadataService)(nil)
+
+func NewTracedVideoMetadataService(store VideoMetadataService) *TracedVideoMetadataService {
+	return &TracedVideoMetadataService{
+		store: store,
+		attrs: []attribute.KeyValue{attribute.String("metadata.service", fmt.Sprintf("%T", store))},
+	}
+}
+
+func (s *TracedVideoMetadataService) Read(ctx context.Context, id string) (*VideoMetadata, error) {
+	ctx, span := tracing.Start(ctx, "metadata.Read", append(s.attrs, attribute.String("video.id", id))...)
+	v, err := s.store.Read(ctx, id)
+	tracing.End(span, err)
+	return v, err
+}
+
+func (s *TracedVideoMetadataService) List(ctx context.Context) ([]VideoMetadata, error) {
+	ctx, span := tracing.Start(ctx, "metadata.List", s.attrs...)
+	videos, err := s.store.List(ctx)
+	span.SetAttributes(attribute.Int("video.count", len(videos)))
+	tracing.End(span, err)
+	return videos, err
+}
+
+func (s *TracedVideoMetadataService) Create(ctx context.Context, videoId string, uploadedAt time.Time) error {
+	ctx, span := tracing.Start(ctx, "metadata.Create", append(s.attrs, attribute.String("video.id", videoId))...)
+	err := s.store.Create(ctx, videoId, uploadedAt)
+	tracing.End(span, err)
+	return err
+}
+
+// TracedVideoContentService records a span for every call to a content
+// service, naming the node the file goes to when the service knows it.
+type TracedVideoContentService struct {
+	store VideoContentService
+	attrs []attribute.KeyValue
+}
+
+var _ VideoContentService = (*TracedVideoContentService)(nil)
+var _ VideoContentDeleter = (*TracedVideoContentService)(nil)
+var _ VideoContentPlacer = (*TracedVideoContentService)(nil)
+
+func NewTracedVideoContentService(store VideoContentService) *TracedVideoContentService {
+	return &TracedVideoContentService{
+		store: store,
+		attrs: []attribute.KeyValue{attribute.String("content.service", fmt.Sprintf("%T", store))},
+	}
+}
+
+func (s *TracedVideoContentService) fileAttrs(videoId, filename string) []attribute.KeyValue {
+	attrs := append(s.attrs, attribute.String("video.id", videoId), attribute.String("video.file", filename))
+	if node := s.NodeFor(videoId, filename); node != "" {
+		attrs = append(attrs, attribute.String("storage.node", node))
+	}
+	return attrs
+}
+
+func (s *TracedVideoContentService) Read(ctx context.Context, videoId string, filename string) ([]byte, error) {
+	ctx, span := tracing.Start(ctx, "content.Read", s.fileAttrs(videoId, filename)...)
+	data, err := s.store.Read(ctx, videoId, filename)
+	span.SetAttributes(attribute.Int("content.bytes", len(data)))
+	tracing.End(span, err)
+	return data, err
+}
+
+func (s *TracedVideoContentService) Write(ctx context.Context, videoId string, filename string, data []byte) error {
+	attrs := append(s.fileAttrs(videoId, filename), attribute.Int("content.bytes", len(data)))
+	ctx, span := tracing.Start(ctx, "content.Write", attrs...)
+	err := s.store.Write(ctx, videoId, filename, data)
+	tracing.End(span, err)
+	return err
+}
+
+func (s *TracedVideoContentService) Delete(ctx context.Context, videoId string, filename string) error {
+	deleter, ok := s.store.(VideoContentDeleter)
+	if !ok {
+		return fmt.Errorf("content store %T cannot delete files", s.store)
+	}
+	ctx, span := tracing.Start(ctx, "content.Delete", s.fileAttrs(videoId, filename)...)
+	err := deleter.Delete(ctx, videoId, filename)
+	tracing.End(span, err)
+	return err
+}
+
+func (s *TracedVideoContentService) NodeFor(videoId string, filename string) string {
+	if placer, ok := s.store.(VideoContentPlacer); ok {
+		return placer.NodeFor(videoId, filename)
+	}
+	return ""
+}
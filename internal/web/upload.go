@@ -0,0 +1,183 @@
+// Writing the files of an uploaded video in parallel, all or nothing
+
+package web
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// UploadConfig bounds the writes of an upload.
+type UploadConfig struct {
+	// Workers bounds the files written at a time, and NodeWorkers those
+	// written to any one storage node.
+	Workers     int
+	NodeWorkers int
+	// Attempts is how many times a write failing with a transient error is
+	// tried. The first retry waits Backoff, and each one after twice as
+	// long as the last.
+	Attempts int
+	Backoff  time.Duration
+}
+
+var DefaultUploadConfig = UploadConfig{
+	Workers:     16,
+	NodeWorkers: 4,
+	Attempts:    4,
+	Backoff:     100 * time.Millisecond,
+}
+
+// claimUpload reports whether no other upload of videoId is running on s,
+// and if so marks one as running until releaseUpload. Uploads of a new id
+// that race on different web servers are caught when Create fails.
+func (s *server) claimUpload(videoId string) bool {
+	s.uploadingMu.Lock()
+	defer s.uploadingMu.Unlock()
+	if s.uploading[videoId] {
+		return false
+	}
+	if s.uploading == nil {
+		s.uploading = make(map[string]bool)
+	}
+	s.uploading[videoId] = true
+	return true
+}
+
+func (s *server) releaseUpload(videoId string) {
+	s.uploadingMu.Lock()
+	defer s.uploadingMu.Unlock()
+	delete(s.uploading, videoId)
+}
+
+// uploadFile is a file of a video waiting to be written from disk.
+type uploadFile struct {
+	name string
+	path string
+}
+
+// uploadFiles writes the files of a video, grouping them by the node they
+// go to so that no node gets more than NodeWorkers writes at a time. It
+// writes all of them or none: if one fails, no more are started and those
+// already written are deleted. Cancelling ctx fails the upload.
+func uploadFiles(ctx context.Context, content VideoContentService, videoId string, files []uploadFile, config UploadConfig) error {
+	placer, _ := content.(VideoContentPlacer)
+	groups := make(map[string][]uploadFile)
+	for _, f := range files {
+		node := ""
+		if placer != nil {
+			node = placer.NodeFor(videoId, f.name)
+		}
+		groups[node] = append(groups[node], f)
+	}
+
+	slots := make(chan struct{}, max(config.Workers, 1))
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		written []string
+		failErr error
+		failed  atomic.Bool
+	)
+	for node, group := range groups {
+		queue := make(chan uploadFile, len(group))
+		for _, f := range group {
+			queue <- f
+		}
+		close(queue)
+		workers := config.NodeWorkers
+		if node == "" {
+			// Files of unknown placement share only the overall limit.
+			workers = config.Workers
+		}
+		for range min(max(workers, 1), len(group)) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for f := range queue {
+					if failed.Load() {
+						return
+					}
+					slots <- struct{}{}
+					err := uploadOne(ctx, content, videoId, f, config)
+					<-slots
+					mu.Lock()
+					if err == nil {
+						written = append(written, f.name)
+					} else if failErr == nil {
+						failErr = err
+						failed.Store(true)
+					}
+					mu.Unlock()
+				}
+			}()
+		}
+	}
+	wg.Wait()
+	if failErr != nil {
+		removeFiles(ctx, content, videoId, written)
+		return failErr
+	}
+	return nil
+}
+
+func uploadOne(ctx context.Context, content VideoContentService, videoId string, f uploadFile, config UploadConfig) error {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("read %s: %v", f.name, err)
+	}
+	return writeWithRetry(ctx, content, videoId, f.name, data, config)
+}
+
+// writeWithRetry writes a file, retrying transient errors with exponential
+// backoff and jitter.
+func writeWithRetry(ctx context.Context, content VideoContentService, videoId, filename string, data []byte, config UploadConfig) error {
+	backoff := config.Backoff
+	for attempt := 1; ; attempt++ {
+		err := content.Write(ctx, videoId, filename, data)
+		if err == nil || attempt >= config.Attempts || !transient(err) || ctx.Err() != nil {
+			return err
+		}
+		slog.WarnContext(ctx, "upload: write failed, retrying", "video", videoId, "file", filename, "attempt", attempt, "attempts", config.Attempts, "err", err)
+		select {
+		case <-time.After(backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+// transient reports whether a failed write may succeed if tried again.
+func transient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// removeFiles deletes the files of a failed upload, even if the upload
+// failed because ctx was cancelled. What it cannot delete is left for
+// orphan collection.
+func removeFiles(ctx context.Context, content VideoContentService, videoId string, names []string) {
+	ctx = context.WithoutCancel(ctx)
+	deleter, ok := content.(VideoContentDeleter)
+	if !ok {
+		slog.WarnContext(ctx, "upload: content service cannot delete the files written", "service", fmt.Sprintf("%T", content), "video", videoId, "files", len(names))
+		return
+	}
+	for _, name := range names {
+		if err := deleter.Delete(ctx, videoId, name); err != nil {
+			slog.WarnContext(ctx, "upload: clean up failed", "video", videoId, "file", name, "err", err)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package web
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// flakyStore is a testStore whose writes of a file fail with the errors
+// queued for it, one per attempt, before they go through.
+type flakyStore struct {
+	*testStore
+	failMu   sync.Mutex
+	failures map[string][]error
+	attempts map[string]int
+}
+
+func newFlakyStore() *flakyStore {
+	return &flakyStore{testStore: newTestStore(), failures: make(map[string][]error), attempts: make(map[string]int)}
+}
+
+func (s *flakyStore) Write(ctx context.Context, videoId string, filename string, data []byte) error {
+	s.failMu.Lock()
+	s.attempts[filename]++
+	if errs := s.failures[filename]; len(errs) > 0 {
+		s.failures[filename] = errs[1:]
+		s.failMu.Unlock()
+		return errs[0]
+	}
+	s.failMu.Unlock()
+	return s.testStore.Write(ctx, videoId, filename, data)
+}
+
+func (s *flakyStore) Delete(ctx context.Context, videoId string, filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, videoId+"/"+filename)
+	return nil
+}
+
+// uploadDir writes n segments to a temporary directory as the files of an
+// upload.
+func uploadDir(t *testing.T, n int) []uploadFile {
+	t.Helper()
+	dir := t.TempDir()
+	var files []uploadFile
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("chunk-0-%05d.m4s", i)
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, uploadFile{name: name, path: path})
+	}
+	return files
+}
+
+var testUploadConfig = UploadConfig{Workers: 4, NodeWorkers: 2, Attempts: 3, Backoff: time.Millisecond}
+
+func TestUploadRetriesTransientErrors(t *testing.T) {
+	store := newFlakyStore()
+	files := uploadDir(t, 10)
+	unavailable := status.Error(codes.Unavailable, "node restarting")
+	store.failures[files[3].name] = []error{unavailable, unavailable}
+	if err := uploadFiles(context.Background(), store, "v", files, testUploadConfig); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.attempts[files[3].name]; got != 3 {
+		t.Fatalf("%s was tried %d times, want 3", files[3].name, got)
+	}
+	if len(store.files) != len(files) {
+		t.Fatalf("%d of %d files stored", len(store.files), len(files))
+	}
+}
+
+// TestUploadIsAllOrNothing fails one file of an upload, with an error that
+// is not retried and with one that keeps coming back. Either way the upload
+// must fail and leave none of its files behind.
+func TestUploadIsAllOrNothing(t *testing.T) {
+	for _, c := range []struct {
+		err      error
+		attempts int
+	}{
+		{status.Error(codes.InvalidArgument, "bad file"), 1},
+		{status.Error(codes.Unavailable, "node down"), testUploadConfig.Attempts},
+	} {
+		store := newFlakyStore()
+		files := uploadDir(t, 10)
+		bad := files[5].name
+		store.failures[bad] = []error{c.err, c.err, c.err, c.err}
+		err := uploadFiles(context.Background(), store, "v", files, testUploadConfig)
+		if status.Code(err) != status.Code(c.err) {
+			t.Fatalf("upload with %v failing: %v", c.err, err)
+		}
+		if got := store.attempts[bad]; got != c.attempts {
+			t.Errorf("%v: %s was tried %d times, want %d", c.err, bad, got, c.attempts)
+		}
+		if len(store.files) != 0 {
+			t.Errorf("%v: the failed upload left %d files", c.err, len(store.files))
+		}
+	}
+}
@@ -0,0 +1,115 @@
+// Package writetest checks that a way of writing a file is atomic: a crash
+// or a concurrent reader only ever sees a complete old or new version. It
+// is shared by the tests of the packages that write files.
+package writetest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// childEnv passes the argument of KillLoop to the child.
+const childEnv = "WRITETEST_CHILD_ARG"
+
+// Versions are the two contents writers alternate between. They are large
+// enough that a kill or a read usually lands inside a write.
+func Versions() [2][]byte {
+	return [2][]byte{
+		bytes.Repeat([]byte("old "), 1<<20),
+		bytes.Repeat([]byte("new!"), 1<<20),
+	}
+}
+
+// Check fails the test unless got is one of the Versions.
+func Check(t testing.TB, what string, got []byte) {
+	t.Helper()
+	v := Versions()
+	if !bytes.Equal(got, v[0]) && !bytes.Equal(got, v[1]) {
+		t.Fatalf("%s: %d bytes that are neither version", what, len(got))
+	}
+}
+
+// ChildArg returns the argument KillLoop passed to the child running this
+// test, or "" if the test was not started by KillLoop.
+func ChildArg() string {
+	return os.Getenv(childEnv)
+}
+
+// KillLoop runs the test named test in a child process, passing it arg,
+// and kills it with SIGKILL a little later each round. The child should
+// write the Versions in turn until it is killed; check is called after
+// each kill to look at what it left.
+func KillLoop(t *testing.T, test, arg string, check func(round int)) {
+	t.Helper()
+	for i := 0; i < 10; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^"+test+"$")
+		cmd.Env = append(os.Environ(), childEnv+"="+arg)
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Duration(100+20*i) * time.Millisecond)
+		cmd.Process.Signal(syscall.SIGKILL)
+		cmd.Wait()
+		check(i)
+	}
+}
+
+// ReadWhileWriting writes the Versions in turn with write while several
+// readers call read, for a while, and fails the test if a read errs or
+// sees anything but a complete version. The first version must already be
+// written.
+func ReadWhileWriting(t *testing.T, write func(content []byte) error, read func() ([]byte, error)) {
+	t.Helper()
+	v := Versions()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	reads := make([]int, 4)
+	errs := make(chan error, len(reads)+1)
+	for r := range reads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				got, err := read()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !bytes.Equal(got, v[0]) && !bytes.Equal(got, v[1]) {
+					errs <- fmt.Errorf("read %d bytes that are neither version", len(got))
+					return
+				}
+				reads[r]++
+			}
+		}()
+	}
+	writes := 0
+	for deadline := time.Now().Add(500 * time.Millisecond); time.Now().Before(deadline); writes++ {
+		if err := write(v[(writes+1)%2]); err != nil {
+			errs <- err
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("after %d writes: %v", writes, err)
+	}
+	for r, n := range reads {
+		if n == 0 {
+			t.Fatalf("reader %d read nothing during %d writes", r, writes)
+		}
+	}
+}